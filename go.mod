@@ -8,6 +8,7 @@ require (
 	github.com/Azure/azure-pipeline-go v0.2.2 // indirect
 	github.com/Azure/azure-storage-blob-go v0.8.0 // indirect
 	github.com/aws/aws-sdk-go v1.35.24
+	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/ghodss/yaml v1.0.0
 	github.com/gofrs/uuid v3.2.0+incompatible
 	github.com/google/wire v0.4.0 // indirect
@@ -23,7 +24,11 @@ require (
 	github.com/spf13/pflag v1.0.5
 	github.com/vmware-tanzu/velero v1.5.0
 	gocloud.dev v0.15.0
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	golang.org/x/sys v0.0.0-20210112080510-489259a85091
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 	google.golang.org/api v0.26.0
+	google.golang.org/grpc v1.29.1
 	k8s.io/api v0.20.2
 	k8s.io/apimachinery v0.20.2
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
@@ -0,0 +1,275 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gocloud.dev/blob/memblob"
+)
+
+const (
+	// benchFile is name of the file uploaded by benchmark
+	benchFile = "bench"
+
+	// benchPollInterval is interval to check the progress of benchmark transfer
+	benchPollInterval = 10 * time.Millisecond
+)
+
+// BenchmarkConfig is the config of data transfer benchmark
+type BenchmarkConfig struct {
+	// Size is number of bytes of synthetic data transferred
+	Size int64
+
+	// WriteSize is number of bytes sent by client in single write
+	WriteSize int
+
+	// Port is port of the data server
+	Port int
+
+	// Restore if set then uploaded data is also downloaded
+	Restore bool
+
+	// Config is the config of volumesnapshotlocation used for the transfer
+	Config map[string]string
+}
+
+// BenchmarkResult is the measurement of a data transfer benchmark
+type BenchmarkResult struct {
+	// Operation is backup or restore
+	Operation string `json:"operation"`
+
+	// Bytes is number of bytes transferred
+	Bytes int64 `json:"bytes"`
+
+	// Duration is time taken by the transfer
+	Duration time.Duration `json:"duration"`
+
+	// Throughput is transfer rate in MiB/s
+	Throughput float64 `json:"throughputMiBps"`
+
+	// Allocs and AllocBytes are number and size of the heap allocations during the transfer
+	Allocs     uint64 `json:"allocs"`
+	AllocBytes uint64 `json:"allocBytes"`
+}
+
+// String returns the result in single line
+func (r BenchmarkResult) String() string {
+	return fmt.Sprintf("%-8s %12d bytes %12v %10.2f MiB/s %10d allocs %14d alloc-bytes",
+		r.Operation, r.Bytes, r.Duration.Round(time.Millisecond), r.Throughput, r.Allocs, r.AllocBytes)
+}
+
+// RunBenchmark streams the synthetic data through the data server to an in-memory
+// bucket, and measures the throughput and allocations of the transfer. Config of the
+// provider is ignored, other config is used as it is used for the backup or restore.
+func RunBenchmark(log logrus.FieldLogger, cfg BenchmarkConfig) ([]BenchmarkResult, error) {
+	if cfg.Size <= 0 || cfg.WriteSize <= 0 {
+		return nil, errors.Errorf("invalid benchmark size=%d write size=%d", cfg.Size, cfg.WriteSize)
+	}
+
+	c := &Conn{
+		Log:        log,
+		provider:   Memory,
+		bucketname: benchFile,
+	}
+	if err := c.parseConfig(cfg.Config); err != nil {
+		return nil, err
+	}
+	c.ctx = context.Background()
+
+	// bucket isn't shared with the connections of memory provider
+	c.bucket = memblob.OpenBucket(nil)
+	defer func() {
+		_ = c.bucket.Close()
+	}()
+	c.SetDedupVolume(benchFile)
+
+	var results []BenchmarkResult
+
+	r, err := c.benchmarkBackup(cfg)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, r)
+
+	if cfg.Restore {
+		r, err := c.benchmarkRestore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// benchmarkBackup uploads the synthetic data, sent by a client like cStor, to the bucket
+func (c *Conn) benchmarkBackup(cfg BenchmarkConfig) (BenchmarkResult, error) {
+	// random data so that it is not compressed or deduplicated by the pipeline
+	data := make([]byte, cfg.WriteSize)
+	_, _ = rand.New(rand.NewSource(1)).Read(data)
+
+	m := startMeasure()
+	conn, done, err := c.startBenchServer(cfg.Port, func() bool { return c.Upload(benchFile, cfg.Size, cfg.Port) })
+	if err != nil {
+		return BenchmarkResult{}, err
+	}
+
+	for sent := int64(0); sent < cfg.Size; {
+		n := int64(len(data))
+		if cfg.Size-sent < n {
+			n = cfg.Size - sent
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			_ = conn.Close()
+			c.StopServer()
+			<-done
+			return BenchmarkResult{}, errors.Wrapf(err, "failed to send data at offset=%d", sent)
+		}
+		sent += n
+	}
+
+	// connection is closed once the data is received, like cStor does once the backup is completed
+	for {
+		if transferred, _ := c.Progress(); transferred >= cfg.Size {
+			break
+		}
+		select {
+		case <-done:
+			_ = conn.Close()
+			return BenchmarkResult{}, errors.New("backup server exited before receiving the data")
+		case <-time.After(benchPollInterval):
+		}
+	}
+	c.StopServer()
+	_ = conn.Close()
+
+	// file is written to the bucket once the client is disconnected, server exits later
+	// on epoll timeout, so transfer is measured till the file exists
+	var r BenchmarkResult
+	for {
+		if ok, _ := c.bucket.Exists(c.ctx, benchFile); ok {
+			r = m.result("backup", cfg.Size)
+			break
+		}
+		select {
+		case <-done:
+			return BenchmarkResult{}, errors.New("backup failed")
+		case <-time.After(benchPollInterval):
+		}
+	}
+
+	if !<-done {
+		return BenchmarkResult{}, errors.New("backup failed")
+	}
+	return r, nil
+}
+
+// benchmarkRestore downloads the uploaded data, and discards it
+func (c *Conn) benchmarkRestore(cfg BenchmarkConfig) (BenchmarkResult, error) {
+	m := startMeasure()
+	conn, done, err := c.startBenchServer(cfg.Port, func() bool { return c.Download(benchFile, cfg.Port) })
+	if err != nil {
+		return BenchmarkResult{}, err
+	}
+
+	// server closes the connection once the data is sent
+	received, err := io.Copy(ioutil.Discard, conn)
+	r := m.result("restore", received)
+	_ = conn.Close()
+	c.StopServer()
+
+	if !<-done {
+		return BenchmarkResult{}, errors.New("restore failed")
+	}
+	if err != nil {
+		return BenchmarkResult{}, errors.Wrapf(err, "failed to receive data at offset=%d", received)
+	}
+	if received != cfg.Size {
+		return BenchmarkResult{}, errors.Errorf("restore received %d bytes, expected %d", received, cfg.Size)
+	}
+	return r, nil
+}
+
+// startBenchServer runs the given transfer, and connects to its data server.
+// Result of the transfer is sent on the returned channel.
+func (c *Conn) startBenchServer(port int, transfer func() bool) (net.Conn, <-chan bool, error) {
+	c.ConnStateReset()
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- transfer()
+	}()
+
+	select {
+	case <-*c.ConnReady:
+	case <-done:
+		return nil, nil, errors.Errorf("failed to start data server on port=%d", port)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		c.StopServer()
+		<-done
+		return nil, nil, errors.Wrapf(err, "failed to connect to data server")
+	}
+	return conn, done, nil
+}
+
+// benchMeasure is the start of a benchmark measurement
+type benchMeasure struct {
+	start time.Time
+	mem   runtime.MemStats
+}
+
+// startMeasure starts the measurement of time and allocations
+func startMeasure() *benchMeasure {
+	m := &benchMeasure{}
+	runtime.GC()
+	runtime.ReadMemStats(&m.mem)
+	m.start = time.Now()
+	return m
+}
+
+// result return the result of measurement for the given transfer
+func (m *benchMeasure) result(op string, bytes int64) BenchmarkResult {
+	d := time.Since(m.start)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	r := BenchmarkResult{
+		Operation:  op,
+		Bytes:      bytes,
+		Duration:   d,
+		Allocs:     mem.Mallocs - m.mem.Mallocs,
+		AllocBytes: mem.TotalAlloc - m.mem.TotalAlloc,
+	}
+	if d > 0 {
+		r.Throughput = float64(bytes) / (1024 * 1024) / d.Seconds()
+	}
+	return r
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import "sync"
+
+// bufferPools has the pool of client buffers for each buffer length, so that buffers
+// are reused by the clients of concurrent and subsequent transfers
+var bufferPools sync.Map
+
+// getBuffer return a buffer of given length from the pool
+func getBuffer(length uint64) []byte {
+	pool, _ := bufferPools.LoadOrStore(length, &sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, length)
+			return &b
+		},
+	})
+	return *(pool.(*sync.Pool).Get().(*[]byte))
+}
+
+// putBuffer returns the given buffer to the pool
+func putBuffer(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+
+	buf = buf[:cap(buf)]
+	if pool, ok := bufferPools.Load(uint64(len(buf))); ok {
+		pool.(*sync.Pool).Put(&buf)
+	}
+}
+
+// releaseBuffer returns the buffer of given client to the pool
+func (c *Client) releaseBuffer() {
+	putBuffer(c.buffer)
+	c.buffer = nil
+}
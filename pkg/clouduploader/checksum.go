@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChecksumCRC32C is CRC-32 checksum with Castagnoli polynomial, it uses
+	// SSE4.2/ARMv8 CRC32 instructions if available
+	ChecksumCRC32C = "crc32c"
+
+	// ChecksumXXHash64 is 64-bit xxHash checksum
+	ChecksumXXHash64 = "xxhash64"
+
+	// ChecksumSHA256 is SHA-256 checksum, it uses SHA extensions of CPU if available
+	ChecksumSHA256 = "sha256"
+
+	// defaultChecksumAlgorithm is fast non-cryptographic checksum used for data integrity
+	defaultChecksumAlgorithm = ChecksumCRC32C
+)
+
+// crc32cTable is CRC-32 table for Castagnoli polynomial
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// getChecksumAlgorithm returns the checksum algorithm from the config
+// - if compliance mode is enabled then SHA-256 is used
+// - if algorithm is not specified then defaultChecksumAlgorithm is used
+func getChecksumAlgorithm(config map[string]string) (string, error) {
+	algorithm, ok := config[ChecksumAlgorithm]
+
+	if mode, exists := config[ComplianceMode]; exists {
+		compliance, err := strconv.ParseBool(mode)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to parse %s (expected format bool)", ComplianceMode)
+		}
+
+		if compliance {
+			if ok && algorithm != ChecksumSHA256 {
+				return "", errors.Errorf("%s=%s is not allowed in %s, only %s is supported",
+					ChecksumAlgorithm, algorithm, ComplianceMode, ChecksumSHA256)
+			}
+			return ChecksumSHA256, nil
+		}
+	}
+
+	if !ok {
+		return defaultChecksumAlgorithm, nil
+	}
+
+	if newChecksumHash(algorithm) == nil {
+		return "", errors.Errorf("invalid %s=%s, expected %s, %s or %s",
+			ChecksumAlgorithm, algorithm, ChecksumCRC32C, ChecksumXXHash64, ChecksumSHA256)
+	}
+	return algorithm, nil
+}
+
+// newChecksumHash returns the hash for the given checksum algorithm,
+// it returns nil if algorithm is not supported
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	case ChecksumXXHash64:
+		return xxhash.New()
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// formatChecksum returns the checksum of the given hash in "<algorithm>:<hex>" format
+func formatChecksum(algorithm string, h hash.Hash) string {
+	return algorithm + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// ChecksumAlgorithmOf returns the algorithm of the given checksum, having "<algorithm>:<hex>" format
+func ChecksumAlgorithmOf(checksum string) string {
+	idx := strings.Index(checksum, ":")
+	if idx < 0 {
+		return ""
+	}
+	return checksum[:idx]
+}
+
+// SetChecksumAlgorithm sets the checksum algorithm for the upload/download operation
+// It is used while restoring the backup having checksum of other algorithm.
+func (c *Conn) SetChecksumAlgorithm(algorithm string) error {
+	if newChecksumHash(algorithm) == nil {
+		return errors.Errorf("checksum algorithm=%s is not supported", algorithm)
+	}
+	c.checksumAlgorithm = algorithm
+	return nil
+}
+
+// DefaultChecksumAlgorithm returns the checksum algorithm configured for the connection
+func (c *Conn) DefaultChecksumAlgorithm() string {
+	return c.defaultChecksumAlgorithm
+}
@@ -20,12 +20,20 @@ import (
 	"context"
 	"crypto/tls"
 	base64 "encoding/base64"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -33,6 +41,8 @@ import (
 	"gocloud.dev/blob/gcsblob"
 	"gocloud.dev/blob/s3blob"
 	"gocloud.dev/gcp"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/googleapi"
 	"k8s.io/apimachinery/pkg/api/resource"
 )
@@ -41,6 +51,14 @@ const (
 	// S3Profile profile for s3 base remote storage
 	S3Profile = "profile"
 
+	// CredentialsFile config key for the credentials file of the storage-bucket, it is set by velero
+	// for the volumesnapshotlocation having credential. For AWS, it is a shared credentials file,
+	// and for GCP, a service account key file.
+	CredentialsFile = "credentialsFile"
+
+	// gcpScope is the scope of GCP credentials
+	gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
 	// PROVIDER provider key
 	PROVIDER = "provider"
 
@@ -62,6 +80,10 @@ const (
 	// GCP gcp cloud provider
 	GCP = "gcp"
 
+	// Memory is in-memory provider, objects are kept in the memory of plugin process.
+	// It is used for testing without cloud provider.
+	Memory = "memory"
+
 	// AWSUrl aws s3 url
 	AWSUrl = "s3Url"
 
@@ -79,6 +101,50 @@ const (
 
 	// MultiPartChunkSize is chunk size in case of multi-part upload of individual files
 	MultiPartChunkSize = "multiPartChunkSize"
+
+	// SocketReadBufferSize is size of kernel receive buffer for data server connection
+	SocketReadBufferSize = "socketReadBufferSize"
+
+	// SocketWriteBufferSize is size of kernel send buffer for data server connection
+	SocketWriteBufferSize = "socketWriteBufferSize"
+
+	// ReadAheadSize is number of bytes read from data server connection in single read
+	ReadAheadSize = "readAheadSize"
+
+	// WriteBufferSize is number of bytes written to data server connection in single write, for restore
+	WriteBufferSize = "writeBufferSize"
+
+	// BindAddress is IP address on which data server listens, all the interfaces are used if not set
+	BindAddress = "bindAddress"
+
+	// ServerShutdownTimeout is time limit to drain the active transfers once data server is stopped
+	ServerShutdownTimeout = "serverShutdownTimeout"
+
+	// DefaultServerShutdownTimeout is default time limit to drain the active transfers of data server
+	DefaultServerShutdownTimeout = time.Minute
+
+	// ConnectionPoolSize is number of idle HTTP connections kept for reuse with cloud provider
+	ConnectionPoolSize = "connectionPoolSize"
+
+	// IdleConnectionTimeout is time for which an idle HTTP connection is kept for reuse
+	IdleConnectionTimeout = "idleConnectionTimeout"
+
+	// KeepAlivePeriod is interval for TCP keep-alive probes of HTTP connections
+	KeepAlivePeriod = "keepAlivePeriod"
+
+	// ChecksumAlgorithm is algorithm of checksum computed for the transferred data
+	ChecksumAlgorithm = "checksumAlgorithm"
+
+	// ComplianceMode if set then SHA-256 is used as checksum algorithm
+	ComplianceMode = "complianceMode"
+)
+
+const (
+	// serverStop requests the data server to exit once the active transfers are drained
+	serverStop int32 = iota + 1
+
+	// serverAbort requests the data server to exit by aborting the active transfers
+	serverAbort
 )
 
 // Conn defines resource used for cloud related operation
@@ -107,11 +173,96 @@ type Conn struct {
 	// file represent remote file name
 	file string
 
+	// transport is HTTP transport used for cloud operation, shared by all copies of Conn
+	transport *http.Transport
+
 	// partSize for multi-part upload, default value 5MB for AWS (8MB for GCP)
 	partSize int64
 
-	// exitServer, if server connection needs to be stopped or not
-	ExitServer bool
+	// exitServer is set, atomically, to serverStop or serverAbort if data server needs to exit
+	exitServer int32
+
+	// shutdownTimeout is time limit to drain the active transfers once data server is stopped
+	shutdownTimeout time.Duration
+
+	// dataKeepAlive is period of TCP keep-alive probes of data server connections, 0 to disable
+	dataKeepAlive time.Duration
+
+	// dataWriteTimeout is time limit for data sent to data server connection, 0 to disable
+	dataWriteTimeout time.Duration
+
+	// dataIdleTimeout is time limit for data server connection to transfer no data, 0 to disable
+	dataIdleTimeout time.Duration
+
+	// stagingPath is local directory in which snapshot is staged before upload, if set
+	stagingPath string
+
+	// bytesTransferred is number of bytes transferred for ongoing upload/download
+	bytesTransferred int64
+
+	// fileSize is expected size of the file for ongoing upload/download
+	fileSize int64
+
+	// checksum is hash of the data transferred by ongoing upload/download
+	checksum hash.Hash
+
+	// checksumAlgorithm is algorithm of checksum for ongoing upload/download
+	checksumAlgorithm string
+
+	// defaultChecksumAlgorithm is checksum algorithm configured for the connection
+	defaultChecksumAlgorithm string
+
+	// sockReadBufferSize is SO_RCVBUF for data server, if 0 then kernel auto-tuning is used
+	sockReadBufferSize int
+
+	// sockWriteBufferSize is SO_SNDBUF for data server, if 0 then kernel auto-tuning is used
+	sockWriteBufferSize int
+
+	// readAheadSize is read buffer length for data server connection,
+	// if 0 then it is tuned from the measured RTT and bandwidth
+	readAheadSize int
+
+	// writeBufferSize is write buffer length for data server connection of restore,
+	// if 0 then readAheadSize is used
+	writeBufferSize int
+
+	// bindAddress is IP address on which data server listens, if empty then all the interfaces are used
+	bindAddress string
+
+	// dedup is set if snapshot is uploaded as chunks, skipping the chunks already uploaded
+	dedup bool
+
+	// dedupChunkSize is size of the chunks of deduplicated snapshot
+	dedupChunkSize int
+
+	// chunkDir is directory of the chunks of the volume, relative to backupPathPrefix,
+	// if empty then snapshot is not deduplicated
+	chunkDir string
+
+	// segmentSize is size of the objects of segmented snapshot, if 0 then snapshot is uploaded as single object
+	segmentSize int64
+
+	// s3Client is client for streaming multi-part upload to AWS, it is nil for other providers
+	s3Client *s3.S3
+
+	// uploadConcurrency is number of parts uploaded concurrently, if 0 then default is used
+	uploadConcurrency int
+
+	// uploadBufferLimit is limit of memory used for buffering the parts of upload, 0 for no limit
+	uploadBufferLimit int
+
+	// downloadStreams is number of concurrent ranged reads of a file for restore,
+	// if less than 2 then file is read serially
+	downloadStreams int
+
+	// downloadPartSize is size of the ranged reads of a file for parallel download
+	downloadPartSize int
+
+	// listLimiter is rate limiter of list requests, shared by the connections to the storage-bucket
+	listLimiter *rate.Limiter
+
+	// listPageSize is maximum number of objects returned in a page of List
+	listPageSize int
 
 	// ConnReady describes the connection ready state
 	ConnReady *chan bool
@@ -126,6 +277,8 @@ func (c *Conn) setupBucket(
 		return c.setupAWS(ctx, bucket, config)
 	case GCP:
 		return c.setupGCP(ctx, bucket, config)
+	case Memory:
+		return c.setupMemory(bucket), nil
 	default:
 		return nil, errors.New("provider is not supported")
 	}
@@ -133,14 +286,12 @@ func (c *Conn) setupBucket(
 
 // setupGCP creates a connection to GCP's blob storage
 func (c *Conn) setupGCP(ctx context.Context, bucket string, config map[string]string) (*blob.Bucket, error) {
-	_ = config
-	/* TBD: use cred file using env variable */
-	creds, err := gcp.DefaultCredentials(ctx)
+	creds, err := gcpCredentials(ctx, config[CredentialsFile])
 	if err != nil {
 		return nil, err
 	}
 
-	d, err := gcp.NewHTTPClient(gcp.DefaultTransport(), gcp.CredentialsTokenSource(creds))
+	d, err := gcp.NewHTTPClient(c.transport, gcp.CredentialsTokenSource(creds))
 	if err != nil {
 		return nil, err
 	}
@@ -150,6 +301,25 @@ func (c *Conn) setupGCP(ctx context.Context, bucket string, config map[string]st
 	return gcsblob.OpenBucket(ctx, d, bucket, nil)
 }
 
+// gcpCredentials return the credentials from given service account key file, default
+// credentials are used if file is not set
+func gcpCredentials(ctx context.Context, file string) (*google.Credentials, error) {
+	if file == "" {
+		return gcp.DefaultCredentials(ctx)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s=%s", CredentialsFile, file)
+	}
+
+	creds, err := google.CredentialsFromJSON(ctx, data, gcpScope)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s=%s", CredentialsFile, file)
+	}
+	return creds, nil
+}
+
 // setupAWS creates a connection to AWS's blob storage
 func (c *Conn) setupAWS(ctx context.Context, bucketName string, config map[string]string) (*blob.Bucket, error) {
 	var (
@@ -212,17 +382,21 @@ func (c *Conn) setupAWS(ctx context.Context, bucketName string, config map[strin
 
 	// check if tls verification is disabled
 	if skipTLSVerification {
-		defaultTransport := http.DefaultTransport.(*http.Transport)
-		defaultTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} /* #nosec */
-
-		awsconfig = awsconfig.WithHTTPClient(&http.Client{Transport: defaultTransport})
+		c.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} /* #nosec */
 	}
 
+	awsconfig = awsconfig.WithHTTPClient(&http.Client{Transport: c.transport})
+
 	opts := session.Options{
 		Config:  *awsconfig,
 		Profile: profile,
 	}
 
+	// credentials file of the location is used instead of the default shared credentials file
+	if file, ok := config[CredentialsFile]; ok && file != "" {
+		opts.SharedConfigFiles = []string{file}
+	}
+
 	if caCert, ok := config[AWSCaCert]; ok {
 		if len(caCert) > 0 {
 			caCertData, err := base64.StdEncoding.DecodeString(caCert)
@@ -237,6 +411,7 @@ func (c *Conn) setupAWS(ctx context.Context, bucketName string, config map[strin
 	if _, err := s.Config.Credentials.Get(); err != nil {
 		return nil, errors.Wrapf(err, "failed to get credentials value")
 	}
+	c.s3Client = s3.New(s)
 	return s3blob.OpenBucket(ctx, s, bucketName, nil)
 }
 
@@ -270,6 +445,10 @@ func (c *Conn) Init(config map[string]string) error {
 	}
 	c.backupPathPrefix = backupPathPrefix
 
+	if err := c.parseConfig(config); err != nil {
+		return err
+	}
+
 	c.ctx = context.Background()
 	b, err := c.setupBucket(c.ctx, provider, bucketName, config)
 	if err != nil {
@@ -279,56 +458,240 @@ func (c *Conn) Init(config map[string]string) error {
 	return nil
 }
 
+// parseConfig parses the config of data transfer, which is not specific to the provider
+func (c *Conn) parseConfig(config map[string]string) error {
+	var err error
+	if c.sockReadBufferSize, err = getSizeConfig(config, SocketReadBufferSize); err != nil {
+		return err
+	}
+	if c.sockWriteBufferSize, err = getSizeConfig(config, SocketWriteBufferSize); err != nil {
+		return err
+	}
+	if c.readAheadSize, err = getSizeConfig(config, ReadAheadSize); err != nil {
+		return err
+	}
+	if c.writeBufferSize, err = getSizeConfig(config, WriteBufferSize); err != nil {
+		return err
+	}
+
+	if addr, ok := config[BindAddress]; ok {
+		if net.ParseIP(addr) == nil {
+			return errors.Errorf("invalid %s=%s, expected IP address", BindAddress, addr)
+		}
+		c.bindAddress = addr
+	}
+
+	c.shutdownTimeout = DefaultServerShutdownTimeout
+	if val, ok := config[ServerShutdownTimeout]; ok {
+		if c.shutdownTimeout, err = time.ParseDuration(val); err != nil {
+			return errors.Wrapf(err, "failed to parse %s=%s", ServerShutdownTimeout, val)
+		}
+	}
+
+	if c.dataKeepAlive, err = getDurationConfig(config, DataKeepAlivePeriod, DefaultDataKeepAlivePeriod); err != nil {
+		return err
+	}
+	if c.dataWriteTimeout, err = getDurationConfig(config, DataWriteTimeout, DefaultDataWriteTimeout); err != nil {
+		return err
+	}
+	if c.dataIdleTimeout, err = getDurationConfig(config, DataIdleTimeout, DefaultDataIdleTimeout); err != nil {
+		return err
+	}
+
+	if c.stagingPath, err = getStagingPath(config); err != nil {
+		return err
+	}
+
+	if c.dedup, c.dedupChunkSize, err = getDedupConfig(config); err != nil {
+		return err
+	}
+
+	if c.segmentSize, err = getSegmentSize(config); err != nil {
+		return err
+	}
+
+	// chunks of deduplicated snapshot are already separate objects
+	if c.dedup && c.segmentSize > 0 {
+		return errors.Errorf("%s can't be used with %s", ObjectSegmentSize, Dedup)
+	}
+
+	if c.uploadConcurrency, err = getCountConfig(config, UploadConcurrency); err != nil {
+		return err
+	}
+
+	if c.downloadStreams, err = getCountConfig(config, DownloadStreams); err != nil {
+		return err
+	}
+	if c.downloadPartSize, err = getSizeConfig(config, DownloadPartSize); err != nil {
+		return err
+	}
+	if c.downloadPartSize == 0 {
+		c.downloadPartSize = DefaultDownloadPartSize
+	}
+
+	c.uploadBufferLimit = DefaultUploadBufferLimit
+	if _, ok := config[UploadBufferLimit]; ok {
+		if c.uploadBufferLimit, err = getSizeConfig(config, UploadBufferLimit); err != nil {
+			return err
+		}
+	}
+
+	if c.transport, err = newHTTPTransport(config); err != nil {
+		return err
+	}
+
+	listRateLimit, listPageSize, err := getListConfig(config)
+	if err != nil {
+		return err
+	}
+	c.listLimiter = getListLimiter(c.Location(""), listRateLimit)
+	c.listPageSize = listPageSize
+
+	if c.defaultChecksumAlgorithm, err = getChecksumAlgorithm(config); err != nil {
+		return err
+	}
+	c.checksumAlgorithm = c.defaultChecksumAlgorithm
+	return nil
+}
+
+// Clone returns a copy of the connection which shares the storage-bucket with c
+// but has its own state for upload/download operation, so that data transfer of
+// multiple files can be performed concurrently using different copies.
+// If ctx is canceled then ongoing data transfer of the copy is aborted.
+func (c *Conn) Clone(ctx context.Context) *Conn {
+	return &Conn{
+		Log:              c.Log,
+		ctx:              ctx,
+		bucket:           c.bucket,
+		provider:         c.provider,
+		bucketname:       c.bucketname,
+		prefix:           c.prefix,
+		backupPathPrefix: c.backupPathPrefix,
+		partSize:         c.partSize,
+		transport:        c.transport,
+
+		checksumAlgorithm:        c.defaultChecksumAlgorithm,
+		defaultChecksumAlgorithm: c.defaultChecksumAlgorithm,
+
+		sockReadBufferSize:  c.sockReadBufferSize,
+		sockWriteBufferSize: c.sockWriteBufferSize,
+		readAheadSize:       c.readAheadSize,
+		writeBufferSize:     c.writeBufferSize,
+		bindAddress:         c.bindAddress,
+		shutdownTimeout:     c.shutdownTimeout,
+		dataKeepAlive:       c.dataKeepAlive,
+		dataWriteTimeout:    c.dataWriteTimeout,
+		dataIdleTimeout:     c.dataIdleTimeout,
+		stagingPath:         c.stagingPath,
+
+		dedup:          c.dedup,
+		dedupChunkSize: c.dedupChunkSize,
+		segmentSize:    c.segmentSize,
+
+		s3Client:          c.s3Client,
+		uploadConcurrency: c.uploadConcurrency,
+		uploadBufferLimit: c.uploadBufferLimit,
+		downloadStreams:   c.downloadStreams,
+		downloadPartSize:  c.downloadPartSize,
+		listLimiter:       c.listLimiter,
+		listPageSize:      c.listPageSize,
+	}
+}
+
 // Create creates a connection to cloud blob storage object/file
 func (c *Conn) Create(opType ServerOperation) ReadWriter {
-	s := &Server{
-		Log: c.Log,
-	}
+	return c.create(c.ctx, opType)
+}
+
+// create creates a connection to cloud blob storage object/file using given ctx, if ctx
+// is canceled before the connection is destroyed then the write to the object is aborted
+func (c *Conn) create(ctx context.Context, opType ServerOperation) ReadWriter {
 	switch opType {
 	case OpBackup:
-		w, err := c.bucket.NewWriter(c.ctx, c.file, &blob.WriterOptions{BufferSize: int(c.partSize)})
-		if err != nil {
-			c.Log.Errorf("Failed to obtain writer: %s", err.Error())
-			return nil
+		var (
+			w   io.WriteCloser
+			err error
+		)
+		if c.stagingPath != "" {
+			w, err = c.newStagingWriter(ctx, c.file)
+		} else {
+			w, err = c.newBackupWriter(ctx, c.file)
 		}
-
-		wConn, err := s.GetReadWriter(w, nil, OpBackup)
 		if err != nil {
+			c.Log.Errorf("Failed to obtain writer: %s", err.Error())
 			return nil
 		}
-		return wConn
+		return w
 	case OpRestore:
-		r, err := c.bucket.NewReader(c.ctx, c.file, nil)
+		r, err := c.newFileReader(ctx, c.file, 0)
 		if err != nil {
 			c.Log.Errorf("Failed to obtain reader: %s", err.Error())
 			return nil
 		}
-
-		rConn, err := s.GetReadWriter(nil, r, OpRestore)
-		if err != nil {
-			return nil
-		}
-		return rConn
+		return r
 	}
 	return nil
 }
 
-// Destroy close the connection to blob storage object object/file
-func (c *Conn) Destroy(rw ReadWriter, opType ServerOperation) {
-	switch opType {
-	case OpBackup:
-		w := (*blob.Writer)(rw)
-		if err := w.Close(); err != nil {
-			c.Log.Warnf("Failed to close file interface : %s", err.Error())
+// newBackupWriter return a writer which uploads the data of given file to cloud blob storage
+func (c *Conn) newBackupWriter(ctx context.Context, file string) (io.WriteCloser, error) {
+	if c.chunkDir != "" {
+		return c.newDedupWriter(ctx, file), nil
+	}
+
+	if c.segmentSize > 0 {
+		return c.newSegmentWriter(ctx, file), nil
+	}
+	return c.newObjectWriter(ctx, file)
+}
+
+// newObjectWriter return a writer which uploads the given data as single object
+func (c *Conn) newObjectWriter(ctx context.Context, file string) (io.WriteCloser, error) {
+	if c.s3Client != nil {
+		return c.newStreamWriter(ctx, file), nil
+	}
+
+	return c.bucket.NewWriter(ctx, file, &blob.WriterOptions{BufferSize: int(c.partSize)})
+}
+
+// newFileReader return a reader for the data of given file from given offset. Data
+// of deduplicated, or segmented, snapshot file is read from its chunks or segments.
+func (c *Conn) newFileReader(ctx context.Context, file string, offset int64) (io.ReadCloser, error) {
+	attrs, err := c.bucket.Attributes(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := attrs.Metadata[dedupMetadataKey]; ok {
+		index, err := c.getChunkIndex(ctx, file)
+		if err != nil {
+			return nil, err
 		}
-		return
-	case OpRestore:
-		r := (*blob.Reader)(rw)
-		if err := r.Close(); err != nil {
-			c.Log.Warnf("Failed to close file interface : %s", err.Error())
+		return c.newDedupReader(ctx, index, offset), nil
+	}
+
+	if _, ok := attrs.Metadata[segmentMetadataKey]; ok {
+		index, err := c.getSegmentIndex(ctx, file)
+		if err != nil {
+			return nil, err
 		}
-		return
+		return c.newSegmentReader(ctx, index, offset), nil
+	}
+
+	if c.downloadStreams > 1 && attrs.Size-offset > int64(c.downloadPartSize) {
+		return c.newParallelReader(ctx, file, attrs.Size, offset), nil
+	}
+	return c.bucket.NewRangeReader(ctx, file, offset, -1, nil)
+}
+
+// Destroy close the connection to blob storage object object/file, it return
+// the error in closing, for backup the uploaded file is incomplete if it fails
+func (c *Conn) Destroy(rw ReadWriter, opType ServerOperation) error {
+	err := rw.Close()
+	if err != nil {
+		c.Log.Warnf("Failed to close file interface : %s", err.Error())
 	}
+	return err
 }
 
 // getPartSize returns the multiPartChunkSize from the config
@@ -355,3 +718,40 @@ func getPartSize(config map[string]string) (val int64, err error) {
 	}
 	return
 }
+
+// getCountConfig returns the value of given count config key
+// - if key is not specified then it will return 0
+// - if value is not a positive number then it will return an error
+func getCountConfig(config map[string]string, key string) (int, error) {
+	val, ok := config[key]
+	if !ok {
+		return 0, nil
+	}
+
+	count, err := strconv.Atoi(val)
+	if err != nil || count < 1 {
+		return 0, errors.Errorf("invalid %s=%s, expected positive number", key, val)
+	}
+	return count, nil
+}
+
+// getSizeConfig returns the value of given size config key in bytes
+// - if key is not specified then it will return 0
+// - if value is invalid or negative then it will return an error
+func getSizeConfig(config map[string]string, key string) (int, error) {
+	val, ok := config[key]
+	if !ok {
+		return 0, nil
+	}
+
+	q, err := resource.ParseQuantity(val)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s=%s", key, val)
+	}
+
+	size, ok := q.AsInt64()
+	if !ok || size < 0 || size > math.MaxInt32 {
+		return 0, errors.Errorf("invalid %s=%s", key, val)
+	}
+	return int(size), nil
+}
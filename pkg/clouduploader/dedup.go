@@ -0,0 +1,377 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+const (
+	// Dedup if set then snapshot is uploaded as chunks, and chunks already uploaded
+	// for the volume are not uploaded again
+	Dedup = "dedup"
+
+	// DedupChunkSize is size of the chunks of deduplicated snapshot
+	DedupChunkSize = "dedupChunkSize"
+
+	// DefaultDedupChunkSize is default size of the chunks of deduplicated snapshot
+	DefaultDedupChunkSize = 4 * 1024 * 1024
+
+	// MinDedupChunkSize is minimum size of the chunks of deduplicated snapshot
+	MinDedupChunkSize = 64 * 1024
+
+	// chunkDir is remote storage-bucket directory for the chunks of deduplicated snapshots,
+	// it is not created in backupDir so that it is not considered as backup by velero
+	chunkDir = "chunks"
+
+	// dedupMetadataKey is set in the metadata of chunk index of deduplicated snapshot
+	dedupMetadataKey = "openebs-dedup"
+
+	// dedupIndexVersion is version of chunk index
+	dedupIndexVersion = 1
+)
+
+// chunkIndex is uploaded as snapshot file of deduplicated snapshot. It lists the
+// chunks of snapshot data, in order, by their SHA-256 hash. Dir is directory of
+// the chunks relative to backupPathPrefix.
+type chunkIndex struct {
+	Version   int      `json:"version"`
+	Dir       string   `json:"dir"`
+	ChunkSize int      `json:"chunkSize"`
+	Size      int64    `json:"size"`
+	Chunks    []string `json:"chunks"`
+}
+
+// SetDedupVolume sets the volume whose snapshot is uploaded by the connection, chunks
+// are shared by the snapshots of same volume. It is no-op if dedup is not configured.
+func (c *Conn) SetDedupVolume(volume string) {
+	if !c.dedup {
+		return
+	}
+
+	c.chunkDir = chunkDir + "/" + c.prefix + "-" + volume
+}
+
+// DedupEnabled returns true if snapshot is uploaded as deduplicated chunks
+func (c *Conn) DedupEnabled() bool {
+	return c.dedup
+}
+
+// chunkKey return the key of given chunk in given chunk directory
+func (c *Conn) chunkKey(dir, hash string) string {
+	if c.backupPathPrefix == "" {
+		return dir + "/" + hash
+	}
+	return c.backupPathPrefix + "/" + dir + "/" + hash
+}
+
+// getDedupConfig returns the dedup config from given config
+func getDedupConfig(config map[string]string) (bool, int, error) {
+	val, ok := config[Dedup]
+	if !ok {
+		return false, 0, nil
+	}
+
+	dedup, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, 0, errors.Wrapf(err, "failed to parse %s (expected format bool)", Dedup)
+	}
+
+	size, err := getSizeConfig(config, DedupChunkSize)
+	if err != nil {
+		return false, 0, err
+	}
+	if size == 0 {
+		size = DefaultDedupChunkSize
+	}
+	if size < MinDedupChunkSize {
+		return false, 0, errors.Errorf("%s should be more than %v", DedupChunkSize, MinDedupChunkSize)
+	}
+	return dedup, size, nil
+}
+
+// dedupWriter uploads the snapshot data as chunks, skipping the chunks which exist
+// already, and uploads the chunk index as snapshot file on close
+type dedupWriter struct {
+	c    *Conn
+	ctx  context.Context
+	file string
+
+	buf   []byte
+	index chunkIndex
+
+	// uploaded and skipped are number of chunks uploaded and already present
+	uploaded, skipped int
+}
+
+// newDedupWriter return a writer for deduplicated snapshot file. If ctx is canceled
+// before the writer is closed then chunk index is not uploaded.
+func (c *Conn) newDedupWriter(ctx context.Context, file string) *dedupWriter {
+	return &dedupWriter{
+		c:    c,
+		ctx:  ctx,
+		file: file,
+		buf:  make([]byte, 0, c.dedupChunkSize),
+		index: chunkIndex{
+			Version:   dedupIndexVersion,
+			Dir:       c.chunkDir,
+			ChunkSize: c.dedupChunkSize,
+		},
+	}
+}
+
+// Write buffers the given data, and uploads the chunks filled by it
+func (w *dedupWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		l := cap(w.buf) - len(w.buf)
+		if l > len(p) {
+			l = len(p)
+		}
+		w.buf = append(w.buf, p[:l]...)
+		p = p[l:]
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered chunk, if it is not present already
+func (w *dedupWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(w.buf)
+	hash := hex.EncodeToString(sum[:])
+	key := w.c.chunkKey(w.index.Dir, hash)
+
+	exists, err := w.c.bucket.Exists(w.ctx, key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check chunk=%s", key)
+	}
+
+	if exists {
+		w.skipped++
+	} else {
+		if err := w.c.bucket.WriteAll(w.ctx, key, w.buf, nil); err != nil {
+			return errors.Wrapf(err, "failed to upload chunk=%s", key)
+		}
+		w.uploaded++
+	}
+
+	w.index.Chunks = append(w.index.Chunks, hash)
+	w.index.Size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close uploads the remaining chunk and the chunk index
+func (w *dedupWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		return errors.Wrapf(err, "upload of file=%s aborted", w.file)
+	}
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(w.index)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal chunk index of file=%s", w.file)
+	}
+
+	opts := &blob.WriterOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{dedupMetadataKey: strconv.Itoa(dedupIndexVersion)},
+	}
+	if err := w.c.bucket.WriteAll(w.ctx, w.file, data, opts); err != nil {
+		return errors.Wrapf(err, "failed to upload chunk index of file=%s", w.file)
+	}
+
+	w.c.Log.Infof("Uploaded file=%s as %d chunks, %d new and %d already present",
+		w.file, len(w.index.Chunks), w.uploaded, w.skipped)
+	return nil
+}
+
+// getChunkIndex return the chunk index of given file, if it is a deduplicated snapshot file.
+// It return nil if file is not deduplicated.
+func (c *Conn) getChunkIndex(ctx context.Context, file string) (*chunkIndex, error) {
+	attrs, err := c.bucket.Attributes(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs.Metadata[dedupMetadataKey]; !ok {
+		return nil, nil
+	}
+
+	data, err := c.bucket.ReadAll(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var index chunkIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse chunk index of file=%s", file)
+	}
+	if index.Version != dedupIndexVersion || index.ChunkSize <= 0 || index.Dir == "" {
+		return nil, errors.Errorf("unsupported chunk index, version=%d chunkSize=%d, of file=%s",
+			index.Version, index.ChunkSize, file)
+	}
+	return &index, nil
+}
+
+// collectChunks deletes the chunks, in the chunk directory of given index, which are not referenced
+// by any snapshot file of the volume. It is mark-and-sweep, so chunks left by the failed uploads are
+// also deleted. Caller should ensure that snapshot of the volume is not uploaded concurrently, since
+// the chunks skipped by the upload are referenced only once its chunk index is uploaded.
+func (c *Conn) collectChunks(ctx context.Context, index *chunkIndex) error {
+	volume := strings.TrimPrefix(path.Base(index.Dir), c.prefix+"-")
+
+	files, err := c.ListBackupFiles("")
+	if err != nil {
+		return err
+	}
+
+	// chunks are shared only by the snapshots of same volume, snapshot file name is
+	// the volume name prefixed by schedule name, if any
+	used := map[string]bool{}
+	for _, f := range files {
+		if f.Name != volume && !strings.HasSuffix(f.Name, "-"+volume) {
+			continue
+		}
+
+		idx, err := c.getChunkIndex(ctx, f.Key)
+		if err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				continue
+			}
+			return errors.Wrapf(err, "failed to read chunk index of file=%s", f.Key)
+		}
+		if idx == nil || idx.Dir != index.Dir {
+			continue
+		}
+		for _, hash := range idx.Chunks {
+			used[hash] = true
+		}
+	}
+
+	prefix := c.chunkKey(index.Dir, "")
+	deleted := 0
+	err = c.Walk(ctx, ListOptions{Prefix: prefix}, func(obj ListObject) error {
+		if obj.IsDir || used[strings.TrimPrefix(obj.Key, prefix)] {
+			return nil
+		}
+		if err := c.bucket.Delete(ctx, obj.Key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return errors.Wrapf(err, "failed to delete chunk=%s", obj.Key)
+		}
+		deleted++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.Log.Infof("Removed %d unused chunks from %s, %d chunks are in use", deleted, index.Dir, len(used))
+	return nil
+}
+
+// dedupReader reads the data of deduplicated snapshot from its chunks
+type dedupReader struct {
+	c     *Conn
+	ctx   context.Context
+	index *chunkIndex
+
+	// next is index of the next chunk to read
+	next int
+
+	// skip is number of bytes to skip from the next chunk
+	skip int64
+
+	cur *blob.Reader
+}
+
+// newDedupReader return a reader for the data of deduplicated snapshot, having given
+// chunk index, from the given offset
+func (c *Conn) newDedupReader(ctx context.Context, index *chunkIndex, offset int64) *dedupReader {
+	size := int64(index.ChunkSize)
+
+	return &dedupReader{
+		c:     c,
+		ctx:   ctx,
+		index: index,
+		next:  int(offset / size),
+		skip:  offset % size,
+	}
+}
+
+// Read reads the data from the current chunk, and opens the next chunk once current is read
+func (r *dedupReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next >= len(r.index.Chunks) {
+				return 0, io.EOF
+			}
+
+			key := r.c.chunkKey(r.index.Dir, r.index.Chunks[r.next])
+			cur, err := r.c.bucket.NewRangeReader(r.ctx, key, r.skip, -1, nil)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to read chunk=%s", key)
+			}
+			r.cur, r.next, r.skip = cur, r.next+1, 0
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			if cerr := r.cur.Close(); cerr != nil {
+				r.c.Log.Warnf("Failed to close chunk reader : %s", cerr.Error())
+			}
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the reader of current chunk
+func (r *dedupReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DataKeepAlivePeriod is idle time, and interval, for TCP keep-alive probes of data server connections
+	DataKeepAlivePeriod = "dataKeepAlivePeriod"
+
+	// DefaultDataKeepAlivePeriod is default period for TCP keep-alive probes of data server connections
+	DefaultDataKeepAlivePeriod = 30 * time.Second
+
+	// DataWriteTimeout is time limit for the data sent to data server connection to be sent and acknowledged
+	DataWriteTimeout = "dataWriteTimeout"
+
+	// DefaultDataWriteTimeout is default time limit for the data sent to data server connection
+	DefaultDataWriteTimeout = 2 * time.Minute
+
+	// DataIdleTimeout is time limit for data server connection to transfer no data, once it
+	// is exceeded the connection is closed and its transfer is failed
+	DataIdleTimeout = "dataIdleTimeout"
+
+	// DefaultDataIdleTimeout is default time limit for data server connection to transfer no data
+	DefaultDataIdleTimeout = 10 * time.Minute
+
+	// dataKeepAliveProbes is number of unacknowledged keep-alive probes after which connection is closed
+	dataKeepAliveProbes = 3
+)
+
+// getDurationConfig returns the value of given duration config key
+// - if key is not specified then it will return given default value
+// - if value is invalid or negative then it will return an error
+func getDurationConfig(config map[string]string, key string, def time.Duration) (time.Duration, error) {
+	val, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("invalid %s=%s (expected format duration)", key, val)
+	}
+	return d, nil
+}
+
+// setClientTimeouts sets the TCP keep-alive and user timeout on given client connection, so
+// that the connection to a dead peer is closed by the kernel
+func (s *Server) setClientTimeouts(fd int) error {
+	if period := int(s.cl.dataKeepAlive.Seconds()); period > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+			return errors.Wrapf(err, "failed to enable keep-alive")
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, period); err != nil {
+			return errors.Wrapf(err, "failed to set keep-alive idle time")
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, period); err != nil {
+			return errors.Wrapf(err, "failed to set keep-alive interval")
+		}
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, dataKeepAliveProbes); err != nil {
+			return errors.Wrapf(err, "failed to set keep-alive probes")
+		}
+	}
+
+	// unacknowledged data, or keep-alive probes, for more than user timeout closes the connection
+	if ms := int(s.cl.dataWriteTimeout / time.Millisecond); ms > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, ms); err != nil {
+			return errors.Wrapf(err, "failed to set user timeout")
+		}
+	}
+	return nil
+}
+
+// closeIdleClients closes the client connections which didn't transfer any data for
+// the idle timeout, their transfer is failed
+func (s *Server) closeIdleClients(efd int) {
+	if s.cl.dataIdleTimeout == 0 {
+		return
+	}
+
+	c := s.FirstClient
+	for c != nil {
+		next := c.next
+
+		if idle := time.Since(c.lastActive); idle > s.cl.dataIdleTimeout {
+			s.Log.Errorf("Client{%v} didn't transfer data for %v, closing it", c.fd, idle.Round(time.Second))
+
+			var event syscall.EpollEvent
+			s.addClientToEvent(c, &event)
+			s.handleClientError(errors.Errorf("idle timeout for fd{%v}", c.fd), event, efd)
+		}
+		c = next
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ListRateLimit is maximum number of list requests per second sent to the storage-bucket
+	ListRateLimit = "listRateLimit"
+
+	// DefaultListRateLimit is default maximum number of list requests per second
+	DefaultListRateLimit = 10
+
+	// ListPageSize is maximum number of objects returned in a page of List
+	ListPageSize = "listPageSize"
+
+	// DefaultListPageSize is default maximum number of objects returned in a page of List
+	DefaultListPageSize = 1000
+
+	// maxListCursors is maximum number of listings kept open for continuation
+	maxListCursors = 64
+)
+
+// listLimiters are the rate limiters of list requests by storage-bucket location, shared
+// by the connections of the process so that the limit applies to all the listings of bucket
+var listLimiters = struct {
+	sync.Mutex
+	limiters map[string]*rate.Limiter
+}{
+	limiters: map[string]*rate.Limiter{},
+}
+
+// listCursors are the open listings by continuation token of their next page, so that
+// next page is listed without listing the objects of previous pages again
+var listCursors = struct {
+	sync.Mutex
+	cursors map[string]*listCursor
+}{
+	cursors: map[string]*listCursor{},
+}
+
+// ListOptions are the options to list the objects of storage-bucket
+type ListOptions struct {
+	// Prefix lists the objects having the given prefix only
+	Prefix string
+
+	// Delimiter, if set, lists the objects having the delimiter after the prefix as
+	// a directory, i.e. the key upto the delimiter with IsDir set
+	Delimiter string
+
+	// PageSize is maximum number of objects in the page, if 0 then configured page size is used
+	PageSize int
+
+	// ContinuationToken is the token returned with previous page, to list the next page
+	ContinuationToken string
+}
+
+// ListObject is an object, or directory, of storage-bucket
+type ListObject struct {
+	// Key is key of the object
+	Key string
+
+	// Size is size of the object
+	Size int64
+
+	// ModTime is time at which object was last modified
+	ModTime time.Time
+
+	// IsDir is true if the object is a directory, listed due to delimiter
+	IsDir bool
+}
+
+// ListPage is a page of the objects of storage-bucket, in lexicographical order of keys
+type ListPage struct {
+	// Objects are the objects of the page
+	Objects []ListObject
+
+	// ContinuationToken is the token to list the next page, it is empty for the last page
+	ContinuationToken string
+}
+
+// listToken is the content of continuation token, it is independent of the provider
+type listToken struct {
+	Location  string `json:"location"`
+	Prefix    string `json:"prefix"`
+	Delimiter string `json:"delimiter"`
+	After     string `json:"after"`
+}
+
+// listCursor is an open listing of storage-bucket
+type listCursor struct {
+	it *blob.ListIterator
+
+	// ctx is context of the List call using the cursor, list requests wait for rate limiter with it
+	ctx context.Context
+
+	// next is the object read from iterator but not yet returned
+	next *blob.ListObject
+}
+
+// getListLimiter return the rate limiter of list requests for given storage-bucket location.
+// Limit of the shared limiter is updated to given limit.
+func getListLimiter(location string, limit int) *rate.Limiter {
+	listLimiters.Lock()
+	defer listLimiters.Unlock()
+
+	l, ok := listLimiters.limiters[location]
+	if !ok {
+		l = rate.NewLimiter(rate.Limit(limit), limit)
+		listLimiters.limiters[location] = l
+	} else if l.Limit() != rate.Limit(limit) {
+		l.SetLimit(rate.Limit(limit))
+		l.SetBurst(limit)
+	}
+	return l
+}
+
+// getListConfig return the rate limit of list requests and page size of List from given config
+func getListConfig(config map[string]string) (limit, pageSize int, err error) {
+	if limit, err = getCountConfig(config, ListRateLimit); err != nil {
+		return 0, 0, err
+	}
+	if limit == 0 {
+		limit = DefaultListRateLimit
+	}
+
+	if pageSize, err = getCountConfig(config, ListPageSize); err != nil {
+		return 0, 0, err
+	}
+	if pageSize == 0 {
+		pageSize = DefaultListPageSize
+	}
+	return limit, pageSize, nil
+}
+
+// takeListCursor removes and return the open listing for given token, it return nil if the
+// listing is not open, e.g. token is from other plugin process
+func takeListCursor(token string) *listCursor {
+	listCursors.Lock()
+	defer listCursors.Unlock()
+
+	cur := listCursors.cursors[token]
+	delete(listCursors.cursors, token)
+	return cur
+}
+
+// putListCursor keeps the listing open for given token, an arbitrary listing is closed
+// if the maximum number of listings are open
+func putListCursor(token string, cur *listCursor) {
+	listCursors.Lock()
+	defer listCursors.Unlock()
+
+	if len(listCursors.cursors) >= maxListCursors {
+		for t := range listCursors.cursors {
+			delete(listCursors.cursors, t)
+			break
+		}
+	}
+	listCursors.cursors[token] = cur
+}
+
+// newListCursor opens a listing of given prefix and delimiter. Each list request to the
+// provider waits for the rate limiter of storage-bucket.
+func (c *Conn) newListCursor(ctx context.Context, prefix, delimiter string) *listCursor {
+	cur := &listCursor{ctx: ctx}
+	cur.it = c.bucket.List(&blob.ListOptions{
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		BeforeList: func(func(interface{}) bool) error {
+			if c.listLimiter == nil {
+				return nil
+			}
+			return c.listLimiter.Wait(cur.ctx)
+		},
+	})
+	return cur
+}
+
+// nextObject return the next object of the listing, or io.EOF if there are no more objects
+func (cur *listCursor) nextObject() (*blob.ListObject, error) {
+	if obj := cur.next; obj != nil {
+		cur.next = nil
+		return obj, nil
+	}
+	return cur.it.Next(cur.ctx)
+}
+
+// List return a page of the objects of storage-bucket matching the given options. Next page is
+// listed by setting ContinuationToken of the options to the token returned with the page.
+// Token can be used with any connection to the same storage-bucket.
+func (c *Conn) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	var token listToken
+
+	if opts.ContinuationToken != "" {
+		data, err := base64.RawURLEncoding.DecodeString(opts.ContinuationToken)
+		if err == nil {
+			err = json.Unmarshal(data, &token)
+		}
+		if err != nil || token.Location != c.Location("") ||
+			token.Prefix != opts.Prefix || token.Delimiter != opts.Delimiter {
+			return nil, errors.New("invalid continuation token")
+		}
+	}
+
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = c.listPageSize
+	}
+	if pageSize == 0 {
+		pageSize = DefaultListPageSize
+	}
+
+	cur := takeListCursor(opts.ContinuationToken)
+	if cur == nil {
+		// listing is resumed after the last key of the previous page
+		cur = c.newListCursor(ctx, opts.Prefix, opts.Delimiter)
+	}
+	cur.ctx = ctx
+
+	page := &ListPage{}
+	for len(page.Objects) < pageSize {
+		obj, err := cur.nextObject()
+		if err == io.EOF {
+			return page, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list objects with prefix=%s", opts.Prefix)
+		}
+
+		if obj.Key <= token.After {
+			continue
+		}
+
+		page.Objects = append(page.Objects, ListObject{
+			Key:     obj.Key,
+			Size:    obj.Size,
+			ModTime: obj.ModTime,
+			IsDir:   obj.IsDir,
+		})
+	}
+
+	// check if there are more objects for the next page
+	obj, err := cur.nextObject()
+	if err == io.EOF {
+		return page, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list objects with prefix=%s", opts.Prefix)
+	}
+	cur.next = obj
+
+	token = listToken{
+		Location:  c.Location(""),
+		Prefix:    opts.Prefix,
+		Delimiter: opts.Delimiter,
+		After:     page.Objects[len(page.Objects)-1].Key,
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode continuation token")
+	}
+	page.ContinuationToken = base64.RawURLEncoding.EncodeToString(data)
+	putListCursor(page.ContinuationToken, cur)
+	return page, nil
+}
+
+// Walk calls fn for each object of storage-bucket matching the given options, listing the
+// objects page by page. If fn return an error then listing is stopped and the error is returned.
+func (c *Conn) Walk(ctx context.Context, opts ListOptions, fn func(ListObject) error) error {
+	for {
+		page, err := c.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, obj := range page.Objects {
+			if err := fn(obj); err != nil {
+				takeListCursor(page.ContinuationToken)
+				return err
+			}
+		}
+
+		if page.ContinuationToken == "" {
+			return nil
+		}
+		opts.ContinuationToken = page.ContinuationToken
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"sync"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+)
+
+var (
+	// memoryBuckets are the buckets of memory provider, by bucket name. Buckets are shared
+	// by the connections of the process, so that uploaded data can be downloaded by another
+	// connection having the same bucket.
+	memoryBuckets   = map[string]*blob.Bucket{}
+	memoryBucketsMu sync.Mutex
+)
+
+// setupMemory return the in-memory bucket of given name, it is created if it doesn't exist.
+// Data of the bucket is kept in the memory of the process, and lost once it exits.
+func (c *Conn) setupMemory(bucketName string) *blob.Bucket {
+	memoryBucketsMu.Lock()
+	defer memoryBucketsMu.Unlock()
+
+	b, ok := memoryBuckets[bucketName]
+	if !ok {
+		c.Log.Warnf("Using in-memory bucket{%s}, uploaded data will be lost once the plugin exits", bucketName)
+		b = memblob.OpenBucket(nil)
+		memoryBuckets[bucketName] = b
+	}
+	return b
+}
+
+// ResetMemoryBuckets removes all the buckets, and their data, of memory provider
+func ResetMemoryBuckets() {
+	memoryBucketsMu.Lock()
+	defer memoryBucketsMu.Unlock()
+
+	for name, b := range memoryBuckets {
+		_ = b.Close()
+		delete(memoryBuckets, name)
+	}
+}
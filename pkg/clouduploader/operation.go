@@ -17,18 +17,25 @@ limitations under the License.
 package clouduploader
 
 import (
+	"context"
 	"io"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
 const (
 	// backupDir is remote storage-bucket directory
 	backupDir = "backups"
+
+	// canaryFile is name of the canary object, it is not created in backupDir
+	// so that it is not considered as backup by velero
+	canaryFile = "velero-plugin-canary"
 )
 
 const (
@@ -51,6 +58,7 @@ func (c *Conn) Upload(file string, fileSize int64, port int) bool {
 	c.Log.Infof("Uploading snapshot to '%s' with provider{%s} to bucket{%s}", file, c.provider, c.bucketname)
 
 	c.file = file
+	c.resetProgress(fileSize)
 	if c.partSize == 0 {
 		// MaxUploadParts is limited to 10k
 		// 100 is arbitrary value considering snapshot metadata
@@ -68,7 +76,8 @@ func (c *Conn) Upload(file string, fileSize int64, port int) bool {
 	err := s.Run(OpBackup, port)
 	if err != nil {
 		c.Log.Errorf("Failed to upload snapshot to bucket: %s", err.Error())
-		if c.bucket.Delete(c.ctx, file) != nil {
+		// c.ctx may be canceled, so use a new context to delete the partial file
+		if c.bucket.Delete(context.Background(), file) != nil {
 			c.Log.Errorf("Failed to delete uncompleted snapshot{%s} from cloud", file)
 		}
 		return false
@@ -78,12 +87,38 @@ func (c *Conn) Upload(file string, fileSize int64, port int) bool {
 	return true
 }
 
-// Delete will delete file from cloud blob storage
+// Delete will delete file from cloud blob storage, segments of segmented snapshot file are also deleted.
+// For deduplicated snapshot file, chunks not referenced by other snapshots of the volume are deleted.
 func (c *Conn) Delete(file string) bool {
 	c.Log.Infof("Removing snapshot:'%s' from bucket{%s} provider{%s}", file, c.bucketname, c.provider)
 
-	if c.bucket.Delete(c.ctx, file) != nil {
-		c.Log.Errorf("Failed to remove snapshot{%s} from cloud", file)
+	// chunks are collected only once the chunk index is deleted
+	chunks, _ := c.getChunkIndex(c.ctx, file)
+	defer func() {
+		if chunks == nil {
+			return
+		}
+		if err := c.collectChunks(c.ctx, chunks); err != nil {
+			c.Log.Warnf("Failed to remove unused chunks of snapshot{%s}, they are removed with next snapshot : %s", file, err)
+		}
+	}()
+
+	// file is checked for segments only if it exists, its deletion handles the errors
+	if index, err := c.getSegmentIndex(c.ctx, file); err == nil && index != nil {
+		if err := c.deleteSegments(c.ctx, index, index.Segments); err != nil {
+			c.Log.Errorf("Failed to remove segments of snapshot{%s} from cloud : %s", file, err)
+			return false
+		}
+	}
+
+	if err := c.bucket.Delete(c.ctx, file); err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// snapshot is already removed
+			c.Log.Infof("Snapshot:'%s' doesn't exist in bucket{%s}", file, c.bucketname)
+			return true
+		}
+		c.Log.Errorf("Failed to remove snapshot{%s} from cloud : %s", file, err)
+		chunks = nil
 		return false
 	}
 	return true
@@ -94,6 +129,10 @@ func (c *Conn) Delete(file string) bool {
 // connect and download data from cloud blob storage file
 func (c *Conn) Download(file string, port int) bool {
 	c.file = file
+
+	fileSize, _ := c.ObjectSize(file)
+	c.resetProgress(fileSize)
+
 	s := &Server{
 		Log: c.Log,
 		cl:  c,
@@ -177,7 +216,37 @@ func (c *Conn) GetFileNameWithSchd(file, schdname string) string {
 func (c *Conn) ConnStateReset() {
 	ch := make(chan bool, 1)
 	c.ConnReady = &ch
-	c.ExitServer = false
+	atomic.StoreInt32(&c.exitServer, 0)
+}
+
+// StopServer requests the data server to stop. Server stops accepting new connections
+// and exits once the active transfers are drained or the shutdown timeout is elapsed.
+func (c *Conn) StopServer() {
+	atomic.StoreInt32(&c.exitServer, serverStop)
+}
+
+// AbortServer requests the data server to exit without draining the active transfers.
+// Writes of the active clients are aborted, so the partial file isn't committed to cloud.
+func (c *Conn) AbortServer() {
+	atomic.StoreInt32(&c.exitServer, serverAbort)
+}
+
+// ServerAborted returns true if data server is requested to abort
+func (c *Conn) ServerAborted() bool {
+	return atomic.LoadInt32(&c.exitServer) == serverAbort
+}
+
+// serverStopped returns true if data server is requested to stop
+func (c *Conn) serverStopped() bool {
+	return atomic.LoadInt32(&c.exitServer) == serverStop
+}
+
+// getShutdownTimeout return the time limit to drain the active transfers of data server
+func (c *Conn) getShutdownTimeout() time.Duration {
+	if c.shutdownTimeout == 0 {
+		return DefaultServerShutdownTimeout
+	}
+	return c.shutdownTimeout
 }
 
 // ConnReadyWait will return when connection is ready to accept the connection
@@ -193,37 +262,28 @@ func (c *Conn) ConnReadyWait() bool {
 func (c *Conn) listKeys(prefix string, keyType int) ([]string, error) {
 	keys := []string{}
 
-	lister := c.bucket.List(&blob.ListOptions{
-		Delimiter: "/",
-		Prefix:    prefix,
-	})
-	for {
-		obj, err := lister.Next(c.ctx)
-		if err == io.EOF {
-			break
-		}
-
-		if err != nil {
-			c.Log.Errorf("Failed to get next blob err=%v", err)
-			return keys, err
-		}
-
+	err := c.Walk(c.ctx, ListOptions{Delimiter: "/", Prefix: prefix}, func(obj ListObject) error {
 		switch keyType {
 		case ListKeyBoth:
 		case ListKeyFile:
 			if obj.IsDir {
-				continue
+				return nil
 			}
 		case ListKeyDir:
 			if !obj.IsDir {
-				continue
+				return nil
 			}
 		default:
 			c.Log.Warningf("Invalid keyType=%d, Ignored", keyType)
-			continue
+			return nil
 		}
 
 		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		c.Log.Errorf("Failed to get next blob err=%v", err)
+		return keys, err
 	}
 	return keys, nil
 }
@@ -273,6 +333,70 @@ func (c *Conn) GetSnapListFromCloud(file, backup string) ([]string, error) {
 	return snapList, nil
 }
 
+// RemoteFile is a file, having the configured prefix, in the backup directory of storage-bucket
+type RemoteFile struct {
+	// Key is key of the file in storage-bucket
+	Key string
+
+	// Backup is name of the backup directory having the file
+	Backup string
+
+	// Name is name of the file without the configured prefix and backup name, i.e.
+	// the file argument of GenerateRemoteFilename followed by the extension if any
+	Name string
+
+	// Size is size of the object
+	Size int64
+}
+
+// ListBackupFiles return the files, having the configured prefix, of the given backup.
+// It return the files of all the backups if backup is empty.
+func (c *Conn) ListBackupFiles(backup string) ([]RemoteFile, error) {
+	var files []RemoteFile
+
+	dirs, err := c.listKeys(c.bkpPathPrefix(backup), ListKeyDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get list of directory")
+	}
+
+	for _, dir := range dirs {
+		// dir will contain path with trailing '/', example: 'backups/b-0/'
+		s := strings.Split(dir, "/")
+		bkp := s[len(s)-2]
+		if backup != "" && bkp != backup {
+			continue
+		}
+
+		err := c.Walk(c.ctx, ListOptions{Delimiter: "/", Prefix: dir + c.prefix + "-"}, func(obj ListObject) error {
+			if obj.IsDir {
+				return nil
+			}
+
+			name := strings.TrimPrefix(obj.Key, dir+c.prefix+"-")
+			ext := ""
+			if i := strings.LastIndex(name, "-"+bkp); i >= 0 {
+				name, ext = name[:i], name[i+len(bkp)+1:]
+			}
+			files = append(files, RemoteFile{
+				Key:    obj.Key,
+				Backup: bkp,
+				Name:   name + ext,
+				Size:   obj.Size,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get list of files at path=%s", dir)
+		}
+	}
+	return files, nil
+}
+
+// Location return the location of given file, as provider://bucket/file
+func (c *Conn) Location(file string) string {
+	return c.provider + "://" + c.bucketname + "/" + file
+}
+
 // FileExists check if the given file exists or not in the given backup
 // the argument should be the same as that of GenerateRemoteFilename(file, backup) call
 // used while doing the backup of the volume
@@ -281,3 +405,134 @@ func (c *Conn) FileExists(file, backup string) (bool, error) {
 
 	return c.bucket.Exists(c.ctx, c.GenerateRemoteFilename(file, backup))
 }
+
+// ObjectExists check if the given object exists in the storage-bucket
+func (c *Conn) ObjectExists(file string) (bool, error) {
+	return c.bucket.Exists(c.ctx, file)
+}
+
+// CheckAccess checks if the storage-bucket is reachable, by looking up the canary object.
+// Unlike CheckCanary, it doesn't write to the storage-bucket.
+func (c *Conn) CheckAccess(ctx context.Context) error {
+	file := c.prefix + "-" + canaryFile
+	if c.backupPathPrefix != "" {
+		file = c.backupPathPrefix + "/" + file
+	}
+
+	if _, err := c.bucket.Exists(ctx, file); err != nil {
+		return errors.Wrapf(err, "failed to access bucket=%s", c.bucketname)
+	}
+	return nil
+}
+
+// CheckCanary writes the canary object, having current time, in the storage-bucket and reads
+// it back to validate the credentials and bucket policy for upload and download
+func (c *Conn) CheckCanary() error {
+	file := c.prefix + "-" + canaryFile
+	if c.backupPathPrefix != "" {
+		file = c.backupPathPrefix + "/" + file
+	}
+
+	data := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := c.bucket.WriteAll(c.ctx, file, data, nil); err != nil {
+		return errors.Wrapf(err, "failed to write canary object=%s", file)
+	}
+
+	read, err := c.bucket.ReadAll(c.ctx, file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read canary object=%s", file)
+	}
+
+	if string(read) != string(data) {
+		return errors.Errorf("canary object=%s has %q, expected %q", file, read, data)
+	}
+	return nil
+}
+
+// ObjectSize return the size of the given object in the storage-bucket,
+// for deduplicated or segmented snapshot file it is the size of snapshot data
+func (c *Conn) ObjectSize(file string) (int64, error) {
+	index, err := c.getChunkIndex(c.ctx, file)
+	if err != nil {
+		return 0, err
+	}
+	if index != nil {
+		return index.Size, nil
+	}
+
+	segments, err := c.getSegmentIndex(c.ctx, file)
+	if err != nil {
+		return 0, err
+	}
+	if segments != nil {
+		return segments.Size, nil
+	}
+
+	attrs, err := c.bucket.Attributes(c.ctx, file)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Size, nil
+}
+
+// BucketUsage return the total size of the objects in the storage-bucket
+func (c *Conn) BucketUsage() (int64, error) {
+	var size int64
+
+	err := c.Walk(c.ctx, ListOptions{}, func(obj ListObject) error {
+		size += obj.Size
+		return nil
+	})
+	return size, err
+}
+
+// ObjectChecksum downloads the given object from the storage-bucket and return
+// its checksum, in "<algorithm>:<hex>" format, using the connection's checksum algorithm
+func (c *Conn) ObjectChecksum(file string) (string, error) {
+	r, err := c.newFileReader(c.ctx, file, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			c.Log.Warnf("Failed to close file interface : %s", err.Error())
+		}
+	}()
+
+	h := newChecksumHash(c.checksumAlgorithm)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return formatChecksum(c.checksumAlgorithm, h), nil
+}
+
+// Progress return the number of bytes transferred and the expected size
+// of the file for ongoing upload/download operation
+func (c *Conn) Progress() (transferred, total int64) {
+	return atomic.LoadInt64(&c.bytesTransferred), atomic.LoadInt64(&c.fileSize)
+}
+
+// Checksum return the checksum, in "<algorithm>:<hex>" format, of the data
+// transferred by the last upload/download operation
+func (c *Conn) Checksum() string {
+	if c.checksum == nil {
+		return ""
+	}
+	return formatChecksum(c.checksumAlgorithm, c.checksum)
+}
+
+// resetProgress resets the transfer progress and checksum for new upload/download operation
+func (c *Conn) resetProgress(fileSize int64) {
+	atomic.StoreInt64(&c.bytesTransferred, 0)
+	atomic.StoreInt64(&c.fileSize, fileSize)
+	c.checksum = newChecksumHash(c.checksumAlgorithm)
+}
+
+// addTransferred adds the given transferred data to transfer progress and checksum
+func (c *Conn) addTransferred(data []byte) {
+	atomic.AddInt64(&c.bytesTransferred, int64(len(data)))
+	if c.checksum != nil {
+		// hash.Hash doesn't return an error for Write
+		_, _ = c.checksum.Write(data)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DownloadStreams is number of ranged reads of a file performed concurrently for restore
+	DownloadStreams = "downloadStreams"
+
+	// DownloadPartSize is size of the ranged reads of a file for parallel download
+	DownloadPartSize = "downloadPartSize"
+
+	// DefaultDownloadPartSize is default size of the ranged reads of a file for parallel download
+	DefaultDownloadPartSize = 8 * 1024 * 1024
+)
+
+// downloadPart is the data of a part of the file downloaded by parallel reader
+type downloadPart struct {
+	data []byte
+	err  error
+}
+
+// parallelReader downloads the parts of a file using concurrent ranged reads, and
+// returns the data of parts in order. Memory used by the reader is bounded by
+// (streams + 1) * part size.
+type parallelReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// parts has the pending parts in order of the data
+	parts chan chan downloadPart
+
+	// cur is the current part, data is returned from buf
+	cur []byte
+	buf []byte
+}
+
+// newParallelReader return the reader for the data of given file, having given size,
+// from given offset. If ctx is canceled then ongoing downloads are aborted.
+func (c *Conn) newParallelReader(ctx context.Context, file string, size, offset int64) *parallelReader {
+	ctx, cancel := context.WithCancel(ctx)
+
+	partSize := int64(c.downloadPartSize)
+	if partSize <= 0 {
+		partSize = DefaultDownloadPartSize
+	}
+
+	r := &parallelReader{
+		ctx:    ctx,
+		cancel: cancel,
+		parts:  make(chan chan downloadPart, c.downloadStreams),
+	}
+
+	go func() {
+		defer close(r.parts)
+
+		for off := offset; off < size; off += partSize {
+			length := partSize
+			if off+length > size {
+				length = size - off
+			}
+
+			ch := make(chan downloadPart, 1)
+			select {
+			case r.parts <- ch:
+			case <-ctx.Done():
+				return
+			}
+			go c.downloadPart(ctx, file, off, length, ch)
+		}
+	}()
+	return r
+}
+
+// downloadPart downloads the given range of file, and sends its data on given channel
+func (c *Conn) downloadPart(ctx context.Context, file string, offset, length int64, ch chan<- downloadPart) {
+	rd, err := c.bucket.NewRangeReader(ctx, file, offset, length, nil)
+	if err != nil {
+		ch <- downloadPart{err: errors.Wrapf(err, "failed to read file=%s at offset=%d", file, offset)}
+		return
+	}
+	defer func() {
+		if err := rd.Close(); err != nil {
+			c.Log.Warnf("Failed to close file interface : %s", err.Error())
+		}
+	}()
+
+	buf := getBuffer(uint64(length))
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		putBuffer(buf)
+		ch <- downloadPart{err: errors.Wrapf(err, "failed to read file=%s at offset=%d", file, offset)}
+		return
+	}
+	ch <- downloadPart{data: buf}
+}
+
+// Read returns the data of current part, and waits for the next part once current is read
+func (r *parallelReader) Read(p []byte) (int, error) {
+	if len(r.cur) == 0 {
+		putBuffer(r.buf)
+		r.buf, r.cur = nil, nil
+
+		ch, ok := <-r.parts
+		if !ok {
+			if err := r.ctx.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+
+		part := <-ch
+		if part.err != nil {
+			return 0, part.err
+		}
+		r.buf, r.cur = part.data, part.data
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Close aborts the pending downloads
+func (r *parallelReader) Close() error {
+	r.cancel()
+	putBuffer(r.buf)
+	r.buf, r.cur = nil, nil
+	return nil
+}
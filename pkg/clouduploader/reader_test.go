@@ -0,0 +1,138 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"gocloud.dev/blob/memblob"
+)
+
+const (
+	// testPartSize is size of the chunks and segments of test data
+	testPartSize = 10
+
+	// testDataSize is size of test data, last part is partially filled
+	testDataSize = 35
+)
+
+// readerOffsets are the offsets, from which the snapshot is read, at and around the part boundaries
+var readerOffsets = []int64{0, 1, testPartSize - 1, testPartSize, testPartSize + 1, 2 * testPartSize, testDataSize - 1, testDataSize}
+
+// newTestConn return the connection to an in-memory bucket
+func newTestConn(t *testing.T) *Conn {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	c := &Conn{Log: log, bucket: memblob.OpenBucket(nil)}
+	t.Cleanup(func() { _ = c.bucket.Close() })
+	return c
+}
+
+// testData return the data of test snapshot
+func testData() []byte {
+	data := make([]byte, testDataSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+// writeParts uploads the given data in parts of testPartSize, using key returned by keyOf for each part
+func writeParts(t *testing.T, c *Conn, data []byte, keyOf func(part int) string) int {
+	parts := 0
+	for off := 0; off < len(data); off += testPartSize {
+		end := off + testPartSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := c.bucket.WriteAll(context.TODO(), keyOf(parts), data[off:end], nil); err != nil {
+			t.Fatalf("failed to write part=%d : %s", parts, err)
+		}
+		parts++
+	}
+	return parts
+}
+
+func TestDedupReaderOffset(t *testing.T) {
+	c := newTestConn(t)
+	data := testData()
+	index := &chunkIndex{Version: 1, Dir: "chunks", ChunkSize: testPartSize, Size: int64(len(data))}
+
+	writeParts(t, c, data, func(part int) string {
+		hash := fmt.Sprintf("chunk-%d", part)
+		index.Chunks = append(index.Chunks, hash)
+		return c.chunkKey(index.Dir, hash)
+	})
+
+	for _, offset := range readerOffsets {
+		t.Run(fmt.Sprintf("offset=%d", offset), func(t *testing.T) {
+			r := c.newDedupReader(context.TODO(), index, offset)
+			if r.next != int(offset/testPartSize) || r.skip != offset%testPartSize {
+				t.Errorf("reader starts at chunk=%d skip=%d, want chunk=%d skip=%d",
+					r.next, r.skip, offset/testPartSize, offset%testPartSize)
+			}
+
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read : %s", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("failed to close reader : %s", err)
+			}
+			if !bytes.Equal(got, data[offset:]) {
+				t.Errorf("read %v, want %v", got, data[offset:])
+			}
+		})
+	}
+}
+
+func TestSegmentReaderOffset(t *testing.T) {
+	c := newTestConn(t)
+	data := testData()
+	index := &segmentIndex{Version: 1, Dir: "segments", SegmentSize: testPartSize, Size: int64(len(data))}
+
+	index.Segments = writeParts(t, c, data, func(part int) string {
+		return c.segmentKey(index, part)
+	})
+
+	for _, offset := range readerOffsets {
+		t.Run(fmt.Sprintf("offset=%d", offset), func(t *testing.T) {
+			r := c.newSegmentReader(context.TODO(), index, offset)
+			if r.next != int(offset/testPartSize) || r.skip != offset%testPartSize {
+				t.Errorf("reader starts at segment=%d skip=%d, want segment=%d skip=%d",
+					r.next, r.skip, offset/testPartSize, offset%testPartSize)
+			}
+
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read : %s", err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("failed to close reader : %s", err)
+			}
+			if !bytes.Equal(got, data[offset:]) {
+				t.Errorf("read %v, want %v", got, data[offset:])
+			}
+		})
+	}
+}
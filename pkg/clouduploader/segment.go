@@ -0,0 +1,326 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// ObjectSegmentSize if set then snapshot is uploaded as multiple objects of this size
+	ObjectSegmentSize = "objectSegmentSize"
+
+	// MinObjectSegmentSize is minimum size of the objects of segmented snapshot
+	MinObjectSegmentSize = 64 * 1024 * 1024
+
+	// segmentDir is remote storage-bucket directory for the segments of snapshots,
+	// it is not created in backupDir so that it is not considered as backup by velero
+	segmentDir = "segments"
+
+	// segmentMetadataKey is set in the metadata of segment index of segmented snapshot
+	segmentMetadataKey = "openebs-segments"
+
+	// segmentIndexVersion is version of segment index
+	segmentIndexVersion = 1
+)
+
+// segmentIndex is uploaded as snapshot file of segmented snapshot. Snapshot data is
+// stored, in order, in Segments number of objects of SegmentSize, except the last
+// one. Dir is directory of the segments relative to backupPathPrefix.
+type segmentIndex struct {
+	Version     int    `json:"version"`
+	Dir         string `json:"dir"`
+	SegmentSize int64  `json:"segmentSize"`
+	Size        int64  `json:"size"`
+	Segments    int    `json:"segments"`
+}
+
+// getSegmentSize returns the segment size from given config, it return 0 if not set
+func getSegmentSize(config map[string]string) (int64, error) {
+	val, ok := config[ObjectSegmentSize]
+	if !ok {
+		return 0, nil
+	}
+
+	q, err := resource.ParseQuantity(val)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s=%s", ObjectSegmentSize, val)
+	}
+
+	size, ok := q.AsInt64()
+	if !ok || size < MinObjectSegmentSize {
+		return 0, errors.Errorf("invalid %s=%s, it should be more than %v", ObjectSegmentSize, val, MinObjectSegmentSize)
+	}
+	return size, nil
+}
+
+// newSegmentIndex return the index for segmented snapshot of given file. Segments of
+// backups/<backup>/<file> are stored in segments/<backup>/<file>/.
+func (c *Conn) newSegmentIndex(file string) segmentIndex {
+	return segmentIndex{
+		Version:     segmentIndexVersion,
+		Dir:         segmentDir + "/" + path.Base(path.Dir(file)) + "/" + path.Base(file),
+		SegmentSize: c.segmentSize,
+	}
+}
+
+// segmentKey return the key of given segment of the index
+func (c *Conn) segmentKey(index *segmentIndex, segment int) string {
+	return c.chunkKey(index.Dir, fmt.Sprintf("%05d", segment))
+}
+
+// writeSegmentIndex uploads the given segment index as the given file
+func (c *Conn) writeSegmentIndex(ctx context.Context, file string, index *segmentIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal segment index of file=%s", file)
+	}
+
+	opts := &blob.WriterOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{segmentMetadataKey: strconv.Itoa(segmentIndexVersion)},
+	}
+	if err := c.bucket.WriteAll(ctx, file, data, opts); err != nil {
+		return errors.Wrapf(err, "failed to upload segment index of file=%s", file)
+	}
+	return nil
+}
+
+// getSegmentIndex return the segment index of given file, if it is a segmented snapshot file.
+// It return nil if file is not segmented.
+func (c *Conn) getSegmentIndex(ctx context.Context, file string) (*segmentIndex, error) {
+	attrs, err := c.bucket.Attributes(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs.Metadata[segmentMetadataKey]; !ok {
+		return nil, nil
+	}
+
+	data, err := c.bucket.ReadAll(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	var index segmentIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse segment index of file=%s", file)
+	}
+	if index.Version != segmentIndexVersion || index.SegmentSize <= 0 || index.Dir == "" {
+		return nil, errors.Errorf("unsupported segment index, version=%d segmentSize=%d, of file=%s",
+			index.Version, index.SegmentSize, file)
+	}
+	return &index, nil
+}
+
+// deleteSegments deletes the first count segments of given index
+func (c *Conn) deleteSegments(ctx context.Context, index *segmentIndex, count int) error {
+	for i := 0; i < count; i++ {
+		key := c.segmentKey(index, i)
+		if err := c.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return errors.Wrapf(err, "failed to delete segment=%s", key)
+		}
+	}
+	return nil
+}
+
+// segmentWriter uploads the snapshot data as segments, and uploads the segment
+// index as snapshot file on close. Segments are deleted if the upload fails.
+type segmentWriter struct {
+	c    *Conn
+	ctx  context.Context
+	file string
+
+	index segmentIndex
+
+	// cur is writer of the current segment, and written is number of bytes written to it
+	cur     io.WriteCloser
+	written int64
+
+	// err is the failure in writing a segment
+	err error
+}
+
+// newSegmentWriter return a writer for segmented snapshot file. If ctx is canceled
+// before the writer is closed then segment index is not uploaded.
+func (c *Conn) newSegmentWriter(ctx context.Context, file string) *segmentWriter {
+	return &segmentWriter{
+		c:     c,
+		ctx:   ctx,
+		file:  file,
+		index: c.newSegmentIndex(file),
+	}
+}
+
+// Write writes the given data to the current segment, and starts the next segment once
+// current segment is full
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		if w.cur == nil {
+			key := w.c.segmentKey(&w.index, w.index.Segments)
+			if w.cur, w.err = w.c.newObjectWriter(w.ctx, key); w.err != nil {
+				return n - len(p), errors.Wrapf(w.err, "failed to upload segment=%s", key)
+			}
+			w.index.Segments++
+		}
+
+		l := w.index.SegmentSize - w.written
+		if l > int64(len(p)) {
+			l = int64(len(p))
+		}
+		if _, w.err = w.cur.Write(p[:l]); w.err != nil {
+			return n - len(p), w.err
+		}
+		p = p[l:]
+		w.written += l
+		w.index.Size += l
+
+		if w.written == w.index.SegmentSize {
+			err := w.cur.Close()
+			w.cur, w.written = nil, 0
+			if err != nil {
+				w.err = err
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close completes the upload of the current segment and uploads the segment index
+func (w *segmentWriter) Close() error {
+	err := w.close()
+	if err == nil {
+		w.c.Log.Infof("Uploaded file=%s as %d segments", w.file, w.index.Segments)
+		return nil
+	}
+
+	// c.ctx may be canceled, so use a new context to delete the uploaded segments
+	if derr := w.c.deleteSegments(context.Background(), &w.index, w.index.Segments); derr != nil {
+		w.c.Log.Errorf("Failed to delete segments of uncompleted file=%s : %s", w.file, derr)
+	}
+	return err
+}
+
+func (w *segmentWriter) close() error {
+	if w.cur != nil {
+		// upload of the segment is aborted if ctx is canceled
+		if err := w.cur.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+		w.cur = nil
+	}
+
+	if err := w.ctx.Err(); err != nil {
+		return errors.Wrapf(err, "upload of file=%s aborted", w.file)
+	}
+	if w.err != nil {
+		return errors.Wrapf(w.err, "failed to upload file=%s", w.file)
+	}
+	return w.c.writeSegmentIndex(w.ctx, w.file, &w.index)
+}
+
+// segmentReader reads the data of segmented snapshot from its segments
+type segmentReader struct {
+	c     *Conn
+	ctx   context.Context
+	index *segmentIndex
+
+	// next is index of the next segment to read
+	next int
+
+	// skip is number of bytes to skip from the next segment
+	skip int64
+
+	cur io.ReadCloser
+}
+
+// newSegmentReader return a reader for the data of segmented snapshot, having given
+// segment index, from the given offset
+func (c *Conn) newSegmentReader(ctx context.Context, index *segmentIndex, offset int64) *segmentReader {
+	return &segmentReader{
+		c:     c,
+		ctx:   ctx,
+		index: index,
+		next:  int(offset / index.SegmentSize),
+		skip:  offset % index.SegmentSize,
+	}
+}
+
+// Read reads the data from the current segment, and opens the next segment once current is read.
+// Segment is read using concurrent ranged reads if downloadStreams is configured.
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next >= r.index.Segments {
+				return 0, io.EOF
+			}
+
+			size := r.index.Size - int64(r.next)*r.index.SegmentSize
+			if size > r.index.SegmentSize {
+				size = r.index.SegmentSize
+			}
+
+			key := r.c.segmentKey(r.index, r.next)
+			if r.c.downloadStreams > 1 && size-r.skip > int64(r.c.downloadPartSize) {
+				r.cur = r.c.newParallelReader(r.ctx, key, size, r.skip)
+			} else {
+				cur, err := r.c.bucket.NewRangeReader(r.ctx, key, r.skip, -1, nil)
+				if err != nil {
+					return 0, errors.Wrapf(err, "failed to read segment=%s", key)
+				}
+				r.cur = cur
+			}
+			r.next, r.skip = r.next+1, 0
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			if cerr := r.cur.Close(); cerr != nil {
+				r.c.Log.Warnf("Failed to close segment reader : %s", cerr.Error())
+			}
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close closes the reader of current segment
+func (r *segmentReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
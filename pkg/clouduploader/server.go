@@ -17,12 +17,16 @@ limitations under the License.
 package clouduploader
 
 import (
+	"context"
+	"io"
 	"net"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"gocloud.dev/blob"
+	"golang.org/x/sys/unix"
 )
 
 // TransferStatus represents upload/download status of client/server
@@ -72,6 +76,10 @@ type Server struct {
 	// state represents server state
 	state ServerState
 
+	// closeErr is error in closing the file of a client whose backup wasn't aborted,
+	// uploaded file is incomplete if it is set
+	closeErr error
+
 	/* client link-list */
 	FirstClient *Client
 	LastClient  *Client
@@ -89,12 +97,42 @@ type Client struct {
 	// bufferLen defines read/write buffer length
 	bufferLen uint64
 
-	// buffer is to read/write data from/to client
+	// buffer is to read/write data from/to client, it is taken from the buffer pool
+	// and returned to it once client is disconnected
 	buffer []byte
 
 	// status represents current status for client operation(upload/download)
 	status TransferStatus
 
+	// autoTune is set if bufferLen needs to be tuned from the measured RTT and bandwidth
+	autoTune bool
+
+	// rtt is round trip time of client connection measured at accept
+	rtt time.Duration
+
+	// startTime is time at which client connection was accepted
+	startTime time.Time
+
+	// received is number of bytes received from client
+	received int64
+
+	// sent is number of bytes sent to client, it is the offset from which
+	// the download is resumed if the download stream breaks
+	sent int64
+
+	// readRetry is number of consecutive attempts to resume the broken download stream
+	readRetry int
+
+	// lastActive is time at which data was last received from, or sent to, client
+	lastActive time.Time
+
+	// ctx is context of cloud blob storage file of client
+	ctx context.Context
+
+	// cancel aborts the write to cloud blob storage file of client, if it is
+	// called before the file is destroyed
+	cancel context.CancelFunc
+
 	// for link-list
 	next *Client
 }
@@ -112,9 +150,15 @@ const (
 	// ReadBufferLen defines max number of bytes should be read from wire
 	ReadBufferLen = 32 * 1024
 
+	// MaxReadBufferLen defines upper limit for auto-tuned read buffer length
+	MaxReadBufferLen = 4 * 1024 * 1024
+
 	// EPOLLTIMEOUT defines timeout for epoll_wait
 	EPOLLTIMEOUT = 5 * 1000 // 5 second
 
+	// MaxReadRetry defines max number of consecutive attempts to resume the broken download stream
+	MaxReadRetry = 5
+
 	// OpBackup : backup operation
 	OpBackup ServerOperation = 1
 
@@ -147,8 +191,18 @@ func (s *Server) acceptClient(fd, epfd int) (int, error) {
 		return (-1), err
 	}
 
-	readerWriter := s.cl.Create(s.OpType)
+	if err = s.setClientTimeouts(connFd); err != nil {
+		if cerr := syscall.Close(connFd); cerr != nil {
+			s.Log.Warnf("Failed to close cline {%v} : %s", connFd, cerr.Error())
+		}
+		s.Log.Errorf("Failed to set timeouts for client {%v}, closing it : %s", connFd, err.Error())
+		return (-1), err
+	}
+
+	ctx, cancel := context.WithCancel(s.cl.ctx)
+	readerWriter := s.cl.create(ctx, s.OpType)
 	if readerWriter == nil {
+		cancel()
 		s.Log.Errorf("Failed to create file interface")
 		if err = syscall.Close(connFd); err != nil {
 			s.Log.Warnf("Failed to close cline {%v} : %s", connFd, err.Error())
@@ -159,11 +213,27 @@ func (s *Server) acceptClient(fd, epfd int) (int, error) {
 	c = new(Client)
 	c.fd = connFd
 	c.file = readerWriter
+	c.ctx = ctx
+	c.cancel = cancel
 	c.bufferLen = ReadBufferLen
-	c.buffer = make([]byte, c.bufferLen)
+	if s.OpType == OpRestore && s.cl.writeBufferSize > 0 {
+		c.bufferLen = uint64(s.cl.writeBufferSize)
+	} else if s.cl.readAheadSize > 0 {
+		c.bufferLen = uint64(s.cl.readAheadSize)
+	} else {
+		c.autoTune = s.OpType == OpBackup
+	}
+	c.buffer = getBuffer(c.bufferLen)
 	c.status = TransferStatusInit
+	c.startTime = time.Now()
+	c.lastActive = c.startTime
 	c.next = nil
 
+	if info, err := unix.GetsockoptTCPInfo(connFd, unix.IPPROTO_TCP, unix.TCP_INFO); err == nil {
+		c.rtt = time.Duration(info.Rtt) * time.Microsecond
+		s.Log.Infof("Client{%v} connected, rtt=%v read buffer=%v", connFd, c.rtt, c.bufferLen)
+	}
+
 	event = new(syscall.EpollEvent)
 	if s.OpType == OpBackup {
 		event.Events = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLHUP | syscall.EPOLLERR | EPOLLET
@@ -190,13 +260,15 @@ func (s *Server) acceptClient(fd, epfd int) (int, error) {
 
 func (s *Server) handleRead(event syscall.EpollEvent) error {
 	var c = s.getClientFromEvent(event)
-	var writer *blob.Writer
 
 	if s.OpType != OpBackup {
 		return errors.New("invalid backup operation")
 	}
 
-	writer = (*blob.Writer)(c.file)
+	writer, ok := c.file.(io.Writer)
+	if !ok {
+		return errors.New("invalid file interface for backup")
+	}
 	for {
 		nbytes, e := s.RecvData(c)
 		if e != nil {
@@ -207,6 +279,14 @@ func (s *Server) handleRead(event syscall.EpollEvent) error {
 			if err != nil {
 				return errors.Errorf("write returned error : %s", err.Error())
 			}
+			s.cl.addTransferred(c.buffer[:nbytes])
+			c.received += int64(nbytes)
+			c.lastActive = time.Now()
+
+			if c.autoTune && uint64(nbytes) == c.bufferLen {
+				// more data is pending on socket, try to read-ahead more
+				s.tuneReadBuffer(c)
+			}
 		} else {
 			return nil // connection closed
 		}
@@ -215,20 +295,28 @@ func (s *Server) handleRead(event syscall.EpollEvent) error {
 
 func (s *Server) handleWrite(event syscall.EpollEvent) error {
 	var c = s.getClientFromEvent(event)
-	var reader *blob.Reader
 
 	if s.OpType != OpRestore {
 		return errors.New("invalid backup operation")
 	}
 
-	reader = (*blob.Reader)(c.file)
+	reader, ok := c.file.(io.Reader)
+	if !ok {
+		return errors.New("invalid file interface for restore")
+	}
 	nbytes, e := reader.Read(c.buffer)
 	if nbytes > 0 {
 		e = s.SendData(c, nbytes)
 		if e != nil {
 			return e
 		}
-	} else if nbytes == 0 {
+		s.cl.addTransferred(c.buffer[:nbytes])
+		c.sent += int64(nbytes)
+		c.readRetry = 0
+	} else if e != nil && e != io.EOF && c.readRetry < MaxReadRetry && s.cl.ctx.Err() == nil {
+		// data sent to client is already received by replica, so continue from the last sent offset
+		return s.resumeRead(c, e)
+	} else if e == nil || e == io.EOF {
 		s.updateClientStatus(c, TransferStatusDone)
 		s.Log.Infof("Downloading of operation finished for client{%v}", c.fd)
 		return e
@@ -244,13 +332,31 @@ func (s *Server) handleWrite(event syscall.EpollEvent) error {
 func (s *Server) Run(opType ServerOperation, port int) error {
 	var event syscall.EpollEvent
 	var events [MaxEpollEvents]syscall.EpollEvent
+	var runErr error
+	var stopTime time.Time
 
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
+	family, addr := s.serverSockaddr(port)
+
+	fd, err := syscall.Socket(family, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
+	if err != nil && family == syscall.AF_INET6 && s.cl.bindAddress == "" {
+		// IPv6 is disabled on the node, listen on IPv4 addresses only
+		s.Log.Warnf("Failed to initialize IPv6 socket, using IPv4 : %s", err.Error())
+		family, addr = syscall.AF_INET, &syscall.SockaddrInet4{Port: port}
+		fd, err = syscall.Socket(family, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
+	}
 	if err != nil {
 		s.Log.Errorf("Failed to initialize socket : %s", err.Error())
 		return err
 	}
 
+	if family == syscall.AF_INET6 && s.cl.bindAddress == "" {
+		// accept the IPv4 connections too, for dual-stack cluster
+		if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			s.Log.Errorf("Failed to enable dual-stack socket : %s", err.Error())
+			return err
+		}
+	}
+
 	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
 		s.Log.Errorf("Failed to set reuseaddr for socket : %s", err.Error())
 		return err
@@ -261,11 +367,15 @@ func (s *Server) Run(opType ServerOperation, port int) error {
 		return err
 	}
 
-	addr := syscall.SockaddrInet4{Port: port}
-	copy(addr.Addr[:], net.ParseIP("0.0.0.0").To4())
+	// socket buffer sizes are inherited by accepted connections,
+	// so it needs to be set before listen
+	if err = s.setSocketBufferSize(fd); err != nil {
+		return err
+	}
 
-	if err = syscall.Bind(fd, &addr); err != nil {
-		s.Log.Errorf("Failed to bind server to port {%v} : %s", port, err.Error())
+	if err = syscall.Bind(fd, addr); err != nil {
+		s.Log.Errorf("Failed to bind server to %s : %s",
+			net.JoinHostPort(s.cl.bindAddress, strconv.Itoa(port)), err.Error())
 		return err
 	}
 
@@ -296,6 +406,20 @@ func (s *Server) Run(opType ServerOperation, port int) error {
 	s.state.status = TransferStatusInit
 
 	for {
+		if err := s.cl.ctx.Err(); err != nil {
+			s.Log.Errorf("Transfer aborted.. closing the server : %s", err.Error())
+			s.disconnectAllClient(epfd, true)
+			runErr = errors.Wrapf(err, "transfer aborted")
+			goto exit
+		}
+
+		if s.cl.ServerAborted() {
+			s.Log.Errorf("Transfer aborted by request.. closing the server")
+			s.disconnectAllClient(epfd, true)
+			runErr = errors.New("transfer aborted by request")
+			goto exit
+		}
+
 		nevents, err := syscall.EpollWait(epfd, events[:], EPOLLTIMEOUT)
 		if err != nil {
 			if isEINTR(err) {
@@ -307,10 +431,26 @@ func (s *Server) Run(opType ServerOperation, port int) error {
 			return err
 		}
 
-		if nevents == 0 && s.cl.ExitServer {
-			s.Log.Infof("Transfer done.. closing the server")
-			s.disconnectAllClient(epfd)
-			goto exit
+		if s.cl.serverStopped() {
+			if stopTime.IsZero() {
+				stopTime = time.Now()
+				s.stopAccept(fd, epfd)
+			}
+
+			if s.state.runningCount == 0 || nevents == 0 {
+				s.Log.Infof("Transfer done.. closing the server")
+				s.disconnectAllClient(epfd, false)
+				goto exit
+			}
+
+			if time.Since(stopTime) > s.cl.getShutdownTimeout() {
+				// transfer of active clients is incomplete, so abort their writes
+				s.Log.Errorf("Transfer of %v clients didn't complete in %v.. closing the server",
+					s.state.runningCount, s.cl.getShutdownTimeout())
+				s.disconnectAllClient(epfd, true)
+				runErr = errors.New("shutdown timed out with active transfers")
+				goto exit
+			}
 		}
 
 		for ev := 0; ev < nevents; ev++ {
@@ -337,14 +477,19 @@ func (s *Server) Run(opType ServerOperation, port int) error {
 				}
 			}
 		}
+
+		s.closeIdleClients(epfd)
 	}
 
 exit:
+	if runErr == nil && s.closeErr != nil {
+		runErr = errors.Wrapf(s.closeErr, "failed to complete upload")
+	}
 	if err := syscall.Close(epfd); err != nil {
 		s.Log.Warnf("Failed to close {%v} : %s", epfd, err.Error())
 	}
 	if err := syscall.Close(fd); err != nil {
 		s.Log.Warnf("Failed to close {%v} : %s", fd, err.Error())
 	}
-	return nil
+	return runErr
 }
@@ -17,6 +17,8 @@ limitations under the License.
 package clouduploader
 
 import (
+	"io"
+	"net"
 	"syscall"
 	"time"
 	"unsafe"
@@ -25,8 +27,9 @@ import (
 	"gocloud.dev/blob"
 )
 
-// ReadWriter is used for read/write operation on cloud blob storage file
-type ReadWriter unsafe.Pointer
+// ReadWriter is used for read/write operation on cloud blob storage file,
+// it is io.Writer for backup and io.Reader for restore
+type ReadWriter io.Closer
 
 // updateClientStatus updates the status of client for current operation
 func (s *Server) updateClientStatus(c *Client, status TransferStatus) {
@@ -112,12 +115,17 @@ func (s *Server) SendData(c *Client, dataLen int) error {
 		nbytes, e := syscall.Write(c.fd, c.buffer[index:dataLen])
 		if nbytes > 0 {
 			index += nbytes
+			c.lastActive = time.Now()
 			if index == dataLen {
 				return nil
 			}
 			continue
 		} else {
 			if e == syscall.EAGAIN {
+				// socket buffer is full, peer is not reading the data
+				if s.cl.dataWriteTimeout > 0 && time.Since(c.lastActive) > s.cl.dataWriteTimeout {
+					return errors.Errorf("Write timed out for fd{%v} after %v", c.fd, s.cl.dataWriteTimeout)
+				}
 				time.Sleep(time.Millisecond)
 				continue
 			} else {
@@ -144,6 +152,27 @@ func (s *Server) RecvData(c *Client) (int, error) {
 	}
 }
 
+// resumeRead reopens the cloud blob storage file of given client, using ranged read from
+// the offset of data sent to client, so that the broken download stream is resumed
+func (s *Server) resumeRead(c *Client, readErr error) error {
+	c.readRetry++
+	s.Log.Warnf("Download stream broken for client{%v} at offset{%v} : %s, resuming it (attempt %v/%v)",
+		c.fd, c.sent, readErr.Error(), c.readRetry, MaxReadRetry)
+
+	time.Sleep(time.Duration(c.readRetry) * time.Second)
+
+	r, err := s.cl.newFileReader(c.ctx, s.cl.file, c.sent)
+	if err != nil {
+		// next read on the broken stream fails again and resume is retried
+		s.Log.Errorf("Failed to obtain reader at offset{%v} for client{%v} : %s", c.sent, c.fd, err.Error())
+		return nil
+	}
+
+	s.cl.Destroy(c.file, OpRestore)
+	c.file = r
+	return nil
+}
+
 // GetReadWriter will return interface for cloud blob storage file operation
 func (s *Server) GetReadWriter(bwriter *blob.Writer, breader *blob.Reader, opType ServerOperation) (ReadWriter, error) {
 	if opType != OpBackup && opType != OpRestore {
@@ -164,6 +193,8 @@ func (s *Server) handleClientError(err error, event syscall.EpollEvent, efd int)
 		s.state.successCount++
 	} else {
 		s.state.failedCount++
+		// abort the write so that partial data isn't committed to the file
+		c.cancel()
 	}
 
 	if err := syscall.EpollCtl(efd, syscall.EPOLL_CTL_DEL, c.fd, nil); err != nil {
@@ -174,13 +205,25 @@ func (s *Server) handleClientError(err error, event syscall.EpollEvent, efd int)
 		s.Log.Warnf("Failed to close {%v}: %s", c.fd, err.Error())
 	}
 
-	s.cl.Destroy(c.file, s.OpType)
+	s.destroyClientFile(c)
+	c.cancel()
+	c.releaseBuffer()
 	s.Log.Infof("Client{%v} operation completed.. completed count{%v}", c.fd, s.state.successCount)
 	s.removeFromClientList(c)
 }
 
-// disconnectAllClient disconnects all client connected to server
-func (s *Server) disconnectAllClient(efd int) {
+// destroyClientFile closes the file of given client, and records the error if
+// the file of a backup, which wasn't aborted, fails to close
+func (s *Server) destroyClientFile(c *Client) {
+	aborted := c.ctx.Err() != nil
+	if err := s.cl.Destroy(c.file, s.OpType); err != nil && s.OpType == OpBackup && !aborted {
+		s.closeErr = err
+	}
+}
+
+// disconnectAllClient disconnects all client connected to server. If abort is
+// set then the write of clients, whose transfer is not done, is aborted.
+func (s *Server) disconnectAllClient(efd int, abort bool) {
 	var nextClient *Client
 
 	if s.FirstClient == nil || s.state.runningCount == 0 {
@@ -188,11 +231,14 @@ func (s *Server) disconnectAllClient(efd int) {
 	}
 
 	curClient := s.FirstClient
-	for curClient.next != nil {
+	for curClient != nil {
 		if s.getClientStatus(curClient) == TransferStatusDone {
 			s.state.successCount++
 		} else {
 			s.state.failedCount++
+			if abort {
+				curClient.cancel()
+			}
 		}
 
 		if err := syscall.EpollCtl(efd, syscall.EPOLL_CTL_DEL, curClient.fd, nil); err != nil {
@@ -203,7 +249,9 @@ func (s *Server) disconnectAllClient(efd int) {
 			s.Log.Warnf("Failed to close {%v}: %s", curClient.fd, err.Error())
 		}
 
-		s.cl.Destroy(curClient.file, s.OpType)
+		s.destroyClientFile(curClient)
+		curClient.cancel()
+		curClient.releaseBuffer()
 		s.Log.Infof("Disconnecting Client{%v}", curClient.fd)
 
 		nextClient = curClient.next
@@ -212,6 +260,53 @@ func (s *Server) disconnectAllClient(efd int) {
 	}
 }
 
+// setSocketBufferSize sets the configured kernel send/receive buffer size for given socket
+// If size is not configured then kernel auto-tuning of buffer is used.
+func (s *Server) setSocketBufferSize(fd int) error {
+	if s.cl.sockReadBufferSize > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, s.cl.sockReadBufferSize); err != nil {
+			s.Log.Errorf("Failed to set receive buffer size {%v} : %s", s.cl.sockReadBufferSize, err.Error())
+			return err
+		}
+	}
+
+	if s.cl.sockWriteBufferSize > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, s.cl.sockWriteBufferSize); err != nil {
+			s.Log.Errorf("Failed to set send buffer size {%v} : %s", s.cl.sockWriteBufferSize, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// tuneReadBuffer doubles the read buffer of given client, limited by the
+// bandwidth-delay product measured for the client connection.
+func (s *Server) tuneReadBuffer(c *Client) {
+	limit := uint64(MaxReadBufferLen)
+
+	elapsed := time.Since(c.startTime)
+	if c.rtt > 0 && elapsed > 0 {
+		// bandwidth-delay product, data in flight on the connection
+		bdp := uint64(float64(c.received) / elapsed.Seconds() * c.rtt.Seconds())
+		if bdp < limit {
+			limit = bdp
+		}
+	}
+
+	if limit < ReadBufferLen {
+		limit = ReadBufferLen
+	}
+
+	if c.bufferLen*2 > limit {
+		return
+	}
+
+	c.releaseBuffer()
+	c.bufferLen *= 2
+	c.buffer = getBuffer(c.bufferLen)
+	s.Log.Debugf("Client{%v} read buffer tuned to %v", c.fd, c.bufferLen)
+}
+
 // isEINTR check if given error is generated because of EINTR
 func isEINTR(err error) bool {
 	if err == nil {
@@ -224,3 +319,29 @@ func isEINTR(err error) bool {
 	}
 	return false
 }
+
+// serverSockaddr return the socket family and address on which server listens for given port.
+// If bind address is not set then server listens on all the IPv6 and IPv4 addresses.
+func (s *Server) serverSockaddr(port int) (int, syscall.Sockaddr) {
+	ip := net.ParseIP(s.cl.bindAddress)
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return syscall.AF_INET, sa
+	}
+
+	sa := &syscall.SockaddrInet6{Port: port}
+	if ip != nil {
+		copy(sa.Addr[:], ip.To16())
+	}
+	return syscall.AF_INET6, sa
+}
+
+// stopAccept removes the server fd from epoll, so that new connections are not accepted
+// while the active transfers are drained
+func (s *Server) stopAccept(fd, efd int) {
+	if err := syscall.EpollCtl(efd, syscall.EPOLL_CTL_DEL, fd, nil); err != nil {
+		s.Log.Warnf("Failed to delete server fd{%v} from EPOLL: %s", fd, err.Error())
+	}
+	s.Log.Infof("Server stopped.. draining %v active clients", s.state.runningCount)
+}
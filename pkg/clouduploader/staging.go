@@ -0,0 +1,223 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// StagingPath is local directory in which snapshot is staged before it is uploaded,
+	// snapshot is uploaded while it is received if it is not set
+	StagingPath = "stagingPath"
+
+	// stagingUploadRetries is number of attempts to upload the staged snapshot
+	stagingUploadRetries = 5
+
+	// stagingRetryInterval is interval before the first retry of upload, it is doubled for every retry
+	stagingRetryInterval = 5 * time.Second
+)
+
+// getStagingPath returns the staging directory from given config
+func getStagingPath(config map[string]string) (string, error) {
+	path, ok := config[StagingPath]
+	if !ok {
+		return "", nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid %s=%s", StagingPath, path)
+	}
+	if !info.IsDir() {
+		return "", errors.Errorf("invalid %s=%s, it is not a directory", StagingPath, path)
+	}
+	return path, nil
+}
+
+// stagingWriter writes the snapshot data to a local file, and uploads the file on close.
+// Snapshot data received from cStor is not blocked on the connectivity with cloud provider.
+type stagingWriter struct {
+	c    *Conn
+	ctx  context.Context
+	file string
+
+	f *os.File
+}
+
+// newStagingWriter return a writer which stages the data of given file in the staging directory.
+// If ctx is canceled before the writer is closed then staged data is not uploaded.
+func (c *Conn) newStagingWriter(ctx context.Context, file string) (*stagingWriter, error) {
+	f, err := ioutil.TempFile(c.stagingPath, filepath.Base(file)+"-*")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create staging file in %s", c.stagingPath)
+	}
+
+	return &stagingWriter{
+		c:    c,
+		ctx:  ctx,
+		file: file,
+		f:    f,
+	}, nil
+}
+
+// Write writes the given data to the staging file
+func (w *stagingWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		return n, errors.Wrapf(err, "failed to write staging file %s", w.f.Name())
+	}
+	return n, nil
+}
+
+// Close uploads the staging file, with retries, and removes it
+func (w *stagingWriter) Close() error {
+	defer func() {
+		if err := w.f.Close(); err != nil {
+			w.c.Log.Warnf("Failed to close staging file %s : %s", w.f.Name(), err.Error())
+		}
+		if err := os.Remove(w.f.Name()); err != nil {
+			w.c.Log.Warnf("Failed to remove staging file %s : %s", w.f.Name(), err.Error())
+		}
+	}()
+
+	if err := w.ctx.Err(); err != nil {
+		return errors.Wrapf(err, "upload of file=%s aborted", w.file)
+	}
+
+	if w.c.segmentSize > 0 && w.c.chunkDir == "" {
+		return w.uploadSegments()
+	}
+	return w.retry("staged file="+w.file, w.upload)
+}
+
+// retry executes the given upload, of given description, till it succeeds or the
+// retries are exhausted
+func (w *stagingWriter) retry(desc string, upload func() error) error {
+	interval := stagingRetryInterval
+	for attempt := 1; ; attempt++ {
+		err := upload()
+		if err == nil {
+			w.c.Log.Infof("Uploaded %s in %d attempt(s)", desc, attempt)
+			return nil
+		}
+
+		if attempt == stagingUploadRetries || w.ctx.Err() != nil {
+			return errors.Wrapf(err, "failed to upload %s in %d attempt(s)", desc, attempt)
+		}
+
+		w.c.Log.Warnf("Failed to upload %s, attempt=%d, retrying in %v : %s",
+			desc, attempt, interval, err.Error())
+
+		select {
+		case <-time.After(interval):
+		case <-w.ctx.Done():
+			return errors.Wrapf(w.ctx.Err(), "upload of file=%s aborted", w.file)
+		}
+		interval *= 2
+	}
+}
+
+// uploadSegments uploads the staging file as segments, failed segment is uploaded again
+// without uploading the other segments. Uploaded segments are deleted on failure.
+func (w *stagingWriter) uploadSegments() error {
+	info, err := w.f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat staging file %s", w.f.Name())
+	}
+
+	index := w.c.newSegmentIndex(w.file)
+	index.Size = info.Size()
+	index.Segments = int((index.Size + index.SegmentSize - 1) / index.SegmentSize)
+
+	for i := 0; i < index.Segments; i++ {
+		key := w.c.segmentKey(&index, i)
+		section := io.NewSectionReader(w.f, int64(i)*index.SegmentSize, index.SegmentSize)
+
+		err = w.retry(fmt.Sprintf("segment=%s of staged file=%s", key, w.file), func() error {
+			if _, err := section.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			return w.uploadObject(key, section)
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.retry("segment index of staged file="+w.file, func() error {
+			return w.c.writeSegmentIndex(w.ctx, w.file, &index)
+		})
+	}
+
+	if err != nil {
+		// w.ctx may be canceled, so use a new context to delete the uploaded segments
+		if derr := w.c.deleteSegments(context.Background(), &index, index.Segments); derr != nil {
+			w.c.Log.Errorf("Failed to delete segments of uncompleted file=%s : %s", w.file, derr)
+		}
+	}
+	return err
+}
+
+// uploadObject uploads the data of given reader as single object, partial upload is aborted on failure
+func (w *stagingWriter) uploadObject(key string, r io.Reader) error {
+	ctx, cancel := context.WithCancel(w.ctx)
+	defer cancel()
+
+	dst, err := w.c.newObjectWriter(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		cancel()
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// upload uploads the staging file from the beginning, partial upload is aborted on failure
+func (w *stagingWriter) upload() error {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "failed to seek staging file %s", w.f.Name())
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	defer cancel()
+
+	dst, err := w.c.newBackupWriter(ctx, w.file)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, w.f); err != nil {
+		cancel()
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
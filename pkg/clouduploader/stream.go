@@ -0,0 +1,129 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+const (
+	// UploadConcurrency is number of parts uploaded concurrently in multi-part upload
+	UploadConcurrency = "uploadConcurrency"
+
+	// UploadBufferLimit is limit of memory used for buffering the parts of multi-part upload
+	UploadBufferLimit = "uploadBufferLimit"
+
+	// DefaultUploadBufferLimit is default limit of memory used for buffering the parts of upload
+	DefaultUploadBufferLimit = 512 * 1024 * 1024
+)
+
+// streamWriter streams the data written to it to the multi-part upload of a file.
+// Parts are buffered in the pool of uploader, so memory used by the upload is
+// bounded by (concurrency + 1) * part size, irrespective of the file size.
+type streamWriter struct {
+	ctx  context.Context
+	file string
+
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newStreamWriter starts the multi-part upload of given file and return the writer for
+// its data. If ctx is canceled before the writer is closed then the upload is aborted.
+func (c *Conn) newStreamWriter(ctx context.Context, file string) *streamWriter {
+	partSize, concurrency := c.uploadParts()
+
+	c.Log.Infof("Uploading file=%s with part size=%d concurrency=%d", file, partSize, concurrency)
+
+	uploader := s3manager.NewUploaderWithClient(c.s3Client, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = concurrency
+	})
+
+	pr, pw := io.Pipe()
+	w := &streamWriter{
+		ctx:  ctx,
+		file: file,
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(c.bucketname),
+			Key:    aws.String(file),
+			Body:   pr,
+		})
+		// write to the pipe fails once upload fails
+		_ = pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+// Write streams the given data to the upload, it blocks until the data is read by the uploader
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	if err != nil {
+		return n, errors.Wrapf(err, "failed to upload file=%s", w.file)
+	}
+	return n, nil
+}
+
+// Close completes the upload, or aborts it if ctx is canceled, and waits for the uploader
+func (w *streamWriter) Close() error {
+	if err := w.ctx.Err(); err != nil {
+		_ = w.pw.CloseWithError(err)
+	} else {
+		_ = w.pw.Close()
+	}
+
+	if err := <-w.done; err != nil {
+		return errors.Wrapf(err, "failed to upload file=%s", w.file)
+	}
+	return nil
+}
+
+// uploadParts return the part size and concurrency of multi-part upload, so that
+// memory used for buffering the parts is within uploadBufferLimit
+func (c *Conn) uploadParts() (int64, int) {
+	partSize := c.partSize
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+
+	concurrency := c.uploadConcurrency
+	if concurrency == 0 {
+		concurrency = s3manager.DefaultUploadConcurrency
+	}
+
+	// one more part is buffered while reading the data for next upload
+	if limit := int64(c.uploadBufferLimit); limit > 0 && int64(concurrency+1)*partSize > limit {
+		concurrency = int(limit/partSize) - 1
+		if concurrency < 1 {
+			// part size can't be reduced, since it is required for the number of parts of the file
+			c.Log.Warnf("Memory for upload, 2 parts of size=%d, exceeds %s=%d", partSize, UploadBufferLimit, limit)
+			concurrency = 1
+		}
+	}
+	return partSize, concurrency
+}
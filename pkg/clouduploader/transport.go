@@ -0,0 +1,83 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultConnectionPoolSize is default number of idle connections kept for reuse.
+	// http.DefaultTransport keeps only 2 idle connections per host, so connections of
+	// parallel part uploads are closed and re-established with a new TLS handshake.
+	defaultConnectionPoolSize = 32
+
+	// defaultIdleConnectionTimeout is default time for which an idle connection is kept in pool
+	defaultIdleConnectionTimeout = 90 * time.Second
+
+	// defaultKeepAlivePeriod is default interval for TCP keep-alive probes
+	defaultKeepAlivePeriod = 30 * time.Second
+
+	// dialTimeout is time limit to establish the connection with cloud provider
+	dialTimeout = 30 * time.Second
+)
+
+// newHTTPTransport returns the http transport for the cloud provider connection.
+// Transport is shared by all the copies of Conn, so that HTTP connections are reused
+// across parts and volumes being uploaded or downloaded.
+func newHTTPTransport(config map[string]string) (*http.Transport, error) {
+	var (
+		poolSize    = defaultConnectionPoolSize
+		idleTimeout = defaultIdleConnectionTimeout
+		keepAlive   = defaultKeepAlivePeriod
+		err         error
+	)
+
+	if val, ok := config[ConnectionPoolSize]; ok {
+		if poolSize, err = strconv.Atoi(val); err != nil || poolSize <= 0 {
+			return nil, errors.Errorf("invalid %s=%s (expected format positive integer)", ConnectionPoolSize, val)
+		}
+	}
+
+	if val, ok := config[IdleConnectionTimeout]; ok {
+		if idleTimeout, err = time.ParseDuration(val); err != nil || idleTimeout < 0 {
+			return nil, errors.Errorf("invalid %s=%s (expected format duration)", IdleConnectionTimeout, val)
+		}
+	}
+
+	if val, ok := config[KeepAlivePeriod]; ok {
+		// negative value disables the TCP keep-alive
+		if keepAlive, err = time.ParseDuration(val); err != nil {
+			return nil, errors.Errorf("invalid %s=%s (expected format duration)", KeepAlivePeriod, val)
+		}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
+	}).DialContext
+	tr.MaxIdleConns = poolSize
+	tr.MaxIdleConnsPerHost = poolSize
+	tr.IdleConnTimeout = idleTimeout
+	return tr, nil
+}
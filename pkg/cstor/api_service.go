@@ -21,30 +21,91 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
 	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// httpRestCall execute REST API over HTTP
-func (p *Plugin) httpRestCall(url, reqtype string, data []byte) ([]byte, error) {
+const (
+	// defaultRestRetries is default number of retries of failed REST API call
+	defaultRestRetries = 3
+
+	// defaultRestRetryBackoff is default wait before the first retry of REST API call
+	defaultRestRetryBackoff = 2 * time.Second
+
+	// endpointCheckTimeout is timeout to connect to an endpoint of API server for health check
+	endpointCheckTimeout = 2 * time.Second
+)
+
+// restCallError is the error of a REST API call, retryable is set if call may succeed on retry
+type restCallError struct {
+	err       error
+	retryable bool
+}
+
+func (e *restCallError) Error() string {
+	return e.err.Error()
+}
+
+// httpRestCall execute REST API, of given path, over HTTP on given addresses of API server.
+// Call failed with connection error or with retryable status is failed over to the next
+// address. If the call fails on all the addresses then it is retried, as per restRetries,
+// with exponential backoff.
+func (p *Plugin) httpRestCall(addrs []string, path, reqtype string, data []byte) ([]byte, error) {
+	var err error
+
+	if len(addrs) == 0 {
+		return nil, errors.New("no address of API server")
+	}
+
+	backoff := p.restRetryBackoff
+	for retry := 0; ; retry++ {
+		for _, addr := range addrs {
+			var respdata []byte
+
+			respdata, err = p.httpRestCallOnce(addr+path, reqtype, data)
+			if err == nil {
+				return respdata, nil
+			}
+
+			if rerr, ok := err.(*restCallError); !ok || !rerr.retryable {
+				return nil, err
+			}
+			p.Log.Warnf("REST call %s %s failed : %s", reqtype, addr+path, err)
+		}
+
+		if retry >= p.restRetries {
+			return nil, err
+		}
+
+		p.Log.Warnf("REST call %s %s failed on %d address(es), retrying in %v (%d/%d)",
+			reqtype, path, len(addrs), backoff, retry+1, p.restRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// httpRestCallOnce execute REST API over HTTP without retry
+func (p *Plugin) httpRestCallOnce(url, reqtype string, data []byte) ([]byte, error) {
 	req, err := http.NewRequest(reqtype, url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/json")
 
-	c := &http.Client{
-		Timeout: p.restTimeout,
-	}
-
-	resp, err := c.Do(req)
+	resp, err := p.restClient.Do(req)
 	if err != nil {
-		return nil, errors.Errorf("Error when connecting to maya-apiserver : %s", err.Error())
+		return nil, &restCallError{
+			err:       errors.Errorf("Error when connecting to maya-apiserver : %s", err.Error()),
+			retryable: true,
+		}
 	}
 
 	defer func() {
@@ -55,18 +116,161 @@ func (p *Plugin) httpRestCall(url, reqtype string, data []byte) ([]byte, error)
 
 	respdata, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, errors.Errorf(
-			"Unable to read response from maya-apiserver, err=%s data=%s",
-			err.Error(), string(respdata))
+		return nil, &restCallError{
+			err: errors.Errorf("Unable to read response from maya-apiserver, err=%s data=%s",
+				err.Error(), string(respdata)),
+			retryable: true,
+		}
 	}
 
 	code := resp.StatusCode
 	if code != http.StatusOK {
-		return nil, errors.Errorf("Status error{%v}, response=%s", http.StatusText(code), string(respdata))
+		return nil, &restCallError{
+			err:       errors.Errorf("Status error{%v}, response=%s", http.StatusText(code), string(respdata)),
+			retryable: isRetryableStatus(code),
+		}
 	}
 	return respdata, nil
 }
 
+// isRetryableStatus returns true if request failed with given HTTP status may succeed on retry
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// getServiceAddrs return the addresses of ready endpoints of given service of API server,
+// healthy endpoints first. Given service address is returned if endpoints can't be used.
+func (p *Plugin) getServiceAddrs(svc *v1.Service, svcAddr string) []string {
+	var healthy, unhealthy []string
+
+	if svc == nil {
+		return []string{svcAddr}
+	}
+
+	ep, err := p.K8sClient.CoreV1().Endpoints(svc.Namespace).Get(context.TODO(), svc.Name, metav1.GetOptions{})
+	if err != nil {
+		p.Log.Warnf("Failed to fetch endpoints of service=%s/%s, using service address : %s", svc.Namespace, svc.Name, err)
+		return []string{svcAddr}
+	}
+
+	for _, subset := range ep.Subsets {
+		port, ok := endpointPort(svc, subset)
+		if !ok {
+			continue
+		}
+
+		// addresses of not ready endpoints are listed in subset.NotReadyAddresses
+		for _, addr := range subset.Addresses {
+			hostPort := net.JoinHostPort(addr.IP, strconv.FormatInt(int64(port), 10))
+
+			conn, err := net.DialTimeout("tcp", hostPort, endpointCheckTimeout)
+			if err != nil {
+				p.Log.Warnf("Endpoint=%s of service=%s/%s is not reachable : %s", hostPort, svc.Namespace, svc.Name, err)
+				unhealthy = append(unhealthy, "http://"+hostPort)
+				continue
+			}
+			_ = conn.Close()
+			healthy = append(healthy, "http://"+hostPort)
+		}
+	}
+
+	addrs := append(healthy, unhealthy...)
+	if len(addrs) == 0 {
+		p.Log.Warnf("Service=%s/%s doesn't have ready endpoints, using service address", svc.Namespace, svc.Name)
+		return []string{svcAddr}
+	}
+	return addrs
+}
+
+// endpointPort return the port, of given endpoint subset, for the first port of given service
+func endpointPort(svc *v1.Service, subset v1.EndpointSubset) (int32, bool) {
+	if len(svc.Spec.Ports) == 0 || len(subset.Ports) == 0 {
+		return 0, false
+	}
+
+	name := svc.Spec.Ports[0].Name
+	for _, port := range subset.Ports {
+		if port.Name == name {
+			return port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// initOpenEBSAddr fetches the address of maya-apiserver and cvc-server. If the services are
+// not found in the configured openebs namespace, e.g. volumesnapshotlocation is copied from the
+// cluster having openebs in different namespace, then the services are searched in all the
+// namespaces and openebs namespace is updated to the namespace of found service.
+// If the services are not found in any namespace then openebs namespace is discovered from
+// the openebs operators, else configured namespace, or default openebs namespace, is used.
+// Discovered namespace is cached, and the cache is invalidated if services are not found in it.
+func (p *Plugin) initOpenEBSAddr() error {
+	var err error
+
+	configuredNs := p.namespace
+	cachedNs, cached := getCachedNamespace(configuredNs)
+	if cached {
+		p.namespace = cachedNs
+	}
+
+	for {
+		p.mayaAddr, err = p.getMapiAddr()
+		if err != nil {
+			return errors.Wrapf(err, "error fetching Maya-ApiServer rest client address")
+		}
+
+		p.cvcAddr, err = p.getCVCAddr()
+		if err != nil {
+			return errors.Wrapf(err, "error fetching CVC rest client address")
+		}
+
+		if p.mayaAddr != "" || p.cvcAddr != "" {
+			break
+		}
+
+		if p.namespace == "" {
+			// backup and remote restore are performed using the resources of openebs,
+			// only local restore depends on maya-apiserver/cvc-server
+			p.Log.Warnf("maya-apiserver/cvc-server service not found, restore of local backup will fail")
+			p.namespace, err = p.discoverOpenEBSNamespace(configuredNs)
+			if err != nil {
+				p.Log.Warnf("Failed to discover openebs namespace from operators : %s", err)
+			}
+			if p.namespace == "" {
+				p.namespace = configuredNs
+			}
+			if p.namespace == "" {
+				p.namespace = defaultOpenEBSNamespace
+			}
+			break
+		}
+
+		if cached && p.namespace == cachedNs {
+			invalidateNamespace(configuredNs)
+			cached = false
+		}
+		p.Log.Warnf("maya-apiserver/cvc-server service not found in namespace=%s, searching in all namespaces", p.namespace)
+		p.namespace = ""
+	}
+
+	if configuredNs != "" && configuredNs != p.namespace && !cached {
+		p.Log.Warnf("Using openebs namespace=%s instead of configured namespace=%s", p.namespace, configuredNs)
+	}
+	if !cached {
+		cacheNamespace(configuredNs, p.namespace, p.namespaceCacheTTL)
+	}
+	return nil
+}
+
 // getMapiAddr return maya API server's ip address
 func (p *Plugin) getMapiAddr() (string, error) {
 	var openebsNs string
@@ -123,6 +327,7 @@ fetchip:
 		if s.Spec.ClusterIP != "" {
 			// update the namespace
 			p.namespace = s.Namespace
+			p.mayaService = s.DeepCopy()
 			return "http://" + s.Spec.ClusterIP + ":" + strconv.FormatInt(int64(s.Spec.Ports[0].Port), 10), nil
 		}
 	}
@@ -167,6 +372,7 @@ func (p *Plugin) getCVCAddr() (string, error) {
 		if s.Spec.ClusterIP != "" {
 			// update the namespace
 			p.namespace = s.Namespace
+			p.cvcService = s.DeepCopy()
 			return "http://" + s.Spec.ClusterIP + ":" + strconv.FormatInt(int64(s.Spec.Ports[0].Port), 10), nil
 		}
 	}
@@ -174,82 +380,48 @@ func (p *Plugin) getCVCAddr() (string, error) {
 	return "", nil
 }
 
-func (p *Plugin) sendBackupRequest(vol *Volume) (*v1alpha1.CStorBackup, error) {
-	var url string
-
-	scheduleName := p.getScheduleName(vol.backupName) // This will be backup/schedule name
-
-	serverAddr := p.cstorServerAddr + ":" + strconv.Itoa(CstorBackupPort)
-
-	bkpSpec := &v1alpha1.CStorBackupSpec{
-		BackupName: scheduleName,
-		VolumeName: vol.volname,
-		SnapName:   vol.backupName,
-		BackupDest: serverAddr,
-		LocalSnap:  p.local,
-	}
-
-	bkp := &v1alpha1.CStorBackup{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: vol.namespace,
-		},
-		Spec: *bkpSpec,
-	}
-
-	if vol.isCSIVolume {
-		url = p.cvcAddr + backupEndpoint
-	} else {
-		url = p.mayaAddr + backupEndpoint
-	}
+// sendRestoreRequest sends the request to maya-apiserver/cvc-server to create the volume
+// cloned from the snapshot of source volume, for restoring the local backup
+func (p *Plugin) sendRestoreRequest(vol *Volume) (*v1alpha1.CStorRestore, error) {
+	var addrs []string
 
-	bkpData, err := json.Marshal(bkp)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Error parsing json")
+	if vol.isCSIVolume && p.cvcAddr != "" {
+		addrs = p.getServiceAddrs(p.cvcService, p.cvcAddr)
+	} else if !vol.isCSIVolume && p.mayaAddr != "" {
+		addrs = p.getServiceAddrs(p.mayaService, p.mayaAddr)
 	}
 
-	_, err = p.httpRestCall(url, "POST", bkpData)
-	if err != nil {
-		return nil, errors.Wrapf(err, "Error calling REST api")
+	if len(addrs) == 0 {
+		return nil, errors.New("local restore requires maya-apiserver/cvc-server service, which is not found")
 	}
 
-	return bkp, nil
-}
-
-func (p *Plugin) sendRestoreRequest(vol *Volume) (*v1alpha1.CStorRestore, error) {
-	var url string
-
-	restoreSrc := p.cstorServerAddr + ":" + strconv.Itoa(CstorRestorePort)
-
-	if p.local {
-		restoreSrc = vol.srcVolname
+	// restore resource is created in the namespace of restored volume claim,
+	// similar to backup resource
+	restoreNs := vol.namespace
+	if restoreNs == "" {
+		restoreNs = p.namespace
 	}
 
 	restore := &v1alpha1.CStorRestore{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: p.namespace,
+			Namespace: restoreNs,
 		},
 		Spec: v1alpha1.CStorRestoreSpec{
 			RestoreName:  vol.backupName,
 			VolumeName:   vol.volname,
-			RestoreSrc:   restoreSrc,
+			RestoreSrc:   vol.srcVolname,
 			StorageClass: vol.storageClass,
 			Size:         vol.size,
-			Local:        p.local,
+			Local:        true,
 		},
 	}
 
-	if vol.isCSIVolume {
-		url = p.cvcAddr + restorePath
-	} else {
-		url = p.mayaAddr + restorePath
-	}
-
 	restoreData, err := json.Marshal(restore)
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := p.httpRestCall(url, "POST", restoreData)
+	data, err := p.httpRestCall(addrs, restorePath, "POST", restoreData)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Error executing REST api for restore")
 	}
@@ -282,52 +454,3 @@ func isEmptyRestResponse(data []byte) (bool, error) {
 
 	return false, nil
 }
-
-func (p *Plugin) sendDeleteRequest(backup, volume, namespace, schedule string, isCSIVolume bool) error {
-	var url string
-
-	if isCSIVolume {
-		url = p.cvcAddr + backupEndpoint + backup
-	} else {
-		url = p.mayaAddr + backupEndpoint + backup
-	}
-
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return errors.Wrapf(err, "failed to create HTTP request")
-	}
-
-	q := req.URL.Query()
-	q.Add("volume", volume)
-	q.Add("namespace", namespace)
-	q.Add("schedule", schedule)
-
-	req.URL.RawQuery = q.Encode()
-
-	c := &http.Client{
-		Timeout: p.restTimeout,
-	}
-
-	resp, err := c.Do(req)
-	if err != nil {
-		return errors.Wrapf(err, "failed to connect maya-apiserver")
-	}
-
-	defer func() {
-		if err = resp.Body.Close(); err != nil {
-			p.Log.Warnf("Failed to close response err=%s", err)
-		}
-	}()
-
-	respdata, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return errors.Wrapf(err, "failed to read response from maya-apiserver, response=%s", string(respdata))
-	}
-
-	code := resp.StatusCode
-	if code != http.StatusOK {
-		return errors.Errorf("HTTP Status error{%v} from maya-apiserver, response=%s", code, string(respdata))
-	}
-
-	return nil
-}
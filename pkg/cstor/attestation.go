@@ -0,0 +1,316 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AttestationSecret config key for the secret, in openebs namespace, having the attestation signing key
+	AttestationSecret = "attestationSecret"
+
+	// AttestationLogURL config key for the transparency log endpoint to which attestations are submitted
+	AttestationLogURL = "attestationLogURL"
+
+	// attestationPrivateKey is the secret data key having PEM encoded PKCS#8 ed25519 private key
+	attestationPrivateKey = "privateKey"
+
+	// attestationPublicKey is the secret data key having PEM encoded PKIX ed25519 public key
+	attestationPublicKey = "publicKey"
+
+	// attestationSuffix is suffix for the name of backup attestation file
+	attestationSuffix = ".attestation"
+
+	// attestationPayloadType is the type of attestation payload
+	attestationPayloadType = "application/vnd.openebs.velero-plugin.backup+json"
+)
+
+// attestationStatement describes the backup data attested by the signature
+type attestationStatement struct {
+	// Backup is velero backup name
+	Backup string `json:"backup"`
+
+	// Volume is volume name
+	Volume string `json:"volume"`
+
+	// ManifestDigest is sha256 digest of the uploaded backup manifest
+	ManifestDigest string `json:"manifestDigest"`
+
+	// Checksum is checksum of uploaded snapshot data
+	Checksum string `json:"checksum"`
+
+	// Size is number of bytes of snapshot data uploaded
+	Size int64 `json:"size"`
+
+	// Timestamp is time at which attestation is created
+	Timestamp metav1.Time `json:"timestamp"`
+}
+
+// backupAttestation is the signed attestation of a remote backup,
+// signature is computed over the payload type and the payload
+type backupAttestation struct {
+	// PayloadType is type of payload
+	PayloadType string `json:"payloadType"`
+
+	// Payload is base64 encoded attestationStatement
+	Payload string `json:"payload"`
+
+	// KeyID identifies the key used to sign the attestation
+	KeyID string `json:"keyID"`
+
+	// Signature is base64 encoded ed25519 signature
+	Signature string `json:"signature"`
+}
+
+// initAttestation loads the attestation keys from the configured secret.
+// If only public key is available then backups are not attested, but
+// attestation of backups is verified on restore.
+func (p *Plugin) initAttestation(config map[string]string) error {
+	p.attestationLogURL = config[AttestationLogURL]
+
+	name, ok := config[AttestationSecret]
+	if !ok || name == "" {
+		if p.attestationLogURL != "" {
+			return errors.Errorf("%s requires %s", AttestationLogURL, AttestationSecret)
+		}
+		return nil
+	}
+
+	secret, err := p.K8sClient.CoreV1().Secrets(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get attestation secret=%s/%s", p.namespace, name)
+	}
+
+	if data, ok := secret.Data[attestationPrivateKey]; ok {
+		key, err := parsePrivateKey(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s of secret=%s", attestationPrivateKey, name)
+		}
+		p.attestationSigner = key
+		p.attestationVerifier = key.Public().(ed25519.PublicKey)
+	} else if data, ok := secret.Data[attestationPublicKey]; ok {
+		key, err := parsePublicKey(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s of secret=%s", attestationPublicKey, name)
+		}
+		p.attestationVerifier = key
+	} else {
+		return errors.Errorf("secret=%s doesn't have %s or %s", name, attestationPrivateKey, attestationPublicKey)
+	}
+
+	p.Log.Infof("Loaded attestation key=%s from secret=%s", keyID(p.attestationVerifier), name)
+	return nil
+}
+
+// parsePrivateKey parses the PEM encoded PKCS#8 ed25519 private key
+func parsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not ed25519 private key")
+	}
+	return edKey, nil
+}
+
+// parsePublicKey parses the PEM encoded PKIX ed25519 public key
+func parsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("key is not ed25519 public key")
+	}
+	return edKey, nil
+}
+
+// keyID return the identifier of the given public key, first 8 bytes of its sha256 digest
+func keyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signingInput return the data signed for the given payload, payload type is
+// included so that signature can't be reused for other type of payload
+func signingInput(payloadType string, payload []byte) []byte {
+	return append([]byte(payloadType+"\n"), payload...)
+}
+
+// attestBackup signs the attestation of the uploaded backup of the given volume, and uploads
+// it alongside the snapshot data. If transparency log is configured then attestation is
+// submitted to it, failure in submitting it doesn't fail the backup.
+func (p *Plugin) attestBackup(vol *Volume, filename string, manifest []byte) error {
+	if p.attestationSigner == nil {
+		return nil
+	}
+
+	size, _ := vol.cl.Progress()
+	digest := sha256.Sum256(manifest)
+
+	payload, err := json.Marshal(attestationStatement{
+		Backup:         vol.backupName,
+		Volume:         vol.volname,
+		ManifestDigest: "sha256:" + hex.EncodeToString(digest[:]),
+		Checksum:       vol.cl.Checksum(),
+		Size:           size,
+		Timestamp:      metav1.Now(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode attestation statement")
+	}
+
+	att := backupAttestation{
+		PayloadType: attestationPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		KeyID:       keyID(p.attestationVerifier),
+		Signature:   base64.StdEncoding.EncodeToString(ed25519.Sign(p.attestationSigner, signingInput(attestationPayloadType, payload))),
+	}
+
+	data, err := json.MarshalIndent(att, "", "\t")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode attestation")
+	}
+
+	if ok := vol.cl.Write(data, filename+attestationSuffix); !ok {
+		return errors.New("failed to upload attestation")
+	}
+
+	if p.attestationLogURL != "" {
+		if err := p.submitAttestation(data); err != nil {
+			p.Log.Warningf("Failed to submit attestation of backup=%s volume=%s to transparency log : %s",
+				vol.backupName, vol.volname, err)
+		}
+	}
+	return nil
+}
+
+// submitAttestation posts the given attestation to the configured transparency log
+func (p *Plugin) submitAttestation(data []byte) error {
+	resp, err := p.restClient.Post(p.attestationLogURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
+			p.Log.Warnf("Failed to close response : %s", err.Error())
+		}
+	}()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("status=%d response=%s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// verifyAttestation verifies the attestation of the given remote backup against its manifest.
+// It returns false without error if attestation key is not configured or backup doesn't have
+// an attestation, and error if attestation is invalid.
+func (p *Plugin) verifyAttestation(snapshotTag, backupName string) (bool, error) {
+	if p.attestationVerifier == nil {
+		return false, nil
+	}
+
+	filename := p.cl.GenerateRemoteFilename(snapshotTag, backupName)
+
+	exists, err := p.cl.ObjectExists(filename + attestationSuffix)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to check attestation of snapshot=%s", backupName)
+	}
+	if !exists {
+		p.Log.Warningf("Attestation not found for snapshot=%s, backup data can't be proven unmodified", backupName)
+		return false, nil
+	}
+
+	data, ok := p.cl.Read(filename + attestationSuffix)
+	if !ok {
+		return false, errors.Errorf("failed to download attestation of snapshot=%s", backupName)
+	}
+
+	att := backupAttestation{}
+	if err := json.Unmarshal(data, &att); err != nil {
+		return false, errors.Wrapf(err, "failed to decode attestation of snapshot=%s", backupName)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(att.Payload)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to decode attestation payload of snapshot=%s", backupName)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(att.Signature)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to decode attestation signature of snapshot=%s", backupName)
+	}
+
+	if att.PayloadType != attestationPayloadType ||
+		!ed25519.Verify(p.attestationVerifier, signingInput(att.PayloadType, payload), sig) {
+		return false, errors.Errorf("invalid signature on attestation of snapshot=%s, key=%s", backupName, att.KeyID)
+	}
+
+	stmt := attestationStatement{}
+	if err := json.Unmarshal(payload, &stmt); err != nil {
+		return false, errors.Wrapf(err, "failed to decode attestation statement of snapshot=%s", backupName)
+	}
+
+	if stmt.Backup != backupName {
+		return false, errors.Errorf("attestation of snapshot=%s is for backup=%s", backupName, stmt.Backup)
+	}
+
+	manifest, ok := p.cl.Read(filename + manifestSuffix)
+	if !ok {
+		return false, errors.Errorf("failed to download manifest of snapshot=%s", backupName)
+	}
+
+	digest := sha256.Sum256(manifest)
+	if stmt.ManifestDigest != "sha256:"+hex.EncodeToString(digest[:]) {
+		return false, errors.Errorf("manifest of snapshot=%s is modified after attestation", backupName)
+	}
+
+	p.Log.Infof("Attestation of snapshot=%s is verified, signed at %s", backupName, stmt.Timestamp)
+	return true, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// backupCatalogGroup is API group of VolumeBackupCatalog resource
+	backupCatalogGroup = "velero.openebs.io"
+
+	// backupCatalogVersion is API version of VolumeBackupCatalog resource
+	backupCatalogVersion = "v1alpha1"
+
+	// backupTypeFull and backupTypeIncremental are the types of backup in catalog
+	backupTypeFull        = "full"
+	backupTypeIncremental = "incremental"
+
+	// localLocation is location of the backup in catalog for local snapshot
+	localLocation = "local"
+)
+
+// backupCatalogGVR is the VolumeBackupCatalog resource, refer example/01-volumebackupcatalog.yaml
+var backupCatalogGVR = schema.GroupVersionResource{
+	Group:    backupCatalogGroup,
+	Version:  backupCatalogVersion,
+	Resource: "volumebackupcatalogs",
+}
+
+// isBackupCatalogServed returns true if VolumeBackupCatalog resource is served by the cluster,
+// backups are cataloged in configmap if CRD is not installed
+func (p *Plugin) isBackupCatalogServed() bool {
+	p.backupCatalogOnce.Do(func() {
+		if p.dynamicClient == nil {
+			return
+		}
+
+		gv := backupCatalogGVR.GroupVersion().String()
+		list, err := p.K8sClient.Discovery().ServerResourcesForGroupVersion(gv)
+		if err != nil {
+			p.Log.Debugf("VolumeBackupCatalog is not served, backups are cataloged in configmap : %s", err)
+			return
+		}
+		for _, r := range list.APIResources {
+			if r.Name == backupCatalogGVR.Resource {
+				p.backupCatalogServed = true
+			}
+		}
+	})
+	return p.backupCatalogServed
+}
+
+// updateBackupCatalog updates the backups of VolumeBackupCatalog of given volume, creating it
+// if it doesn't exist. Backups should be sorted by timestamp by the update.
+func (p *Plugin) updateBackupCatalog(volname string, update func([]catalogEntry) []catalogEntry) error {
+	client := p.dynamicClient.Resource(backupCatalogGVR).Namespace(p.namespace)
+
+	// catalog may be created or updated concurrently by the backup of another schedule
+	retriable := func(err error) bool {
+		return k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err)
+	}
+
+	return retry.OnError(retry.DefaultBackoff, retriable, func() error {
+		cur, err := client.Get(context.TODO(), volname, metav1.GetOptions{})
+		create := k8serrors.IsNotFound(err)
+		if create {
+			cur = &unstructured.Unstructured{Object: map[string]interface{}{
+				"spec": map[string]interface{}{"volume": volname},
+			}}
+			cur.SetAPIVersion(backupCatalogGVR.GroupVersion().String())
+			cur.SetKind("VolumeBackupCatalog")
+			cur.SetName(volname)
+			cur.SetNamespace(p.namespace)
+			cur.SetLabels(map[string]string{cVRPVLabel: volname})
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to fetch VolumeBackupCatalog=%s", volname)
+		}
+
+		var backups []catalogEntry
+		if list, ok, _ := unstructured.NestedSlice(cur.Object, "status", "backups"); ok {
+			for _, item := range list {
+				var b catalogEntry
+				if obj, ok := item.(map[string]interface{}); ok &&
+					runtime.DefaultUnstructuredConverter.FromUnstructured(obj, &b) == nil {
+					backups = append(backups, b)
+				}
+			}
+		}
+
+		backups = update(backups)
+
+		list := make([]interface{}, 0, len(backups))
+		for i := range backups {
+			obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&backups[i])
+			if err != nil {
+				return errors.Wrapf(err, "failed to encode backup=%s", backups[i].Name)
+			}
+			list = append(list, obj)
+		}
+
+		status := map[string]interface{}{
+			"backups":     list,
+			"backupCount": int64(len(backups)),
+			"lastUpdated": time.Now().UTC().Format(time.RFC3339),
+		}
+		if len(backups) != 0 {
+			status["latestBackup"] = backups[len(backups)-1].Name
+		}
+		if err := unstructured.SetNestedMap(cur.Object, status, "status"); err != nil {
+			return errors.Wrapf(err, "failed to set status of VolumeBackupCatalog=%s", volname)
+		}
+
+		if create {
+			_, err = client.Create(context.TODO(), cur, metav1.CreateOptions{})
+		} else {
+			_, err = client.Update(context.TODO(), cur, metav1.UpdateOptions{})
+		}
+		return err
+	})
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// BackupNameTemplate config key for the template of the names of scheduled backups, it is used
+	// to find the schedule of a backup. Template has placeholders {schedule} and {timestamp}, and
+	// optionally layout of the timestamp as {timestamp:LAYOUT}.
+	BackupNameTemplate = "backupNameTemplate"
+
+	// defaultBackupNameTemplate is the template of the names of backups created by velero schedule
+	defaultBackupNameTemplate = "{schedule}-{timestamp}"
+
+	schedulePlaceholder  = "{schedule}"
+	timestampPlaceholder = "{timestamp"
+)
+
+// defaultNameTemplate parses the names of backups created by velero schedule
+var defaultNameTemplate = mustParseNameTemplate(defaultBackupNameTemplate)
+
+// backupNameTemplate parses the names of scheduled backups
+type backupNameTemplate struct {
+	// re matches the backup name, having schedule and timestamp as submatches
+	re *regexp.Regexp
+
+	// scheduleIdx and timestampIdx are indexes of schedule and timestamp submatch
+	scheduleIdx, timestampIdx int
+
+	// layout is time layout of the timestamp
+	layout string
+}
+
+// parseNameTemplate parses the given backup name template. Template should have both,
+// {schedule} and {timestamp}, placeholders exactly once. Timestamp layout should have
+// fixed width, like 2006-01-02T15-04-05, since timestamp is matched by its length.
+func parseNameTemplate(spec string) (*backupNameTemplate, error) {
+	if strings.Count(spec, schedulePlaceholder) != 1 {
+		return nil, errors.Errorf("template %q should have %s exactly once", spec, schedulePlaceholder)
+	}
+	if strings.Count(spec, timestampPlaceholder) != 1 {
+		return nil, errors.Errorf("template %q should have %s} exactly once", spec, timestampPlaceholder)
+	}
+
+	t := &backupNameTemplate{layout: scheduleTimestampFormat}
+
+	tsStart := strings.Index(spec, timestampPlaceholder)
+	tsLen := strings.Index(spec[tsStart:], "}") + 1
+	if tsLen == 0 {
+		return nil, errors.Errorf("template %q has unterminated %s", spec, timestampPlaceholder)
+	}
+	if ts := spec[tsStart : tsStart+tsLen]; ts != timestampPlaceholder+"}" {
+		if !strings.HasPrefix(ts, timestampPlaceholder+":") || len(ts) == len(timestampPlaceholder)+2 {
+			return nil, errors.Errorf("template %q has invalid placeholder %s", spec, ts)
+		}
+		t.layout = ts[len(timestampPlaceholder)+1 : len(ts)-1]
+	}
+
+	schStart := strings.Index(spec, schedulePlaceholder)
+	if schStart > tsStart && schStart < tsStart+tsLen {
+		return nil, errors.Errorf("template %q has invalid placeholder", spec)
+	}
+
+	schedule := "(.+)"
+	timestamp := "(.{" + strconv.Itoa(len(t.layout)) + "})"
+
+	var expr string
+	if schStart < tsStart {
+		expr = regexp.QuoteMeta(spec[:schStart]) + schedule +
+			regexp.QuoteMeta(spec[schStart+len(schedulePlaceholder):tsStart]) + timestamp +
+			regexp.QuoteMeta(spec[tsStart+tsLen:])
+		t.scheduleIdx, t.timestampIdx = 1, 2
+	} else {
+		expr = regexp.QuoteMeta(spec[:tsStart]) + timestamp +
+			regexp.QuoteMeta(spec[tsStart+tsLen:schStart]) + schedule +
+			regexp.QuoteMeta(spec[schStart+len(schedulePlaceholder):])
+		t.scheduleIdx, t.timestampIdx = 2, 1
+	}
+
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compile template %q", spec)
+	}
+	t.re = re
+	return t, nil
+}
+
+func mustParseNameTemplate(spec string) *backupNameTemplate {
+	t, err := parseNameTemplate(spec)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// parse return the schedule and timestamp of the given backup name. It return false
+// if backup name doesn't match the template, i.e. backup is not created by schedule.
+func (t *backupNameTemplate) parse(backupName string) (string, time.Time, bool) {
+	m := t.re.FindStringSubmatch(backupName)
+	if m == nil {
+		return "", time.Time{}, false
+	}
+
+	ts, err := time.Parse(t.layout, m[t.timestampIdx])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return m[t.scheduleIdx], ts, true
+}
+
+// scheduleOf return the schedule name of given backup, or the backup name if
+// backup is not created by schedule
+func (t *backupNameTemplate) scheduleOf(backupName string) string {
+	if schedule, _, ok := t.parse(backupName); ok {
+		return schedule
+	}
+	return backupName
+}
+
+// sortBackups sorts the given backups from oldest to latest, by the timestamp parsed from
+// their names as per the backup name template
+func (p *Plugin) sortBackups(backups []string) {
+	sort.SliceStable(backups, func(i, j int) bool { return p.isBackupBefore(backups[i], backups[j]) })
+}
+
+// isBackupBefore returns true if backup a is created before backup b, as per the timestamp
+// parsed from their names. Backups having same timestamp are compared by name, and backups
+// whose names don't have timestamp are considered older than the backups having timestamp.
+func (p *Plugin) isBackupBefore(a, b string) bool {
+	ta, okA := p.getBackupTimestamp(a)
+	tb, okB := p.getBackupTimestamp(b)
+
+	if okA != okB {
+		return okB
+	}
+	if okA && !ta.Equal(tb) {
+		return ta.Before(tb)
+	}
+	return a < b
+}
+
+// getNameTemplate return the backup name template from given config
+func getNameTemplate(config map[string]string) (*backupNameTemplate, error) {
+	spec, ok := config[BackupNameTemplate]
+	if !ok || spec == "" || spec == defaultBackupNameTemplate {
+		return defaultNameTemplate, nil
+	}
+
+	t, err := parseNameTemplate(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", BackupNameTemplate)
+	}
+	return t, nil
+}
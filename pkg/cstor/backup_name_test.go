@@ -0,0 +1,167 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackupNameTemplateParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   string
+		backupName string
+		schedule   string
+		timestamp  time.Time
+		ok         bool
+	}{
+		{
+			name:       "default template",
+			template:   defaultBackupNameTemplate,
+			backupName: "daily-20210513104034",
+			schedule:   "daily",
+			timestamp:  time.Date(2021, 5, 13, 10, 40, 34, 0, time.UTC),
+			ok:         true,
+		},
+		{
+			name:       "default template with dash in schedule",
+			template:   defaultBackupNameTemplate,
+			backupName: "daily-db-20210513104034",
+			schedule:   "daily-db",
+			timestamp:  time.Date(2021, 5, 13, 10, 40, 34, 0, time.UTC),
+			ok:         true,
+		},
+		{
+			name:       "default template without timestamp",
+			template:   defaultBackupNameTemplate,
+			backupName: "backup-1",
+		},
+		{
+			name:       "default template with invalid timestamp",
+			template:   defaultBackupNameTemplate,
+			backupName: "daily-20211313104034",
+		},
+		{
+			name:       "custom layout",
+			template:   "{schedule}.{timestamp:2006-01-02T15-04-05}",
+			backupName: "nightly-db.2021-05-13T10-40-34",
+			schedule:   "nightly-db",
+			timestamp:  time.Date(2021, 5, 13, 10, 40, 34, 0, time.UTC),
+			ok:         true,
+		},
+		{
+			name:       "timestamp before schedule",
+			template:   "{timestamp:20060102}-{schedule}",
+			backupName: "20210513-weekly",
+			schedule:   "weekly",
+			timestamp:  time.Date(2021, 5, 13, 0, 0, 0, 0, time.UTC),
+			ok:         true,
+		},
+		{
+			name:       "custom template not matched",
+			template:   "{schedule}.{timestamp:2006-01-02T15-04-05}",
+			backupName: "nightly-db-20210513104034",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseNameTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("parseNameTemplate(%q) failed : %s", tt.template, err)
+			}
+
+			schedule, ts, ok := tmpl.parse(tt.backupName)
+			if ok != tt.ok || schedule != tt.schedule || !ts.Equal(tt.timestamp) {
+				t.Errorf("parse(%q) = %q, %v, %v, want %q, %v, %v",
+					tt.backupName, schedule, ts, ok, tt.schedule, tt.timestamp, tt.ok)
+			}
+
+			want := tt.schedule
+			if !tt.ok {
+				want = tt.backupName
+			}
+			if got := tmpl.scheduleOf(tt.backupName); got != want {
+				t.Errorf("scheduleOf(%q) = %q, want %q", tt.backupName, got, want)
+			}
+		})
+	}
+}
+
+func TestParseNameTemplateInvalid(t *testing.T) {
+	for _, template := range []string{
+		"{timestamp}",
+		"{schedule}",
+		"{schedule}-{schedule}-{timestamp}",
+		"{schedule}-{timestamp}-{timestamp}",
+		"{schedule}-{timestamp",
+		"{schedule}-{timestamp:}",
+		"{schedule}-{timestampX}",
+	} {
+		if _, err := parseNameTemplate(template); err == nil {
+			t.Errorf("parseNameTemplate(%q) succeeded, want error", template)
+		}
+	}
+}
+
+func TestSortBackups(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		backups  []string
+		want     []string
+	}{
+		{
+			name:     "default template",
+			template: defaultBackupNameTemplate,
+			backups:  []string{"daily-20210514000000", "daily-20210512000000", "daily-20210513000000"},
+			want:     []string{"daily-20210512000000", "daily-20210513000000", "daily-20210514000000"},
+		},
+		{
+			name:     "non-chronological layout",
+			template: "{schedule}-{timestamp:02-01-2006}",
+			backups:  []string{"daily-01-06-2021", "daily-31-05-2021", "daily-02-05-2021"},
+			want:     []string{"daily-02-05-2021", "daily-31-05-2021", "daily-01-06-2021"},
+		},
+		{
+			name:     "backups without timestamp are older",
+			template: defaultBackupNameTemplate,
+			backups:  []string{"daily-20210513000000", "manual-b", "manual-a"},
+			want:     []string{"manual-a", "manual-b", "daily-20210513000000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plugin{backupNameTemplate: mustParseNameTemplate(tt.template)}
+
+			got := append([]string(nil), tt.backups...)
+			p.sortBackups(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sortBackups(%v) = %v, want %v", tt.backups, got, tt.want)
+			}
+
+			for i := 1; i < len(tt.want); i++ {
+				if !p.isBackupBefore(tt.want[i-1], tt.want[i]) || p.isBackupBefore(tt.want[i], tt.want[i-1]) {
+					t.Errorf("isBackupBefore(%q, %q) is inconsistent with the order", tt.want[i-1], tt.want[i])
+				}
+			}
+		})
+	}
+}
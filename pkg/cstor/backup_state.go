@@ -0,0 +1,205 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// backupStatePrefix is prefix for the name of volume's backup state configmap
+	backupStatePrefix = "velero-backup-state-"
+
+	// backupStateLabel is set on backup state configmap with volume name as value
+	backupStateLabel = "openebs.io/velero-backup-state"
+
+	// backupStateDataKey is the configmap data key having the backup state
+	backupStateDataKey = "state"
+)
+
+// backupState describes the in-progress remote backup of a volume. It is persisted
+// in a configmap, so that backup interrupted by restart of velero can be cleaned up.
+type backupState struct {
+	// Backup is velero backup name
+	Backup string `json:"backup"`
+
+	// Schedule is schedule name for scheduled backup, or backup name for non-scheduled backup
+	Schedule string `json:"schedule"`
+
+	// Volume is volume name
+	Volume string `json:"volume"`
+
+	// Namespace is namespace of backup resources of the volume
+	Namespace string `json:"namespace"`
+
+	// IsCSIVolume is true for cStor based CSI volume
+	IsCSIVolume bool `json:"isCSIVolume"`
+
+	// File is remote file name for snapshot data
+	File string `json:"file"`
+
+	// StartTime is time at which backup was started
+	StartTime metav1.Time `json:"startTime"`
+}
+
+// backupStateName return the name of backup state configmap for the given volume
+func backupStateName(volname string) string {
+	return backupStatePrefix + volname
+}
+
+// saveBackupState persists the state of in-progress backup of the given task
+// If state of an earlier backup of the volume exists then it will be cleaned up.
+func (p *Plugin) saveBackupState(t *backupTask) error {
+	vol := t.vol
+
+	data, err := json.Marshal(backupState{
+		Backup:      vol.backupName,
+		Schedule:    p.getScheduleName(vol.backupName),
+		Volume:      vol.volname,
+		Namespace:   vol.backupNamespace,
+		IsCSIVolume: vol.isCSIVolume,
+		File:        t.filename,
+		StartTime:   metav1.NewTime(t.startTime),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode backup state of volume=%s", vol.volname)
+	}
+
+	cm, err := p.K8sClient.
+		CoreV1().
+		ConfigMaps(p.namespace).
+		Get(context.TODO(), backupStateName(vol.volname), metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to fetch backup state of volume=%s", vol.volname)
+		}
+
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      backupStateName(vol.volname),
+				Namespace: p.namespace,
+				Labels: map[string]string{
+					backupStateLabel: vol.volname,
+				},
+			},
+			Data: map[string]string{
+				backupStateDataKey: string(data),
+			},
+		}
+		_, err = p.K8sClient.CoreV1().ConfigMaps(p.namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+
+	// previous backup of the volume was interrupted before plugin could clean it up
+	if s, err := decodeBackupState(cm); err == nil && s.Backup != vol.backupName {
+		if inProgress, err := velero.IsBackupInProgress(s.Backup); err == nil && !inProgress {
+			p.cleanupInterruptedBackup(s)
+		}
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[backupStateDataKey] = string(data)
+	_, err = p.K8sClient.CoreV1().ConfigMaps(p.namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// deleteBackupState deletes the persisted state of backup of the given volume
+func (p *Plugin) deleteBackupState(volname string) {
+	err := p.K8sClient.
+		CoreV1().
+		ConfigMaps(p.namespace).
+		Delete(context.TODO(), backupStateName(volname), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Warningf("Failed to delete backup state of volume=%s : %s", volname, err)
+	}
+}
+
+// decodeBackupState return the backup state from the given configmap
+func decodeBackupState(cm *v1.ConfigMap) (*backupState, error) {
+	s := &backupState{}
+	if err := json.Unmarshal([]byte(cm.Data[backupStateDataKey]), s); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode backup state=%s", cm.Name)
+	}
+	return s, nil
+}
+
+// cleanupInterruptedBackups cleans up the backups which were interrupted by the restart of velero.
+//
+// velero marks the in-progress backups as failed after restart, so such backups can't be resumed.
+// If velero backup of a persisted backup state is not in progress then the plugin instance, which
+// was executing the backup, doesn't exist anymore. For such backups, snapshot, backup resources
+// and partially uploaded data are deleted.
+func (p *Plugin) cleanupInterruptedBackups() {
+	list, err := p.K8sClient.
+		CoreV1().
+		ConfigMaps(p.namespace).
+		List(context.TODO(), metav1.ListOptions{LabelSelector: backupStateLabel})
+	if err != nil {
+		p.Log.Warningf("Failed to list backup states : %s", err)
+		return
+	}
+
+	for i := range list.Items {
+		s, err := decodeBackupState(&list.Items[i])
+		if err != nil {
+			p.Log.Warningf("Deleting invalid backup state : %s", err)
+			p.deleteBackupState(list.Items[i].Labels[backupStateLabel])
+			continue
+		}
+
+		inProgress, err := velero.IsBackupInProgress(s.Backup)
+		if err != nil {
+			p.Log.Warningf("Failed to check status of backup=%s : %s", s.Backup, err)
+			continue
+		}
+		if inProgress {
+			continue
+		}
+
+		p.cleanupInterruptedBackup(s)
+	}
+}
+
+// cleanupInterruptedBackup deletes the snapshot, backup resources and uploaded data of the given backup
+func (p *Plugin) cleanupInterruptedBackup(s *backupState) {
+	p.Log.Infof("Cleaning up backup=%s of volume=%s interrupted by restart, started at %v",
+		s.Backup, s.Volume, s.StartTime)
+
+	if err := p.deleteBackup(s.Backup, s.Volume, s.Namespace, s.Schedule, s.IsCSIVolume); err != nil {
+		p.Log.Warningf("Failed to execute clean-up request for backup=%s of volume=%s : %s", s.Backup, s.Volume, err)
+		return
+	}
+
+	for _, file := range []string{s.File, s.File + manifestSuffix} {
+		if exists, err := p.cl.ObjectExists(file); err == nil && exists {
+			if !p.cl.Delete(file) {
+				p.Log.Warningf("Failed to remove file=%s of interrupted backup=%s", file, s.Backup)
+			}
+		}
+	}
+
+	p.deleteBackupState(s.Volume)
+}
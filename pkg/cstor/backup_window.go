@@ -0,0 +1,321 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BackupWindow config key for the time windows in which snapshot of a volume can be taken,
+	// windows are comma separated and each window is like "[Mon-Fri ]22:00-06:00"
+	BackupWindow = "backupWindow"
+
+	// BackupWindowTimezone config key for timezone of the backup windows, default is UTC
+	BackupWindowTimezone = "backupWindowTimezone"
+
+	// BackupWindowPolicy config key for the action to take if backup is started outside the backup windows
+	BackupWindowPolicy = "backupWindowPolicy"
+
+	// WindowPolicyWait waits for the next backup window to open
+	WindowPolicyWait = "wait"
+
+	// WindowPolicyFail fails the backup of the volume
+	WindowPolicyFail = "fail"
+
+	// minutesPerDay is number of minutes in a day, it is the maximum end time of a window
+	minutesPerDay = 24 * 60
+)
+
+// weekdays are the abbreviated names of week days, in the order of time.Weekday
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// backupWindow is a daily time window in which backups are allowed. If end is before
+// start then window ends on the next day.
+type backupWindow struct {
+	// days are the week days on which window starts
+	days [7]bool
+
+	// start and end are minutes since midnight
+	start, end int
+
+	spec string
+}
+
+// isOpen returns true if the window is open at the given time
+func (w backupWindow) isOpen(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	prevDay := (day + 6) % 7
+
+	if w.start < w.end {
+		return w.days[day] && m >= w.start && m < w.end
+	}
+	return (w.days[day] && m >= w.start) || (w.days[prevDay] && m < w.end)
+}
+
+// nextOpen return the time, after the given time, at which the window opens next
+func (w backupWindow) nextOpen(t time.Time) time.Time {
+	for i := 0; i <= 7; i++ {
+		d := t.AddDate(0, 0, i)
+		if !w.days[d.Weekday()] {
+			continue
+		}
+		open := time.Date(d.Year(), d.Month(), d.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+		if open.After(t) {
+			return open
+		}
+	}
+	// unreachable, window is open on at least one day of the week
+	return t
+}
+
+// parseBackupWindows return the backup windows from the given comma separated windows
+func parseBackupWindows(val string) ([]backupWindow, error) {
+	var windows []backupWindow
+
+	for _, spec := range strings.Split(val, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		w, err := parseBackupWindow(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid window %q", spec)
+		}
+		windows = append(windows, w)
+	}
+
+	if len(windows) == 0 {
+		return nil, errors.New("no window specified")
+	}
+	return windows, nil
+}
+
+// parseBackupWindow parses the window like "Mon-Fri 22:00-06:00", days are optional
+func parseBackupWindow(spec string) (backupWindow, error) {
+	w := backupWindow{spec: spec}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return w, err
+		}
+		fields = fields[1:]
+	default:
+		return w, errors.New("expected format like \"Mon-Fri 22:00-06:00\"")
+	}
+
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return w, errors.Errorf("invalid time range %q, expected format like 22:00-06:00", fields[0])
+	}
+
+	var err error
+	if w.start, err = parseMinutes(times[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseMinutes(times[1]); err != nil {
+		return w, err
+	}
+	if w.start == minutesPerDay {
+		return w, errors.New("window can't start at 24:00")
+	}
+	if w.start == w.end {
+		return w, errors.New("start and end time of window are same")
+	}
+	return w, nil
+}
+
+// parseDays parses the days like "Mon-Fri" or "Sat"
+func (w *backupWindow) parseDays(days string) error {
+	r := strings.Split(strings.ToLower(days), "-")
+	if len(r) > 2 {
+		return errors.Errorf("invalid days %q, expected format like Mon-Fri", days)
+	}
+
+	first, err := parseWeekday(r[0])
+	if err != nil {
+		return err
+	}
+	last := first
+	if len(r) == 2 {
+		if last, err = parseWeekday(r[1]); err != nil {
+			return err
+		}
+	}
+
+	// range may wrap around the week, like Sat-Sun
+	for d := first; ; d = (d + 1) % 7 {
+		w.days[d] = true
+		if d == last {
+			break
+		}
+	}
+	return nil
+}
+
+// parseWeekday return the week day of given abbreviated name
+func parseWeekday(day string) (int, error) {
+	for i, d := range weekdays {
+		if day == d {
+			return i, nil
+		}
+	}
+	return 0, errors.Errorf("invalid day %q, expected one of %s", day, strings.Join(weekdays, ", "))
+}
+
+// parseMinutes return the minutes since midnight for given time like 22:30
+func parseMinutes(hhmm string) (int, error) {
+	parts := strings.Split(hhmm, ":")
+	if len(parts) != 2 {
+		return 0, errors.Errorf("invalid time %q, expected format HH:MM", hhmm)
+	}
+
+	h, herr := strconv.Atoi(parts[0])
+	m, merr := strconv.Atoi(parts[1])
+	if herr != nil || merr != nil || h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, errors.Errorf("invalid time %q, expected time from 00:00 to 24:00", hhmm)
+	}
+	return h*60 + m, nil
+}
+
+// initBackupWindow parses the backup window config
+func (p *Plugin) initBackupWindow(config map[string]string) error {
+	val, ok := config[BackupWindow]
+	if !ok || val == "" {
+		return nil
+	}
+
+	windows, err := parseBackupWindows(val)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse %s", BackupWindow)
+	}
+
+	loc := time.UTC
+	if tz, ok := config[BackupWindowTimezone]; ok && tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return errors.Wrapf(err, "failed to load %s=%s", BackupWindowTimezone, tz)
+		}
+	}
+
+	policy := WindowPolicyWait
+	if val, ok := config[BackupWindowPolicy]; ok {
+		if val != WindowPolicyWait && val != WindowPolicyFail {
+			return errors.Errorf("invalid %s=%s, expected %s or %s",
+				BackupWindowPolicy, val, WindowPolicyWait, WindowPolicyFail)
+		}
+		policy = val
+	}
+
+	p.backupWindows = windows
+	p.backupWindowLocation = loc
+	p.backupWindowPolicy = policy
+	return nil
+}
+
+// nextBackupWindow return the time at which a backup window opens next, it return
+// the given time if any of the window is open
+func (p *Plugin) nextBackupWindow(now time.Time) time.Time {
+	now = now.In(p.backupWindowLocation)
+
+	var next time.Time
+	for _, w := range p.backupWindows {
+		if w.isOpen(now) {
+			return now
+		}
+		if t := w.nextOpen(now); next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
+
+// waitForBackupWindow waits until a backup window is open, if backup windows are configured.
+// If backupWindowPolicy is fail then error is returned instead of waiting. Wait is bounded
+// by backupTimeout, and error is returned if velero backup is canceled while waiting.
+func (p *Plugin) waitForBackupWindow(vol *Volume) error {
+	if len(p.backupWindows) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	next := p.nextBackupWindow(now)
+	if !next.After(now) {
+		return nil
+	}
+
+	windows := make([]string, 0, len(p.backupWindows))
+	for _, w := range p.backupWindows {
+		windows = append(windows, w.spec)
+	}
+	msg := fmt.Sprintf("backup is outside the %s=%q (%s), next window opens at %s",
+		BackupWindow, strings.Join(windows, ","), p.backupWindowLocation, next.Format(time.RFC3339))
+
+	if p.backupWindowPolicy == WindowPolicyFail {
+		return errors.Errorf("backup of volume=%s failed, %s", vol.volname, msg)
+	}
+
+	p.volumeLog(vol, phaseSnapshot).Infof("Waiting, %s", msg)
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if p.backupTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), p.backupTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return errors.Errorf("backup of volume=%s failed, window didn't open within %s=%v, %s",
+				vol.volname, BackupTimeout, p.backupTimeout, msg)
+		case <-time.After(p.backupStatusInterval):
+		}
+
+		canceled, err := velero.IsBackupCanceled(vol.backupName)
+		if err != nil {
+			p.Log.Warnf("Failed to check if backup=%s is canceled : %s", vol.backupName, err)
+			continue
+		}
+		if canceled {
+			return errors.Errorf("backup=%s is canceled while waiting for backup window", vol.backupName)
+		}
+	}
+}
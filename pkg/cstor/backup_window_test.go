@@ -0,0 +1,133 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"testing"
+	"time"
+)
+
+// windowTime return the time on given day of May 2021, 2021-05-03 is Monday
+func windowTime(day, hour, min int) time.Time {
+	return time.Date(2021, 5, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestParseBackupWindow(t *testing.T) {
+	tests := []struct {
+		spec    string
+		days    [7]bool
+		start   int
+		end     int
+		wantErr bool
+	}{
+		{spec: "22:00-06:00", days: [7]bool{true, true, true, true, true, true, true}, start: 22 * 60, end: 6 * 60},
+		{spec: "Mon-Fri 01:30-24:00", days: [7]bool{false, true, true, true, true, true, false}, start: 90, end: minutesPerDay},
+		{spec: "Sat-Sun 10:00-12:00", days: [7]bool{true, false, false, false, false, false, true}, start: 600, end: 720},
+		{spec: "wed 00:00-00:30", days: [7]bool{false, false, false, true, false, false, false}, start: 0, end: 30},
+		{spec: "Mon-Fri", wantErr: true},
+		{spec: "Mon Fri 01:00-02:00", wantErr: true},
+		{spec: "Mon-Tue-Wed 01:00-02:00", wantErr: true},
+		{spec: "Someday 01:00-02:00", wantErr: true},
+		{spec: "01:00", wantErr: true},
+		{spec: "1-02:00", wantErr: true},
+		{spec: "01:60-02:00", wantErr: true},
+		{spec: "01:00-24:01", wantErr: true},
+		{spec: "24:00-02:00", wantErr: true},
+		{spec: "02:00-02:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			w, err := parseBackupWindow(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBackupWindow(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if w.days != tt.days || w.start != tt.start || w.end != tt.end {
+				t.Errorf("parseBackupWindow(%q) = days=%v %d-%d, want days=%v %d-%d",
+					tt.spec, w.days, w.start, w.end, tt.days, tt.start, tt.end)
+			}
+		})
+	}
+
+	if _, err := parseBackupWindows(" , "); err == nil {
+		t.Errorf("parseBackupWindows() of empty windows succeeded")
+	}
+	if windows, err := parseBackupWindows("Mon 01:00-02:00, Tue 03:00-04:00"); err != nil || len(windows) != 2 {
+		t.Errorf("parseBackupWindows() = %v, %v, want 2 windows", windows, err)
+	}
+}
+
+func TestBackupWindowIsOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{name: "same day window at start", spec: "Mon-Fri 09:00-17:00", at: windowTime(3, 9, 0), want: true},
+		{name: "same day window at end", spec: "Mon-Fri 09:00-17:00", at: windowTime(3, 17, 0)},
+		{name: "same day window on other day", spec: "Mon-Fri 09:00-17:00", at: windowTime(8, 10, 0)},
+		{name: "window till midnight", spec: "01:00-24:00", at: windowTime(3, 23, 59), want: true},
+		{name: "overnight window before midnight", spec: "Fri 22:00-06:00", at: windowTime(7, 23, 0), want: true},
+		{name: "overnight window after midnight", spec: "Fri 22:00-06:00", at: windowTime(8, 5, 59), want: true},
+		{name: "overnight window at end", spec: "Fri 22:00-06:00", at: windowTime(8, 6, 0)},
+		{name: "overnight window before start", spec: "Fri 22:00-06:00", at: windowTime(7, 5, 0)},
+		{name: "overnight window on sunday of previous week", spec: "Sun 22:00-06:00", at: windowTime(3, 1, 0), want: true},
+		{name: "overnight window on next day", spec: "Fri 22:00-06:00", at: windowTime(8, 23, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseBackupWindow(tt.spec)
+			if err != nil {
+				t.Fatalf("parseBackupWindow(%q) failed : %s", tt.spec, err)
+			}
+			if got := w.isOpen(tt.at); got != tt.want {
+				t.Errorf("isOpen(%s) of %q = %v, want %v", tt.at, tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupWindowNextOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		at   time.Time
+		want time.Time
+	}{
+		{name: "later same day", spec: "22:00-06:00", at: windowTime(3, 12, 0), want: windowTime(3, 22, 0)},
+		{name: "at start", spec: "22:00-06:00", at: windowTime(3, 22, 0), want: windowTime(4, 22, 0)},
+		{name: "next week day", spec: "Mon-Fri 09:00-17:00", at: windowTime(7, 18, 0), want: windowTime(10, 9, 0)},
+		{name: "same day next week", spec: "Mon 09:00-17:00", at: windowTime(3, 9, 30), want: windowTime(10, 9, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseBackupWindow(tt.spec)
+			if err != nil {
+				t.Fatalf("parseBackupWindow(%q) failed : %s", tt.spec, err)
+			}
+			if got := w.nextOpen(tt.at); !got.Equal(tt.want) {
+				t.Errorf("nextOpen(%s) of %q = %s, want %s", tt.at, tt.spec, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,641 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// OverlapPolicyWait waits for the running backup of the volume to complete
+	OverlapPolicyWait = "wait"
+
+	// OverlapPolicySkip skips the backup of the volume if its previous backup is running
+	OverlapPolicySkip = "skip"
+
+	// defaultOverlapTimeout is default time limit to wait for the running backup of the volume
+	defaultOverlapTimeout = time.Hour
+)
+
+// getRunningBackups return the list of CStorBackup, for the given volume,
+// whose data transfer is not yet completed
+// CStorBackup whose velero backup is not in progress, e.g. left behind by a restart of
+// velero, is stale and not considered as running.
+func (p *Plugin) getRunningBackups(vol *Volume) ([]string, error) {
+	var running []string
+
+	listOpts := metav1.ListOptions{
+		LabelSelector: cVRPVLabel + "=" + vol.volname,
+	}
+
+	if vol.isCSIVolume {
+		bkpList, err := p.OpenEBSAPIsClient.CstorV1().
+			CStorBackups(vol.backupNamespace).
+			List(context.TODO(), listOpts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list backups of volume=%s", vol.volname)
+		}
+		for _, bkp := range bkpList.Items {
+			if !isBackupRunning(string(bkp.Status)) {
+				continue
+			}
+			active, err := p.isBackupActive(backupNameOfResource(bkp.Name, bkp.Spec.VolumeName), bkp.Name)
+			if err != nil {
+				return nil, err
+			}
+			if active {
+				running = append(running, bkp.Name)
+			}
+		}
+		return running, nil
+	}
+
+	bkpList, err := p.OpenEBSClient.OpenebsV1alpha1().
+		CStorBackups(vol.backupNamespace).
+		List(context.TODO(), listOpts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list backups of volume=%s", vol.volname)
+	}
+	for _, bkp := range bkpList.Items {
+		if !isBackupRunning(string(bkp.Status)) {
+			continue
+		}
+		active, err := p.isBackupActive(backupNameOf(bkp), bkp.Name)
+		if err != nil {
+			return nil, err
+		}
+		if active {
+			running = append(running, bkp.Name)
+		}
+	}
+	return running, nil
+}
+
+// isBackupActive returns true if the given velero backup, of the running CStorBackup
+// having given name, is in progress
+func (p *Plugin) isBackupActive(bkpName, name string) (bool, error) {
+	inProgress, err := velero.IsBackupInProgress(bkpName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to check backup=%s of backup resource=%s", bkpName, name)
+	}
+	if !inProgress {
+		p.Log.Debugf("Backup resource=%s is stale, backup=%s is not in progress", name, bkpName)
+	}
+	return inProgress, nil
+}
+
+// checkBackupOverlap ensures that the previous backup of the given volume is not running
+// - If overlap policy is 'skip' then it will return an error with running backup names
+// - If overlap policy is 'wait' then it will wait for the running backup to complete,
+//   till p.overlapTimeout
+func (p *Plugin) checkBackupOverlap(vol *Volume) error {
+	running, err := p.getRunningBackups(vol)
+	if err != nil {
+		return err
+	}
+
+	if len(running) == 0 {
+		return nil
+	}
+
+	if p.overlapPolicy == OverlapPolicySkip {
+		return errors.Errorf("skipping backup=%s of volume=%s, previous backup %v is still running",
+			vol.backupName, vol.volname, running)
+	}
+
+	p.Log.Infof("Backup %v of volume=%s is still running, waiting for it to complete", running, vol.volname)
+
+	err = wait.PollImmediate(p.backupStatusInterval, p.overlapTimeout, func() (bool, error) {
+		running, err = p.getRunningBackups(vol)
+		if err != nil {
+			return false, err
+		}
+		return len(running) == 0, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "previous backup %v of volume=%s didn't complete in %v",
+			running, vol.volname, p.overlapTimeout)
+	}
+	return nil
+}
+
+// backupTask describes the backup of a volume
+type backupTask struct {
+	vol *Volume
+
+	// port is used to receive the snapshot data from cStor pool
+	port int
+
+	// size is volume size in bytes
+	size int64
+
+	// filename is remote file name for snapshot data
+	filename string
+
+	// startTime is time at which backup was started
+	startTime time.Time
+
+	// ctx is canceled once backup is completed, canceled or timed out
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// bkp is CStorBackup created by backup request
+	bkp *v1alpha1.CStorBackup
+
+	// slot is backup slot held on the pool sending the backup
+	slot *poolSlot
+
+	// lease is the lease of volume held while backup is in progress
+	lease *volumeLease
+
+	// err is set if backup request failed
+	err error
+}
+
+// prepareBackup ensures that the previous backup of the volume is not running,
+// and creates the backup of PVC, if remote backup is configured
+func (p *Plugin) prepareBackup(vol *Volume) error {
+	vol.backupNamespace = vol.namespace
+	vol.claimState = ""
+	vol.labels = p.getBackupLabels(vol.backupName)
+
+	if p.backupTerminating {
+		state, err := p.getClaimState(vol)
+		if err != nil {
+			return err
+		}
+		vol.claimState = state
+
+		// backup resources can't be created in terminating namespace
+		if isNamespaceUnavailable(state) {
+			vol.backupNamespace = p.namespace
+		}
+
+		if state != "" {
+			p.Log.Warningf("Claim %s/%s of volume=%s is in state=%s, backup resources are created in namespace=%s",
+				vol.namespace, vol.pvcName, vol.volname, state, vol.backupNamespace)
+		}
+	}
+
+	clone, err := p.getCloneSource(vol)
+	if err != nil {
+		return err
+	}
+	vol.clone = clone
+
+	if clone != nil {
+		// full snapshot stream of the clone has all its data, so restored volume is independent of the source
+		p.Log.Infof("Volume=%s is provisioned from snapshot=%s of volume=%s, it is backed up as independent volume",
+			vol.volname, clone.Snapshot, clone.Volume)
+	}
+
+	// snapshot of unhealthy volume, or volume without quorum, may not have consistent data
+	if err := p.checkVolumeHealth(vol); err != nil {
+		return err
+	}
+
+	if p.local {
+		return nil
+	}
+
+	// ensure that previous backup of the volume is not transferring the data
+	if err := p.checkBackupOverlap(vol); err != nil {
+		return err
+	}
+
+	// abort the backup before starting the transfer if it doesn't fit in bucket quota
+	if err := p.checkBackupCapacity(vol); err != nil {
+		return err
+	}
+
+	// If cloud snapshot is configured then we need to backup PVC also
+	if err := p.backupPVC(vol.volname); err != nil {
+		return errors.Wrapf(err, "failed to create backup for PVC")
+	}
+	return nil
+}
+
+// newBackupTask returns the backup task for the given volume
+// Caller should execute task.cancel once backup is completed.
+func (p *Plugin) newBackupTask(vol *Volume, port int, startTime time.Time) (*backupTask, error) {
+	size, ok := vol.size.AsInt64()
+	if !ok {
+		return nil, errors.Errorf("Failed to parse volume size %v", vol.size)
+	}
+
+	t := &backupTask{
+		vol:       vol,
+		port:      port,
+		size:      size,
+		startTime: startTime,
+	}
+
+	if p.backupTimeout > 0 {
+		t.ctx, t.cancel = context.WithTimeout(context.Background(), p.backupTimeout)
+	} else {
+		t.ctx, t.cancel = context.WithCancel(context.Background())
+	}
+
+	if p.local {
+		return t, nil
+	}
+
+	vol.cl = p.cl.Clone(t.ctx)
+	// data server logs of the backup have the fields of volume
+	vol.cl.Log = p.volumeLog(vol, phaseUpload)
+	// chunks of deduplicated snapshot are shared by the backups of volume
+	vol.cl.SetDedupVolume(vol.volname)
+
+	t.filename = p.cl.GenerateRemoteFilename(vol.snapshotTag, vol.backupName)
+	if t.filename == "" {
+		t.cancel()
+		return nil, errors.Errorf("Error creating remote file name for backup")
+	}
+	return t, nil
+}
+
+// createBackups sends the backup request for the volumes of the given tasks concurrently,
+// so that snapshots of the volumes are taken together. Snapshot hooks of the applications
+// are executed before and after taking the snapshots.
+// It returns error if snapshot hooks fail, failure of backup request is set in the task.
+func (p *Plugin) createBackups(tasks []*backupTask) error {
+	var preHooks, postHooks []snapshotHook
+
+	for _, t := range tasks {
+		hooks, err := p.getSnapshotHooks(t.vol, PreSnapshotHookPrefix)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get pre-snapshot hooks")
+		}
+		preHooks = appendSnapshotHooks(preHooks, hooks)
+
+		hooks, err = p.getSnapshotHooks(t.vol, PostSnapshotHookPrefix)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get post-snapshot hooks")
+		}
+		postHooks = appendSnapshotHooks(postHooks, hooks)
+	}
+
+	// leases and slots are acquired before executing the hooks, so that application is not
+	// paused while waiting for them. These are released once backup is completed.
+	if err := p.acquireVolumeLeases(tasks[0].ctx, tasks); err != nil {
+		return err
+	}
+	if err := p.acquirePoolSlots(tasks[0].ctx, tasks); err != nil {
+		for _, t := range tasks {
+			p.releasePoolSlots(t)
+		}
+		return err
+	}
+
+	if err := p.runSnapshotHooks(preHooks, "pre-snapshot"); err != nil {
+		// pre-snapshot hook may have been executed for some of the pods, so resume the application
+		if herr := p.runSnapshotHooks(postHooks, "post-snapshot"); herr != nil {
+			p.Log.Errorf("Post-snapshot hook failed : %s", herr)
+		}
+		for _, t := range tasks {
+			p.releasePoolSlots(t)
+		}
+		return errors.Wrapf(err, "pre-snapshot hook failed")
+	}
+
+	if !p.local {
+		for _, t := range tasks {
+			// backup can still be performed, but can't be cleaned up if velero restarts
+			if err := p.saveBackupState(t); err != nil {
+				p.Log.Warningf("Failed to save state of backup=%s for volume=%s : %s", t.vol.backupName, t.vol.volname, err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range tasks {
+		wg.Add(1)
+		go func(t *backupTask) {
+			defer wg.Done()
+			t.bkp, t.err = p.createBackup(t.vol, t.port)
+		}(t)
+	}
+	wg.Wait()
+
+	// post-snapshot hooks are executed even if snapshot failed, to resume the application
+	// Failure of post-snapshot hook doesn't fail the backup since snapshot is already taken
+	if herr := p.runSnapshotHooks(postHooks, "post-snapshot"); herr != nil {
+		p.Log.Errorf("Post-snapshot hook failed : %s", herr)
+	}
+
+	for _, t := range tasks {
+		if t.err == nil {
+			continue
+		}
+
+		vol := t.vol
+		// backup resources may have been created before the failure
+		if derr := p.deleteBackup(vol.backupName, vol.volname, vol.backupNamespace,
+			p.getScheduleName(vol.backupName), vol.isCSIVolume); derr != nil {
+			p.volumeLog(vol, phaseCleanup).WithError(derr).Warn("Failed to clean-up backup")
+		}
+		t.err = errors.Wrapf(t.err, "Failed to create backup")
+		p.releasePoolSlots(t)
+
+		if !p.local {
+			p.deleteBackupState(vol.volname)
+		}
+	}
+	return nil
+}
+
+// completeBackup uploads the snapshot of the given task to cloud storage, if remote
+// backup is configured, and records the backup in volume's catalog
+func (p *Plugin) completeBackup(t *backupTask) error {
+	vol := t.vol
+
+	defer p.releasePoolSlots(t)
+
+	vol.transfer = nil
+	if p.local {
+		// local snapshot
+		p.catalogCompletedBackup(vol, t.startTime, "")
+		p.annotateBackupStatus(vol)
+		return nil
+	}
+
+	// backup is either completed or cleaned up by now
+	defer p.deleteBackupState(vol.volname)
+
+	go p.watchBackupCancel(t.ctx, t.cancel, vol)
+
+	// pools of the replicas on which the backup failed, backup is retried on other replica
+	failed := map[string]bool{}
+	uploadStart := time.Now()
+
+	var res backupResult
+	for {
+		result := make(chan backupResult, 1)
+		go p.checkBackupStatus(t.ctx, t.bkp, vol, len(failed) < p.backupReplicaRetries, result)
+
+		// data server is aborted by status check if the backup fails, so that partial
+		// snapshot isn't committed, and status check returns the result of the failure
+		if !vol.cl.Upload(t.filename, t.size, t.port) && !vol.cl.ServerAborted() {
+			// backup is aborted by status check once the context is canceled, wait for
+			// it so that backup resources are not updated after the failure is returned
+			t.cancel()
+			res = <-result
+			if res.retained {
+				p.cleanupRetainedBackup(t.bkp, vol)
+			}
+			if res.err != nil {
+				return errors.Wrapf(res.err, "failed to upload snapshot")
+			}
+			return errors.New("failed to upload snapshot")
+		}
+
+		// upload completes, or is aborted, once the backup status is final
+		res = <-result
+		if !res.retained {
+			break
+		}
+
+		pool := backupPool(t.bkp, vol.isCSIVolume)
+		failed[pool] = true
+		log := p.volumeLog(vol, phaseUpload).WithField("pool", pool)
+		if res.err != nil {
+			log = log.WithError(res.err)
+		}
+		log.Warnf("Backup failed on replica, status:{%v}, retrying on other replica", res.status)
+
+		if err := p.retryBackupOnReplica(t, failed); err != nil {
+			log.WithError(err).Error("Failed to retry backup on other replica")
+			p.cleanupRetainedBackup(t.bkp, vol)
+			// snapshot sent by the failed replica is incomplete
+			if !vol.cl.Delete(t.filename) {
+				log.Warnf("Failed to delete uncompleted snapshot=%s", t.filename)
+			}
+			break
+		}
+	}
+	vol.prevSnapName = res.prevSnapName
+
+	if res.err != nil {
+		return errors.Wrapf(res.err, "failed to upload snapshot")
+	}
+	if res.status != v1alpha1.BKPCStorStatusDone {
+		return errors.Errorf("Failed to upload snapshot, status:{%v}", res.status)
+	}
+
+	transferred, _ := vol.cl.Progress()
+	vol.transfer = newTransferStats(transferred, time.Since(uploadStart), len(failed))
+
+	verification, err := p.verifyBackup(vol, t.filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to verify backup")
+	}
+
+	manifest, err := p.uploadManifest(vol, t.filename, verification)
+	if err != nil {
+		return errors.Wrapf(err, "failed to upload manifest for backup")
+	}
+
+	if err := p.attestBackup(vol, t.filename, manifest); err != nil {
+		return errors.Wrapf(err, "failed to attest backup")
+	}
+	p.volumeLog(vol, phaseUpload).WithFields(logrus.Fields{
+		logFieldBytes:    transferred,
+		"throughput":     formatBytes(vol.transfer.Throughput) + "/s",
+		"replicaRetries": vol.transfer.ReplicaRetries,
+	}).Infof("Backup completed in %v, snapshot uploaded in %v", time.Since(t.startTime), vol.transfer.Duration.Duration)
+
+	p.catalogCompletedBackup(vol, t.startTime, t.filename)
+	p.recordTransferStats(vol)
+	p.annotateBackupStatus(vol)
+	p.applyRetention(vol)
+	return nil
+}
+
+// acquireBackupPorts waits for the given number of ports from the pool of backup ports
+func (p *Plugin) acquireBackupPorts(count int) []int {
+	ports := make([]int, count)
+
+	if p.local {
+		for i := range ports {
+			ports[i] = p.backupPort
+		}
+		return ports
+	}
+
+	// ports are acquired under lock so that concurrent requests, for multiple
+	// ports, don't wait for each other's ports
+	p.backupPorts.lock.Lock()
+	defer p.backupPorts.lock.Unlock()
+
+	for i := range ports {
+		ports[i] = <-p.backupPorts.ports
+	}
+	return ports
+}
+
+// releaseBackupPort returns the given port to the pool of backup ports
+func (p *Plugin) releaseBackupPort(port int) {
+	if !p.local {
+		p.backupPorts.ports <- port
+	}
+}
+
+// watchBackupCancel cancels the backup context if velero backup of the given
+// volume is deleted or canceled. It returns once ctx is done.
+func (p *Plugin) watchBackupCancel(ctx context.Context, cancel context.CancelFunc, vol *Volume) {
+	bkpName := vol.backupName
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.backupStatusInterval):
+		}
+
+		canceled, err := velero.IsBackupCanceled(bkpName)
+		if err != nil {
+			p.Log.Warnf("Failed to check if backup=%s is canceled : %s", bkpName, err)
+			continue
+		}
+
+		if canceled {
+			p.volumeLog(vol, phaseUpload).Info("Backup is canceled, aborting backup of volume")
+			cancel()
+			return
+		}
+	}
+}
+
+// abortBackup marks the given backup as failed and cleans up the backup resources.
+// Data transfer is aborted so that the partial snapshot isn't committed to cloud storage.
+func (p *Plugin) abortBackup(bkp *v1alpha1.CStorBackup, vol *Volume) {
+	failed := *bkp
+	failed.Status = v1alpha1.BKPCStorStatusFailed
+
+	vol.cl.AbortServer()
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": failed.Status,
+	})
+	if err == nil {
+		err = p.patchBackup(&failed, vol.isCSIVolume, patch)
+	}
+	if err != nil {
+		p.volumeLog(vol, phaseUpload).WithError(err).Warn("Failed to mark backup as failed")
+	}
+
+	if err = p.cleanupCompletedBackup(failed, vol.isCSIVolume); err != nil {
+		p.volumeLog(vol, phaseCleanup).WithError(err).Warn("Failed to execute clean-up request")
+	}
+}
+
+// isLocalSnapshotRetained returns true if the snapshot of the given backup is
+// retained in cStor pool and source volume exists in the cluster
+func (p *Plugin) isLocalSnapshotRetained(volumeID, snapName string) bool {
+	var status string
+
+	pv, err := p.getPV(volumeID)
+	if err != nil || pv.Spec.ClaimRef == nil {
+		p.Log.Debugf("Source volume=%s not found for local restore : %v", volumeID, err)
+		return false
+	}
+
+	name := snapName + "-" + volumeID
+	ns := p.findBackupNamespace(volumeID, p.getScheduleName(snapName), pv.Spec.ClaimRef.Namespace)
+
+	if isCSIPv(*pv) {
+		bkp, err := p.OpenEBSAPIsClient.CstorV1().CStorBackups(ns).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			p.Log.Debugf("Backup=%s/%s not found for local restore : %s", ns, name, err)
+			return false
+		}
+		// local restore clones the snapshot named as backup, snapshot taken
+		// through CSI VolumeSnapshot is named by CSI driver
+		if bkp.Spec.SnapName != snapName {
+			p.Log.Debugf("Snapshot of backup=%s/%s is taken through CSI, skipping local restore", ns, name)
+			return false
+		}
+		status = string(bkp.Status)
+	} else {
+		bkp, err := p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(ns).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			p.Log.Debugf("Backup=%s/%s not found for local restore : %s", ns, name, err)
+			return false
+		}
+		status = string(bkp.Status)
+	}
+
+	return status == string(v1alpha1.BKPCStorStatusDone)
+}
+
+// checkDependentBackups return an error if the given scheduled backup of the volume
+// is needed to restore the later incremental backups of the schedule.
+// Backups which are being deleted are not considered as dependent backups, so that
+// all the backups of a schedule can be deleted together. Deletion fails on this error
+// only if BlockDependentDeletion is set.
+func (p *Plugin) checkDependentBackups(volumeID, bkpName, scheduleName string) error {
+	var dependents []string
+
+	chain, err := p.getIncrementalChain(volumeID, scheduleName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get incremental backups of schedule=%s for volume=%s", scheduleName, volumeID)
+	}
+
+	// later backups of the chain depend on the given backup
+	for _, snap := range chain {
+		if !p.isBackupBefore(bkpName, snap) {
+			continue
+		}
+
+		deleted, err := velero.IsBackupCanceled(snap)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check dependent backup=%s", snap)
+		}
+		if !deleted {
+			dependents = append(dependents, snap)
+		}
+	}
+
+	if len(dependents) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("backup=%s of volume=%s is required to restore incremental backups %v of schedule=%s. "+
+		"Delete the dependent backups along with it (velero backup delete %s %s), "+
+		"or delete all the backups of the schedule together",
+		bkpName, volumeID, dependents, scheduleName, bkpName, strings.Join(dependents, " "))
+}
+
+// isBackupRunning returns true if backup status is not a terminal one
+func isBackupRunning(status string) bool {
+	switch v1alpha1.CStorBackupStatus(status) {
+	case v1alpha1.BKPCStorStatusDone, v1alpha1.BKPCStorStatusFailed, v1alpha1.BKPCStorStatusInvalid:
+		return false
+	}
+	return true
+}
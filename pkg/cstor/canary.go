@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// CanaryInterval config key for interval to check the canary object in storage-bucket
+	CanaryInterval = "canaryInterval"
+
+	// defaultCanaryInterval is default interval to check the canary object
+	defaultCanaryInterval = time.Hour
+
+	// CanaryHealthy represents that canary object is written and read successfully
+	CanaryHealthy = "Healthy"
+
+	// CanaryUnhealthy represents that canary object couldn't be written or read
+	CanaryUnhealthy = "Unhealthy"
+
+	// canaryStatusPrefix is prefix for the name of canary status configmap
+	canaryStatusPrefix = "velero-canary-"
+
+	// canaryStatusLabel is set on canary status configmap with bucket name as value
+	canaryStatusLabel = "openebs.io/velero-canary"
+
+	// canary status configmap data keys
+	canaryStatusKey      = "status"
+	canaryErrorKey       = "error"
+	canaryLastCheckKey   = "lastCheckTime"
+	canaryLastSuccessKey = "lastSuccessTime"
+)
+
+// runCanary checks the canary object in storage-bucket, and repeats the check
+// after every p.canaryInterval while the plugin is running
+func (p *Plugin) runCanary() {
+	for {
+		p.checkCanary()
+
+		if p.canaryInterval <= 0 {
+			return
+		}
+		time.Sleep(p.canaryInterval)
+	}
+}
+
+// checkCanary writes and reads the canary object in storage-bucket, and records
+// the result in canary status configmap
+func (p *Plugin) checkCanary() {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	status := map[string]string{
+		canaryStatusKey:    CanaryHealthy,
+		canaryErrorKey:     "",
+		canaryLastCheckKey: now,
+	}
+
+	if err := p.cl.CheckCanary(); err != nil {
+		p.Log.Errorf("Canary check failed for bucket=%s, backups may fail : %s", p.config[cloud.BUCKET], err)
+		status[canaryStatusKey] = CanaryUnhealthy
+		status[canaryErrorKey] = err.Error()
+	} else {
+		status[canaryLastSuccessKey] = now
+	}
+
+	if err := p.saveCanaryStatus(status); err != nil {
+		p.Log.Warningf("Failed to update canary status for bucket=%s : %s", p.config[cloud.BUCKET], err)
+	}
+}
+
+// saveCanaryStatus creates or updates the canary status configmap of the bucket
+func (p *Plugin) saveCanaryStatus(status map[string]string) error {
+	bucket := p.config[cloud.BUCKET]
+	name := canaryStatusPrefix + bucket
+
+	cm, err := p.K8sClient.CoreV1().ConfigMaps(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: p.namespace,
+				Labels: map[string]string{
+					canaryStatusLabel: bucket,
+				},
+			},
+			Data: status,
+		}
+		_, err = p.K8sClient.CoreV1().ConfigMaps(p.namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	for k, v := range status {
+		cm.Data[k] = v
+	}
+	_, err = p.K8sClient.CoreV1().ConfigMaps(p.namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
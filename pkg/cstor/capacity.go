@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// BucketQuota config key for the quota of storage-bucket, backup is aborted
+	// if estimated size of backup doesn't fit in the remaining quota
+	BucketQuota = "bucketQuota"
+)
+
+// checkBackupCapacity estimates the size of backup of the given volume using the used size
+// of the volume, and ensures that it fits in the remaining bucket quota, if configured.
+// Incremental backups transfer only the modified data, so for such backups it is only
+// ensured that the bucket quota is not exhausted.
+func (p *Plugin) checkBackupCapacity(vol *Volume) error {
+	used, err := p.getVolumeUsedSize(vol)
+	if err != nil {
+		p.Log.Warningf("Failed to estimate size of backup=%s for volume=%s : %s", vol.backupName, vol.volname, err)
+	} else {
+		p.Log.Infof("Estimated size of backup=%s for volume=%s is %s", vol.backupName, vol.volname, formatBytes(used))
+	}
+	vol.usedSize = used
+
+	if p.bucketQuota == 0 {
+		return nil
+	}
+
+	incremental, err := p.isIncrementalBackup(vol)
+	if err != nil {
+		p.Log.Warningf("Failed to check if backup=%s of volume=%s is incremental : %s", vol.backupName, vol.volname, err)
+	}
+
+	required := used
+	if incremental {
+		required = 0
+	}
+
+	usage, err := p.cl.BucketUsage()
+	if err != nil {
+		p.Log.Warningf("Failed to get usage of bucket=%s, skipping quota check : %s", p.config[cloud.BUCKET], err)
+		return nil
+	}
+
+	if usage+required > p.bucketQuota || usage >= p.bucketQuota {
+		return errors.Errorf("insufficient space in bucket=%s for backup=%s of volume=%s, "+
+			"estimated size=%s bucket usage=%s quota=%s",
+			p.config[cloud.BUCKET], vol.backupName, vol.volname,
+			formatBytes(required), formatBytes(usage), formatBytes(p.bucketQuota))
+	}
+	return nil
+}
+
+// isIncrementalBackup return true if the given volume has remote backups of the same schedule,
+// since cStor takes incremental snapshot from the last completed backup of the schedule
+func (p *Plugin) isIncrementalBackup(vol *Volume) (bool, error) {
+	scheduleName := p.getScheduleName(vol.backupName)
+	if scheduleName == vol.backupName {
+		return false, nil
+	}
+
+	chain, err := p.getIncrementalChain(vol.snapshotTag, scheduleName)
+	if err != nil {
+		return false, err
+	}
+
+	for _, snap := range chain {
+		if snap != vol.backupName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getVolumeUsedSize return the used size of the given volume, maximum of the used size
+// reported by its replicas
+func (p *Plugin) getVolumeUsedSize(vol *Volume) (int64, error) {
+	var (
+		sizes []string
+		used  int64
+	)
+
+	listOpts := metav1.ListOptions{
+		LabelSelector: cVRPVLabel + "=" + vol.volname,
+	}
+
+	if vol.isCSIVolume {
+		cvrList, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to fetch CVR for volume=%s", vol.volname)
+		}
+		for _, cvr := range cvrList.Items {
+			sizes = append(sizes, cvr.Status.Capacity.Used)
+		}
+	} else {
+		cvrList, err := p.OpenEBSClient.OpenebsV1alpha1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to fetch CVR for volume=%s", vol.volname)
+		}
+		for _, cvr := range cvrList.Items {
+			sizes = append(sizes, cvr.Status.Capacity.Used)
+		}
+	}
+
+	if len(sizes) == 0 {
+		return 0, errors.Errorf("CVR not found for volume=%s", vol.volname)
+	}
+
+	for _, s := range sizes {
+		size, err := parseZFSSize(s)
+		if err != nil {
+			p.Log.Debugf("Failed to parse used size=%q of volume=%s : %s", s, vol.volname, err)
+			continue
+		}
+		if size > used {
+			used = size
+		}
+	}
+	return used, nil
+}
+
+// parseZFSSize parses the size reported by cStor replica, in zfs human readable format
+// like "6.05M" or "1.50G", having binary prefixed units
+func parseZFSSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+
+	mult := float64(1)
+	if idx := strings.IndexByte("BKMGTPE", s[len(s)-1]); idx >= 0 {
+		for i := 0; i < idx; i++ {
+			mult *= 1024
+		}
+		s = s[:len(s)-1]
+	}
+
+	val, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(val * mult), nil
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// catalogPrefix is prefix for the name of volume's backup catalog configmap
+	catalogPrefix = "velero-catalog-"
+
+	// catalogLabel is set on backup catalog configmap with volume name as value
+	catalogLabel = "openebs.io/velero-catalog"
+
+	// catalogDataKey is the configmap data key having list of catalog entries
+	catalogDataKey = "backups"
+
+	// MaxCatalogEntries defines number of backup entries retained in volume's catalog
+	MaxCatalogEntries = 30
+
+	// scheduleTimestampFormat is format of timestamp suffix in scheduled backup name
+	scheduleTimestampFormat = "20060102150405"
+)
+
+// catalogEntry describes a successful backup of a volume in its catalog
+type catalogEntry struct {
+	// Name is velero backup name
+	Name string `json:"name"`
+
+	// Schedule is schedule name for scheduled backup, or backup name for non-scheduled backup
+	Schedule string `json:"schedule"`
+
+	// StartTime is time at which backup was started by plugin
+	StartTime metav1.Time `json:"startTime"`
+
+	// Duration is time taken to complete the backup
+	Duration metav1.Duration `json:"duration"`
+
+	// Timestamp is time at which backup is completed
+	Timestamp metav1.Time `json:"timestamp"`
+
+	// Size is number of bytes of snapshot data uploaded, it is 0 for local snapshot
+	Size int64 `json:"size"`
+
+	// Type is full or incremental
+	Type string `json:"type"`
+
+	// Location is location of snapshot data, as provider://bucket/file, or local for local snapshot
+	Location string `json:"location"`
+}
+
+// catalogName return the name of catalog configmap for the given volume
+func catalogName(volname string) string {
+	return catalogPrefix + volname
+}
+
+// catalogCompletedBackup adds the completed backup of given volume, started at given time and uploaded
+// to given remote file, to its catalog and check if schedule interval is aligned with the observed
+// backup duration. Failure in updating the catalog doesn't fail the backup.
+func (p *Plugin) catalogCompletedBackup(vol *Volume, startTime time.Time, filename string) {
+	e := catalogEntry{
+		Name:      vol.backupName,
+		Schedule:  p.getScheduleName(vol.backupName),
+		StartTime: metav1.NewTime(startTime),
+		Duration:  metav1.Duration{Duration: time.Since(startTime)},
+		Timestamp: metav1.Now(),
+		Type:      backupTypeFull,
+		Location:  localLocation,
+	}
+	if vol.prevSnapName != "" {
+		e.Type = backupTypeIncremental
+	}
+	if !p.local {
+		e.Size, _ = vol.cl.Progress()
+		e.Location = vol.cl.Location(filename)
+	}
+
+	entries, err := p.updateCatalog(vol.volname, func(entries []catalogEntry) []catalogEntry {
+		for i := range entries {
+			if entries[i].Name == e.Name {
+				entries[i] = e
+				return entries
+			}
+		}
+		return append(entries, e)
+	})
+	if err != nil {
+		p.volumeLog(vol, phaseUpload).WithError(err).Warn("Failed to update backup catalog")
+		return
+	}
+
+	if e.Schedule != vol.backupName {
+		p.checkScheduleAlignment(vol.volname, e.Schedule, entries)
+	}
+}
+
+// uncatalogBackup removes the deleted backup of given volume from its catalog
+func (p *Plugin) uncatalogBackup(volname, backup string) {
+	_, err := p.updateCatalog(volname, func(entries []catalogEntry) []catalogEntry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.Name != backup {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		p.Log.Warnf("Failed to remove backup=%s from catalog of volume=%s : %s", backup, volname, err)
+	}
+}
+
+// updateCatalog updates the entries of the catalog of given volume, and return the updated
+// entries sorted by completion timestamp. Catalog is stored in VolumeBackupCatalog if the
+// resource is served by the cluster, otherwise in configmap of the volume.
+func (p *Plugin) updateCatalog(volname string, update func([]catalogEntry) []catalogEntry) ([]catalogEntry, error) {
+	var result []catalogEntry
+
+	sorted := func(entries []catalogEntry) []catalogEntry {
+		entries = update(entries)
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Timestamp.Before(&entries[j].Timestamp)
+		})
+		result = entries
+		return entries
+	}
+
+	if p.isBackupCatalogServed() {
+		return result, p.updateBackupCatalog(volname, sorted)
+	}
+
+	cm, entries, err := p.getCatalog(volname)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = sorted(entries)
+	if cm == nil && len(entries) == 0 {
+		return entries, nil
+	}
+	return entries, p.saveCatalog(cm, volname, entries)
+}
+
+// getCatalog return the catalog configmap and its entries for the given volume
+// If catalog doesn't exist then it will return nil configmap without error
+func (p *Plugin) getCatalog(volname string) (*v1.ConfigMap, []catalogEntry, error) {
+	var entries []catalogEntry
+
+	cm, err := p.K8sClient.
+		CoreV1().
+		ConfigMaps(p.namespace).
+		Get(context.TODO(), catalogName(volname), metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, entries, nil
+		}
+		return nil, entries, errors.Wrapf(err, "failed to fetch catalog for volume=%s", volname)
+	}
+
+	if data, ok := cm.Data[catalogDataKey]; ok && data != "" {
+		if err := json.Unmarshal([]byte(data), &entries); err != nil {
+			return cm, entries, errors.Wrapf(err, "failed to decode catalog for volume=%s", volname)
+		}
+	}
+	return cm, entries, nil
+}
+
+// saveCatalog creates or updates the catalog configmap for the given volume
+func (p *Plugin) saveCatalog(cm *v1.ConfigMap, volname string, entries []catalogEntry) error {
+	if len(entries) > MaxCatalogEntries {
+		entries = entries[len(entries)-MaxCatalogEntries:]
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode catalog for volume=%s", volname)
+	}
+
+	if cm == nil {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      catalogName(volname),
+				Namespace: p.namespace,
+				Labels: map[string]string{
+					catalogLabel: volname,
+				},
+			},
+			Data: map[string]string{
+				catalogDataKey: string(data),
+			},
+		}
+		_, err = p.K8sClient.CoreV1().ConfigMaps(p.namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[catalogDataKey] = string(data)
+	_, err = p.K8sClient.CoreV1().ConfigMaps(p.namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	return err
+}
+
+// checkScheduleAlignment logs a warning if the interval of given schedule is shorter than
+// the p95 duration of the backups taken for the volume by that schedule.
+// Since velero doesn't pass the schedule spec to plugin, interval is derived from
+// the timestamps of scheduled backup names.
+func (p *Plugin) checkScheduleAlignment(volname, scheduleName string, entries []catalogEntry) {
+	var (
+		durations  []time.Duration
+		timestamps []time.Time
+	)
+
+	for _, e := range entries {
+		// duration is not recorded for the backups cataloged by older version of plugin
+		if e.Schedule != scheduleName || e.Duration.Duration == 0 {
+			continue
+		}
+		durations = append(durations, e.Duration.Duration)
+
+		if ts, ok := p.getBackupTimestamp(e.Name); ok {
+			timestamps = append(timestamps, ts)
+		}
+	}
+
+	interval := minInterval(timestamps)
+	if interval == 0 {
+		// we need atleast two backups to find out schedule interval
+		return
+	}
+
+	p95 := percentile(durations, 95)
+	if interval < p95 {
+		p.Log.Warningf("Schedule=%s interval=%v is shorter than p95 backup duration=%v for volume=%s, "+
+			"backups may overlap. Consider increasing the schedule interval to at least %v",
+			scheduleName, interval, p95, volname, p95.Round(time.Minute)+time.Minute)
+	}
+}
+
+// getBackupTimestamp parse the timestamp from scheduled backup name, as per the backup name template
+func (p *Plugin) getBackupTimestamp(backupName string) (time.Time, bool) {
+	_, ts, ok := p.nameTemplate().parse(backupName)
+	return ts, ok
+}
+
+// minInterval return the minimum non-zero gap between the given timestamps
+func minInterval(timestamps []time.Time) time.Duration {
+	var interval time.Duration
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i].Before(timestamps[j]) })
+
+	for i := 1; i < len(timestamps); i++ {
+		gap := timestamps[i].Sub(timestamps[i-1])
+		if gap > 0 && (interval == 0 || gap < interval) {
+			interval = gap
+		}
+	}
+	return interval
+}
+
+// percentile return the nearest-rank percentile of the given durations
+func percentile(durations []time.Duration, pct float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(pct / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
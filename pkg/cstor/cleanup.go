@@ -0,0 +1,232 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"time"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// defaultStaleBackupTTL is default age after which failed or interrupted backup resources are deleted,
+	// clean-up is disabled by default since it deletes the snapshots of the backups
+	defaultStaleBackupTTL = 0
+)
+
+// backupRecord describes CStorBackup or CStorCompletedBackup resource
+// of cstor v1 or v1alpha1 API
+type backupRecord struct {
+	name        string
+	namespace   string
+	backupName  string
+	volumeName  string
+	snapName    string
+	status      string
+	created     time.Time
+	isCSIVolume bool
+}
+
+// key return the identifier of the schedule/backup and volume for the record
+func (r backupRecord) key() string {
+	return r.namespace + "/" + r.backupName + "/" + r.volumeName
+}
+
+// veleroBackupName return the velero backup name of the CStorBackup record
+func (r backupRecord) veleroBackupName() string {
+	return backupNameOfResource(r.name, r.volumeName)
+}
+
+// isBackupInUse returns true if the given CStorBackup record may still be transferring data,
+// i.e. its velero backup is in progress or lease of its volume is held by a plugin instance.
+// Backup is considered in use if it can't be checked.
+func (p *Plugin) isBackupInUse(r backupRecord) bool {
+	inProgress, err := velero.IsBackupInProgress(r.veleroBackupName())
+	if err != nil {
+		p.Log.Warnf("Failed to check backup=%s of backup resource=%s/%s, skipping its clean-up : %s",
+			r.veleroBackupName(), r.namespace, r.name, err)
+		return true
+	}
+	if inProgress {
+		return true
+	}
+
+	lease, err := p.K8sClient.CoordinationV1().Leases(p.namespace).
+		Get(context.TODO(), volumeLeasePrefix+r.volumeName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return false
+		}
+		p.Log.Warnf("Failed to check lease of volume=%s, skipping clean-up of backup resource=%s/%s : %s",
+			r.volumeName, r.namespace, r.name, err)
+		return true
+	}
+	return isLeaseValid(lease)
+}
+
+// listBackups return the CStorBackups of all the namespaces
+func (p *Plugin) listBackups() []backupRecord {
+	var records []backupRecord
+
+	alphaList, err := p.OpenEBSClient.OpenebsV1alpha1().
+		CStorBackups(metav1.NamespaceAll).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		p.Log.Debugf("Failed to list v1alpha1 backups : %s", err)
+	} else {
+		for _, bkp := range alphaList.Items {
+			records = append(records, backupRecord{
+				name:       bkp.Name,
+				namespace:  bkp.Namespace,
+				backupName: bkp.Spec.BackupName,
+				volumeName: bkp.Spec.VolumeName,
+				snapName:   bkp.Spec.SnapName,
+				status:     string(bkp.Status),
+				created:    bkp.CreationTimestamp.Time,
+			})
+		}
+	}
+
+	v1List, err := p.OpenEBSAPIsClient.CstorV1().
+		CStorBackups(metav1.NamespaceAll).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		p.Log.Debugf("Failed to list v1 backups : %s", err)
+	} else {
+		for _, bkp := range v1List.Items {
+			records = append(records, backupRecord{
+				name:        bkp.Name,
+				namespace:   bkp.Namespace,
+				backupName:  bkp.Spec.BackupName,
+				volumeName:  bkp.Spec.VolumeName,
+				// snapshot taken through CSI VolumeSnapshot is deleted using the backup name
+				snapName:    backupNameOfResource(bkp.Name, bkp.Spec.VolumeName),
+				status:      string(bkp.Status),
+				created:     bkp.CreationTimestamp.Time,
+				isCSIVolume: true,
+			})
+		}
+	}
+	return records
+}
+
+// listCompletedBackups return the CStorCompletedBackups of all the namespaces
+func (p *Plugin) listCompletedBackups() []backupRecord {
+	var records []backupRecord
+
+	alphaList, err := p.OpenEBSClient.OpenebsV1alpha1().
+		CStorCompletedBackups(metav1.NamespaceAll).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		p.Log.Debugf("Failed to list v1alpha1 completed backups : %s", err)
+	} else {
+		for _, bkp := range alphaList.Items {
+			records = append(records, backupRecord{
+				name:       bkp.Name,
+				namespace:  bkp.Namespace,
+				backupName: bkp.Spec.BackupName,
+				volumeName: bkp.Spec.VolumeName,
+				created:    bkp.CreationTimestamp.Time,
+			})
+		}
+	}
+
+	v1List, err := p.OpenEBSAPIsClient.CstorV1().
+		CStorCompletedBackups(metav1.NamespaceAll).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		p.Log.Debugf("Failed to list v1 completed backups : %s", err)
+	} else {
+		for _, bkp := range v1List.Items {
+			records = append(records, backupRecord{
+				name:        bkp.Name,
+				namespace:   bkp.Namespace,
+				backupName:  bkp.Spec.BackupName,
+				volumeName:  bkp.Spec.VolumeName,
+				created:     bkp.CreationTimestamp.Time,
+				isCSIVolume: true,
+			})
+		}
+	}
+	return records
+}
+
+// cleanupStaleBackups deletes the backup resources which are older than p.staleBackupTTL and
+//	- CStorBackup is failed, or is not completed yet (interrupted backup)
+//	- CStorCompletedBackup doesn't have any CStorBackup for its schedule and volume
+// CStorBackup whose velero backup is in progress, or whose volume lease is held by other
+// velero replica or shard, is not deleted.
+func (p *Plugin) cleanupStaleBackups() {
+	if p.staleBackupTTL == 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-p.staleBackupTTL)
+	active := map[string]bool{}
+
+	for _, bkp := range p.listBackups() {
+		if bkp.created.After(cutoff) || bkp.status == string(v1alpha1.BKPCStorStatusDone) || p.isBackupInUse(bkp) {
+			active[bkp.key()] = true
+			continue
+		}
+
+		p.Log.Infof("Deleting stale backup=%s/%s status=%s created=%v", bkp.namespace, bkp.name, bkp.status, bkp.created)
+
+		// delete request removes the snapshot along with the backup resource
+		err := p.deleteBackup(bkp.snapName, bkp.volumeName, bkp.namespace, bkp.backupName, bkp.isCSIVolume)
+		if err == nil {
+			continue
+		}
+
+		p.Log.Warnf("Failed to execute clean-up request for stale backup=%s/%s, deleting resource : %s",
+			bkp.namespace, bkp.name, err)
+		if err = p.deleteBackupResource(bkp, false); err != nil {
+			p.Log.Warnf("Failed to delete stale backup=%s/%s : %s", bkp.namespace, bkp.name, err)
+		}
+	}
+
+	for _, cbkp := range p.listCompletedBackups() {
+		if cbkp.created.After(cutoff) || active[cbkp.key()] {
+			continue
+		}
+
+		p.Log.Infof("Deleting stale completed backup=%s/%s created=%v", cbkp.namespace, cbkp.name, cbkp.created)
+		if err := p.deleteBackupResource(cbkp, true); err != nil {
+			p.Log.Warnf("Failed to delete stale completed backup=%s/%s : %s", cbkp.namespace, cbkp.name, err)
+		}
+	}
+}
+
+// deleteBackupResource deletes the CStorBackup, or CStorCompletedBackup if completed is set, for the given record
+func (p *Plugin) deleteBackupResource(r backupRecord, completed bool) error {
+	opts := metav1.DeleteOptions{}
+
+	switch {
+	case r.isCSIVolume && completed:
+		return p.OpenEBSAPIsClient.CstorV1().CStorCompletedBackups(r.namespace).Delete(context.TODO(), r.name, opts)
+	case r.isCSIVolume:
+		return p.OpenEBSAPIsClient.CstorV1().CStorBackups(r.namespace).Delete(context.TODO(), r.name, opts)
+	case completed:
+		return p.OpenEBSClient.OpenebsV1alpha1().CStorCompletedBackups(r.namespace).Delete(context.TODO(), r.name, opts)
+	default:
+		return p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(r.namespace).Delete(context.TODO(), r.name, opts)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"strings"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cloneSource is the snapshot from which a cStor volume is provisioned
+type cloneSource struct {
+	// Volume is name of the source volume
+	Volume string `json:"volume"`
+
+	// Snapshot is name of the snapshot of source volume
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// getCloneSource return the source snapshot of given volume, it return nil if the volume
+// is not provisioned from a snapshot. Source of CSI volume is set in its CStorVolumeConfig,
+// and of non CSI volume in the labels and annotations of its CStorVolume.
+func (p *Plugin) getCloneSource(vol *Volume) (*cloneSource, error) {
+	if vol.isCSIVolume {
+		cvc, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumeConfigs(p.namespace).Get(context.TODO(), vol.volname, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch cstorVolumeConfig=%s", vol.volname)
+		}
+		if cvc.Spec.CStorVolumeSource == "" {
+			return nil, nil
+		}
+
+		// source is set as volume@snapshot
+		parts := strings.SplitN(cvc.Spec.CStorVolumeSource, "@", 2)
+		src := &cloneSource{Volume: parts[0]}
+		if len(parts) == 2 {
+			src.Snapshot = parts[1]
+		}
+		return src, nil
+	}
+
+	cv, err := p.OpenEBSClient.OpenebsV1alpha1().CStorVolumes(p.namespace).Get(context.TODO(), vol.volname, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch cstorVolume=%s", vol.volname)
+	}
+
+	srcVol := cv.Labels[string(v1alpha1.SourceVolumeKey)]
+	if srcVol == "" {
+		return nil, nil
+	}
+	return &cloneSource{
+		Volume:   srcVol,
+		Snapshot: cv.Annotations[string(v1alpha1.SnapshotNameKey)],
+	}, nil
+}
+
+// setCloneClaimSpec updates the given PVC, of the clone volume, to be restored as an
+// independent volume. Data source is cleared, and storageClass of non CSI clone, which
+// is the snapshot promoter, is replaced by the storageClass of the source volume.
+func (p *Plugin) setCloneClaimSpec(pvc *v1.PersistentVolumeClaim, vol *Volume) {
+	pvc.Spec.DataSource = nil
+
+	if vol.isCSIVolume {
+		return
+	}
+
+	srcPV, err := p.getPV(vol.clone.Volume)
+	if err != nil {
+		p.Log.Warnf("Failed to get source volume=%s of clone volume=%s, storageClass=%s is retained : %s",
+			vol.clone.Volume, vol.volname, *pvc.Spec.StorageClassName, err)
+		return
+	}
+
+	if sc := srcPV.Spec.StorageClassName; sc != "" && sc != *pvc.Spec.StorageClassName {
+		p.Log.Infof("Recording storageClass=%s of source volume=%s for clone volume=%s", sc, srcPV.Name, vol.volname)
+		pvc.Spec.StorageClassName = &sc
+	}
+}
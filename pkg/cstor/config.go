@@ -0,0 +1,231 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// StrictConfig config key to fail the initialization if config has unknown keys
+const StrictConfig = "strictConfig"
+
+// configKeys are the config keys supported by the plugin, including the keys of cloud connection
+var configKeys = []string{
+	NAMESPACE, NamespaceCacheTTL, StrictConfig, LocalSnapshot, RestoreAllIncrementalSnapshots, AutoSetTargetIP,
+	RestorePort, BackupPort, NetworkInterface, NetworkCIDR, UsePodIP, IPFamily,
+	RestTimeOut, RestRetries, RestRetryBackoff, RestMaxIdleConns, RestIdleConnTimeout, RestTLSHandshakeTimeout,
+	RestCaCert, RestInsecureSkipTLSVerify, BackupOverlapPolicy, BackupOverlapTimeout, RetainLocalSnapshot,
+	BackupStatusInterval, BackupTimeout, BackupStallTimeout, BackupReplicaRetries, StaleBackupTTL, VerifyBackup, ExistingVolumePolicy,
+	BackupTerminatingVolumes, BlockDependentDeletion, Parallel, AttestationSecret, AttestationLogURL, CanaryInterval,
+	BucketQuota, SnapshotMode, VolumeSnapshotClass, CSISnapshotTimeout, LogLevel,
+	RestorePoolCluster, PoolBackupLimit, RestoreReplicaCount, RestoreSize, RestoreDryRun,
+	RetentionCount, RetentionPeriod, FullBackupInterval, ShardGroup, ShardID, ShardLeaseDuration, ShardClaimDuration, RestoreStorageClass,
+	VolumeLabelSelector, BackupWindow, BackupWindowTimezone, BackupWindowPolicy, BackupNameTemplate, VolumeHealthPolicy,
+	RestoreZoneMapping, ZonePoolCluster, HealthAddress, VolumeStatusAnnotations,
+	cloud.PROVIDER, cloud.BUCKET, cloud.PREFIX, cloud.BackupPathPrefix, cloud.REGION,
+	cloud.AWSUrl, cloud.AWSForcePath, cloud.AWSSsl, cloud.AWSCaCert, cloud.AWSInSecureSkipTLSVerify,
+	cloud.MultiPartChunkSize, cloud.SocketReadBufferSize, cloud.SocketWriteBufferSize,
+	cloud.ReadAheadSize, cloud.WriteBufferSize, cloud.BindAddress, cloud.ServerShutdownTimeout, cloud.ConnectionPoolSize,
+	cloud.IdleConnectionTimeout, cloud.KeepAlivePeriod, cloud.ChecksumAlgorithm, cloud.ComplianceMode,
+	cloud.Dedup, cloud.DedupChunkSize, cloud.UploadConcurrency, cloud.UploadBufferLimit,
+	cloud.DownloadStreams, cloud.DownloadPartSize, cloud.DataKeepAlivePeriod, cloud.DataWriteTimeout,
+	cloud.DataIdleTimeout, cloud.StagingPath, cloud.CredentialsFile, cloud.S3Profile,
+	cloud.ListRateLimit, cloud.ListPageSize, cloud.ObjectSegmentSize,
+}
+
+// durationConfigKeys are the config keys having duration value
+var durationConfigKeys = []string{
+	RestTimeOut, RestRetryBackoff, RestIdleConnTimeout, RestTLSHandshakeTimeout, BackupOverlapTimeout, BackupStatusInterval, BackupTimeout,
+	BackupStallTimeout, StaleBackupTTL, CanaryInterval, CSISnapshotTimeout, RetentionPeriod, ShardLeaseDuration, ShardClaimDuration, NamespaceCacheTTL,
+	cloud.ServerShutdownTimeout, cloud.IdleConnectionTimeout, cloud.KeepAlivePeriod,
+	cloud.DataKeepAlivePeriod, cloud.DataWriteTimeout, cloud.DataIdleTimeout,
+}
+
+// boolConfigKeys are the config keys having boolean value
+var boolConfigKeys = []string{
+	StrictConfig, LocalSnapshot, RestoreAllIncrementalSnapshots, AutoSetTargetIP, UsePodIP, RetainLocalSnapshot, RestInsecureSkipTLSVerify,
+	BackupTerminatingVolumes, BlockDependentDeletion, RestoreDryRun, VolumeStatusAnnotations, cloud.Dedup,
+}
+
+// validateConfig validates the given config of volumesnapshotlocation, and returns
+// an error listing all the problems found in the config. Unknown keys are returned as
+// warnings, these are reported as problems only if StrictConfig is set.
+func validateConfig(config map[string]string) (warnings []string, err error) {
+	var problems []string
+
+	known := map[string]bool{}
+	for _, key := range configKeys {
+		known[key] = true
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if known[key] {
+			continue
+		}
+		if s := suggestConfigKey(key); s != "" {
+			warnings = append(warnings, fmt.Sprintf("unknown key %q, did you mean %q?", key, s))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("unknown key %q", key))
+		}
+	}
+
+	if isTrue(config[StrictConfig]) {
+		problems, warnings = append(problems, warnings...), nil
+	}
+
+	// cloud connection is not used for local snapshot
+	if !isTrue(config[LocalSnapshot]) {
+		switch provider, ok := config[cloud.PROVIDER]; {
+		case !ok || provider == "":
+			problems = append(problems, fmt.Sprintf("%q is required for remote backup, expected %s, %s or %s",
+				cloud.PROVIDER, cloud.AWS, cloud.GCP, cloud.Memory))
+		case provider != cloud.AWS && provider != cloud.GCP && provider != cloud.Memory:
+			problems = append(problems, fmt.Sprintf("invalid %s=%s, expected %s, %s or %s",
+				cloud.PROVIDER, provider, cloud.AWS, cloud.GCP, cloud.Memory))
+		}
+
+		if config[cloud.BUCKET] == "" {
+			problems = append(problems, fmt.Sprintf("%q is required for remote backup", cloud.BUCKET))
+		}
+	}
+
+	for _, key := range []string{cloud.PREFIX, cloud.BackupPathPrefix} {
+		if val := config[key]; strings.HasPrefix(val, "/") || strings.HasSuffix(val, "/") {
+			problems = append(problems, fmt.Sprintf("invalid %s=%s, it should not start or end with '/'", key, val))
+		}
+	}
+
+	if ns, ok := config[NAMESPACE]; ok {
+		if errs := validation.IsDNS1123Label(ns); len(errs) != 0 {
+			problems = append(problems, fmt.Sprintf("invalid %s=%s, %s", NAMESPACE, ns, strings.Join(errs, ", ")))
+		}
+	}
+
+	for _, key := range []string{RestorePort, BackupPort} {
+		if val, ok := config[key]; ok {
+			if port, err := strconv.Atoi(val); err != nil || port < 1 || port > math.MaxUint16 {
+				problems = append(problems, fmt.Sprintf("invalid %s=%s, expected port from 1 to %d", key, val, math.MaxUint16))
+			}
+		}
+	}
+
+	if addr, ok := config[HealthAddress]; ok {
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			problems = append(problems, fmt.Sprintf("invalid %s=%s, expected address like :8085", HealthAddress, addr))
+		}
+	}
+
+	if _, err := parseVolumeSelector(config); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid %s=%s, %s", VolumeLabelSelector, config[VolumeLabelSelector], errors.Cause(err)))
+	}
+
+	for _, key := range durationConfigKeys {
+		if val, ok := config[key]; ok {
+			if _, err := time.ParseDuration(val); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid %s=%s, expected duration like 30s, 5m or 1h", key, val))
+			}
+		}
+	}
+
+	for _, key := range boolConfigKeys {
+		if val, ok := config[key]; ok && !isBool(val) {
+			problems = append(problems, fmt.Sprintf("invalid %s=%s, expected \"true\" or \"false\"", key, val))
+		}
+	}
+
+	if len(problems) == 0 {
+		return warnings, nil
+	}
+	return warnings, errors.Errorf("invalid volumesnapshotlocation config, %d problem(s) found: %s",
+		len(problems), strings.Join(problems, "; "))
+}
+
+// isBool returns true if given value is accepted as boolean config, refer isTrue
+func isBool(val string) bool {
+	switch strings.ToLower(val) {
+	case trueStr, "yes", "1", "false", "no", "0":
+		return true
+	}
+	return false
+}
+
+// suggestConfigKey return the supported config key which is closest to given unknown key,
+// it return empty string if none of the key is close enough
+func suggestConfigKey(key string) string {
+	var (
+		best     string
+		bestDist = 3
+	)
+
+	for _, k := range configKeys {
+		if strings.EqualFold(k, key) {
+			return k
+		}
+		if d := editDistance(strings.ToLower(k), strings.ToLower(key)); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance return the levenshtein distance between given strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,564 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	uuid "github.com/gofrs/uuid"
+	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
+	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	snapclient "github.com/openebs/maya/pkg/client/snapshot/cstor/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// backupNameLabel is set on CStorBackup with the backup/schedule name
+	backupNameLabel = "openebs.io/backup"
+
+	// restoreNameLabel is set on CStorRestore with the restore name
+	restoreNameLabel = "openebs.io/restore"
+)
+
+// getTargetIP return the IP of the target service of given volume
+func (p *Plugin) getTargetIP(volname string, isCSIVolume bool) (string, error) {
+	var ip string
+
+	if isCSIVolume {
+		cv, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumes(p.namespace).Get(context.TODO(), volname, metav1.GetOptions{})
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to fetch cstorVolume=%s", volname)
+		}
+		ip = cv.Spec.TargetIP
+	} else {
+		cv, err := p.OpenEBSClient.OpenebsV1alpha1().CStorVolumes(p.namespace).Get(context.TODO(), volname, metav1.GetOptions{})
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to fetch cstorVolume=%s", volname)
+		}
+		ip = cv.Spec.TargetIP
+	}
+
+	if ip == "" {
+		return "", errors.Errorf("cstorVolume=%s doesn't have target IP", volname)
+	}
+	return ip, nil
+}
+
+// createSnapshot creates the snapshot of given volume through the target of volume
+func (p *Plugin) createSnapshot(volname, snapName string, isCSIVolume bool) error {
+	ip, err := p.getTargetIP(volname, isCSIVolume)
+	if err != nil {
+		return err
+	}
+
+	p.Log.Infof("Creating snapshot=%s of volume=%s", snapName, volname)
+	if _, err = snapclient.CreateSnapshot(ip, volname, snapName); err != nil {
+		return errors.Wrapf(err, "failed to create snapshot=%s of volume=%s", snapName, volname)
+	}
+	return nil
+}
+
+// deleteSnapshot deletes the snapshot of given volume through the target of volume
+func (p *Plugin) deleteSnapshot(volname, snapName string, isCSIVolume bool) error {
+	ip, err := p.getTargetIP(volname, isCSIVolume)
+	if k8serrors.IsNotFound(errors.Cause(err)) {
+		// snapshots are deleted along with the volume
+		p.Log.Infof("Volume=%s doesn't exist, skipping deletion of snapshot=%s", volname, snapName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.Log.Infof("Deleting snapshot=%s of volume=%s", snapName, volname)
+	if _, err = snapclient.DestroySnapshot(ip, volname, snapName); err != nil {
+		return errors.Wrapf(err, "failed to delete snapshot=%s of volume=%s", snapName, volname)
+	}
+	return nil
+}
+
+// getHealthyReplicaPool return the UID of the pool having a healthy replica of given volume.
+// Pools in exclude, e.g. pools on which the backup failed, are skipped.
+func (p *Plugin) getHealthyReplicaPool(volname string, isCSIVolume bool, exclude map[string]bool) (string, error) {
+	listOpts := metav1.ListOptions{
+		LabelSelector: cVRPVLabel + "=" + volname,
+	}
+
+	if isCSIVolume {
+		cvrList, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to fetch CVRs of volume=%s", volname)
+		}
+		for _, cvr := range cvrList.Items {
+			if cvr.Status.Phase == cstorv1.CVRStatusOnline && !exclude[cvr.Labels[cstorPoolInstanceUIDLabel]] {
+				return cvr.Labels[cstorPoolInstanceUIDLabel], nil
+			}
+		}
+	} else {
+		cvrList, err := p.OpenEBSClient.OpenebsV1alpha1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to fetch CVRs of volume=%s", volname)
+		}
+		for _, cvr := range cvrList.Items {
+			if cvr.Status.Phase == v1alpha1.CVRStatusOnline && !exclude[cvr.Labels[cstorPoolUIDLabel]] {
+				return cvr.Labels[cstorPoolUIDLabel], nil
+			}
+		}
+	}
+	return "", errors.Errorf("unable to find healthy CVR for volume=%s", volname)
+}
+
+// getLastBackupSnap return the snapshot of last completed backup of given backup's schedule.
+// CStorCompletedBackup, tracking the completed backups of schedule, is created if it doesn't exist.
+func (p *Plugin) getLastBackupSnap(bkp *v1alpha1.CStorBackup, isCSIVolume bool) (string, error) {
+	name := bkp.Spec.BackupName + "-" + bkp.Spec.VolumeName
+
+	if isCSIVolume {
+		cbkp, err := p.OpenEBSAPIsClient.CstorV1().CStorCompletedBackups(bkp.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err == nil {
+			return cbkp.Spec.LastSnapName, nil
+		}
+		if !k8serrors.IsNotFound(err) {
+			return "", errors.Wrapf(err, "failed to fetch last completed-backup=%s", name)
+		}
+
+		cbkp = &cstorv1.CStorCompletedBackup{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: bkp.Namespace,
+				Labels:    bkp.Labels,
+			},
+			Spec: cstorv1.CStorCompletedBackupSpec{
+				BackupName: bkp.Spec.BackupName,
+				VolumeName: bkp.Spec.VolumeName,
+			},
+		}
+		_, err = p.OpenEBSAPIsClient.CstorV1().CStorCompletedBackups(bkp.Namespace).Create(context.TODO(), cbkp, metav1.CreateOptions{})
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to create last completed-backup=%s", name)
+		}
+		return "", nil
+	}
+
+	cbkp, err := p.OpenEBSClient.OpenebsV1alpha1().CStorCompletedBackups(bkp.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err == nil {
+		return cbkp.Spec.PrevSnapName, nil
+	}
+	if !k8serrors.IsNotFound(err) {
+		return "", errors.Wrapf(err, "failed to fetch last completed-backup=%s", name)
+	}
+
+	cbkp = &v1alpha1.CStorCompletedBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: bkp.Namespace,
+			Labels:    bkp.Labels,
+		},
+		Spec: v1alpha1.CStorBackupSpec{
+			BackupName: bkp.Spec.BackupName,
+			VolumeName: bkp.Spec.VolumeName,
+		},
+	}
+	_, err = p.OpenEBSClient.OpenebsV1alpha1().CStorCompletedBackups(bkp.Namespace).Create(context.TODO(), cbkp, metav1.CreateOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create last completed-backup=%s", name)
+	}
+	return "", nil
+}
+
+// createBackup creates the snapshot of given volume and the CStorBackup to upload
+// the snapshot, incremental to last completed backup of schedule, to the plugin
+// server listening on given port
+func (p *Plugin) createBackup(vol *Volume, port int) (*v1alpha1.CStorBackup, error) {
+	scheduleName := p.getScheduleName(vol.backupName) // This will be backup/schedule name
+
+	bkp := &v1alpha1.CStorBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vol.backupName + "-" + vol.volname,
+			Namespace: vol.backupNamespace,
+		},
+		Spec: v1alpha1.CStorBackupSpec{
+			BackupName: scheduleName,
+			VolumeName: vol.volname,
+			SnapName:   vol.backupName,
+			BackupDest: net.JoinHostPort(p.cstorServerAddr, strconv.Itoa(port)),
+			LocalSnap:  p.local,
+		},
+	}
+
+	if p.isCSISnapshotMode(vol) {
+		// snapshot is named by CSI driver, so backup resource has the name of backup
+		snapName, err := p.createCSISnapshot(vol)
+		if err != nil {
+			return nil, err
+		}
+		bkp.Spec.SnapName = snapName
+	} else if err := p.createSnapshot(vol.volname, vol.backupName, vol.isCSIVolume); err != nil {
+		return nil, err
+	}
+
+	if p.local {
+		if _, err := p.getHealthyReplicaPool(vol.volname, vol.isCSIVolume, nil); err != nil {
+			return nil, err
+		}
+		return bkp, nil
+	}
+	return p.sendBackupRequest(vol, bkp, nil)
+}
+
+// sendBackupRequest creates the given CStorBackup, for the snapshot already taken, on the pool
+// of a healthy replica of the volume. Pools in exclude are not used for the backup.
+func (p *Plugin) sendBackupRequest(vol *Volume, bkp *v1alpha1.CStorBackup, exclude map[string]bool) (*v1alpha1.CStorBackup, error) {
+	scheduleName := bkp.Spec.BackupName
+
+	var err error
+
+	// pool is selected while acquiring the backup slot, if poolBackupLimit is set
+	pool := vol.backupPool
+	if pool == "" || exclude[pool] {
+		if pool, err = p.getHealthyReplicaPool(vol.volname, vol.isCSIVolume, exclude); err != nil {
+			return nil, err
+		}
+	}
+
+	poolLabel := cstorPoolUIDLabel
+	if vol.isCSIVolume {
+		poolLabel = cstorPoolInstanceUIDLabel
+	}
+	bkp.Labels = map[string]string{
+		poolLabel:       pool,
+		cVRPVLabel:      vol.volname,
+		backupNameLabel: scheduleName,
+	}
+
+	bkp.Spec.PrevSnapName, err = p.getLastBackupSnap(bkp, vol.isCSIVolume)
+	if err != nil {
+		return nil, err
+	}
+
+	if bkp.Spec.PrevSnapName != "" && p.fullBackupInterval > 0 && scheduleName != vol.backupName {
+		// retention can delete the incremental chain only once a later full backup exists
+		due, err := p.isFullBackupDue(vol, scheduleName)
+		if err != nil {
+			p.volumeLog(vol, phaseSnapshot).WithError(err).Warn("Failed to check if full backup is due, taking incremental backup")
+		} else if due {
+			p.volumeLog(vol, phaseSnapshot).Infof("Taking full backup as per %s=%d", FullBackupInterval, p.fullBackupInterval)
+			bkp.Spec.PrevSnapName = ""
+		}
+	}
+	bkp.Status = v1alpha1.BKPCStorStatusPending
+
+	p.volumeLog(vol, phaseSnapshot).WithFields(logrus.Fields{
+		"pool":         pool,
+		"prevSnapshot": bkp.Spec.PrevSnapName,
+	}).Infof("Creating backup resource=%s/%s", bkp.Namespace, bkp.Name)
+
+	if vol.isCSIVolume {
+		_, err = p.OpenEBSAPIsClient.CstorV1().CStorBackups(bkp.Namespace).Create(context.TODO(), toCStorV1Backup(bkp), metav1.CreateOptions{})
+	} else {
+		_, err = p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(bkp.Namespace).Create(context.TODO(), bkp, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create backup=%s/%s", bkp.Namespace, bkp.Name)
+	}
+
+	p.labelBackup(bkp, vol)
+	p.annotateDegradedBackup(bkp, vol)
+	return bkp, nil
+}
+
+// toCStorV1Backup converts the given v1alpha1 CStorBackup to cstor v1 CStorBackup
+func toCStorV1Backup(bkp *v1alpha1.CStorBackup) *cstorv1.CStorBackup {
+	return &cstorv1.CStorBackup{
+		ObjectMeta: bkp.ObjectMeta,
+		Spec: cstorv1.CStorBackupSpec{
+			BackupName:   bkp.Spec.BackupName,
+			VolumeName:   bkp.Spec.VolumeName,
+			SnapName:     bkp.Spec.SnapName,
+			PrevSnapName: bkp.Spec.PrevSnapName,
+			BackupDest:   bkp.Spec.BackupDest,
+			LocalSnap:    bkp.Spec.LocalSnap,
+		},
+		Status: cstorv1.CStorBackupStatus(bkp.Status),
+	}
+}
+
+// getBackup return the current state of given CStorBackup
+func (p *Plugin) getBackup(bkp *v1alpha1.CStorBackup, isCSIVolume bool) (*v1alpha1.CStorBackup, error) {
+	name := bkp.Name
+
+	if !isCSIVolume {
+		return p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(bkp.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+
+	b, err := p.OpenEBSAPIsClient.CstorV1().CStorBackups(bkp.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return fromCStorV1Backup(b), nil
+}
+
+// fromCStorV1Backup converts the given cstor v1 CStorBackup to v1alpha1 CStorBackup
+func fromCStorV1Backup(b *cstorv1.CStorBackup) *v1alpha1.CStorBackup {
+	return &v1alpha1.CStorBackup{
+		ObjectMeta: b.ObjectMeta,
+		Spec: v1alpha1.CStorBackupSpec{
+			BackupName:   b.Spec.BackupName,
+			VolumeName:   b.Spec.VolumeName,
+			SnapName:     b.Spec.SnapName,
+			PrevSnapName: b.Spec.PrevSnapName,
+			BackupDest:   b.Spec.BackupDest,
+			LocalSnap:    b.Spec.LocalSnap,
+		},
+		Status: v1alpha1.CStorBackupStatus(b.Status),
+	}
+}
+
+// deleteBackup deletes the snapshot of given backup and its CStorBackup. If the backup is the
+// last completed backup of schedule, or schedule doesn't have completed backup, then
+// CStorCompletedBackup of the schedule is also deleted so that next backup of schedule is full backup.
+func (p *Plugin) deleteBackup(backup, volume, namespace, schedule string, isCSIVolume bool) error {
+	var (
+		lastSnap string
+		found    bool
+		vs       *unstructured.Unstructured
+	)
+
+	// snapshot name and backup name are same, unless snapshot is taken through CSI VolumeSnapshot
+	snapName := backup
+	if isCSIVolume {
+		var err error
+		if vs, err = p.getCSISnapshot(namespace, backup, volume); err != nil {
+			return err
+		}
+		if vs != nil {
+			snapName = vs.GetLabels()[cstorSnapshotLabel]
+		}
+	}
+
+	cbkpName := schedule + "-" + volume
+	if isCSIVolume {
+		cbkp, err := p.OpenEBSAPIsClient.CstorV1().CStorCompletedBackups(namespace).Get(context.TODO(), cbkpName, metav1.GetOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to fetch last completed-backup=%s", cbkpName)
+		}
+		if err == nil {
+			lastSnap, found = cbkp.Spec.LastSnapName, true
+		}
+	} else {
+		cbkp, err := p.OpenEBSClient.OpenebsV1alpha1().CStorCompletedBackups(namespace).Get(context.TODO(), cbkpName, metav1.GetOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to fetch last completed-backup=%s", cbkpName)
+		}
+		if err == nil {
+			lastSnap, found = cbkp.Spec.PrevSnapName, true
+		}
+	}
+
+	if found && (lastSnap == snapName || lastSnap == "") {
+		var err error
+		if isCSIVolume {
+			err = p.OpenEBSAPIsClient.CstorV1().CStorCompletedBackups(namespace).Delete(context.TODO(), cbkpName, metav1.DeleteOptions{})
+		} else {
+			err = p.OpenEBSClient.OpenebsV1alpha1().CStorCompletedBackups(namespace).Delete(context.TODO(), cbkpName, metav1.DeleteOptions{})
+		}
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete last completed-backup=%s", cbkpName)
+		}
+	}
+
+	if vs != nil {
+		if err := p.deleteCSISnapshot(vs); err != nil {
+			return err
+		}
+	} else if err := p.deleteSnapshot(volume, backup, isCSIVolume); err != nil {
+		return err
+	}
+
+	var err error
+	name := backup + "-" + volume
+	if isCSIVolume {
+		err = p.OpenEBSAPIsClient.CstorV1().CStorBackups(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	} else {
+		err = p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	}
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete backup=%s/%s", namespace, name)
+	}
+	return nil
+}
+
+// createRestore creates the CStorRestore, for each replica of given volume, to download
+// the snapshot from the plugin server
+func (p *Plugin) createRestore(vol *Volume) (*v1alpha1.CStorRestore, error) {
+	var pools []string
+
+	listOpts := metav1.ListOptions{
+		LabelSelector: cVRPVLabel + "=" + vol.volname,
+	}
+
+	// restore resource is created in the namespace of restored volume claim,
+	// similar to backup resource
+	restoreNs := vol.namespace
+	if restoreNs == "" {
+		restoreNs = p.namespace
+	}
+
+	rst := &v1alpha1.CStorRestore{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: restoreNs,
+		},
+		Spec: v1alpha1.CStorRestoreSpec{
+			RestoreName:  vol.backupName,
+			VolumeName:   vol.volname,
+			RestoreSrc:   net.JoinHostPort(p.cstorServerAddr, strconv.Itoa(p.restorePort)),
+			StorageClass: vol.storageClass,
+			Size:         vol.size,
+		},
+		Status: v1alpha1.RSTCStorStatusPending,
+	}
+
+	poolLabel := cstorPoolUIDLabel
+	if vol.isCSIVolume {
+		poolLabel = cstorPoolInstanceUIDLabel
+		cvrList, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch CVRs of volume=%s", vol.volname)
+		}
+		for _, cvr := range cvrList.Items {
+			pools = append(pools, cvr.Labels[poolLabel])
+		}
+	} else {
+		cvrList, err := p.OpenEBSClient.OpenebsV1alpha1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch CVRs of volume=%s", vol.volname)
+		}
+		for _, cvr := range cvrList.Items {
+			pools = append(pools, cvr.Labels[poolLabel])
+		}
+	}
+
+	if len(pools) == 0 {
+		return nil, errors.Errorf("no CVR found for volume=%s", vol.volname)
+	}
+
+	for _, pool := range pools {
+		nuuid, err := uuid.NewV4()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to generate uuid for restore")
+		}
+
+		r := rst.DeepCopy()
+		r.Name = rst.Spec.RestoreName + "-" + nuuid.String()
+		r.Labels = map[string]string{
+			poolLabel:        pool,
+			cVRPVLabel:       vol.volname,
+			restoreNameLabel: rst.Spec.RestoreName,
+		}
+
+		if vol.isCSIVolume {
+			_, err = p.OpenEBSAPIsClient.CstorV1().CStorRestores(restoreNs).Create(context.TODO(), toCStorV1Restore(r), metav1.CreateOptions{})
+		} else {
+			_, err = p.OpenEBSClient.OpenebsV1alpha1().CStorRestores(restoreNs).Create(context.TODO(), r, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create restore for volume=%s on pool=%s", vol.volname, pool)
+		}
+		p.volumeLog(vol, phaseRestore).WithField("pool", pool).Infof("Restore resource=%s/%s created", restoreNs, r.Name)
+	}
+
+	p.labelRestores(rst, vol)
+	return rst, nil
+}
+
+// toCStorV1Restore converts the given v1alpha1 CStorRestore to cstor v1 CStorRestore
+func toCStorV1Restore(rst *v1alpha1.CStorRestore) *cstorv1.CStorRestore {
+	return &cstorv1.CStorRestore{
+		ObjectMeta: rst.ObjectMeta,
+		Spec: cstorv1.CStorRestoreSpec{
+			RestoreName:  rst.Spec.RestoreName,
+			VolumeName:   rst.Spec.VolumeName,
+			RestoreSrc:   rst.Spec.RestoreSrc,
+			StorageClass: rst.Spec.StorageClass,
+			Size:         rst.Spec.Size,
+			Local:        rst.Spec.Local,
+		},
+		Status: cstorv1.CStorRestoreStatus(rst.Status),
+	}
+}
+
+// restoreSelector return the label selector of CStorRestores, of all the replicas, of given restore
+func restoreSelector(rst *v1alpha1.CStorRestore) string {
+	return restoreNameLabel + "=" + rst.Spec.RestoreName + "," + cVRPVLabel + "=" + rst.Spec.VolumeName
+}
+
+// listRestoreStatuses return the status of CStorRestores, of all the replicas, of given restore
+// mapped by CStorRestore name, along with the resource version of the list
+func (p *Plugin) listRestoreStatuses(rst *v1alpha1.CStorRestore,
+	isCSIVolume bool) (map[string]v1alpha1.CStorRestoreStatus, string, error) {
+	statuses := map[string]v1alpha1.CStorRestoreStatus{}
+
+	listOpts := metav1.ListOptions{
+		LabelSelector: restoreSelector(rst),
+	}
+
+	if isCSIVolume {
+		list, err := p.OpenEBSAPIsClient.CstorV1().CStorRestores(rst.Namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to fetch restores of volume=%s", rst.Spec.VolumeName)
+		}
+		for _, r := range list.Items {
+			statuses[r.Name] = v1alpha1.CStorRestoreStatus(r.Status)
+		}
+		return statuses, list.ResourceVersion, nil
+	}
+
+	list, err := p.OpenEBSClient.OpenebsV1alpha1().CStorRestores(rst.Namespace).List(context.TODO(), listOpts)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to fetch restores of volume=%s", rst.Spec.VolumeName)
+	}
+	for _, r := range list.Items {
+		statuses[r.Name] = r.Status
+	}
+	return statuses, list.ResourceVersion, nil
+}
+
+// aggregateRestoreStatus return the status of restore from the status of CStorRestores of all
+// the replicas. Restore is failed if restore of any replica is failed, and it is done once
+// restore of all the replicas is done.
+func aggregateRestoreStatus(statuses map[string]v1alpha1.CStorRestoreStatus) v1alpha1.CStorRestoreStatus {
+	status := v1alpha1.RSTCStorStatusEmpty
+	for _, s := range statuses {
+		switch s {
+		case v1alpha1.RSTCStorStatusFailed, v1alpha1.RSTCStorStatusInvalid:
+			return v1alpha1.RSTCStorStatusFailed
+		case v1alpha1.RSTCStorStatusDone:
+			if status == v1alpha1.RSTCStorStatusEmpty {
+				status = v1alpha1.RSTCStorStatusDone
+			}
+		default:
+			status = v1alpha1.RSTCStorStatusInProgress
+		}
+	}
+	return status
+}
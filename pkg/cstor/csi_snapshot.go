@@ -0,0 +1,268 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// SnapshotMode config key for the way snapshot of CSI volume is taken for remote backup
+	SnapshotMode = "snapshotMode"
+
+	// SnapshotModeTarget is value of SnapshotMode config to take snapshot through the volume target
+	SnapshotModeTarget = "target"
+
+	// SnapshotModeCSI is value of SnapshotMode config to take snapshot through CSI VolumeSnapshot
+	SnapshotModeCSI = "csi"
+
+	// VolumeSnapshotClass config key for VolumeSnapshotClass of the VolumeSnapshots created by plugin
+	VolumeSnapshotClass = "volumeSnapshotClass"
+
+	// CSISnapshotTimeout config key for time limit to wait for VolumeSnapshot to be ready
+	CSISnapshotTimeout = "csiSnapshotTimeout"
+
+	// defaultCSISnapshotTimeout is default time limit to wait for VolumeSnapshot to be ready
+	defaultCSISnapshotTimeout = 10 * time.Minute
+
+	// csiSnapshotPollInterval is interval to check the status of VolumeSnapshot
+	csiSnapshotPollInterval = 2 * time.Second
+
+	// cstorSnapshotLabel is set on VolumeSnapshot with the name of cStor snapshot taken by CSI driver
+	cstorSnapshotLabel = "openebs.io/cstor-snapshot"
+
+	// snapshotGroup is API group of CSI snapshot resources
+	snapshotGroup = "snapshot.storage.k8s.io"
+)
+
+// snapshotGVR return the VolumeSnapshot and VolumeSnapshotContent resources of the
+// served snapshot API version, v1 if available otherwise v1beta1
+func (p *Plugin) snapshotGVR() (vs, vsc schema.GroupVersionResource) {
+	p.snapshotVersionOnce.Do(func() {
+		p.snapshotVersion = "v1beta1"
+		if _, err := p.K8sClient.Discovery().ServerResourcesForGroupVersion(snapshotGroup + "/v1"); err == nil {
+			p.snapshotVersion = "v1"
+		}
+	})
+
+	vs = schema.GroupVersionResource{Group: snapshotGroup, Version: p.snapshotVersion, Resource: "volumesnapshots"}
+	vsc = schema.GroupVersionResource{Group: snapshotGroup, Version: p.snapshotVersion, Resource: "volumesnapshotcontents"}
+	return vs, vsc
+}
+
+// csiSnapshotName return the name of VolumeSnapshot created for given backup of the volume
+func csiSnapshotName(backup, volume string) string {
+	return backup + "-" + volume
+}
+
+// isCSISnapshotMode returns true if snapshot of the given volume is taken through CSI VolumeSnapshot
+func (p *Plugin) isCSISnapshotMode(vol *Volume) bool {
+	return p.snapshotMode == SnapshotModeCSI && vol.isCSIVolume
+}
+
+// createCSISnapshot creates the VolumeSnapshot of the volume claim and waits until it is ready.
+// It return the name of cStor snapshot taken by the CSI driver for the VolumeSnapshot.
+func (p *Plugin) createCSISnapshot(vol *Volume) (string, error) {
+	vsGVR, vscGVR := p.snapshotGVR()
+
+	// VolumeSnapshot is created in the namespace of claim
+	if vol.claimState != "" {
+		return "", errors.Errorf("CSI snapshot of volume=%s can't be taken, claim %s/%s is in state=%s",
+			vol.volname, vol.namespace, vol.pvcName, vol.claimState)
+	}
+
+	name := csiSnapshotName(vol.backupName, vol.volname)
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": vol.pvcName,
+		},
+	}
+	if p.volumeSnapshotClass != "" {
+		spec["volumeSnapshotClassName"] = p.volumeSnapshotClass
+	}
+
+	vs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": spec,
+	}}
+	vs.SetAPIVersion(vsGVR.GroupVersion().String())
+	vs.SetKind("VolumeSnapshot")
+	vs.SetName(name)
+	vs.SetNamespace(vol.namespace)
+	vs.SetLabels(map[string]string{
+		velerov1api.BackupNameLabel: label.GetValidName(vol.backupName),
+		cVRPVLabel:                  vol.volname,
+	})
+
+	log := p.volumeLog(vol, phaseSnapshot)
+	log.Infof("Creating VolumeSnapshot=%s/%s", vol.namespace, name)
+
+	_, err := p.dynamicClient.Resource(vsGVR).Namespace(vol.namespace).Create(context.TODO(), vs, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return "", errors.Wrapf(err, "failed to create VolumeSnapshot=%s/%s", vol.namespace, name)
+	}
+
+	var content string
+	err = wait.PollImmediate(csiSnapshotPollInterval, p.csiSnapshotTimeout, func() (bool, error) {
+		cur, err := p.dynamicClient.Resource(vsGVR).Namespace(vol.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		if msg, ok, _ := unstructured.NestedString(cur.Object, "status", "error", "message"); ok && msg != "" {
+			return false, errors.Errorf("VolumeSnapshot failed : %s", msg)
+		}
+
+		ready, _, _ := unstructured.NestedBool(cur.Object, "status", "readyToUse")
+		content, _, _ = unstructured.NestedString(cur.Object, "status", "boundVolumeSnapshotContentName")
+		return ready && content != "", nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "VolumeSnapshot=%s/%s is not ready", vol.namespace, name)
+	}
+
+	vsc, err := p.dynamicClient.Resource(vscGVR).Get(context.TODO(), content, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch VolumeSnapshotContent=%s", content)
+	}
+
+	// snapshot handle of cStor CSI driver is volume@snapshot
+	handle, _, _ := unstructured.NestedString(vsc.Object, "status", "snapshotHandle")
+	i := strings.LastIndex(handle, "@")
+	if i < 0 || handle[:i] != vol.volname {
+		return "", errors.Errorf("VolumeSnapshotContent=%s has invalid snapshot handle=%q for volume=%s",
+			content, handle, vol.volname)
+	}
+	snapName := handle[i+1:]
+
+	if errs := validation.IsValidLabelValue(snapName); len(errs) != 0 {
+		return "", errors.Errorf("invalid cStor snapshot=%s of VolumeSnapshot=%s/%s : %v",
+			snapName, vol.namespace, name, errs)
+	}
+
+	patch, err := labelPatch(map[string]string{cstorSnapshotLabel: snapName})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to generate label patch for VolumeSnapshot=%s/%s", vol.namespace, name)
+	}
+
+	// label is used to find the backup of a snapshot, for the clean-up of incremental backups
+	_, err = p.dynamicClient.Resource(vsGVR).Namespace(vol.namespace).
+		Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to label VolumeSnapshot=%s/%s", vol.namespace, name)
+	}
+
+	log.Infof("VolumeSnapshot=%s/%s is ready, snapshot=%s", vol.namespace, name, snapName)
+	return snapName, nil
+}
+
+// getCSISnapshot return the VolumeSnapshot of given backup of the volume.
+// It return nil if backup doesn't have VolumeSnapshot.
+func (p *Plugin) getCSISnapshot(namespace, backup, volume string) (*unstructured.Unstructured, error) {
+	if p.dynamicClient == nil {
+		return nil, nil
+	}
+	vsGVR, _ := p.snapshotGVR()
+
+	name := csiSnapshotName(backup, volume)
+	vs, err := p.dynamicClient.Resource(vsGVR).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		// VolumeSnapshot CRD may not be installed
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch VolumeSnapshot=%s/%s", namespace, name)
+	}
+	return vs, nil
+}
+
+// deleteCSISnapshot deletes the given VolumeSnapshot. Snapshot is deleted by the CSI driver
+// if deletion policy of VolumeSnapshotClass is Delete.
+func (p *Plugin) deleteCSISnapshot(vs *unstructured.Unstructured) error {
+	vsGVR, _ := p.snapshotGVR()
+
+	p.Log.Infof("Deleting VolumeSnapshot=%s/%s", vs.GetNamespace(), vs.GetName())
+	err := p.dynamicClient.Resource(vsGVR).Namespace(vs.GetNamespace()).
+		Delete(context.TODO(), vs.GetName(), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete VolumeSnapshot=%s/%s", vs.GetNamespace(), vs.GetName())
+	}
+	return nil
+}
+
+// getSnapshotBackup return the backup of given cStor snapshot of the volume. If snapshot was
+// not taken through CSI VolumeSnapshot then snapshot name and backup name are same.
+func (p *Plugin) getSnapshotBackup(namespace, volume, snapName string) (string, error) {
+	if p.dynamicClient == nil {
+		return snapName, nil
+	}
+	vsGVR, _ := p.snapshotGVR()
+
+	opts := metav1.ListOptions{
+		LabelSelector: cVRPVLabel + "=" + volume + "," + cstorSnapshotLabel + "=" + snapName,
+	}
+	list, err := p.dynamicClient.Resource(vsGVR).Namespace(namespace).List(context.TODO(), opts)
+	if k8serrors.IsNotFound(err) {
+		return snapName, nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list VolumeSnapshots of snapshot=%s", snapName)
+	}
+
+	for _, vs := range list.Items {
+		if name := vs.GetName(); strings.HasSuffix(name, "-"+volume) {
+			return backupNameOfResource(name, volume), nil
+		}
+	}
+	return snapName, nil
+}
+
+// backupNameOf return the velero backup name of given CStorBackup
+func backupNameOf(bkp v1alpha1.CStorBackup) string {
+	return backupNameOfResource(bkp.Name, bkp.Spec.VolumeName)
+}
+
+// backupNameOfResource return the velero backup name from the name of given volume's backup
+// resource, CStorBackup and VolumeSnapshot are named as backup-volume
+func backupNameOfResource(name, volume string) string {
+	return strings.TrimSuffix(name, "-"+volume)
+}
+
+// parseSnapshotMode return the snapshot mode from given config
+func parseSnapshotMode(config map[string]string) (string, error) {
+	mode, ok := config[SnapshotMode]
+	if !ok {
+		return SnapshotModeTarget, nil
+	}
+	if mode != SnapshotModeTarget && mode != SnapshotModeCSI {
+		return "", errors.Errorf("invalid %s=%s, expected %s or %s", SnapshotMode, mode, SnapshotModeTarget, SnapshotModeCSI)
+	}
+	return mode, nil
+}
@@ -18,9 +18,15 @@ package cstor
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
@@ -34,27 +40,43 @@ import (
 	openebs "github.com/openebs/maya/pkg/client/generated/clientset/versioned"
 	"github.com/openebs/velero-plugin/pkg/velero"
 	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/podexec"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
 
 const (
-	mayaAPIServiceName    = "maya-apiserver-service"
-	mayaAPIServiceLabel   = "openebs.io/component-name=maya-apiserver-svc"
-	cvcAPIServiceLabel    = "openebs.io/component-name=cvc-operator-svc"
-	backupEndpoint        = "/latest/backups/"
-	restorePath           = "/latest/restore/"
-	casTypeCStor          = "cstor"
-	backupStatusInterval  = 5
-	restoreStatusInterval = 5
-	openebsVolumeLabel    = "openebs.io/cas-type"
-	openebsCSIName        = "cstor.csi.openebs.io"
-	trueStr               = "true"
+	mayaAPIServiceName      = "maya-apiserver-service"
+	mayaAPIServiceLabel     = "openebs.io/component-name=maya-apiserver-svc"
+	cvcAPIServiceLabel      = "openebs.io/component-name=cvc-operator-svc"
+	restorePath             = "/latest/restore/"
+	casTypeCStor            = "cstor"
+	restoreStatusInterval   = 5
+	openebsVolumeLabel      = "openebs.io/cas-type"
+	openebsCSIName          = "cstor.csi.openebs.io"
+	trueStr                 = "true"
+	defaultOpenEBSNamespace = "openebs"
+
+	// volumeTypeCStor and volumeTypeCStorCSI are the volume types of cStor and cStor CSI volumes
+	volumeTypeCStor    = "cstor"
+	volumeTypeCStorCSI = "cstor-csi"
+
+	// legacyVolumeType is the volume type of backups taken by older version of plugin
+	legacyVolumeType = "cstor-snapshot"
+
+	// deleteRetries is number of attempts to delete either the backup resources or the remote snapshot
+	deleteRetries = 3
+
+	// deleteRetryInterval is interval between the attempts to delete the snapshot
+	deleteRetryInterval = 2 * time.Second
 )
 
 const (
@@ -70,17 +92,98 @@ const (
 	// AutoSetTargetIP config key for setting the targetip automatically after successful restore
 	AutoSetTargetIP = "autoSetTargetIP"
 
-	// SnapshotIDIdentifier is a word to generate snapshotID from volume name and backup name
+	// SnapshotIDIdentifier is a word to generate legacy snapshotID from volume name and backup name
 	SnapshotIDIdentifier = "-velero-bkp-"
 
-	// port to connect for restoring the data
+	// default port to connect for restoring the data
 	CstorRestorePort = 9000
 
-	// port to connect for backup
+	// default port, first of the backup ports, to connect for backup
 	CstorBackupPort = 9001
 
+	// RestorePort config key for port on which plugin serves the data for restore
+	RestorePort = "restorePort"
+
+	// BackupPort config key for first port on which plugin receives the data for backup
+	BackupPort = "backupPort"
+
+	// NetworkInterface config key for name of the interface whose address is advertised to cStor
+	NetworkInterface = "networkInterface"
+
+	// NetworkCIDR config key for CIDR of the address advertised to cStor
+	NetworkCIDR = "networkCIDR"
+
+	// UsePodIP config key to advertise the pod IP, from podIPEnv, to cStor
+	UsePodIP = "usePodIP"
+
+	// IPFamily config key for family, ipv4 or ipv6, of the address advertised to cStor
+	IPFamily = "ipFamily"
+
+	// IPv4Family is value of IPFamily config to advertise IPv4 address
+	IPv4Family = "ipv4"
+
+	// IPv6Family is value of IPFamily config to advertise IPv6 address
+	IPv6Family = "ipv6"
+
+	// podIPEnv is env, set from status.podIP or status.podIPs using downward API, having IPs of velero pod
+	podIPEnv = "POD_IP"
+
 	// RestTimeOut config key for REST API timeout value
 	RestTimeOut = "restApiTimeout"
+
+	// RestRetries config key for number of retries of failed REST API call
+	RestRetries = "restApiRetries"
+
+	// RestRetryBackoff config key for initial wait before retrying the REST API call,
+	// wait is doubled for each retry
+	RestRetryBackoff = "restApiRetryBackoff"
+
+	// BackupOverlapPolicy config key for the action to take if previous backup of volume is running
+	BackupOverlapPolicy = "backupOverlapPolicy"
+
+	// BackupOverlapTimeout config key for time limit to wait for previous backup of volume
+	BackupOverlapTimeout = "backupOverlapTimeout"
+
+	// RetainLocalSnapshot config key for retaining the snapshot in cStor pool after uploading it to cloud
+	RetainLocalSnapshot = "retainLocalSnapshot"
+
+	// BackupStatusInterval config key for interval to poll the backup status
+	BackupStatusInterval = "backupStatusInterval"
+
+	// BackupTimeout config key for time limit to complete the backup of a volume
+	BackupTimeout = "backupTimeout"
+
+	// BackupStallTimeout config key for time limit to wait for the data of a backup,
+	// after which backup is considered as stuck
+	BackupStallTimeout = "backupStallTimeout"
+
+	// StaleBackupTTL config key for age after which failed or interrupted backup resources are deleted
+	StaleBackupTTL = "staleBackupTTL"
+
+	// VerifyBackup config key for verification mode of uploaded backup
+	VerifyBackup = "verifyBackup"
+
+	// ExistingVolumePolicy config key for the action to take if restored PVC already exists
+	ExistingVolumePolicy = "existingVolumePolicy"
+
+	// BackupTerminatingVolumes config key to backup the volumes whose claim or its namespace is terminating
+	BackupTerminatingVolumes = "backupTerminatingVolumes"
+
+	// BlockDependentDeletion config key to fail the deletion of a scheduled backup needed by
+	// later incremental backups of the schedule
+	BlockDependentDeletion = "blockDependentDeletion"
+
+	// defaultBackupStatusInterval is default interval to poll the backup status
+	defaultBackupStatusInterval = 5 * time.Second
+
+	// Parallel config key for number of volumes which can be backed up concurrently
+	Parallel = "parallel"
+
+	// MaxParallelBackups is upper limit for parallel config
+	// Ports used for the backup are allocated from backupPort to
+	// backupPort+MaxParallelBackups-1, this limit ensures that, with
+	// default ports, it doesn't conflict with the ports used by ZFS-LocalPV plugin
+	MaxParallelBackups = 8
 )
 
 // Plugin defines snapshot plugin for CStor volume
@@ -89,10 +192,10 @@ type Plugin struct {
 	Log logrus.FieldLogger
 
 	// K8sClient is used for kubernetes CR operation
-	K8sClient *kubernetes.Clientset
+	K8sClient kubernetes.Interface
 
 	// OpenEBSClient is used for openEBS CR operation
-	OpenEBSClient *openebs.Clientset
+	OpenEBSClient openebs.Interface
 
 	// OpenEBSAPIsClient clientset for OpenEBS CR operations
 	/*
@@ -105,21 +208,47 @@ type Plugin struct {
 	*/
 	OpenEBSAPIsClient openebsapis.Interface
 
+	// dynamicClient is used for CSI snapshot resources
+	dynamicClient dynamic.Interface
+
+	// clientsSet is set if clients are set using SetClients
+	clientsSet bool
+
+	// snapshotVersion is served API version of CSI snapshot resources
+	snapshotVersion string
+
+	// snapshotVersionOnce ensures that snapshotVersion is discovered once
+	snapshotVersionOnce sync.Once
+
+	// backupCatalogServed is set if VolumeBackupCatalog resource is served by the cluster
+	backupCatalogServed bool
+
+	// backupCatalogOnce ensures that VolumeBackupCatalog resource is discovered once
+	backupCatalogOnce sync.Once
+
 	// config to store parameters from velero server
 	config map[string]string
 
 	// namespace in which openebs is installed, default is openebs
 	namespace string
 
+	// namespaceCacheTTL is time for which discovered openebs namespace is cached
+	namespaceCacheTTL time.Duration
+
 	// cl stores cloud connection information
 	cl *cloud.Conn
 
-	// mayaAddr is maya API server address
+	// mayaAddr is maya API server address, used for local restore of non CSI volume
 	mayaAddr string
 
-	// cvcAddr is cvc API server address
+	// cvcAddr is cvc API server address, used for local restore of CSI volume
 	cvcAddr string
 
+	// mayaService and cvcService are the services of maya API server and cvc API server,
+	// their endpoints are used to fail over between the replicas of API server
+	mayaService *v1.Service
+	cvcService  *v1.Service
+
 	// cstorServerAddr is network address used for CStor volume operation
 	// on this address cloud server will perform data operation(backup/restore)
 	cstorServerAddr string
@@ -127,20 +256,200 @@ type Plugin struct {
 	// volumes list of volume
 	volumes map[string]*Volume
 
+	// volumeLock protects volumes and snapshots for concurrent backups, restores and deletions
+	volumeLock sync.Mutex
+
+	// restorePort is port on which plugin serves the data for restore
+	restorePort int
+
+	// backupPort is first port of the ports used to receive the data for backup
+	backupPort int
+
+	// backupPorts is pool of ports available for backup, shared by the plugins
+	// having the same ports. Size of pool limits the number of concurrent backups
+	backupPorts *backupPortPool
+
+	// restoreLock is held while the data is served on restore port
+	restoreLock *sync.Mutex
+
+	// groupBackups is list of ongoing backups of consistency groups
+	groupBackups map[string]*groupBackup
+
+	// groupLock protects groupBackups for concurrent backups
+	groupLock sync.Mutex
+
 	// snapshots list of snapshot
 	snapshots map[string]*Snapshot
 
 	// if only local snapshot enabled
 	local bool
 
-	// if set then restore will restore from base snapshot to given snapshot, including incremental snapshots
+	// if set then restore of scheduled backup will restore from base snapshot to given snapshot,
+	// including incremental snapshots
 	restoreAllSnapshots bool
 
 	// if set then targetip will be set after successful restore
 	autoSetTargetIP bool
 
+	// if set then targetip will be set after successful restore of the latest backup of a schedule,
+	// it is used if restoreAllSnapshots is disabled and autoSetTargetIP is not configured
+	autoSetTargetIPLatest bool
+
+	// if set then remote backup will also retain the snapshot in cStor pool as local restore point
+	retainLocal bool
+
+	// snapshotMode defines the way snapshot of CSI volume is taken for remote backup
+	snapshotMode string
+
+	// volumeSnapshotClass is VolumeSnapshotClass of the VolumeSnapshots created in CSI snapshot mode,
+	// if empty then default VolumeSnapshotClass of the driver is used
+	volumeSnapshotClass string
+
+	// csiSnapshotTimeout defines time limit to wait for VolumeSnapshot to be ready
+	csiSnapshotTimeout time.Duration
+
+	// if set then volumes, whose claim or its namespace is terminating or deleted, are backed up
+	backupTerminating bool
+
+	// if set then deletion of a scheduled backup, needed by later incremental backups, fails
+	blockDependentDeletion bool
+
+	// if set then restore is validated without creating the volumes
+	restoreDryRun bool
+
+	// if set then PVC and PV are annotated with the last backup and restore of volume
+	volumeStatusAnnotations bool
+
+	// verifyMode defines the verification of uploaded backup
+	verifyMode string
+
+	// retentionCount defines number of remote backups retained per schedule of a volume,
+	// if 0 then backups are not deleted by count
+	retentionCount int
+
+	// retentionPeriod defines age after which remote backups of a schedule are deleted,
+	// if 0 then backups are not deleted by age
+	retentionPeriod time.Duration
+
+	// fullBackupInterval defines number of backups of a schedule after which a full backup is
+	// taken, if 0 then backups of a schedule are incremental to the first backup
+	fullBackupInterval int
+
+	// poolBackupLimit is number of volumes which can be backed up concurrently from a pool,
+	// by all the plugin instances. If 0 then backups are not limited per pool
+	poolBackupLimit int
+
+	// bucketQuota is quota of storage-bucket in bytes, if 0 then quota is not checked before backup
+	bucketQuota int64
+
+	// storageClassMapping is mapping of source storageClass to the storageClass used by remote restore
+	storageClassMapping map[string]string
+
+	// existingVolumePolicy defines action to take if restored PVC already exists
+	existingVolumePolicy string
+
+	// poolClusterMapping is mapping of source pool cluster to the pool cluster used by remote restore
+	poolClusterMapping map[string]string
+
+	// zoneMapping is mapping of source zone to the zone used by remote restore
+	zoneMapping map[string]string
+
+	// zonePoolCluster is mapping of zone to the pool cluster having the pools in that zone
+	zonePoolCluster map[string]string
+
+	// sizeMapping is mapping of PVC name to the size of volume created by remote restore
+	sizeMapping map[string]resource.Quantity
+
+	// restoreReplicaCount is replica count of volumes created by remote restore,
+	// if 0 then replica count of the storageClass is used
+	restoreReplicaCount int
+
+	// attestationSigner is used to sign the attestation of remote backups,
+	// if nil then backups are not attested
+	attestationSigner ed25519.PrivateKey
+
+	// attestationVerifier is used to verify the attestation of remote backups on restore,
+	// if nil then attestation is not verified
+	attestationVerifier ed25519.PublicKey
+
+	// attestationLogURL is transparency log endpoint to which attestations are submitted
+	attestationLogURL string
+
+	// canaryInterval defines interval to check the canary object in storage-bucket,
+	// if 0 then canary object is checked only on plugin initialization
+	canaryInterval time.Duration
+
 	// restTimeout defines timeout for REST API calls
 	restTimeout time.Duration
+
+	// restRetries defines number of retries of failed REST API call
+	restRetries int
+
+	// restRetryBackoff defines initial wait before retrying the REST API call
+	restRetryBackoff time.Duration
+
+	// restClient is http client, with shared connection pool, for REST API calls
+	restClient *http.Client
+
+	// overlapPolicy defines action to take if previous backup of volume is running
+	overlapPolicy string
+
+	// overlapTimeout defines time limit to wait for previous backup of volume
+	overlapTimeout time.Duration
+
+	// backupStatusInterval defines interval to report the backup progress
+	// and to re-establish the watch of backup status
+	backupStatusInterval time.Duration
+
+	// backupTimeout defines time limit to complete the backup of a volume,
+	// if 0 then backup doesn't have any time limit
+	backupTimeout time.Duration
+
+	// backupStallTimeout defines time limit to wait for the data of a backup,
+	// if 0 then stuck backup is not detected
+	backupStallTimeout time.Duration
+
+	// backupReplicaRetries is number of times the backup failed on a replica is retried on other replicas
+	backupReplicaRetries int
+
+	// podExecutor is used to execute snapshot hooks in the pods
+	podExecutor podexec.PodCommandExecutor
+
+	// staleBackupTTL defines age after which failed or interrupted backup resources are deleted,
+	// if 0 then stale backup resources are not deleted
+	staleBackupTTL time.Duration
+
+	// shardGroup is group of plugin instances sharing the volumes for backup,
+	// if empty then all the volumes are backed up by this instance
+	shardGroup string
+
+	// shardID is identity of this plugin instance in shard group
+	shardID string
+
+	// shardLeaseDuration is time for which lease of this plugin instance in shard group is valid
+	shardLeaseDuration time.Duration
+
+	// shardClaimDuration is time for which claim of the volume backed up by this instance is valid
+	shardClaimDuration time.Duration
+
+	// volumeSelector selects the volumes to snapshot, if nil then all the volumes are selected
+	volumeSelector labels.Selector
+
+	// backupWindows are the time windows in which snapshot can be taken, if empty then
+	// snapshot can be taken anytime
+	backupWindows []backupWindow
+
+	// backupWindowLocation is timezone of backup windows
+	backupWindowLocation *time.Location
+
+	// backupWindowPolicy is action to take if backup is started outside the backup windows
+	backupWindowPolicy string
+
+	// volumeHealthPolicy is action to take if volume is not healthy before taking the snapshot
+	volumeHealthPolicy string
+
+	// backupNameTemplate parses the names of scheduled backups, to find their schedule
+	backupNameTemplate *backupNameTemplate
 }
 
 // Snapshot describes snapshot object information
@@ -169,12 +478,19 @@ type Volume struct {
 	// namespace is volume claim's namespace
 	namespace string
 
+	// pvcName is volume claim's name
+	pvcName string
+
+	// backupNamespace is namespace for backup resources of the volume, it differs from
+	// volume claim's namespace if claim's namespace is terminating
+	backupNamespace string
+
+	// claimState is state of volume claim at the time of backup, it is empty for active claim
+	claimState string
+
 	// backupName is snapshot name for given volume
 	backupName string
 
-	// backupStatus is backup progress status for given volume
-	backupStatus v1alpha1.CStorBackupStatus
-
 	// restoreStatus is restore progress status for given volume
 	restoreStatus v1alpha1.CStorRestoreStatus
 
@@ -191,31 +507,190 @@ type Volume struct {
 
 	// isCSIVolume is true for cStor based CSI volume
 	isCSIVolume bool
+
+	// cl is cloud connection used for data transfer of the volume
+	cl *cloud.Conn
+
+	// local is true if volume is restored from local snapshot
+	local bool
+
+	// restored is list of snapshots restored from cloud for the volume
+	restored []restoredSnapshot
+
+	// skipped is true if restore of the volume is skipped since its PVC already exists,
+	// or the backup is already restored to the volume
+	skipped bool
+
+	// restoredBackup is the last backup restored to the volume of existing PVC, it is empty
+	// if the volume is not created by restore
+	restoredBackup string
+
+	// prevSnapName is the snapshot from which incremental backup of the volume is taken
+	prevSnapName string
+
+	// usedSize is used size of the volume at the time of backup, it is 0 if not known
+	usedSize int64
+
+	// claim is spec of the volume claim uploaded by backup
+	claim *claimSpec
+
+	// zone is availability zone of the volume, passed by velero for backup
+	zone string
+
+	// clone is the source snapshot of the volume, it is nil if volume is not provisioned from snapshot
+	clone *cloneSource
+
+	// degraded describes the health of volume if it is backed up while unhealthy, it is empty for healthy volume
+	degraded string
+
+	// shardClaim is name of the lease by which the volume is claimed in shard group
+	shardClaim string
+
+	// backupPool is UID of the pool, whose backup slot is held, selected to send the backup
+	backupPool string
+
+	// transfer is statistics of the upload of completed remote backup
+	transfer *transferStats
+
+	// labels is set on backup/restore resources of the volume to correlate them with velero backup/restore
+	labels map[string]string
 }
 
-func (p *Plugin) getServerAddress() string {
-	netInterfaceAddresses, err := net.InterfaceAddrs()
+// getServerAddress return the address of velero pod advertised to cStor for data operation.
+// Address is selected from the pod IPs, if usePodIP is set, or from the addresses of
+// configured network interface matching the configured CIDR. If ipFamily is not set
+// then IPv4 address is preferred over IPv6 address.
+func (p *Plugin) getServerAddress(config map[string]string) (string, error) {
+	var (
+		cidr *net.IPNet
+		ips  []net.IP
+	)
+
+	family := config[IPFamily]
+	if family != "" && family != IPv4Family && family != IPv6Family {
+		return "", errors.Errorf("invalid %s=%s, expected %s or %s", IPFamily, family, IPv4Family, IPv6Family)
+	}
 
+	if isTrue(config[UsePodIP]) {
+		// status.podIPs of dual-stack pod is comma separated list of IPs
+		for _, v := range strings.Split(os.Getenv(podIPEnv), ",") {
+			if ip := net.ParseIP(strings.TrimSpace(v)); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+
+		ip := selectIP(ips, family)
+		if ip == nil {
+			return "", errors.Errorf("invalid pod IP=%q, %s env should be set from status.podIP", os.Getenv(podIPEnv), podIPEnv)
+		}
+		p.Log.Infof("Ip address of velero-plugin server: %s", ip)
+		return ip.String(), nil
+	}
+
+	if val, ok := config[NetworkCIDR]; ok {
+		_, n, err := net.ParseCIDR(val)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to parse %s=%s", NetworkCIDR, val)
+		}
+		cidr = n
+	}
+
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		p.Log.Errorf("Failed to get interface Address for velero server : %s", err.Error())
-		return ""
+		return "", errors.Wrapf(err, "failed to get interfaces of velero server")
 	}
 
-	for _, netInterfaceAddress := range netInterfaceAddresses {
-		networkIP, ok := netInterfaceAddress.(*net.IPNet)
-		if ok && !networkIP.IP.IsLoopback() && networkIP.IP.To4() != nil {
-			ip := networkIP.IP.String()
-			p.Log.Infof("Ip address of velero-plugin server: %s", ip)
+	name := config[NetworkInterface]
+	for _, iface := range ifaces {
+		if name != "" && iface.Name != name {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			p.Log.Warnf("Failed to get address of interface=%s : %s", iface.Name, err)
+			continue
+		}
+
+		for _, addr := range addrs {
+			networkIP, ok := addr.(*net.IPNet)
+			// link-local address can't be used without zone
+			if !ok || networkIP.IP.IsLoopback() || networkIP.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if cidr != nil && !cidr.Contains(networkIP.IP) {
+				continue
+			}
+			ips = append(ips, networkIP.IP)
+		}
+	}
+
+	if ip := selectIP(ips, family); ip != nil {
+		p.Log.Infof("Ip address of velero-plugin server: %s", ip)
+		return ip.String(), nil
+	}
+
+	if name != "" || cidr != nil || family != "" {
+		return "", errors.Errorf("no address found for %s=%q %s=%q %s=%q", NetworkInterface, name,
+			NetworkCIDR, config[NetworkCIDR], IPFamily, family)
+	}
+	return "", errors.New("no non-loopback address found")
+}
+
+// selectIP return the first IP of given family from ips. If family is
+// empty then IPv4 address is preferred over IPv6 address.
+func selectIP(ips []net.IP, family string) net.IP {
+	var v6 net.IP
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if family != IPv6Family {
+				return ip
+			}
+			continue
+		}
+
+		if family == IPv6Family {
 			return ip
 		}
+		if family == "" && v6 == nil {
+			v6 = ip
+		}
 	}
-	return ""
+	return v6
 }
 
-// Init CStor snapshot plugin
-func (p *Plugin) Init(config map[string]string) error {
-	if ns, ok := config[NAMESPACE]; ok {
-		p.namespace = ns
+// getPortConfig return the port configured for given key, or given default port if it is not configured
+func getPortConfig(config map[string]string, key string, def int) (int, error) {
+	val, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+
+	port, err := strconv.Atoi(val)
+	if err != nil || port < 1 || port > math.MaxUint16 {
+		return 0, errors.Errorf("invalid %s=%s, expected port from 1 to %d", key, val, math.MaxUint16)
+	}
+	return port, nil
+}
+
+// SetClients sets the kubernetes, openebs and dynamic clients of the plugin, so that
+// clients are not created from the in-cluster config by Init. It is used to run the
+// plugin against fake clientsets.
+func (p *Plugin) SetClients(k8s kubernetes.Interface, openebsClient openebs.Interface,
+	openebsAPIs openebsapis.Interface, dynamicClient dynamic.Interface) {
+	p.K8sClient = k8s
+	p.OpenEBSClient = openebsClient
+	p.OpenEBSAPIsClient = openebsAPIs
+	p.dynamicClient = dynamicClient
+	p.clientsSet = true
+}
+
+// initClients creates the kubernetes, openebs and velero clients, and fetches
+// the address of maya-apiserver and cvc-server
+func (p *Plugin) initClients() error {
+	if p.clientsSet {
+		return p.initOpenEBSAddr()
 	}
 
 	conf, err := rest.InClusterConfig()
@@ -232,6 +707,13 @@ func (p *Plugin) Init(config map[string]string) error {
 
 	p.K8sClient = clientset
 
+	if p.dynamicClient, err = dynamic.NewForConfig(conf); err != nil {
+		p.Log.Errorf("Error creating dynamic client : %s", err.Error())
+		return errors.New("error creating dynamic client")
+	}
+
+	p.podExecutor = podexec.NewPodCommandExecutor(conf, clientset.CoreV1().RESTClient())
+
 	openEBSClient, err := openebs.NewForConfig(conf)
 	if err != nil {
 		p.Log.Errorf("Failed to create openEBS client. %s", err)
@@ -245,22 +727,57 @@ func (p *Plugin) Init(config map[string]string) error {
 		return err
 	}
 
-	p.mayaAddr, err = p.getMapiAddr()
-	if err != nil {
-		return errors.Wrapf(err, "error fetching Maya-ApiServer rest client address")
+	if err := p.initOpenEBSAddr(); err != nil {
+		return err
 	}
 
-	p.cvcAddr, err = p.getCVCAddr()
+	if err := velero.InitializeClientSet(conf); err != nil {
+		return errors.Wrapf(err, "failed to initialize velero clientSet")
+	}
+	return nil
+}
+
+// Init CStor snapshot plugin
+func (p *Plugin) Init(config map[string]string) error {
+	var err error
+
+	// config is validated before initialization, so that all the problems are reported together
+	warnings, err := validateConfig(config)
+	for _, w := range warnings {
+		p.Log.Warnf("volumesnapshotlocation config has %s, set %s=true to fail on unknown keys", w, StrictConfig)
+	}
 	if err != nil {
-		return errors.Wrapf(err, "error fetching CVC rest client address")
+		return err
+	}
+
+	if ns, ok := config[NAMESPACE]; ok {
+		p.namespace = ns
 	}
 
-	if p.mayaAddr == "" && p.cvcAddr == "" {
-		return errors.New("failed to get address for maya-apiserver/cvc-server service")
+	p.namespaceCacheTTL = defaultNamespaceCacheTTL
+	if ttlStr, ok := config[NamespaceCacheTTL]; ok {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", NamespaceCacheTTL)
+		}
+		p.namespaceCacheTTL = ttl
+	}
+
+	if level, ok := config[LogLevel]; ok {
+		if err := setLogLevel(p.Log, level); err != nil {
+			return err
+		}
+	}
+
+	if err := p.initClients(); err != nil {
+		return err
 	}
 
-	p.cstorServerAddr = p.getServerAddress()
-	if p.cstorServerAddr == "" {
+	// data server listens only on the bind address, so it is advertised to cStor
+	if addr, ok := config[cloud.BindAddress]; ok {
+		p.cstorServerAddr = addr
+	} else if p.cstorServerAddr, err = p.getServerAddress(config); err != nil {
+		p.Log.Errorf("Failed to get address for velero server : %s", err)
 		return errors.New("error fetching cstorVeleroServer address")
 	}
 	p.config = config
@@ -271,6 +788,9 @@ func (p *Plugin) Init(config map[string]string) error {
 	if p.snapshots == nil {
 		p.snapshots = make(map[string]*Snapshot)
 	}
+	if p.groupBackups == nil {
+		p.groupBackups = make(map[string]*groupBackup)
+	}
 
 	// check for user-provided timeout values
 	if timeoutStr, ok := config[RestTimeOut]; ok {
@@ -285,26 +805,313 @@ func (p *Plugin) Init(config map[string]string) error {
 
 	p.Log.Infof("Setting restApiTimeout to %v", p.restTimeout)
 
-	if local, ok := config[LocalSnapshot]; ok && isTrue(local) {
-		p.local = true
-		return nil
+	p.restRetries = defaultRestRetries
+	if retriesStr, ok := config[RestRetries]; ok {
+		retries, err := strconv.Atoi(retriesStr)
+		if err != nil || retries < 0 {
+			return errors.Errorf("invalid %s=%s, expected non-negative number", RestRetries, retriesStr)
+		}
+		p.restRetries = retries
 	}
 
-	if err := velero.InitializeClientSet(conf); err != nil {
-		return errors.Wrapf(err, "failed to initialize velero clientSet")
+	p.restRetryBackoff = defaultRestRetryBackoff
+	if backoffStr, ok := config[RestRetryBackoff]; ok {
+		backoff, err := time.ParseDuration(backoffStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", RestRetryBackoff)
+		}
+		p.restRetryBackoff = backoff
+	}
+
+	restClient, err := newRestClient(config, p.restTimeout)
+	if err != nil {
+		return err
+	}
+	p.restClient = restClient
+
+	p.overlapPolicy = OverlapPolicyWait
+	if policy, ok := config[BackupOverlapPolicy]; ok {
+		if policy != OverlapPolicyWait && policy != OverlapPolicySkip {
+			return errors.Errorf("invalid %s=%s, expected %s or %s",
+				BackupOverlapPolicy, policy, OverlapPolicyWait, OverlapPolicySkip)
+		}
+		p.overlapPolicy = policy
+	}
+
+	p.overlapTimeout = defaultOverlapTimeout
+	if timeoutStr, ok := config[BackupOverlapTimeout]; ok {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", BackupOverlapTimeout)
+		}
+		p.overlapTimeout = timeout
+	}
+
+	p.backupStatusInterval = defaultBackupStatusInterval
+	if intervalStr, ok := config[BackupStatusInterval]; ok {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", BackupStatusInterval)
+		}
+		if interval <= 0 {
+			return errors.Errorf("invalid %s=%s, expected positive duration", BackupStatusInterval, intervalStr)
+		}
+		p.backupStatusInterval = interval
+	}
+
+	if timeoutStr, ok := config[BackupTimeout]; ok {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", BackupTimeout)
+		}
+		p.backupTimeout = timeout
+	}
+
+	p.backupStallTimeout = defaultBackupStallTimeout
+	if timeoutStr, ok := config[BackupStallTimeout]; ok {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", BackupStallTimeout)
+		}
+		p.backupStallTimeout = timeout
+	}
+
+	p.backupReplicaRetries = defaultBackupReplicaRetries
+	if retriesStr, ok := config[BackupReplicaRetries]; ok {
+		retries, err := strconv.Atoi(retriesStr)
+		if err != nil || retries < 0 {
+			return errors.Errorf("invalid %s=%s, expected non-negative number", BackupReplicaRetries, retriesStr)
+		}
+		p.backupReplicaRetries = retries
+	}
+
+	p.staleBackupTTL = defaultStaleBackupTTL
+	if ttlStr, ok := config[StaleBackupTTL]; ok {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", StaleBackupTTL)
+		}
+		p.staleBackupTTL = ttl
+	}
+	if p.staleBackupTTL != 0 && p.backupTimeout != 0 && p.staleBackupTTL <= p.backupTimeout {
+		return errors.Errorf("%s=%v should be greater than %s=%v", StaleBackupTTL, p.staleBackupTTL, BackupTimeout, p.backupTimeout)
+	}
+
+	// cleanup of stale backup resources doesn't block the plugin initialization
+	go p.cleanupStaleBackups()
+
+	if err := p.initSharding(config); err != nil {
+		return err
+	}
+
+	if p.volumeSelector, err = parseVolumeSelector(config); err != nil {
+		return err
+	}
+
+	if err := p.initBackupWindow(config); err != nil {
+		return err
+	}
+
+	if err := p.initVolumeHealthPolicy(config); err != nil {
+		return err
+	}
+
+	if p.backupNameTemplate, err = getNameTemplate(config); err != nil {
+		return err
+	}
+
+	if backupTerminating, ok := config[BackupTerminatingVolumes]; ok {
+		p.backupTerminating = isTrue(backupTerminating)
+	}
+
+	if block, ok := config[BlockDependentDeletion]; ok {
+		p.blockDependentDeletion = isTrue(block)
+	}
+
+	if dryRun, ok := config[RestoreDryRun]; ok {
+		p.restoreDryRun = isTrue(dryRun)
+	}
+
+	p.volumeStatusAnnotations = true
+	if statusAnnotations, ok := config[VolumeStatusAnnotations]; ok {
+		p.volumeStatusAnnotations = isTrue(statusAnnotations)
+	}
+
+	if local, ok := config[LocalSnapshot]; ok && isTrue(local) {
+		p.local = true
+		return p.initHealthServer(config)
 	}
 
-	if restoreAllSnapshots, ok := config[RestoreAllIncrementalSnapshots]; ok && isTrue(restoreAllSnapshots) {
-		p.restoreAllSnapshots = true
-		p.autoSetTargetIP = true
+	// restore of a scheduled backup replays the incremental chain, from base backup
+	// to the given backup, unless user has explicitly disabled it
+	p.restoreAllSnapshots = true
+	if restoreAllSnapshots, ok := config[RestoreAllIncrementalSnapshots]; ok {
+		p.restoreAllSnapshots = isTrue(restoreAllSnapshots)
 	}
+	p.autoSetTargetIP = p.restoreAllSnapshots
 
 	if autoSetTargetIP, ok := config[AutoSetTargetIP]; ok {
 		p.autoSetTargetIP = isTrue(autoSetTargetIP)
+	} else if !p.restoreAllSnapshots {
+		// incremental snapshots are restored one by one, so targetip can be set
+		// only after restoring the latest snapshot
+		p.autoSetTargetIPLatest = true
+	}
+
+	if retainLocal, ok := config[RetainLocalSnapshot]; ok {
+		p.retainLocal = isTrue(retainLocal)
+	}
+
+	if p.snapshotMode, err = parseSnapshotMode(config); err != nil {
+		return err
+	}
+	p.volumeSnapshotClass = config[VolumeSnapshotClass]
+
+	p.csiSnapshotTimeout = defaultCSISnapshotTimeout
+	if timeoutStr, ok := config[CSISnapshotTimeout]; ok {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", CSISnapshotTimeout)
+		}
+		p.csiSnapshotTimeout = timeout
+	}
+
+	p.verifyMode = VerifyNone
+	if mode, ok := config[VerifyBackup]; ok {
+		if mode != VerifyNone && mode != VerifySize && mode != VerifyChecksum {
+			return errors.Errorf("invalid %s=%s, expected %s, %s or %s",
+				VerifyBackup, mode, VerifyNone, VerifySize, VerifyChecksum)
+		}
+		p.verifyMode = mode
+	}
+
+	parallel := 1
+	if parallelStr, ok := config[Parallel]; ok {
+		parallel, err = strconv.Atoi(parallelStr)
+		if err != nil || parallel < 1 || parallel > MaxParallelBackups {
+			return errors.Errorf("invalid %s=%s, expected value from 1 to %d", Parallel, parallelStr, MaxParallelBackups)
+		}
+	}
+
+	if limitStr, ok := config[PoolBackupLimit]; ok {
+		p.poolBackupLimit, err = strconv.Atoi(limitStr)
+		if err != nil || p.poolBackupLimit < 0 {
+			return errors.Errorf("invalid %s=%s, expected non-negative number", PoolBackupLimit, limitStr)
+		}
+	}
+
+	if p.restorePort, err = getPortConfig(config, RestorePort, CstorRestorePort); err != nil {
+		return err
+	}
+	if p.backupPort, err = getPortConfig(config, BackupPort, CstorBackupPort); err != nil {
+		return err
+	}
+	if p.backupPort+parallel-1 > math.MaxUint16 {
+		return errors.Errorf("invalid %s=%d, backup ports exceed %d for %s=%d",
+			BackupPort, p.backupPort, math.MaxUint16, Parallel, parallel)
+	}
+	if p.restorePort >= p.backupPort && p.restorePort < p.backupPort+parallel {
+		return errors.Errorf("invalid %s=%d, it conflicts with backup ports %d-%d",
+			RestorePort, p.restorePort, p.backupPort, p.backupPort+parallel-1)
+	}
+
+	if p.backupPorts, err = getBackupPortPool(p.backupPort, parallel, p.restorePort); err != nil {
+		return err
+	}
+	p.restoreLock = getRestorePortLock(p.restorePort)
+
+	p.canaryInterval = defaultCanaryInterval
+	if intervalStr, ok := config[CanaryInterval]; ok {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", CanaryInterval)
+		}
+		p.canaryInterval = interval
+	}
+
+	if countStr, ok := config[RetentionCount]; ok {
+		p.retentionCount, err = strconv.Atoi(countStr)
+		if err != nil || p.retentionCount < 0 {
+			return errors.Errorf("invalid %s=%s, expected non-negative number", RetentionCount, countStr)
+		}
+	}
+
+	if periodStr, ok := config[RetentionPeriod]; ok {
+		p.retentionPeriod, err = time.ParseDuration(periodStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", RetentionPeriod)
+		}
+	}
+
+	if intervalStr, ok := config[FullBackupInterval]; ok {
+		p.fullBackupInterval, err = strconv.Atoi(intervalStr)
+		if err != nil || p.fullBackupInterval < 0 {
+			return errors.Errorf("invalid %s=%s, expected non-negative number", FullBackupInterval, intervalStr)
+		}
+	}
+
+	if (p.retentionCount > 0 || p.retentionPeriod > 0) && p.fullBackupInterval == 0 && !p.local {
+		p.Log.Warnf("Backups of a schedule are incremental to its first backup, so retention doesn't delete them. Set %s to take periodic full backups",
+			FullBackupInterval)
+	}
+
+	if quotaStr, ok := config[BucketQuota]; ok {
+		quota, err := resource.ParseQuantity(quotaStr)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s", BucketQuota)
+		}
+		p.bucketQuota = quota.Value()
+	}
+
+	if p.storageClassMapping, err = parseNameMapping(config[RestoreStorageClass]); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", RestoreStorageClass)
+	}
+
+	p.existingVolumePolicy = ExistingVolumeRestore
+	if policy, ok := config[ExistingVolumePolicy]; ok {
+		if policy != ExistingVolumeRestore && policy != ExistingVolumeSkip &&
+			policy != ExistingVolumeFail && policy != ExistingVolumeRename {
+			return errors.Errorf("invalid %s=%s, expected %s, %s, %s or %s", ExistingVolumePolicy, policy,
+				ExistingVolumeRestore, ExistingVolumeSkip, ExistingVolumeFail, ExistingVolumeRename)
+		}
+		p.existingVolumePolicy = policy
+	}
+
+	if p.poolClusterMapping, err = parseNameMapping(config[RestorePoolCluster]); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", RestorePoolCluster)
+	}
+
+	if p.zoneMapping, err = parseNameMapping(config[RestoreZoneMapping]); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", RestoreZoneMapping)
+	}
+
+	if p.zonePoolCluster, err = parseNameMapping(config[ZonePoolCluster]); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", ZonePoolCluster)
+	}
+
+	if p.sizeMapping, err = parseSizeMapping(config[RestoreSize]); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", RestoreSize)
+	}
+
+	if p.restoreReplicaCount, err = parseReplicaCount(config[RestoreReplicaCount]); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", RestoreReplicaCount)
+	}
+
+	if err := p.initAttestation(config); err != nil {
+		return err
 	}
 
 	p.cl = &cloud.Conn{Log: p.Log}
-	return p.cl.Init(config)
+	if err := p.cl.Init(config); err != nil {
+		return err
+	}
+
+	// canary check doesn't block the plugin initialization
+	go p.runCanary()
+
+	// cleanup of interrupted backups doesn't block the plugin initialization
+	go p.cleanupInterruptedBackups()
+	return p.initHealthServer(config)
 }
 
 // SetOpenEBSAPIClient sets openebs client from openebs/apis
@@ -321,7 +1128,6 @@ func (p *Plugin) SetOpenEBSAPIClient(c *rest.Config) error {
 
 // GetVolumeID return volume name for given PV
 func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error) {
-	var isCSIVolume bool
 	pv := new(v1.PersistentVolume)
 
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
@@ -336,40 +1142,116 @@ func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error
 		return "", nil
 	}
 
-	volType, ok := pv.Labels[openebsVolumeLabel]
-	if ok {
-		if volType != casTypeCStor {
-			return "", nil
-		}
-	} else {
-		// check if PV is created by CSI driver
-		if isCSIVolume = isCSIPv(*pv); !isCSIVolume {
-			return "", nil
-		}
+	isCStorVolume, isCSIVolume := getCStorVolumeType(pv)
+	if !isCStorVolume {
+		return "", nil
 	}
 
-	if pv.Status.Phase == v1.VolumeReleased ||
+	reason, err := p.getExcludeReason(pv)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to check if volume=%s is excluded", pv.Name)
+	}
+
+	// velero doesn't take the snapshot if volume ID is empty
+	if reason != "" {
+		p.Log.Infof("Volume=%s is excluded, %s, skipping it", pv.Name, reason)
+		return "", nil
+	}
+
+	// released PV, whose claim is deleted, can be backed up if backup of terminating volumes is enabled
+	if (pv.Status.Phase == v1.VolumeReleased && !p.backupTerminating) ||
 		pv.Status.Phase == v1.VolumeFailed {
 		return "", errors.New("pv is in released state")
 	}
 
+	claim, owned, err := p.claimVolume(pv)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to claim volume=%s in shard group=%s", pv.Name, p.shardGroup)
+	}
+
+	// velero doesn't take the snapshot of the volume claimed by other instance
+	if !owned {
+		return "", nil
+	}
+
+	if volumeModeOf(pv.Spec.VolumeMode) == v1.PersistentVolumeBlock {
+		p.Log.Infof("Volume=%s has volumeMode=%s, raw block data of the volume is backed up", pv.Name, v1.PersistentVolumeBlock)
+	}
+
+	vol := p.addVolume(pv, isCSIVolume)
+	vol.shardClaim = claim
+	return pv.Name, nil
+}
+
+// getCStorVolumeType returns true if the given PV is a cStor volume,
+// along with true if it is a cStor based CSI volume
+func getCStorVolumeType(pv *v1.PersistentVolume) (isCStorVolume, isCSIVolume bool) {
+	volType, ok := pv.Labels[openebsVolumeLabel]
+	if ok {
+		return volType == casTypeCStor, false
+	}
+
+	// check if PV is created by CSI driver
+	isCSIVolume = isCSIPv(*pv)
+	return isCSIVolume, isCSIVolume
+}
+
+// addVolume adds the volume of the given PV to the list of volumes, if it doesn't exist,
+// and returns the volume from the list
+func (p *Plugin) addVolume(pv *v1.PersistentVolume, isCSIVolume bool) *Volume {
+	p.volumeLock.Lock()
+	defer p.volumeLock.Unlock()
+
 	if _, exists := p.volumes[pv.Name]; !exists {
 		p.volumes[pv.Name] = &Volume{
 			volname:      pv.Name,
 			snapshotTag:  pv.Name,
 			storageClass: pv.Spec.StorageClassName,
 			namespace:    pv.Spec.ClaimRef.Namespace,
+			pvcName:      pv.Spec.ClaimRef.Name,
 			size:         pv.Spec.Capacity[v1.ResourceStorage],
 			isCSIVolume:  isCSIVolume,
 		}
 	}
+	return p.volumes[pv.Name]
+}
 
-	return pv.Name, nil
+// getVolume return the volume having given name from the list of volumes
+func (p *Plugin) getVolume(volname string) (*Volume, bool) {
+	p.volumeLock.Lock()
+	defer p.volumeLock.Unlock()
+
+	vol, ok := p.volumes[volname]
+	return vol, ok
+}
+
+// setVolume adds the given volume to the list of volumes, replacing the existing one
+func (p *Plugin) setVolume(vol *Volume) {
+	p.volumeLock.Lock()
+	defer p.volumeLock.Unlock()
+
+	p.volumes[vol.volname] = vol
+}
+
+// getSnapshot return the snapshot having given ID from the list of snapshots
+func (p *Plugin) getSnapshot(snapshotID string) (*Snapshot, bool) {
+	p.volumeLock.Lock()
+	defer p.volumeLock.Unlock()
+
+	snap, ok := p.snapshots[snapshotID]
+	return snap, ok
+}
+
+// setSnapshot adds the given snapshot to the list of snapshots
+func (p *Plugin) setSnapshot(snapshotID string, snap *Snapshot) {
+	p.volumeLock.Lock()
+	defer p.volumeLock.Unlock()
+
+	p.snapshots[snapshotID] = snap
 }
 
 // DeleteSnapshot delete CStor volume snapshot
 func (p *Plugin) DeleteSnapshot(snapshotID string) error {
-	var snapInfo *Snapshot
 	var err error
 
 	if snapshotID == "" {
@@ -378,14 +1260,18 @@ func (p *Plugin) DeleteSnapshot(snapshotID string) error {
 	}
 
 	p.Log.Infof("Deleting snapshot %v", snapshotID)
-	if _, exists := p.snapshots[snapshotID]; !exists {
+	snapInfo, exists := p.getSnapshot(snapshotID)
+	if !exists {
 		snapInfo, err = p.getSnapInfo(snapshotID)
+		if k8serrors.IsNotFound(errors.Cause(err)) {
+			// backup resources of deleted volume can't be located, they are
+			// removed along with the volume or by stale backup clean-up
+			return p.deleteRemoteSnapshotOf(snapshotID, err)
+		}
 		if err != nil {
 			return err
 		}
-		p.snapshots[snapshotID] = snapInfo
-	} else {
-		snapInfo = p.snapshots[snapshotID]
+		p.setSnapshot(snapshotID, snapInfo)
 	}
 
 	scheduleName := p.getScheduleName(snapInfo.backupName)
@@ -398,92 +1284,216 @@ func (p *Plugin) DeleteSnapshot(snapshotID string) error {
 			scheduleName)
 	}
 
-	err = p.sendDeleteRequest(snapInfo.backupName,
-		snapInfo.volID,
-		snapInfo.namespace,
-		scheduleName, snapInfo.isCSIVolume)
-	if err != nil {
-		return errors.Wrapf(err, "failed to execute maya-apiserver DELETE API")
+	if !p.local && scheduleName != snapInfo.backupName {
+		// check if incremental backups of the schedule depend on this backup
+		if err = p.checkDependentBackups(snapInfo.volID, snapInfo.backupName, scheduleName); err != nil {
+			if p.blockDependentDeletion {
+				return err
+			}
+			p.Log.Warnf("%s. Deleting it since %s is not set, dependent backups can't be restored after the deletion",
+				err, BlockDependentDeletion)
+		}
+	}
+
+	// deletion is retried by velero if it fails, so part deleted by a previous
+	// attempt may not exist anymore
+	localErr := retryDelete(func() error {
+		return p.deleteBackup(snapInfo.backupName,
+			snapInfo.volID,
+			snapInfo.namespace,
+			scheduleName, snapInfo.isCSIVolume)
+	})
+	if localErr != nil {
+		localErr = errors.Wrapf(localErr, "failed to delete backup")
 	}
 
 	if p.local {
 		// volumesnapshotlocation is configured for local snapshot
+		if localErr == nil {
+			p.uncatalogBackup(snapInfo.volID, snapInfo.backupName)
+		}
+		return localErr
+	}
+
+	remoteErr := retryDelete(func() error {
+		return p.deleteRemoteSnapshotOfVolume(snapInfo.volID, snapInfo.backupName)
+	})
+	if remoteErr == nil {
+		p.uncatalogBackup(snapInfo.volID, snapInfo.backupName)
+	}
+
+	switch {
+	case localErr != nil && remoteErr != nil:
+		return errors.Errorf("failed to delete snapshot=%s, %s, %s", snapshotID, localErr, remoteErr)
+	case localErr != nil:
+		p.Log.Warnf("Remote snapshot of snapshot=%s is deleted, %s", snapshotID, localErr)
+	case remoteErr != nil:
+		p.Log.Warnf("Backup resources of snapshot=%s are deleted, %s", snapshotID, remoteErr)
+	}
+	return nil
+}
+
+// deleteRemoteSnapshotOf deletes the remote snapshot of given snapshotID, whose volume
+// doesn't exist. Given error, of fetching the volume, is returned for local snapshot.
+func (p *Plugin) deleteRemoteSnapshotOf(snapshotID string, volErr error) error {
+	if p.local {
+		p.Log.Warnf("Skipping deletion of local snapshot=%s : %s", snapshotID, volErr)
 		return nil
 	}
 
-	filename := p.cl.GenerateRemoteFilename(snapInfo.volID, snapInfo.backupName)
+	volumeID, bkpName, err := getInfoFromSnapshotID(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	p.Log.Warnf("Deleting only remote snapshot of snapshot=%s : %s", snapshotID, volErr)
+	err = retryDelete(func() error {
+		return p.deleteRemoteSnapshotOfVolume(volumeID, bkpName)
+	})
+	if err == nil {
+		p.uncatalogBackup(volumeID, bkpName)
+	}
+	return err
+}
+
+// retryDelete executes the given deletion, retrying it till deleteRetries on failure
+func retryDelete(del func() error) error {
+	var err error
+
+	for i := 0; i < deleteRetries; i++ {
+		if i != 0 {
+			time.Sleep(deleteRetryInterval)
+		}
+		if err = del(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// deleteRemoteSnapshotOfVolume removes the remote snapshot of the given volume and backup. If dedup
+// is configured then lease of the volume is held during the removal.
+func (p *Plugin) deleteRemoteSnapshotOfVolume(volname, backupName string) error {
+	if !p.cl.DedupEnabled() {
+		return p.deleteRemoteSnapshot(volname, backupName)
+	}
+
+	// unused chunks are deleted along with the snapshot, so backup of the volume
+	// shouldn't be uploading the chunks, which it skipped, concurrently
+	ctx, cancel := context.WithTimeout(context.Background(), p.overlapTimeout)
+	defer cancel()
+
+	lease, err := p.acquireVolumeLease(ctx, volname, volumeOpDelete, backupName)
+	if err != nil {
+		return err
+	}
+	defer p.releaseVolumeLease(lease)
+
+	return p.deleteRemoteSnapshot(volname, backupName)
+}
+
+// deleteRemoteSnapshot removes the remote snapshot file, and its manifest, of the given backup
+func (p *Plugin) deleteRemoteSnapshot(snapshotTag, backupName string) error {
+	filename := p.cl.GenerateRemoteFilename(snapshotTag, backupName)
 	if filename == "" {
 		return errors.Errorf("Error creating remote file name for backup")
 	}
 
+	// remote snapshot may have been deleted already as per retention policy
+	if exists, err := p.cl.ObjectExists(filename); err == nil && !exists {
+		p.Log.Infof("Remote snapshot=%s doesn't exist, skipping removal", filename)
+		return nil
+	}
+
 	ret := p.cl.Delete(filename)
 	if !ret {
 		return errors.New("failed to remove snapshot")
 	}
 
+	// backups created by older version of plugin don't have manifest
+	if exists, err := p.cl.ObjectExists(filename + manifestSuffix); err == nil && exists {
+		if !p.cl.Delete(filename + manifestSuffix) {
+			p.Log.Warnf("Failed to remove manifest of snapshot=%s", filename)
+		}
+	}
+
+	if exists, err := p.cl.ObjectExists(filename + attestationSuffix); err == nil && exists {
+		if !p.cl.Delete(filename + attestationSuffix) {
+			p.Log.Warnf("Failed to remove attestation of snapshot=%s", filename)
+		}
+	}
+
 	return nil
 }
 
 // CreateSnapshot creates snapshot for CStor volume and upload it to cloud storage
-func (p *Plugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
-	if !p.local {
-		p.cl.ExitServer = false
-	}
-
+func (p *Plugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (snapshotID string, err error) {
 	bkpname, ok := tags["velero.io/backup"]
 	if !ok {
 		return "", errors.New("failed to get backup name")
 	}
 
-	vol, ok := p.volumes[volumeID]
+	vol, ok := p.getVolume(volumeID)
 	if !ok {
 		return "", errors.New("volume not found")
 	}
 	vol.backupName = bkpname
-	size, ok := vol.size.AsInt64()
-	if !ok {
-		return "", errors.Errorf("Failed to parse volume size %v", vol.size)
-	}
+	vol.zone = volumeAZ
 
-	if !p.local {
-		// If cloud snapshot is configured then we need to backup PVC also
-		err := p.backupPVC(volumeID)
-		if err != nil {
-			return "", errors.Wrapf(err, "failed to create backup for PVC")
-		}
-	}
+	// claim of failed backup is released, so that other instance of shard group can backup the volume
+	defer func() {
+		p.completeVolumeClaim(vol, err == nil)
+	}()
 
-	p.Log.Infof("creating snapshot{%s}", bkpname)
+	if err := p.waitForBackupWindow(vol); err != nil {
+		return "", err
+	}
 
-	bkp, err := p.sendBackupRequest(vol)
+	group, err := p.getConsistencyGroup(vol)
 	if err != nil {
-		return "", errors.Wrapf(err, "Failed to send backup request")
+		return "", err
 	}
 
-	p.Log.Infof("Snapshot Successfully Created")
-
-	if p.local {
-		// local snapshot
+	if group != "" {
+		// snapshot of the volume is taken along with the other volumes of the group
+		if err := p.createGroupSnapshot(vol, group); err != nil {
+			return "", err
+		}
 		return generateSnapshotID(volumeID, bkpname), nil
 	}
 
-	filename := p.cl.GenerateRemoteFilename(vol.snapshotTag, vol.backupName)
-	if filename == "" {
-		return "", errors.Errorf("Error creating remote file name for backup")
+	if err := p.prepareBackup(vol); err != nil {
+		return "", err
 	}
 
-	go p.checkBackupStatus(bkp, vol.isCSIVolume)
+	log := p.volumeLog(vol, phaseSnapshot)
+	log.Info("Creating snapshot")
 
-	ok = p.cl.Upload(filename, size, CstorBackupPort)
-	if !ok {
-		return "", errors.New("failed to upload snapshot")
+	startTime := time.Now()
+
+	// wait for the port, if maximum number of backups are in progress
+	port := p.acquireBackupPorts(1)[0]
+	defer p.releaseBackupPort(port)
+
+	t, err := p.newBackupTask(vol, port, startTime)
+	if err != nil {
+		return "", err
 	}
+	defer t.cancel()
 
-	if vol.backupStatus == v1alpha1.BKPCStorStatusDone {
-		return generateSnapshotID(volumeID, bkpname), nil
+	if err := p.createBackups([]*backupTask{t}); err != nil {
+		return "", err
 	}
+	if t.err != nil {
+		return "", t.err
+	}
+
+	log.Info("Snapshot created")
 
-	return "", errors.Errorf("Failed to upload snapshot, status:{%v}", vol.backupStatus)
+	if err := p.completeBackup(t); err != nil {
+		return "", err
+	}
+	return generateSnapshotID(volumeID, bkpname), nil
 }
 
 func (p *Plugin) getSnapInfo(snapshotID string) (*Snapshot, error) {
@@ -497,7 +1507,7 @@ func (p *Plugin) getSnapInfo(snapshotID string) (*Snapshot, error) {
 		PersistentVolumes().
 		Get(context.TODO(), volumeID, metav1.GetOptions{})
 	if err != nil {
-		return nil, errors.Errorf("Error fetching volume{%s} : %s", volumeID, err.Error())
+		return nil, errors.Wrapf(err, "Error fetching volume{%s}", volumeID)
 	}
 
 	// TODO
@@ -508,7 +1518,7 @@ func (p *Plugin) getSnapInfo(snapshotID string) (*Snapshot, error) {
 	return &Snapshot{
 		volID:       volumeID,
 		backupName:  bkpName,
-		namespace:   pv.Spec.ClaimRef.Namespace,
+		namespace:   p.findBackupNamespace(volumeID, p.getScheduleName(bkpName), pv.Spec.ClaimRef.Namespace),
 		isCSIVolume: isCSIVolume,
 	}, nil
 }
@@ -521,7 +1531,7 @@ func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ strin
 		err    error
 	)
 
-	if volumeType != "cstor-snapshot" {
+	if !isValidVolumeType(volumeType) {
 		return "", errors.Errorf("Invalid volume type{%s}", volumeType)
 	}
 
@@ -530,36 +1540,72 @@ func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ strin
 		return "", err
 	}
 
+	startTime := time.Now()
+
+	local := p.local
+	if !local && p.retainLocal {
+		// restore from the retained snapshot if it is available in the cluster
+		local = p.isLocalSnapshotRetained(volumeID, snapName)
+	}
+
 	snapType := "remote"
-	if p.local {
+	if local {
 		snapType = "local"
 	}
 
-	p.Log.Infof("Restoring %s snapshot{%s} for volume:%s", snapType, snapName, volumeID)
+	log := p.Log.WithFields(logrus.Fields{
+		logFieldBackup: snapName,
+		logFieldVolume: volumeID,
+		logFieldPhase:  phaseRestore,
+		"type":         snapType,
+	})
 
-	if p.local {
+	if p.isRestoreExcluded(volumeID, snapName, local) {
+		// PV is not restored by PVRestoreItemAction, so volume of backup is returned as it is
+		return volumeID, nil
+	}
+
+	if p.isRestoreDryRun(snapName) {
+		log.Info("Validating restore of snapshot")
+		return "", p.dryRunRestore(volumeID, snapName, local)
+	}
+
+	log.Info("Restoring snapshot")
+
+	if local {
 		newVol, err = p.getVolumeForLocalRestore(volumeID, snapName)
 		if err != nil {
 			return "", errors.Wrapf(err, "Failed to read PVC for volumeID=%s snap=%s", volumeID, snapName)
 		}
 
+		newVol.labels = p.getRestoreLabels(snapName)
 		err = p.restoreVolumeFromLocal(newVol)
 	} else {
-		newVol, err = p.getVolumeForRemoteRestore(volumeID, snapName)
+		newVol, err = p.getVolumeForRemoteRestore(volumeID, snapName, volumeAZ)
 		if err != nil {
 			return "", errors.Wrapf(err, "Failed to read PVC for volumeID=%s snap=%s", volumeID, snapName)
 		}
 
+		if newVol.skipped {
+			return newVol.volname, nil
+		}
+
+		newVol.labels = p.getRestoreLabels(snapName)
 		err = p.restoreVolumeFromCloud(newVol, snapName)
 	}
 
 	if err != nil {
-		p.Log.Errorf("Failed to restore volume : %s", err)
+		log.WithError(err).Error("Failed to restore volume")
 		return "", errors.Wrapf(err, "Failed to restore volume")
 	}
 
+	// volume already has the data of backup
+	if newVol.skipped {
+		return newVol.volname, nil
+	}
+
 	if newVol.restoreStatus == v1alpha1.RSTCStorStatusDone {
-		if p.autoSetTargetIP {
+		if !newVol.local && p.shouldSetTargetIP(snapName) {
 			if err := p.markCVRsAsRestoreCompleted(newVol); err != nil {
 				readmeUrl := "https://github.com/openebs/velero-plugin#setting-targetip-in-replica"
 				errMsg := fmt.Sprintf(
@@ -570,16 +1616,55 @@ func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ strin
 			}
 		}
 
-		p.Log.Infof("Restore completed for CStor volume:%s snapshot:%s", volumeID, snapName)
+		log.WithField(logFieldNamespace, newVol.namespace).Infof("Restore completed to volume=%s", newVol.volname)
+		p.reportRestoreSummary(newVol, volumeID, snapName, time.Since(startTime))
+		p.annotateRestoreStatus(newVol, volumeID, snapName)
 		return newVol.volname, nil
 	}
 
 	return "", errors.New("failed to restore snapshot")
 }
 
-// GetVolumeInfo return volume information for given volume name
+// GetVolumeInfo return volume information for given volume name. Volume type is the
+// cas type and storageclass of the volume, like cstor/openebs-cstor-sparse. IOPS is
+// always nil since cStor volumes don't have provisioned IOPS.
 func (p *Plugin) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
-	return "cstor-snapshot", nil, nil
+	vol, ok := p.getVolume(volumeID)
+	if ok {
+		return volumeTypeOf(vol.isCSIVolume, vol.storageClass), nil, nil
+	}
+
+	pv, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumes().
+		Get(context.TODO(), volumeID, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to fetch PV=%s", volumeID)
+	}
+	_, isCSIVolume := getCStorVolumeType(pv)
+	return volumeTypeOf(isCSIVolume, pv.Spec.StorageClassName), nil, nil
+}
+
+// volumeTypeOf return the volume type, recorded by velero in backup, for the volume
+// of given storageclass
+func volumeTypeOf(isCSIVolume bool, storageClass string) string {
+	casType := volumeTypeCStor
+	if isCSIVolume {
+		casType = volumeTypeCStorCSI
+	}
+	if storageClass == "" {
+		return casType
+	}
+	return casType + "/" + storageClass
+}
+
+// isValidVolumeType returns true if given volume type is set by the plugin
+func isValidVolumeType(volumeType string) bool {
+	if volumeType == legacyVolumeType {
+		return true
+	}
+	casType := strings.SplitN(volumeType, "/", 2)[0]
+	return casType == volumeTypeCStor || casType == volumeTypeCStorCSI
 }
 
 // SetVolumeID set volumeID for given PV
@@ -590,9 +1675,14 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 		return nil, errors.WithStack(err)
 	}
 
-	vol := p.volumes[volumeID]
+	vol, ok := p.getVolume(volumeID)
+	if !ok {
+		// volume excluded by the restore namespace filter isn't restored, so PV is left
+		// unchanged and it is skipped by the restore item action
+		return unstructuredPV, nil
+	}
 
-	if p.local {
+	if vol.local {
 		if !vol.isCSIVolume {
 			fsType := pv.Spec.PersistentVolumeSource.ISCSI.FSType
 			pv.Spec.PersistentVolumeSource = v1.PersistentVolumeSource{
@@ -614,44 +1704,18 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 	return &unstructured.Unstructured{Object: res}, nil
 }
 
-// getScheduleName return the schedule name for the given backup
-// It will check if backup name have 'bkp-20060102150405' format
+// getScheduleName return the schedule name for the given backup, as per the configured
+// backup name template, or the backup name if it is not a scheduled backup
 func (p *Plugin) getScheduleName(backupName string) string {
-	// for non-scheduled backup, we are considering backup name as schedule name only
-	scheduleOrBackupName := backupName
-
-	// If it is scheduled backup then we need to get the schedule name
-	splitName := strings.Split(backupName, "-")
-	if len(splitName) >= 2 {
-		_, err := time.Parse("20060102150405", splitName[len(splitName)-1])
-		if err != nil {
-			// last substring is not timestamp, so it is not generated from schedule
-			return scheduleOrBackupName
-		}
-		scheduleOrBackupName = strings.Join(splitName[0:len(splitName)-1], "-")
-	}
-	return scheduleOrBackupName
+	return p.nameTemplate().scheduleOf(backupName)
 }
 
-// getInfoFromSnapshotID return backup name and volume id from the given snapshotID
-func getInfoFromSnapshotID(snapshotID string) (volumeID, backupName string, err error) {
-	s := strings.Split(snapshotID, SnapshotIDIdentifier)
-	if len(s) != 2 {
-		err = errors.New("invalid snapshot id")
-		return
+// nameTemplate return the configured backup name template
+func (p *Plugin) nameTemplate() *backupNameTemplate {
+	if p.backupNameTemplate == nil {
+		return defaultNameTemplate
 	}
-
-	volumeID = s[0]
-	backupName = s[1]
-
-	if volumeID == "" || backupName == "" {
-		err = errors.Errorf("invalid volumeID=%s backupName=%s", volumeID, backupName)
-	}
-	return
-}
-
-func generateSnapshotID(volumeID, backupName string) string {
-	return volumeID + SnapshotIDIdentifier + backupName
+	return p.backupNameTemplate
 }
 
 func isTrue(str string) bool {
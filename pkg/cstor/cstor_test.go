@@ -0,0 +1,266 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	snapapi "github.com/openebs/maya/pkg/client/generated/cstor-volume-mgmt/v1alpha1"
+	snapclient "github.com/openebs/maya/pkg/client/snapshot/cstor/v1alpha1"
+	"github.com/openebs/velero-plugin/pkg/cstor"
+	"github.com/openebs/velero-plugin/pkg/cstor/fake"
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"google.golang.org/grpc"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	testNamespace = "openebs"
+	testVolume    = "pvc-1"
+	testBackup    = "backup-1"
+	testPool      = "pool-1"
+)
+
+// snapServer is a fake volume target serving the snapshot API of cStor volume
+type snapServer struct {
+	snapapi.UnimplementedRunSnapCommandServer
+
+	mu      sync.Mutex
+	created []string
+	deleted []string
+}
+
+func (s *snapServer) RunVolumeSnapCreateCommand(_ context.Context, req *snapapi.VolumeSnapCreateRequest) (*snapapi.VolumeSnapCreateResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.created = append(s.created, req.Volume+"@"+req.Snapname)
+	return &snapapi.VolumeSnapCreateResponse{Status: []byte(`{"response":"OK"}`)}, nil
+}
+
+func (s *snapServer) RunVolumeSnapDeleteCommand(_ context.Context, req *snapapi.VolumeSnapDeleteRequest) (*snapapi.VolumeSnapDeleteResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, req.Volume+"@"+req.Snapname)
+	return &snapapi.VolumeSnapDeleteResponse{Status: []byte(`{"response":"OK"}`)}, nil
+}
+
+// snapshots return the snapshots created and deleted through the server
+func (s *snapServer) snapshots() (created, deleted []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.created...), append([]string(nil), s.deleted...)
+}
+
+// startSnapServer starts the fake volume target on the snapshot API port of loopback address.
+// Test is skipped if the port is not available.
+func startSnapServer(t *testing.T) *snapServer {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(snapclient.VolumeGrpcListenPort)))
+	if err != nil {
+		t.Skipf("snapshot API port is not available : %s", err)
+	}
+
+	s := &snapServer{}
+	srv := grpc.NewServer()
+	snapapi.RegisterRunSnapCommandServer(srv, s)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+	return s
+}
+
+// testObjects return the resources of a cStor volume, having a healthy replica, and its velero backup
+func testObjects() []runtime.Object {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   testVolume,
+			Labels: map[string]string{"openebs.io/cas-type": "cstor"},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: "cstor-sc",
+			Capacity:         v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			ClaimRef:         &v1.ObjectReference{Namespace: "app", Name: "data"},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+	}
+
+	cv := &v1alpha1.CStorVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: testVolume, Namespace: testNamespace},
+		Spec:       v1alpha1.CStorVolumeSpec{TargetIP: "127.0.0.1", ReplicationFactor: 1},
+		Status:     v1alpha1.CStorVolumeStatus{Phase: "Healthy"},
+	}
+
+	cvr := &v1alpha1.CStorVolumeReplica{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testVolume + "-" + testPool,
+			Namespace: testNamespace,
+			Labels: map[string]string{
+				"openebs.io/persistent-volume": testVolume,
+				"cstorpool.openebs.io/uid":     testPool,
+			},
+		},
+		Status: v1alpha1.CStorVolumeReplicaStatus{Phase: v1alpha1.CVRStatusOnline},
+	}
+
+	backup := &velerov1.Backup{
+		ObjectMeta: metav1.ObjectMeta{Name: testBackup, Namespace: "velero"},
+		Status:     velerov1.BackupStatus{Phase: velerov1.BackupPhaseInProgress},
+	}
+	return []runtime.Object{pv, cv, cvr, backup}
+}
+
+// newTestPlugin return the plugin, for local snapshots, using fake clientsets having given objects
+// and the fake maya-apiserver
+func newTestPlugin(t *testing.T, objects ...runtime.Object) (*cstor.Plugin, *fake.Clients, *fake.MayaServer) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	maya := fake.NewMayaServer()
+	t.Cleanup(maya.Close)
+	svc, ep := maya.Service(testNamespace, false)
+
+	clients, err := fake.NewClients(append(objects, svc, ep)...)
+	if err != nil {
+		t.Fatalf("failed to create fake clients : %s", err)
+	}
+
+	p, err := fake.NewPlugin(log, clients, map[string]string{
+		"local":       "true",
+		"namespace":   testNamespace,
+		"bindAddress": "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create plugin : %s", err)
+	}
+	return p, clients, maya
+}
+
+// pvObject return the given PV as unstructured object, as passed by velero
+func pvObject(t *testing.T, clients *fake.Clients, name string) runtime.Unstructured {
+	pv, err := clients.K8s.CoreV1().PersistentVolumes().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get pv=%s : %s", name, err)
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		t.Fatalf("failed to convert pv=%s : %s", name, err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	snaps := startSnapServer(t)
+	p, clients, _ := newTestPlugin(t, testObjects()...)
+
+	volumeID, err := p.GetVolumeID(pvObject(t, clients, testVolume))
+	if err != nil || volumeID != testVolume {
+		t.Fatalf("GetVolumeID() = %q, %v, want %q", volumeID, err, testVolume)
+	}
+
+	snapshotID, err := p.CreateSnapshot(volumeID, "", map[string]string{"velero.io/backup": testBackup})
+	if err != nil {
+		t.Fatalf("CreateSnapshot() failed : %s", err)
+	}
+	if snapshotID == "" {
+		t.Errorf("CreateSnapshot() returned empty snapshot ID")
+	}
+	if created, _ := snaps.snapshots(); len(created) != 1 || created[0] != testVolume+"@"+testBackup {
+		t.Errorf("snapshots created = %v, want [%s@%s]", created, testVolume, testBackup)
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	snaps := startSnapServer(t)
+	p, clients, _ := newTestPlugin(t, testObjects()...)
+
+	volumeID, err := p.GetVolumeID(pvObject(t, clients, testVolume))
+	if err != nil {
+		t.Fatalf("GetVolumeID() failed : %s", err)
+	}
+	snapshotID, err := p.CreateSnapshot(volumeID, "", map[string]string{"velero.io/backup": testBackup})
+	if err != nil {
+		t.Fatalf("CreateSnapshot() failed : %s", err)
+	}
+
+	if err := p.DeleteSnapshot(snapshotID); err != nil {
+		t.Fatalf("DeleteSnapshot() failed : %s", err)
+	}
+	if _, deleted := snaps.snapshots(); len(deleted) != 1 || deleted[0] != testVolume+"@"+testBackup {
+		t.Errorf("snapshots deleted = %v, want [%s@%s]", deleted, testVolume, testBackup)
+	}
+
+	if err := p.DeleteSnapshot(""); err != nil {
+		t.Errorf("DeleteSnapshot() of empty snapshot ID failed : %s", err)
+	}
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	snaps := startSnapServer(t)
+
+	// local snapshot is restored to the namespace mapped by in-progress restore of the backup
+	restore := &velerov1.Restore{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore-1", Namespace: "velero"},
+		Spec: velerov1.RestoreSpec{
+			BackupName:       testBackup,
+			NamespaceMapping: map[string]string{"app": "app-restored"},
+		},
+		Status: velerov1.RestoreStatus{Phase: velerov1.RestorePhaseInProgress},
+	}
+	p, clients, maya := newTestPlugin(t, append(testObjects(), restore)...)
+
+	volumeID, err := p.GetVolumeID(pvObject(t, clients, testVolume))
+	if err != nil {
+		t.Fatalf("GetVolumeID() failed : %s", err)
+	}
+	snapshotID, err := p.CreateSnapshot(volumeID, "", map[string]string{"velero.io/backup": testBackup})
+	if err != nil {
+		t.Fatalf("CreateSnapshot() failed : %s", err)
+	}
+	if created, _ := snaps.snapshots(); len(created) != 1 {
+		t.Fatalf("snapshots created = %v, want 1 snapshot", created)
+	}
+
+	newVolumeID, err := p.CreateVolumeFromSnapshot(snapshotID, "cstor-snapshot", "", nil)
+	if err != nil {
+		t.Fatalf("CreateVolumeFromSnapshot() failed : %s", err)
+	}
+	if newVolumeID == "" || newVolumeID == testVolume {
+		t.Errorf("CreateVolumeFromSnapshot() = %q, want new volume", newVolumeID)
+	}
+
+	restores := maya.Restores()
+	if len(restores) != 1 {
+		t.Fatalf("restore requests = %d, want 1", len(restores))
+	}
+	if r := restores[0]; r.Spec.VolumeName != newVolumeID || r.Spec.RestoreName != testBackup {
+		t.Errorf("restore request of volume=%s backup=%s, want volume=%s backup=%s",
+			r.Spec.VolumeName, r.Spec.RestoreName, newVolumeID, testBackup)
+	}
+
+	if _, err := p.CreateVolumeFromSnapshot(snapshotID, "invalid", "", nil); err == nil {
+		t.Errorf("CreateVolumeFromSnapshot() with invalid volume type succeeded")
+	}
+}
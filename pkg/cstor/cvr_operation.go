@@ -23,6 +23,7 @@ import (
 	"time"
 
 	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
+	"github.com/openebs/velero-plugin/pkg/velero"
 	"github.com/pkg/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -154,6 +155,106 @@ func (p *Plugin) getCVRCount(volname string, isCSIVolume bool) int {
 	return obj.Spec.ReplicationFactor
 }
 
+// cstorVolumeDetails describes the CStorVolume of cstor v1 or v1alpha1 API
+type cstorVolumeDetails struct {
+	// phase is current phase of CStorVolume
+	phase string
+
+	// version is current version of CStorVolume
+	version string
+
+	// replicationFactor is number of replicas of the volume
+	replicationFactor int
+
+	// consistencyFactor is minimum number of replicas required for quorum, it may not be set
+	consistencyFactor int
+
+	// replicasReported is true if target has reported the status of replicas
+	replicasReported bool
+
+	// quorumReplicas is number of healthy replicas having quorum
+	quorumReplicas int
+}
+
+// getCStorVolumeDetails returns the details of CStorVolume for the given volume
+func (p *Plugin) getCStorVolumeDetails(vol *Volume) (*cstorVolumeDetails, error) {
+	if vol.isCSIVolume {
+		obj, err := p.OpenEBSAPIsClient.
+			CstorV1().
+			CStorVolumes(p.namespace).
+			Get(context.TODO(), vol.volname, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch cstorVolume=%s", vol.volname)
+		}
+		cv := &cstorVolumeDetails{
+			phase:             string(obj.Status.Phase),
+			version:           obj.VersionDetails.Status.Current,
+			replicationFactor: obj.Spec.ReplicationFactor,
+			consistencyFactor: obj.Spec.ConsistencyFactor,
+			replicasReported:  len(obj.Status.ReplicaStatuses) > 0,
+		}
+		for _, r := range obj.Status.ReplicaStatuses {
+			if r.Mode == replicaModeHealthy && r.Quorum == replicaQuorum {
+				cv.quorumReplicas++
+			}
+		}
+		return cv, nil
+	}
+
+	obj, err := p.OpenEBSClient.
+		OpenebsV1alpha1().
+		CStorVolumes(p.namespace).
+		Get(context.TODO(), vol.volname, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch cstorVolume=%s", vol.volname)
+	}
+	cv := &cstorVolumeDetails{
+		phase:             string(obj.Status.Phase),
+		version:           obj.VersionDetails.Status.Current,
+		replicationFactor: obj.Spec.ReplicationFactor,
+		consistencyFactor: obj.Spec.ConsistencyFactor,
+		replicasReported:  len(obj.Status.ReplicaStatuses) > 0,
+	}
+	for _, r := range obj.Status.ReplicaStatuses {
+		if r.Mode == replicaModeHealthy && r.Quorum == replicaQuorum {
+			cv.quorumReplicas++
+		}
+	}
+	return cv, nil
+}
+
+// getVolumeHealth returns the phase of CStorVolume for the given volume
+func (p *Plugin) getVolumeHealth(vol *Volume) string {
+	cv, err := p.getCStorVolumeDetails(vol)
+	if err != nil {
+		p.Log.Warnf("Failed to get health of volume=%s : %s", vol.volname, err)
+		return "Unknown"
+	}
+	return cv.phase
+}
+
+// shouldSetTargetIP returns true if targetip needs to be set in replicas after restoring the given snapshot
+func (p *Plugin) shouldSetTargetIP(snapName string) bool {
+	if p.autoSetTargetIP {
+		return true
+	}
+
+	if !p.autoSetTargetIPLatest {
+		return false
+	}
+
+	latest, err := velero.IsLatestScheduledBackup(snapName)
+	if err != nil {
+		p.Log.Warnf("Failed to check if backup=%s is latest backup of schedule, targetip will not be set : %s", snapName, err)
+		return false
+	}
+
+	if !latest {
+		p.Log.Infof("Backup=%s is not the latest backup of schedule, targetip will not be set", snapName)
+	}
+	return latest
+}
+
 // markCVRsAsRestoreCompleted annotate relevant CVR with restoreCompletedAnnotation
 // Note: It will not wait for CVR to become healthy. This is mainly to avoid the scenarios
 // where target-affinity is used.
@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// BackupAnnotation is annotation key on PVC or PV to exclude the volume from snapshot.
+	// If it is set to "false" then manifests of the PVC and PV are backed up but data isn't.
+	BackupAnnotation = "openebs.io/velero-backup"
+
+	// VolumeLabelSelector config key for label selector of the volumes to snapshot,
+	// volume is selected if labels of its PV or PVC match the selector
+	VolumeLabelSelector = "volumeLabelSelector"
+)
+
+// isOptedOut returns true if the given annotations exclude the volume from snapshot
+func isOptedOut(annotations map[string]string) bool {
+	val, ok := annotations[BackupAnnotation]
+	return ok && isBool(val) && !isTrue(val)
+}
+
+// parseVolumeSelector return the label selector of volumes from given config,
+// it return nil if selector is not configured
+func parseVolumeSelector(config map[string]string) (labels.Selector, error) {
+	val, ok := config[VolumeLabelSelector]
+	if !ok || val == "" {
+		return nil, nil
+	}
+
+	selector, err := labels.Parse(val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", VolumeLabelSelector)
+	}
+	return selector, nil
+}
+
+// getExcludeReason checks if the volume of given PV should not be snapshotted, either due to
+// BackupAnnotation on the PV or its PVC, or due to VolumeLabelSelector not matching their labels.
+// It return the reason if volume is excluded, otherwise empty string.
+func (p *Plugin) getExcludeReason(pv *v1.PersistentVolume) (string, error) {
+	if isOptedOut(pv.Annotations) {
+		return fmt.Sprintf("PV has %s=%s annotation", BackupAnnotation, pv.Annotations[BackupAnnotation]), nil
+	}
+
+	pvc, err := p.getClaimOf(pv)
+	if err != nil {
+		return "", err
+	}
+
+	if pvc != nil && isOptedOut(pvc.Annotations) {
+		return fmt.Sprintf("PVC has %s=%s annotation", BackupAnnotation, pvc.Annotations[BackupAnnotation]), nil
+	}
+	if p.volumeSelector == nil || p.volumeSelector.Matches(labels.Set(pv.Labels)) {
+		return "", nil
+	}
+	if pvc == nil || !p.volumeSelector.Matches(labels.Set(pvc.Labels)) {
+		return fmt.Sprintf("labels of PV and PVC don't match %s=%s", VolumeLabelSelector, p.volumeSelector), nil
+	}
+	return "", nil
+}
+
+// getClaimOf return the PVC bound to the given PV, it return nil if PV doesn't have PVC
+func (p *Plugin) getClaimOf(pv *v1.PersistentVolume) (*v1.PersistentVolumeClaim, error) {
+	if pv.Spec.ClaimRef == nil {
+		return nil, nil
+	}
+
+	pvc, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).
+		Get(context.TODO(), pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		// claim of released PV may be deleted
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get PVC=%s/%s", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	}
+	return pvc, nil
+}
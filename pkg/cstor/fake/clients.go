@@ -0,0 +1,110 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides the fake clientsets and fake maya-apiserver to run the
+// cStor plugin without a cluster, e.g. for unit tests.
+package fake
+
+import (
+	apisfake "github.com/openebs/api/v2/pkg/client/clientset/versioned/fake"
+	apisscheme "github.com/openebs/api/v2/pkg/client/clientset/versioned/scheme"
+	mayafake "github.com/openebs/maya/pkg/client/generated/clientset/versioned/fake"
+	mayascheme "github.com/openebs/maya/pkg/client/generated/clientset/versioned/scheme"
+	"github.com/openebs/velero-plugin/pkg/cstor"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerofake "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned/fake"
+	veleroscheme "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned/scheme"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+// Clients are the fake clientsets used by the plugin
+type Clients struct {
+	K8s         *k8sfake.Clientset
+	OpenEBS     *mayafake.Clientset
+	OpenEBSAPIs *apisfake.Clientset
+	Velero      *velerofake.Clientset
+	Dynamic     *dynamicfake.FakeDynamicClient
+}
+
+// snapshotListKinds are list kinds of CSI snapshot resources served by fake dynamic client
+var snapshotListKinds = map[schema.GroupVersionResource]string{
+	{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshots"}:             "VolumeSnapshotList",
+	{Group: "snapshot.storage.k8s.io", Version: "v1", Resource: "volumesnapshotcontents"}:      "VolumeSnapshotContentList",
+	{Group: "snapshot.storage.k8s.io", Version: "v1beta1", Resource: "volumesnapshots"}:        "VolumeSnapshotList",
+	{Group: "snapshot.storage.k8s.io", Version: "v1beta1", Resource: "volumesnapshotcontents"}: "VolumeSnapshotContentList",
+}
+
+// NewClients return the fake clientsets having given objects. Object is added to the
+// clientset whose scheme has its type, unstructured objects are added to dynamic client.
+func NewClients(objects ...runtime.Object) (*Clients, error) {
+	var k8sObjs, mayaObjs, apisObjs, veleroObjs, dynamicObjs []runtime.Object
+
+	for _, obj := range objects {
+		switch {
+		case isUnstructured(obj):
+			dynamicObjs = append(dynamicObjs, obj)
+		case recognizes(k8sscheme.Scheme, obj):
+			k8sObjs = append(k8sObjs, obj)
+		case recognizes(mayascheme.Scheme, obj):
+			mayaObjs = append(mayaObjs, obj)
+		case recognizes(apisscheme.Scheme, obj):
+			apisObjs = append(apisObjs, obj)
+		case recognizes(veleroscheme.Scheme, obj):
+			veleroObjs = append(veleroObjs, obj)
+		default:
+			return nil, errors.Errorf("object of type %T is not served by fake clientsets", obj)
+		}
+	}
+
+	return &Clients{
+		K8s:         k8sfake.NewSimpleClientset(k8sObjs...),
+		OpenEBS:     mayafake.NewSimpleClientset(mayaObjs...),
+		OpenEBSAPIs: apisfake.NewSimpleClientset(apisObjs...),
+		Velero:      velerofake.NewSimpleClientset(veleroObjs...),
+		Dynamic:     dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), snapshotListKinds, dynamicObjs...),
+	}, nil
+}
+
+// NewPlugin return the cStor plugin, initialized with given config, using the given
+// fake clientsets. Velero clientset of the plugin is set to the fake velero clientset.
+func NewPlugin(log logrus.FieldLogger, clients *Clients, config map[string]string) (*cstor.Plugin, error) {
+	p := &cstor.Plugin{Log: log}
+	p.SetClients(clients.K8s, clients.OpenEBS, clients.OpenEBSAPIs, clients.Dynamic)
+	velero.SetClientSet(clients.Velero)
+
+	if err := p.Init(config); err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize plugin")
+	}
+	return p, nil
+}
+
+// isUnstructured returns true if given object is unstructured
+func isUnstructured(obj runtime.Object) bool {
+	_, ok := obj.(runtime.Unstructured)
+	return ok
+}
+
+// recognizes returns true if type of given object is registered in given scheme
+func recognizes(scheme *runtime.Scheme, obj runtime.Object) bool {
+	_, _, err := scheme.ObjectKinds(obj)
+	return err == nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// restorePath is path of the restore API of maya-apiserver and cvc-server
+	restorePath = "/latest/restore/"
+
+	// labels of the services, used by plugin to find maya-apiserver and cvc-server
+	mayaServiceName  = "maya-apiserver-service"
+	mayaServiceLabel = "maya-apiserver-svc"
+	cvcServiceName   = "cvc-operator-service"
+	cvcServiceLabel  = "cvc-operator-svc"
+	componentLabel   = "openebs.io/component-name"
+	servicePortName  = "api"
+)
+
+// MayaServer is a fake maya-apiserver, or cvc-server, serving the restore API used by
+// the plugin for the restore of local backups
+type MayaServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+
+	// restores are the restore requests received by the server
+	restores []v1alpha1.CStorRestore
+
+	// response is returned for the restore requests, empty response is returned if nil
+	response *v1alpha1.CASVolume
+
+	// failures is number of next requests failed with failStatus
+	failures   int
+	failStatus int
+}
+
+// NewMayaServer starts the fake maya-apiserver, server needs to be closed once it is not used
+func NewMayaServer() *MayaServer {
+	s := &MayaServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(restorePath, s.handleRestore)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetRestoreResponse sets the CASVolume returned for the restore requests of non CSI volume
+func (s *MayaServer) SetRestoreResponse(cas *v1alpha1.CASVolume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.response = cas
+}
+
+// FailRequests fails the next n requests with given HTTP status
+func (s *MayaServer) FailRequests(n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures, s.failStatus = n, status
+}
+
+// Restores return the restore requests received by the server
+func (s *MayaServer) Restores() []v1alpha1.CStorRestore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]v1alpha1.CStorRestore(nil), s.restores...)
+}
+
+// handleRestore records the restore request, and returns the configured response
+func (s *MayaServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "injected failure", s.failStatus)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var rst v1alpha1.CStorRestore
+	if err := json.NewDecoder(r.Body).Decode(&rst); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.restores = append(s.restores, rst)
+
+	var resp interface{} = ""
+	if s.response != nil {
+		resp = s.response
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Service return the service, and its endpoints, of maya-apiserver, or cvc-server if csi
+// is set, in given namespace, pointing to the fake server. These need to be added to
+// the fake kubernetes clientset, so that the plugin finds the server.
+func (s *MayaServer) Service(namespace string, csi bool) (*v1.Service, *v1.Endpoints) {
+	host, portStr, _ := net.SplitHostPort(s.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	name, label := mayaServiceName, mayaServiceLabel
+	if csi {
+		name, label = cvcServiceName, cvcServiceLabel
+	}
+	meta := metav1.ObjectMeta{
+		Name:      name,
+		Namespace: namespace,
+		Labels:    map[string]string{componentLabel: label},
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: meta,
+		Spec: v1.ServiceSpec{
+			ClusterIP: host,
+			Ports:     []v1.ServicePort{{Name: servicePortName, Port: int32(port)}},
+		},
+	}
+	ep := &v1.Endpoints{
+		ObjectMeta: meta,
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: host}},
+			Ports:     []v1.EndpointPort{{Name: servicePortName, Port: int32(port)}},
+		}},
+	}
+	return svc, ep
+}
@@ -0,0 +1,338 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ConsistencyGroupKey is label or annotation key on PVC to group the volumes of an application.
+	// Snapshots of the volumes of a group are taken together, within a backup.
+	ConsistencyGroupKey = "openebs.io/consistency-group"
+)
+
+// groupBackup describes the backup of the volumes of a consistency group
+type groupBackup struct {
+	// backupName is name of the velero backup
+	backupName string
+
+	// ready is closed once snapshots of the volumes are taken
+	ready chan struct{}
+
+	// done is closed once uploads of all the volumes of the group are completed
+	done chan struct{}
+
+	// err is set if snapshots of the volumes couldn't be taken
+	err error
+
+	// results has channel, for each volume of the group, to receive the backup result of the volume
+	results map[string]chan error
+
+	// pending is number of volumes whose backup result is not yet received
+	pending int
+}
+
+// groupBackupKey return the key of the group backup for the given backup and consistency group
+func groupBackupKey(bkpName, namespace, group string) string {
+	return bkpName + "/" + namespace + "/" + group
+}
+
+// getPVCGroup return the consistency group of the given PVC
+// Label of the PVC takes precedence over the annotation.
+func getPVCGroup(pvc *v1.PersistentVolumeClaim) string {
+	if group, ok := pvc.Labels[ConsistencyGroupKey]; ok {
+		return group
+	}
+	return pvc.Annotations[ConsistencyGroupKey]
+}
+
+// getConsistencyGroup return the consistency group of the given volume
+// If volume doesn't belong to any group then it will return empty string.
+func (p *Plugin) getConsistencyGroup(vol *Volume) (string, error) {
+	pvc, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(vol.namespace).
+		Get(context.TODO(), vol.pvcName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to get PVC=%s/%s", vol.namespace, vol.pvcName)
+	}
+	return getPVCGroup(pvc), nil
+}
+
+// getGroupMembers return the cStor volumes, of the given consistency group, which are
+// included in the backup of the given volume
+func (p *Plugin) getGroupMembers(vol *Volume, group string) ([]*Volume, error) {
+	var members []*Volume
+
+	pvcList, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(vol.namespace).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list PVCs in namespace=%s", vol.namespace)
+	}
+
+	for i := range pvcList.Items {
+		pvc := &pvcList.Items[i]
+
+		if pvc.Name == vol.pvcName {
+			members = append(members, vol)
+			continue
+		}
+
+		if getPVCGroup(pvc) != group || pvc.Status.Phase != v1.ClaimBound {
+			continue
+		}
+
+		included, err := velero.IsPVCIncludedInBackup(vol.backupName, pvc)
+		if err != nil {
+			return nil, err
+		}
+		if !included {
+			p.Log.Infof("PVC=%s/%s of consistency group=%s is not included in backup=%s, skipping it",
+				pvc.Namespace, pvc.Name, group, vol.backupName)
+			continue
+		}
+
+		pv, err := p.getPV(pvc.Spec.VolumeName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get PV of PVC=%s/%s", pvc.Namespace, pvc.Name)
+		}
+
+		isCStorVolume, isCSIVolume := getCStorVolumeType(pv)
+		if !isCStorVolume {
+			p.Log.Warnf("PVC=%s/%s of consistency group=%s is not a cStor volume, skipping it",
+				pvc.Namespace, pvc.Name, group)
+			continue
+		}
+
+		reason, err := p.getExcludeReason(pv)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check if volume=%s is excluded", pv.Name)
+		}
+		if reason != "" {
+			p.Log.Infof("PVC=%s/%s of consistency group=%s is excluded, %s, skipping it",
+				pvc.Namespace, pvc.Name, group, reason)
+			continue
+		}
+
+		// volumes of a group are claimed together, unless group of the PVC is changed
+		claim, owned, err := p.claimVolume(pv)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to claim volume=%s in shard group=%s", pv.Name, p.shardGroup)
+		}
+		if !owned {
+			p.Log.Infof("PVC=%s/%s of consistency group=%s is claimed by other plugin instance of shard group=%s, skipping it",
+				pvc.Namespace, pvc.Name, group, p.shardGroup)
+			continue
+		}
+
+		member := p.addVolume(pv, isCSIVolume)
+		member.backupName = vol.backupName
+		member.shardClaim = claim
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// createGroupSnapshot creates the snapshot of the given volume along with the other volumes
+// of its consistency group.
+//
+// velero requests the snapshot of the volumes of a backup one by one, so on the request for
+// the first volume of the group, plugin takes the snapshots of all the volumes of the group
+// together and uploads them concurrently. Requests for the other volumes of the group wait
+// for the backup of their volume to complete.
+func (p *Plugin) createGroupSnapshot(vol *Volume, group string) error {
+	key := groupBackupKey(vol.backupName, vol.namespace, group)
+
+	p.groupLock.Lock()
+	p.pruneGroupBackups(vol.backupName)
+	gb, exists := p.groupBackups[key]
+	if !exists {
+		gb = &groupBackup{
+			backupName: vol.backupName,
+			ready:      make(chan struct{}),
+			done:       make(chan struct{}),
+			results:    map[string]chan error{},
+		}
+		p.groupBackups[key] = gb
+	}
+	p.groupLock.Unlock()
+
+	if !exists {
+		p.Log.Infof("creating snapshot{%s} of consistency group=%s/%s", vol.backupName, vol.namespace, group)
+		p.backupGroup(gb, vol, group)
+	}
+
+	<-gb.ready
+
+	// failed group backup is removed, requests waiting for it receive the same error
+	// and the next request takes the snapshots of the group again
+	if gb.err != nil {
+		p.removeGroupBackup(key, gb)
+		return gb.err
+	}
+
+	ch, ok := gb.results[vol.volname]
+	if !ok {
+		return errors.Errorf("volume=%s was not found in consistency group=%s/%s while taking its snapshot",
+			vol.volname, vol.namespace, group)
+	}
+
+	err := <-ch
+	p.releaseGroupBackup(key, gb)
+	return err
+}
+
+// releaseGroupBackup removes the group backup from the list, once results of all
+// the volumes of the group are received
+func (p *Plugin) releaseGroupBackup(key string, gb *groupBackup) {
+	p.groupLock.Lock()
+	defer p.groupLock.Unlock()
+
+	gb.pending--
+	if gb.pending == 0 && p.groupBackups[key] == gb {
+		delete(p.groupBackups, key)
+	}
+}
+
+// removeGroupBackup removes the given group backup from the list
+func (p *Plugin) removeGroupBackup(key string, gb *groupBackup) {
+	p.groupLock.Lock()
+	defer p.groupLock.Unlock()
+
+	if p.groupBackups[key] == gb {
+		delete(p.groupBackups, key)
+	}
+}
+
+// pruneGroupBackups removes the group backups, of backups other than the given backup, whose
+// uploads are completed. velero may not request the snapshot of every volume of the group, so
+// results of such volumes are never received. velero executes one backup at a time, so group
+// backups of the previous backups are not requested anymore. Caller should hold groupLock.
+func (p *Plugin) pruneGroupBackups(bkpName string) {
+	for key, gb := range p.groupBackups {
+		if gb.backupName == bkpName {
+			continue
+		}
+
+		select {
+		case <-gb.done:
+			p.Log.Infof("Removing consistency group backup=%s, results of %d volumes were not requested", key, gb.pending)
+			delete(p.groupBackups, key)
+		default:
+		}
+	}
+}
+
+// backupGroup takes the snapshots of the volumes of given volume's consistency group together,
+// and starts the upload of the snapshots. Result of each volume's backup is sent to its channel
+// in gb.results.
+func (p *Plugin) backupGroup(gb *groupBackup, vol *Volume, group string) {
+	var wg sync.WaitGroup
+
+	defer close(gb.ready)
+	defer func() {
+		// uploads of the volumes are tracked, to remove the group backup even if
+		// results of some volumes are not requested by velero
+		go func() {
+			wg.Wait()
+			close(gb.done)
+		}()
+	}()
+
+	members, err := p.getGroupMembers(vol, group)
+	if err != nil {
+		gb.err = errors.Wrapf(err, "failed to get volumes of consistency group=%s/%s", vol.namespace, group)
+		return
+	}
+
+	if !p.local && len(members) > p.backupPorts.count {
+		gb.err = errors.Errorf("consistency group=%s/%s has %d volumes, %s should be at least %d to take their snapshots together",
+			vol.namespace, group, len(members), Parallel, len(members))
+		return
+	}
+
+	for _, m := range members {
+		if err := p.prepareBackup(m); err != nil {
+			gb.err = errors.Wrapf(err, "failed to prepare backup of volume=%s", m.volname)
+			return
+		}
+	}
+
+	startTime := time.Now()
+
+	// wait for the ports, if other backups are in progress
+	ports := p.acquireBackupPorts(len(members))
+
+	tasks := make([]*backupTask, 0, len(members))
+	for i, m := range members {
+		t, err := p.newBackupTask(m, ports[i], startTime)
+		if err != nil {
+			gb.err = err
+			break
+		}
+		tasks = append(tasks, t)
+	}
+
+	if gb.err == nil {
+		gb.err = p.createBackups(tasks)
+	}
+
+	if gb.err != nil {
+		for _, t := range tasks {
+			t.cancel()
+		}
+		for _, port := range ports {
+			p.releaseBackupPort(port)
+		}
+		return
+	}
+
+	p.Log.Infof("Snapshots of consistency group=%s/%s are created", vol.namespace, group)
+
+	gb.pending = len(tasks)
+	for _, t := range tasks {
+		ch := make(chan error, 1)
+		gb.results[t.vol.volname] = ch
+
+		wg.Add(1)
+		go func(t *backupTask, ch chan<- error) {
+			defer wg.Done()
+			defer p.releaseBackupPort(t.port)
+			defer t.cancel()
+
+			if t.err != nil {
+				ch <- t.err
+				return
+			}
+			ch <- p.completeBackup(t)
+		}(t, ch)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HealthAddress config key for the address, like :8085, of the health server serving
+	// /healthz and /readyz endpoints
+	HealthAddress = "healthAddress"
+
+	// healthCheckTimeout is timeout of each check of /readyz
+	healthCheckTimeout = 5 * time.Second
+
+	// HealthOK represents that the check passed
+	HealthOK = "ok"
+
+	// HealthFailed represents that the check failed
+	HealthFailed = "failed"
+)
+
+// openebsGroupVersions are the API group versions of cStor resources, non CSI and CSI
+var openebsGroupVersions = []string{"openebs.io/v1alpha1", "cstor.openebs.io/v1"}
+
+// healthRegistry has the plugins, by location, whose health is reported by the health
+// servers of the plugin process. Velero initializes a plugin for each backup or restore,
+// so the plugin of a location is replaced by the one initialized last.
+var healthRegistry = struct {
+	sync.Mutex
+
+	// plugins are the plugins by location of their volumesnapshotlocation
+	plugins map[string]*Plugin
+
+	// servers are the addresses of the running health servers
+	servers map[string]bool
+}{
+	plugins: map[string]*Plugin{},
+	servers: map[string]bool{},
+}
+
+// healthCheck is the result of a readiness check
+type healthCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthReport is the response of /readyz
+type healthReport struct {
+	Status    string                   `json:"status"`
+	Locations map[string][]healthCheck `json:"locations"`
+}
+
+// initHealthServer registers the plugin for health checks, and starts the health server
+// on the configured address if it is not running yet. Server runs only as long as the
+// plugin process, which velero starts for an operation and stops once it completes.
+func (p *Plugin) initHealthServer(config map[string]string) error {
+	addr, ok := config[HealthAddress]
+	if !ok || addr == "" {
+		return nil
+	}
+
+	healthRegistry.Lock()
+	defer healthRegistry.Unlock()
+
+	healthRegistry.plugins[healthLocation(config)] = p
+	if healthRegistry.servers[addr] {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s=%s", HealthAddress, addr)
+	}
+	healthRegistry.servers[addr] = true
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+
+	p.Log.Infof("Serving /healthz and /readyz on %s", addr)
+	go func() {
+		err := http.Serve(l, mux)
+		p.Log.Errorf("Health server on %s stopped : %s", addr, err)
+
+		healthRegistry.Lock()
+		delete(healthRegistry.servers, addr)
+		healthRegistry.Unlock()
+	}()
+	return nil
+}
+
+// healthLocation return the location reported by health checks for given config
+func healthLocation(config map[string]string) string {
+	if isTrue(config[LocalSnapshot]) {
+		return "local"
+	}
+
+	loc := config[cloud.PROVIDER] + "://" + config[cloud.BUCKET]
+	for _, key := range []string{cloud.BackupPathPrefix, cloud.PREFIX} {
+		if config[key] != "" {
+			loc += "/" + config[key]
+		}
+	}
+	return loc
+}
+
+// handleHealthz reports that the plugin process is serving
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintln(w, HealthOK)
+}
+
+// handleReadyz runs the readiness checks of all the registered plugins, it responds
+// with status 503 if any of the check fails
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	healthRegistry.Lock()
+	plugins := make(map[string]*Plugin, len(healthRegistry.plugins))
+	for loc, p := range healthRegistry.plugins {
+		plugins[loc] = p
+	}
+	healthRegistry.Unlock()
+
+	report := healthReport{Status: HealthOK, Locations: map[string][]healthCheck{}}
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+	)
+	for loc, p := range plugins {
+		wg.Add(1)
+		go func(loc string, p *Plugin) {
+			defer wg.Done()
+			checks := p.checkReadiness(r.Context())
+
+			lock.Lock()
+			defer lock.Unlock()
+			report.Locations[loc] = checks
+			for _, c := range checks {
+				if c.Status != HealthOK {
+					report.Status = HealthFailed
+				}
+			}
+		}(loc, p)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != HealthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// checkReadiness checks the connectivity to kubernetes, OpenEBS APIs and storage-bucket,
+// and the address of data server
+func (p *Plugin) checkReadiness(ctx context.Context) []healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	checks := []healthCheck{
+		newHealthCheck("kubernetes", p.checkAPIServer()),
+	}
+
+	for _, svc := range []struct{ name, addr string }{
+		{"maya-apiserver", p.mayaAddr},
+		{"cvc-server", p.cvcAddr},
+	} {
+		if svc.addr != "" {
+			checks = append(checks, newHealthCheck(svc.name, checkDial(ctx, svc.addr)))
+		}
+	}
+
+	if p.local {
+		return checks
+	}
+
+	checks = append(checks,
+		newHealthCheck("bucket", p.cl.CheckAccess(ctx)),
+		p.checkDataServer(),
+	)
+	return checks
+}
+
+// newHealthCheck return the check with given name for the given error
+func newHealthCheck(name string, err error) healthCheck {
+	if err != nil {
+		return healthCheck{Name: name, Status: HealthFailed, Message: err.Error()}
+	}
+	return healthCheck{Name: name, Status: HealthOK}
+}
+
+// checkAPIServer checks that kubernetes API server serves the cStor resources
+func (p *Plugin) checkAPIServer() error {
+	var errs []string
+
+	for _, gv := range openebsGroupVersions {
+		_, err := p.K8sClient.Discovery().ServerResourcesForGroupVersion(gv)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", gv, err))
+	}
+	return errors.Errorf("cStor resources are not served, %s", strings.Join(errs, "; "))
+}
+
+// checkDial checks that a TCP connection can be opened to given http address
+func checkDial(ctx context.Context, addr string) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", strings.TrimPrefix(addr, "http://"))
+	if err != nil {
+		return errors.Wrapf(err, "%s is not reachable", addr)
+	}
+	return conn.Close()
+}
+
+// checkDataServer checks that data server can listen on the address advertised to cStor,
+// and reports the number of backup ports in use
+func (p *Plugin) checkDataServer() healthCheck {
+	l, err := net.Listen("tcp", net.JoinHostPort(p.cstorServerAddr, "0"))
+	if err != nil {
+		return newHealthCheck("dataServer", errors.Wrapf(err, "failed to listen on address=%s", p.cstorServerAddr))
+	}
+	_ = l.Close()
+
+	c := newHealthCheck("dataServer", nil)
+	c.Message = fmt.Sprintf("address=%s, %d of %d backup ports in use",
+		p.cstorServerAddr, p.backupPorts.count-len(p.backupPorts.ports), p.backupPorts.count)
+	return c
+}
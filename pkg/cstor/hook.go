@@ -0,0 +1,204 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// PreSnapshotHookPrefix is annotation prefix for the hook executed before taking the snapshot
+	PreSnapshotHookPrefix = "pre.hook.snapshot.openebs.io"
+
+	// PostSnapshotHookPrefix is annotation prefix for the hook executed after taking the snapshot
+	PostSnapshotHookPrefix = "post.hook.snapshot.openebs.io"
+
+	// hook annotation keys, used along with hook prefix
+	hookContainerKey = "container"
+	hookCommandKey   = "command"
+	hookOnErrorKey   = "on-error"
+	hookTimeoutKey   = "timeout"
+
+	// defaultHookTimeout is default time limit for the hook execution
+	defaultHookTimeout = 30 * time.Second
+)
+
+// snapshotHook describes the hook to execute in a pod
+type snapshotHook struct {
+	pod  *v1.Pod
+	hook *velerov1api.ExecHook
+}
+
+// getExecHookFromAnnotations parse the hook, having the given prefix, from annotations
+// Format of annotations is same as velero backup hooks:
+//	- <prefix>/container : container to execute the command, default is first container of the pod
+//	- <prefix>/command : command to execute, it can be a JSON array or a single command
+//	- <prefix>/on-error : Fail or Continue, default is Fail
+//	- <prefix>/timeout : time limit for the command, default is 30s
+func getExecHookFromAnnotations(prefix string, annotations map[string]string) (*velerov1api.ExecHook, error) {
+	commandValue, ok := annotations[prefix+"/"+hookCommandKey]
+	if !ok || commandValue == "" {
+		return nil, nil
+	}
+
+	var command []string
+	if strings.HasPrefix(commandValue, "[") {
+		if err := json.Unmarshal([]byte(commandValue), &command); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s/%s", prefix, hookCommandKey)
+		}
+	} else {
+		command = append(command, commandValue)
+	}
+
+	hook := &velerov1api.ExecHook{
+		Container: annotations[prefix+"/"+hookContainerKey],
+		Command:   command,
+		OnError:   velerov1api.HookErrorModeFail,
+		Timeout:   metav1.Duration{Duration: defaultHookTimeout},
+	}
+
+	if onError, ok := annotations[prefix+"/"+hookOnErrorKey]; ok {
+		mode := velerov1api.HookErrorMode(onError)
+		if mode != velerov1api.HookErrorModeFail && mode != velerov1api.HookErrorModeContinue {
+			return nil, errors.Errorf("invalid %s/%s=%s", prefix, hookOnErrorKey, onError)
+		}
+		hook.OnError = mode
+	}
+
+	if timeout, ok := annotations[prefix+"/"+hookTimeoutKey]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s/%s", prefix, hookTimeoutKey)
+		}
+		hook.Timeout = metav1.Duration{Duration: d}
+	}
+	return hook, nil
+}
+
+// getSnapshotHooks return the hooks, having the given prefix, for running pods using the PVC of the volume
+// Hook annotations of the pod take precedence over the hook annotations of the PVC.
+func (p *Plugin) getSnapshotHooks(vol *Volume, prefix string) ([]snapshotHook, error) {
+	var hooks []snapshotHook
+
+	pvc, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(vol.namespace).
+		Get(context.TODO(), vol.pvcName, metav1.GetOptions{})
+	if err != nil {
+		// pods can't be using the deleted PVC
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get PVC=%s/%s", vol.namespace, vol.pvcName)
+	}
+
+	pvcHook, err := getExecHookFromAnnotations(prefix, pvc.Annotations)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid hook on PVC=%s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	pods, err := p.K8sClient.
+		CoreV1().
+		Pods(vol.namespace).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list pods in namespace=%s", vol.namespace)
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != v1.PodRunning || !isPVCUsedByPod(pod, vol.pvcName) {
+			continue
+		}
+
+		hook, err := getExecHookFromAnnotations(prefix, pod.Annotations)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid hook on pod=%s/%s", pod.Namespace, pod.Name)
+		}
+		if hook == nil {
+			hook = pvcHook
+		}
+		if hook != nil {
+			hooks = append(hooks, snapshotHook{pod: pod, hook: hook})
+		}
+	}
+	return hooks, nil
+}
+
+// runSnapshotHooks executes the given hooks in the pods
+// It returns error if execution of any hook, having Fail error mode, fails.
+func (p *Plugin) runSnapshotHooks(hooks []snapshotHook, hookName string) error {
+	for _, h := range hooks {
+		p.Log.Infof("Executing %s hook %v in pod=%s/%s", hookName, h.hook.Command, h.pod.Namespace, h.pod.Name)
+
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(h.pod)
+		if err == nil {
+			err = p.podExecutor.ExecutePodCommand(p.Log, obj, h.pod.Namespace, h.pod.Name, hookName, h.hook)
+		}
+		if err == nil {
+			continue
+		}
+
+		if h.hook.OnError == velerov1api.HookErrorModeContinue {
+			p.Log.Warnf("Failed to execute %s hook in pod=%s/%s, continuing : %s", hookName, h.pod.Namespace, h.pod.Name, err)
+			continue
+		}
+		return errors.Wrapf(err, "failed to execute %s hook in pod=%s/%s", hookName, h.pod.Namespace, h.pod.Name)
+	}
+	return nil
+}
+
+// appendSnapshotHooks appends the given hooks to the list, skipping the hooks which
+// are already in the list for the same pod. A pod using multiple volumes, which are
+// snapshotted together, should execute its hook only once.
+func appendSnapshotHooks(list, hooks []snapshotHook) []snapshotHook {
+	for _, h := range hooks {
+		exists := false
+		for _, l := range list {
+			if l.pod.Namespace == h.pod.Namespace && l.pod.Name == h.pod.Name &&
+				l.hook.Container == h.hook.Container &&
+				strings.Join(l.hook.Command, " ") == strings.Join(h.hook.Command, " ") {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+// isPVCUsedByPod returns true if the given pod mounts the given PVC
+func isPVCUsedByPod(pod *v1.Pod, pvcName string) bool {
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == pvcName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// InventoryCommand is the plugin command to inventory, and clean up, the resources
+	// left in the cluster by the plugin
+	InventoryCommand = "inventory"
+
+	// inventory item kinds
+	kindBackup          = "CStorBackup"
+	kindCompletedBackup = "CStorCompletedBackup"
+	kindRestore         = "CStorRestore"
+	kindConfigMap       = "ConfigMap"
+	kindLease           = "Lease"
+)
+
+// InventoryItem describes a resource left in the cluster by the plugin
+type InventoryItem struct {
+	// Kind is kind of the resource
+	Kind string `json:"kind"`
+
+	// Namespace is namespace of the resource
+	Namespace string `json:"namespace"`
+
+	// Name is name of the resource
+	Name string `json:"name"`
+
+	// Volume is volume name of the backup/restore resource
+	Volume string `json:"volume,omitempty"`
+
+	// Backup is schedule/backup name of the backup resource, or restore name of the restore resource
+	Backup string `json:"backup,omitempty"`
+
+	// Status is status of the backup/restore resource
+	Status string `json:"status,omitempty"`
+
+	// Cleaned is true if resource is deleted
+	Cleaned bool `json:"cleaned"`
+
+	// Error is the failure in deleting the resource
+	Error string `json:"error,omitempty"`
+
+	// isCSIVolume is true for the resource of cStor based CSI volume
+	isCSIVolume bool
+
+	// snapName is snapshot name of the backup resource
+	snapName string
+}
+
+// InventoryReport is the list of resources left in the cluster by the plugin
+type InventoryReport struct {
+	// Time is time at which inventory is taken
+	Time metav1.Time `json:"time"`
+
+	// Namespace is openebs namespace
+	Namespace string `json:"namespace"`
+
+	// Items is list of resources
+	Items []InventoryItem `json:"items"`
+}
+
+// RunInventory lists the resources left in the cluster by the plugin, and deletes them
+// if cleanup is set. Snapshots of backup resources are also deleted from cStor pools.
+// It is meant to be executed explicitly, before uninstalling velero or the plugin,
+// since plugin is not notified on uninstall.
+func RunInventory(log logrus.FieldLogger, namespace string, cleanup bool) (*InventoryReport, error) {
+	p := &Plugin{
+		Log:         log,
+		namespace:   namespace,
+		restTimeout: 60 * time.Second,
+
+		restRetries:      defaultRestRetries,
+		restRetryBackoff: defaultRestRetryBackoff,
+	}
+
+	if err := p.initClients(); err != nil {
+		return nil, err
+	}
+
+	restClient, err := newRestClient(nil, p.restTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p.restClient = restClient
+
+	report := &InventoryReport{
+		Time:      metav1.Now(),
+		Namespace: namespace,
+		Items:     p.listInventory(),
+	}
+
+	if !cleanup {
+		return report, nil
+	}
+
+	// restores and backups are deleted before completed backups, since
+	// completed backups track the snapshots of schedule
+	for _, kind := range []string{kindRestore, kindBackup, kindCompletedBackup, kindConfigMap, kindLease} {
+		for i := range report.Items {
+			item := &report.Items[i]
+			if item.Kind != kind {
+				continue
+			}
+
+			// resource may have been deleted along with the other resources
+			if err := p.cleanupInventoryItem(item); err != nil && !k8serrors.IsNotFound(err) {
+				p.Log.Warnf("Failed to delete %s=%s/%s : %s", item.Kind, item.Namespace, item.Name, err)
+				item.Error = err.Error()
+				continue
+			}
+			item.Cleaned = true
+		}
+	}
+	return report, nil
+}
+
+// listInventory return the backup/restore resources of all the namespaces, and the
+// configmaps and leases created by the plugin in openebs namespace
+func (p *Plugin) listInventory() []InventoryItem {
+	var items []InventoryItem
+
+	for _, r := range p.listBackups() {
+		items = append(items, InventoryItem{
+			Kind:        kindBackup,
+			Namespace:   r.namespace,
+			Name:        r.name,
+			Volume:      r.volumeName,
+			Backup:      r.backupName,
+			Status:      r.status,
+			isCSIVolume: r.isCSIVolume,
+			snapName:    r.snapName,
+		})
+	}
+
+	for _, r := range p.listCompletedBackups() {
+		items = append(items, InventoryItem{
+			Kind:        kindCompletedBackup,
+			Namespace:   r.namespace,
+			Name:        r.name,
+			Volume:      r.volumeName,
+			Backup:      r.backupName,
+			isCSIVolume: r.isCSIVolume,
+		})
+	}
+
+	items = append(items, p.listRestoreInventory()...)
+
+	for _, l := range []string{catalogLabel, backupStateLabel, canaryStatusLabel} {
+		list, err := p.K8sClient.CoreV1().ConfigMaps(p.namespace).
+			List(context.TODO(), metav1.ListOptions{LabelSelector: l})
+		if err != nil {
+			p.Log.Warnf("Failed to list configmaps having label=%s : %s", l, err)
+			continue
+		}
+		for _, cm := range list.Items {
+			items = append(items, InventoryItem{Kind: kindConfigMap, Namespace: cm.Namespace, Name: cm.Name})
+		}
+	}
+
+	for _, l := range []string{shardGroupLabel, shardClaimLabel, poolSlotLabel, volumeLeaseLabel} {
+		list, err := p.K8sClient.CoordinationV1().Leases(p.namespace).
+			List(context.TODO(), metav1.ListOptions{LabelSelector: l})
+		if err != nil {
+			p.Log.Warnf("Failed to list leases having label=%s : %s", l, err)
+			continue
+		}
+		for _, lease := range list.Items {
+			items = append(items, InventoryItem{Kind: kindLease, Namespace: lease.Namespace, Name: lease.Name})
+		}
+	}
+	return items
+}
+
+// listRestoreInventory return the CStorRestores of all the namespaces
+func (p *Plugin) listRestoreInventory() []InventoryItem {
+	var items []InventoryItem
+
+	alphaList, err := p.OpenEBSClient.OpenebsV1alpha1().
+		CStorRestores(metav1.NamespaceAll).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		p.Log.Debugf("Failed to list v1alpha1 restores : %s", err)
+	} else {
+		for _, rst := range alphaList.Items {
+			items = append(items, InventoryItem{
+				Kind:      kindRestore,
+				Namespace: rst.Namespace,
+				Name:      rst.Name,
+				Volume:    rst.Spec.VolumeName,
+				Backup:    rst.Spec.RestoreName,
+				Status:    string(rst.Status),
+			})
+		}
+	}
+
+	v1List, err := p.OpenEBSAPIsClient.CstorV1().
+		CStorRestores(metav1.NamespaceAll).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		p.Log.Debugf("Failed to list v1 restores : %s", err)
+	} else {
+		for _, rst := range v1List.Items {
+			items = append(items, InventoryItem{
+				Kind:        kindRestore,
+				Namespace:   rst.Namespace,
+				Name:        rst.Name,
+				Volume:      rst.Spec.VolumeName,
+				Backup:      rst.Spec.RestoreName,
+				Status:      string(rst.Status),
+				isCSIVolume: true,
+			})
+		}
+	}
+	return items
+}
+
+// cleanupInventoryItem deletes the resource of the given inventory item
+func (p *Plugin) cleanupInventoryItem(item *InventoryItem) error {
+	opts := metav1.DeleteOptions{}
+	record := backupRecord{
+		name:        item.Name,
+		namespace:   item.Namespace,
+		isCSIVolume: item.isCSIVolume,
+	}
+
+	switch item.Kind {
+	case kindBackup:
+		// snapshot is removed along with the backup resource
+		err := p.deleteBackup(item.snapName, item.Volume, item.Namespace, item.Backup, item.isCSIVolume)
+		if err == nil {
+			return nil
+		}
+		p.Log.Warnf("Failed to execute clean-up request for backup=%s/%s, snapshot=%s may remain in pool : %s",
+			item.Namespace, item.Name, item.snapName, err)
+		return p.deleteBackupResource(record, false)
+	case kindCompletedBackup:
+		return p.deleteBackupResource(record, true)
+	case kindRestore:
+		if item.isCSIVolume {
+			return p.OpenEBSAPIsClient.CstorV1().CStorRestores(item.Namespace).Delete(context.TODO(), item.Name, opts)
+		}
+		return p.OpenEBSClient.OpenebsV1alpha1().CStorRestores(item.Namespace).Delete(context.TODO(), item.Name, opts)
+	case kindConfigMap:
+		return p.K8sClient.CoreV1().ConfigMaps(item.Namespace).Delete(context.TODO(), item.Name, opts)
+	case kindLease:
+		return p.K8sClient.CoordinationV1().Leases(item.Namespace).Delete(context.TODO(), item.Name, opts)
+	}
+	return nil
+}
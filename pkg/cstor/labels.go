@@ -0,0 +1,161 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// openebsLabelDomain is the domain of labels set by openebs on backup/restore resources,
+// such labels are not overwritten by the labels of velero resources
+const openebsLabelDomain = "openebs.io/"
+
+// getBackupLabels return the labels, of the given velero backup, to be set on
+// the CStorBackup resources. If backup labels can't be fetched then only the
+// backup name label is returned.
+func (p *Plugin) getBackupLabels(bkpName string) map[string]string {
+	bkpLabels, err := velero.GetBackupLabels(bkpName)
+	if err != nil {
+		p.Log.Warningf("Failed to get labels of backup=%s : %s", bkpName, err)
+		return map[string]string{velerov1api.BackupNameLabel: label.GetValidName(bkpName)}
+	}
+	return filterLabels(bkpLabels)
+}
+
+// getRestoreLabels return the labels, of the in-progress velero restore for the given
+// backup, to be set on the CStorRestore resources. If restore labels can't be fetched
+// then only the backup name label is returned.
+func (p *Plugin) getRestoreLabels(bkpName string) map[string]string {
+	rstLabels, err := p.fetchRestoreLabels(bkpName)
+	if err != nil {
+		p.Log.Warningf("Failed to get labels of restore for backup=%s : %s", bkpName, err)
+		return map[string]string{velerov1api.BackupNameLabel: label.GetValidName(bkpName)}
+	}
+	return filterLabels(rstLabels)
+}
+
+func (p *Plugin) fetchRestoreLabels(bkpName string) (map[string]string, error) {
+	r, err := velero.GetRestore(bkpName)
+	if err != nil {
+		return nil, err
+	}
+	return velero.GetRestoreLabels(r)
+}
+
+// filterLabels removes the labels of openebs domain from the given labels
+func filterLabels(l map[string]string) map[string]string {
+	for k := range l {
+		if strings.Contains(k, openebsLabelDomain) {
+			delete(l, k)
+		}
+	}
+	return l
+}
+
+// labelPatch return the merge patch to set the given labels
+func labelPatch(l map[string]string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": l,
+		},
+	})
+}
+
+// labelBackup sets the labels of the volume on the given CStorBackup
+// Failure in setting labels doesn't fail the backup.
+func (p *Plugin) labelBackup(bkp *v1alpha1.CStorBackup, vol *Volume) {
+	if len(vol.labels) == 0 {
+		return
+	}
+
+	patch, err := labelPatch(vol.labels)
+	if err != nil {
+		p.Log.Warnf("Failed to generate label patch for backup=%s : %s", bkp.Spec.SnapName, err)
+		return
+	}
+
+	if err = p.patchBackup(bkp, vol.isCSIVolume, patch); err != nil {
+		p.Log.Warnf("Failed to set labels on backup=%s/%s : %s", bkp.Namespace, bkp.Spec.SnapName, err)
+	}
+}
+
+// labelRestores sets the labels of the volume on the CStorRestores of the given restore.
+// CStorRestore is created for each replica of the volume.
+// Failure in setting labels doesn't fail the restore.
+func (p *Plugin) labelRestores(rst *v1alpha1.CStorRestore, vol *Volume) {
+	var names []string
+
+	if len(vol.labels) == 0 {
+		return
+	}
+
+	patch, err := labelPatch(vol.labels)
+	if err != nil {
+		p.Log.Warnf("Failed to generate label patch for restore=%s : %s", rst.Spec.RestoreName, err)
+		return
+	}
+
+	listOpts := metav1.ListOptions{
+		LabelSelector: cVRPVLabel + "=" + vol.volname,
+	}
+
+	if vol.isCSIVolume {
+		list, err := p.OpenEBSAPIsClient.CstorV1().CStorRestores(rst.Namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			p.Log.Warnf("Failed to list restores of volume=%s : %s", vol.volname, err)
+			return
+		}
+		for _, r := range list.Items {
+			if r.Spec.RestoreName == rst.Spec.RestoreName {
+				names = append(names, r.Name)
+			}
+		}
+	} else {
+		list, err := p.OpenEBSClient.OpenebsV1alpha1().CStorRestores(rst.Namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			p.Log.Warnf("Failed to list restores of volume=%s : %s", vol.volname, err)
+			return
+		}
+		for _, r := range list.Items {
+			if r.Spec.RestoreName == rst.Spec.RestoreName {
+				names = append(names, r.Name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		if vol.isCSIVolume {
+			_, err = p.OpenEBSAPIsClient.CstorV1().CStorRestores(rst.Namespace).
+				Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+		} else {
+			_, err = p.OpenEBSClient.OpenebsV1alpha1().CStorRestores(rst.Namespace).
+				Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+		}
+		if err != nil {
+			p.Log.Warnf("Failed to set labels on restore=%s/%s : %s", rst.Namespace, name, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LogLevel config key for log level of the plugin
+	LogLevel = "logLevel"
+
+	// log fields set on the logs of backup and restore of a volume
+	logFieldBackup    = "backup"
+	logFieldVolume    = "volume"
+	logFieldNamespace = "namespace"
+	logFieldPhase     = "phase"
+	logFieldBytes     = "bytes"
+
+	// phases of backup and restore of a volume, set as phase log field
+	phaseSnapshot = "snapshot"
+	phaseUpload   = "upload"
+	phaseCleanup  = "cleanup"
+	phaseRestore  = "restore"
+)
+
+// setLogLevel sets the given level on the logger of plugin
+func setLogLevel(log logrus.FieldLogger, levelStr string) error {
+	level, err := logrus.ParseLevel(levelStr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s=%s", LogLevel, levelStr)
+	}
+
+	switch l := log.(type) {
+	case *logrus.Logger:
+		l.SetLevel(level)
+	case *logrus.Entry:
+		l.Logger.SetLevel(level)
+	default:
+		return errors.Errorf("%s can't be set for logger of type %T", LogLevel, log)
+	}
+	return nil
+}
+
+// volumeLog return the logger for the given phase of backup or restore of the volume,
+// having the backup, volume and namespace as log fields
+func (p *Plugin) volumeLog(vol *Volume, phase string) logrus.FieldLogger {
+	return p.Log.WithFields(logrus.Fields{
+		logFieldBackup:    vol.backupName,
+		logFieldVolume:    vol.volname,
+		logFieldNamespace: vol.namespace,
+		logFieldPhase:     phase,
+	})
+}
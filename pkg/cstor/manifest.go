@@ -0,0 +1,240 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"encoding/json"
+
+	"github.com/openebs/velero-plugin/pkg/version"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// manifestSuffix is suffix for the name of backup manifest file
+	manifestSuffix = ".manifest"
+
+	// ManifestVersion is the version of backup manifest format
+	// It needs to be incremented if restore of a backup needs the changes in manifest
+	ManifestVersion = 1
+
+	// CompressionNone represents that snapshot data is uploaded without compression
+	CompressionNone = "none"
+)
+
+// backupManifest describes the remote backup of a volume, and it is uploaded
+// alongside the snapshot data
+type backupManifest struct {
+	// ManifestVersion is version of manifest format
+	ManifestVersion int `json:"manifestVersion"`
+
+	// PluginVersion is version of velero-plugin which created the backup
+	PluginVersion string `json:"pluginVersion"`
+
+	// CStorVersion is version of cStor volume
+	CStorVersion string `json:"cstorVersion,omitempty"`
+
+	// Volume is volume name
+	Volume string `json:"volume"`
+
+	// Backup is velero backup name
+	Backup string `json:"backup"`
+
+	// Schedule is schedule name for scheduled backup, or backup name for non-scheduled backup
+	Schedule string `json:"schedule"`
+
+	// IncrementalParent is the backup from which this incremental backup is taken,
+	// it is empty for full backup
+	IncrementalParent string `json:"incrementalParent,omitempty"`
+
+	// Capacity is capacity of the volume
+	Capacity resource.Quantity `json:"capacity"`
+
+	// Size is number of bytes of snapshot data uploaded
+	Size int64 `json:"size"`
+
+	// UsedSize is used size of the volume at the time of backup, used to estimate the backup size
+	UsedSize int64 `json:"usedSize,omitempty"`
+
+	// StorageClass is storageclass of the volume
+	StorageClass string `json:"storageClass"`
+
+	// Claim is spec of the volume claim at the time of backup, it is nil if claim is not backed up
+	Claim *claimSpec `json:"claim,omitempty"`
+
+	// Topology describes the zones of the volume at the time of backup
+	Topology *volumeTopology `json:"topology,omitempty"`
+
+	// Clone is the source snapshot of the volume, if volume is provisioned from snapshot.
+	// Backup of the clone has all its data, so it is restored as an independent volume.
+	Clone *cloneSource `json:"clone,omitempty"`
+
+	// ReplicaCount is number of replicas of the volume
+	ReplicaCount int `json:"replicaCount,omitempty"`
+
+	// IsCSIVolume is true for cStor based CSI volume
+	IsCSIVolume bool `json:"isCSIVolume"`
+
+	// Checksum is checksum of uploaded snapshot data
+	Checksum string `json:"checksum"`
+
+	// Compression is compression used for snapshot data
+	Compression string `json:"compression"`
+
+	// CreationTime is time at which backup is completed
+	CreationTime metav1.Time `json:"creationTime"`
+
+	// ClaimState is state of volume claim at the time of backup, it is empty for active claim
+	ClaimState string `json:"claimState,omitempty"`
+
+	// RestoreConstraints describes the constraints for restoring the backup
+	RestoreConstraints []string `json:"restoreConstraints,omitempty"`
+
+	// Verification describes the verification of uploaded snapshot data,
+	// it is nil if verification is disabled
+	Verification *backupVerification `json:"verification,omitempty"`
+
+	// Degraded describes the health of volume if it was backed up while unhealthy
+	Degraded string `json:"degraded,omitempty"`
+
+	// Transfer describes the upload of snapshot data
+	Transfer *transferStats `json:"transfer,omitempty"`
+}
+
+// claimSpec describes the resource requests of the volume claim, these are applied
+// on the claim created by restore
+type claimSpec struct {
+	// Size is requested storage of the claim
+	Size resource.Quantity `json:"size"`
+
+	// AccessModes are access modes of the claim
+	AccessModes []v1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// VolumeMode is volume mode of the claim
+	VolumeMode *v1.PersistentVolumeMode `json:"volumeMode,omitempty"`
+}
+
+// getClaimSpec return the claim spec of given PVC
+func getClaimSpec(pvc *v1.PersistentVolumeClaim) *claimSpec {
+	return &claimSpec{
+		Size:        pvc.Spec.Resources.Requests[v1.ResourceStorage],
+		AccessModes: pvc.Spec.AccessModes,
+		VolumeMode:  pvc.Spec.VolumeMode,
+	}
+}
+
+// uploadManifest uploads the manifest for completed backup of the given volume,
+// and return the uploaded manifest data
+func (p *Plugin) uploadManifest(vol *Volume, filename string, verification *backupVerification) ([]byte, error) {
+	size, _ := vol.cl.Progress()
+
+	m := backupManifest{
+		ManifestVersion:   ManifestVersion,
+		PluginVersion:     version.Version,
+		Volume:            vol.volname,
+		Backup:            vol.backupName,
+		Schedule:          p.getScheduleName(vol.backupName),
+		IncrementalParent: vol.prevSnapName,
+		Capacity:          vol.size,
+		Size:              size,
+		UsedSize:          vol.usedSize,
+		StorageClass:      vol.storageClass,
+		Claim:             vol.claim,
+		Clone:             vol.clone,
+		IsCSIVolume:       vol.isCSIVolume,
+		Checksum:          vol.cl.Checksum(),
+		Compression:       CompressionNone,
+		CreationTime:      metav1.Now(),
+		ClaimState:        vol.claimState,
+		Verification:      verification,
+		Degraded:          vol.degraded,
+		Transfer:          vol.transfer,
+	}
+
+	if vol.claimState != "" {
+		m.RestoreConstraints = p.getRestoreConstraints(vol)
+	}
+
+	topology, err := p.getVolumeTopology(vol)
+	if err != nil {
+		p.Log.Warnf("Failed to get topology of volume=%s for manifest : %s", vol.volname, err)
+	}
+	m.Topology = topology
+
+	if cv, err := p.getCStorVolumeDetails(vol); err != nil {
+		p.Log.Warnf("Failed to get cStor details of volume=%s for manifest : %s", vol.volname, err)
+	} else {
+		m.CStorVersion = cv.version
+		m.ReplicaCount = cv.replicationFactor
+	}
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode manifest")
+	}
+
+	if ok := vol.cl.Write(data, filename+manifestSuffix); !ok {
+		return nil, errors.New("failed to upload manifest")
+	}
+	return data, nil
+}
+
+// getManifest return the manifest of the given remote backup.
+// Backups created by older version of plugin don't have manifest,
+// for such backups it will return nil manifest without error.
+func (p *Plugin) getManifest(snapshotTag, backupName string) (*backupManifest, error) {
+	filename := p.cl.GenerateRemoteFilename(snapshotTag, backupName) + manifestSuffix
+
+	exists, err := p.cl.ObjectExists(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check manifest=%s", filename)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	data, ok := p.cl.Read(filename)
+	if !ok {
+		return nil, errors.Errorf("failed to download manifest=%s", filename)
+	}
+
+	m := &backupManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode manifest=%s", filename)
+	}
+	return m, nil
+}
+
+// validateManifest checks if the backup described by manifest can be restored to the given volume
+func validateManifest(m *backupManifest, volname string, capacity resource.Quantity) error {
+	if m.ManifestVersion > ManifestVersion {
+		return errors.Errorf("backup=%s is created by newer plugin version=%s, manifest version %d is not supported",
+			m.Backup, m.PluginVersion, m.ManifestVersion)
+	}
+
+	if m.Compression != "" && m.Compression != CompressionNone {
+		return errors.Errorf("backup=%s has unsupported compression=%s", m.Backup, m.Compression)
+	}
+
+	if capacity.Cmp(m.Capacity) < 0 {
+		return errors.Errorf("capacity=%s of volume=%s is less than capacity=%s of backup=%s",
+			capacity.String(), volname, m.Capacity.String(), m.Backup)
+	}
+	return nil
+}
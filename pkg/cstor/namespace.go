@@ -0,0 +1,123 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// NamespaceCacheTTL config key for the time for which discovered openebs namespace is cached
+	NamespaceCacheTTL = "namespaceCacheTTL"
+
+	// defaultNamespaceCacheTTL is default time for which discovered openebs namespace is cached
+	defaultNamespaceCacheTTL = 5 * time.Minute
+
+	// openebsOperatorSelector selects the pods of openebs operators, which are installed
+	// in the openebs namespace
+	openebsOperatorSelector = "openebs.io/component-name in (maya-apiserver,cspc-operator,cvc-operator)"
+)
+
+// namespaceCache has the discovered openebs namespace by the configured namespace, so that
+// the plugins initialized for each backup and restore don't search all the namespaces
+var namespaceCache = struct {
+	sync.Mutex
+	entries map[string]namespaceCacheEntry
+}{
+	entries: map[string]namespaceCacheEntry{},
+}
+
+// namespaceCacheEntry is the discovered openebs namespace cached till expiry
+type namespaceCacheEntry struct {
+	namespace string
+	expiry    time.Time
+}
+
+// getCachedNamespace return the cached openebs namespace for given configured namespace
+func getCachedNamespace(configured string) (string, bool) {
+	namespaceCache.Lock()
+	defer namespaceCache.Unlock()
+
+	e, ok := namespaceCache.entries[configured]
+	if !ok || time.Now().After(e.expiry) {
+		delete(namespaceCache.entries, configured)
+		return "", false
+	}
+	return e.namespace, true
+}
+
+// cacheNamespace caches the discovered openebs namespace for given configured namespace,
+// caching is disabled if ttl is 0
+func cacheNamespace(configured, ns string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	namespaceCache.Lock()
+	defer namespaceCache.Unlock()
+	namespaceCache.entries[configured] = namespaceCacheEntry{namespace: ns, expiry: time.Now().Add(ttl)}
+}
+
+// invalidateNamespace removes the cached openebs namespace for given configured namespace
+func invalidateNamespace(configured string) {
+	namespaceCache.Lock()
+	defer namespaceCache.Unlock()
+	delete(namespaceCache.entries, configured)
+}
+
+// discoverOpenEBSNamespace return the namespace of openebs operators, maya-apiserver, cspc-operator
+// or cvc-operator, located by their labels in all the namespaces. If operators are found in multiple
+// namespaces then the configured namespace is preferred. It return empty string if operators are
+// not found.
+func (p *Plugin) discoverOpenEBSNamespace(configured string) (string, error) {
+	pods, err := p.K8sClient.CoreV1().Pods(metav1.NamespaceAll).
+		List(context.TODO(), metav1.ListOptions{LabelSelector: openebsOperatorSelector})
+	if err != nil {
+		return "", err
+	}
+
+	found := map[string]bool{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning {
+			found[pod.Namespace] = true
+		}
+	}
+	if len(found) == 0 {
+		return "", nil
+	}
+	if found[configured] {
+		return configured, nil
+	}
+
+	namespaces := make([]string, 0, len(found))
+	for ns := range found {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	if len(namespaces) > 1 {
+		p.Log.Warnf("OpenEBS operators found in namespaces %v, using namespace=%s. Set config %s to use other namespace",
+			namespaces, namespaces[0], NAMESPACE)
+	}
+	return namespaces[0], nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RestorePoolCluster config key for the pool cluster mapping used by remote restore
+	RestorePoolCluster = "restorePoolCluster"
+
+	// restorePoolClusterAnnotation is set on velero restore to override the pool cluster
+	// mapping configured in volumesnapshotlocation for that restore
+	restorePoolClusterAnnotation = "openebs.io/restore-pool-cluster"
+
+	// csiPoolClusterParameter is storageClass parameter for CStorPoolCluster of cStor CSI volume
+	csiPoolClusterParameter = "cstorPoolCluster"
+)
+
+// getPoolClusterMapping return the mapping of pool clusters, StoragePoolClaim for non CSI volume
+// and CStorPoolCluster for CSI volume, used by the restore of given snapshot.
+// Mapping set on velero restore takes precedence over the plugin config.
+func (p *Plugin) getPoolClusterMapping(snapName string) (map[string]string, error) {
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := r.Annotations[restorePoolClusterAnnotation]
+	if !ok {
+		return p.poolClusterMapping, nil
+	}
+
+	mapping, err := parseNameMapping(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse annotation=%s of restore=%s",
+			restorePoolClusterAnnotation, r.Name)
+	}
+	return mapping, nil
+}
+
+// setPVCPoolCluster updates the given PVC to place the replicas of the volume on the pool cluster
+// mapped by restore. Pool cluster of non CSI volume is set using cas config annotation on PVC, while
+// the PVC of CSI volume uses the storageClass, created from PVC's storageClass, having the pool cluster.
+func (p *Plugin) setPVCPoolCluster(pvc *v1.PersistentVolumeClaim, snapName string) error {
+	mapping, err := p.getPoolClusterMapping(snapName)
+	if err != nil || len(mapping) == 0 {
+		return err
+	}
+
+	sc, err := p.getPVCStorageClass(pvc)
+	if err != nil {
+		return errors.Wrapf(err, "can't set pool cluster")
+	}
+
+	poolCluster, err := getPoolCluster(sc)
+	if err != nil {
+		return err
+	}
+
+	newPoolCluster, ok := lookupNameMapping(mapping, poolCluster)
+	if !ok || newPoolCluster == poolCluster {
+		return nil
+	}
+	return p.applyPoolCluster(pvc, sc, poolCluster, newPoolCluster)
+}
+
+// changePVCPoolCluster updates the given PVC to place the replicas of the volume on the given pool cluster
+func (p *Plugin) changePVCPoolCluster(pvc *v1.PersistentVolumeClaim, newPoolCluster string) error {
+	sc, err := p.getPVCStorageClass(pvc)
+	if err != nil {
+		return errors.Wrapf(err, "can't set pool cluster")
+	}
+
+	poolCluster, err := getPoolCluster(sc)
+	if err != nil || poolCluster == newPoolCluster {
+		return err
+	}
+	return p.applyPoolCluster(pvc, sc, poolCluster, newPoolCluster)
+}
+
+// getPoolCluster return the pool cluster of given storageClass, CStorPoolCluster parameter for
+// CSI volume and StoragePoolClaim cas config for non CSI volume
+func getPoolCluster(sc *storagev1.StorageClass) (string, error) {
+	if sc.Provisioner == openebsCSIName {
+		return sc.Parameters[csiPoolClusterParameter], nil
+	}
+
+	poolCluster, err := getCASConfig(sc.Annotations, casConfigStoragePoolClaim)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid storageClass=%s", sc.Name)
+	}
+	return poolCluster, nil
+}
+
+// applyPoolCluster changes the pool cluster of given PVC, having the given storageClass, to newPoolCluster
+func (p *Plugin) applyPoolCluster(pvc *v1.PersistentVolumeClaim, sc *storagev1.StorageClass,
+	poolCluster, newPoolCluster string) error {
+	isCSIVolume := sc.Provisioner == openebsCSIName
+
+	p.Log.Infof("Changing pool cluster of PVC=%s/%s from %s to %s", pvc.Namespace, pvc.Name, poolCluster, newPoolCluster)
+
+	if !isCSIVolume {
+		_, err := p.OpenEBSClient.OpenebsV1alpha1().StoragePoolClaims().Get(context.TODO(), newPoolCluster, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "failed to get storagePoolClaim=%s", newPoolCluster)
+		}
+		return setCASConfig(pvc.Annotations, casConfigStoragePoolClaim, newPoolCluster)
+	}
+
+	_, err := p.OpenEBSAPIsClient.CstorV1().CStorPoolClusters(p.namespace).Get(context.TODO(), newPoolCluster, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get cStorPoolCluster=%s", newPoolCluster)
+	}
+
+	name, err := p.getDerivedStorageClass(sc, "pool-"+newPoolCluster, csiPoolClusterParameter, newPoolCluster)
+	if err != nil {
+		return err
+	}
+	pvc.Spec.StorageClassName = &name
+	return nil
+}
@@ -0,0 +1,338 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PoolBackupLimit config key for number of volumes which can be backed up
+	// concurrently from a cStor pool
+	PoolBackupLimit = "poolBackupLimit"
+
+	// poolSlotLeasePrefix is prefix for the name of lease of the backup slot of a pool
+	poolSlotLeasePrefix = "velero-pool-"
+
+	// poolSlotLabel is set on lease of the backup slot with pool UID as value
+	poolSlotLabel = "openebs.io/velero-pool"
+
+	// poolSlotLeaseDuration is time for which backup slot lease is valid, lease is
+	// renewed while the backup is running, so that slot held by the plugin
+	// instance which is terminated is released after this duration
+	poolSlotLeaseDuration = time.Minute
+
+	// cstorPoolUIDLabel is set on v1alpha1 CVR with the UID of its cStor pool
+	cstorPoolUIDLabel = "cstorpool.openebs.io/uid"
+
+	// cstorPoolInstanceUIDLabel is set on v1 CVR with the UID of its cStor pool instance
+	cstorPoolInstanceUIDLabel = "cstorpoolinstance.openebs.io/uid"
+)
+
+// poolSlot is a backup slot of a pool held by the backup of a volume
+type poolSlot struct {
+	// name is name of the lease of slot
+	name string
+
+	// pool is UID of the pool of slot
+	pool string
+
+	// holder is holder identity of the lease
+	holder string
+
+	// stop is closed to stop the renewal of lease
+	stop chan struct{}
+}
+
+// poolSlotLeaseName return the name of lease for the given slot of pool
+func poolSlotLeaseName(pool string, slot int) string {
+	return poolSlotLeasePrefix + pool + "-" + strconv.Itoa(slot)
+}
+
+// acquirePoolSlots acquires a backup slot on the pool of the replica which sends the backup, for
+// all the given tasks. Pool is selected here, and used by the backup request of the volume, so that
+// slots of other pools having the replica are not held. Slots are shared by all the plugin instances
+// using leases. Slots are acquired in the order of pool UID so that concurrent backups don't deadlock.
+// If ctx is done before acquiring the slots then acquired slots are released.
+func (p *Plugin) acquirePoolSlots(ctx context.Context, tasks []*backupTask) error {
+	for _, t := range tasks {
+		t.vol.backupPool = ""
+	}
+
+	if p.poolBackupLimit == 0 {
+		return nil
+	}
+
+	count := map[string]int{}
+	for _, t := range tasks {
+		pool, err := p.getHealthyReplicaPool(t.vol.volname, t.vol.isCSIVolume, nil)
+		if err != nil {
+			return err
+		}
+		t.vol.backupPool = pool
+		count[pool]++
+	}
+
+	for pool, n := range count {
+		if n > p.poolBackupLimit {
+			return errors.Errorf("%d volumes, to be backed up together, are sent by pool=%s, "+
+				"which exceeds %s=%d", n, pool, PoolBackupLimit, p.poolBackupLimit)
+		}
+	}
+
+	sorted := append([]*backupTask(nil), tasks...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].vol.backupPool != sorted[j].vol.backupPool {
+			return sorted[i].vol.backupPool < sorted[j].vol.backupPool
+		}
+		return sorted[i].vol.volname < sorted[j].vol.volname
+	})
+
+	for _, t := range sorted {
+		slot, err := p.acquirePoolSlot(ctx, t.vol.backupPool, t.vol)
+		if err != nil {
+			for _, t := range tasks {
+				p.releasePoolSlots(t)
+			}
+			return err
+		}
+		t.slot = slot
+	}
+	return nil
+}
+
+// movePoolSlot moves the backup slot of given task to the given pool, on which backup is retried.
+// Slot of the failed pool is released before waiting for the slot of given pool, so that backups
+// retried on each other's pool don't deadlock.
+func (p *Plugin) movePoolSlot(t *backupTask, pool string) error {
+	if p.poolBackupLimit == 0 {
+		return nil
+	}
+
+	p.releasePoolSlot(t.slot)
+	t.slot = nil
+
+	slot, err := p.acquirePoolSlot(t.ctx, pool, t.vol)
+	if err != nil {
+		return err
+	}
+	t.slot = slot
+	return nil
+}
+
+// acquirePoolSlot waits for a free backup slot of the given pool
+func (p *Plugin) acquirePoolSlot(ctx context.Context, pool string, vol *Volume) (*poolSlot, error) {
+	holder := instanceID() + "/" + vol.backupName + "/" + vol.volname
+
+	for logged := false; ; {
+		for i := 0; i < p.poolBackupLimit; i++ {
+			name := poolSlotLeaseName(pool, i)
+
+			ok, _, err := p.tryAcquireLease(name, map[string]string{poolSlotLabel: pool}, holder, poolSlotLeaseDuration)
+			if err != nil {
+				p.Log.Warnf("Failed to acquire backup slot=%s for volume=%s : %s", name, vol.volname, err)
+				continue
+			}
+
+			if ok {
+				slot := &poolSlot{name: name, pool: pool, holder: holder, stop: make(chan struct{})}
+				go p.renewLease(slot.name, holder, poolSlotLeaseDuration, slot.stop)
+				p.Log.Debugf("Acquired backup slot=%s for volume=%s", name, vol.volname)
+				return slot, nil
+			}
+		}
+
+		if !logged {
+			p.Log.Infof("Waiting for backup slot of pool=%s for volume=%s, %s=%d",
+				pool, vol.volname, PoolBackupLimit, p.poolBackupLimit)
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf("failed to acquire backup slot of pool=%s for volume=%s : %s",
+				pool, vol.volname, ctx.Err())
+		case <-time.After(p.backupStatusInterval):
+		}
+	}
+}
+
+// tryAcquireLease acquires the given lease, having the given labels, for holder if the lease doesn't
+// exist or is expired. If the lease is held by other holder then it returns the current holder.
+func (p *Plugin) tryAcquireLease(name string, labels map[string]string, holder string, duration time.Duration) (bool, string, error) {
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(duration.Seconds())
+
+	lease, err := p.K8sClient.CoordinationV1().Leases(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return false, "", err
+		}
+
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: p.namespace,
+				Labels:    labels,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = p.K8sClient.CoordinationV1().Leases(p.namespace).Create(context.TODO(), lease, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return false, "", nil
+		}
+		return err == nil, "", err
+	}
+
+	if isLeaseValid(lease) {
+		return false, *lease.Spec.HolderIdentity, nil
+	}
+
+	// lease holder didn't release or renew the lease, so lease is free
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	_, err = p.K8sClient.CoordinationV1().Leases(p.namespace).Update(context.TODO(), lease, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) {
+		return false, "", nil
+	}
+	return err == nil, "", err
+}
+
+// renewLease renews the given lease, of given duration, until stop is closed
+func (p *Plugin) renewLease(name, holder string, duration time.Duration, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(duration / 3):
+		}
+
+		lease, err := p.K8sClient.CoordinationV1().Leases(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			p.Log.Warnf("Failed to renew lease=%s : %s", name, err)
+			continue
+		}
+
+		if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holder {
+			p.Log.Warnf("Lease=%s is taken over by %v", name, lease.Spec.HolderIdentity)
+			return
+		}
+
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.RenewTime = &now
+		if _, err = p.K8sClient.CoordinationV1().Leases(p.namespace).
+			Update(context.TODO(), lease, metav1.UpdateOptions{}); err != nil {
+			p.Log.Warnf("Failed to renew lease=%s : %s", name, err)
+		}
+	}
+}
+
+// releaseLease deletes the given lease if it is held by the given holder. Lease is deleted with
+// precondition on its version, so that the lease taken over by other holder is not deleted.
+func (p *Plugin) releaseLease(name, holder string) error {
+	lease, err := p.K8sClient.CoordinationV1().Leases(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holder {
+		p.Log.Infof("Lease=%s is taken over by %v, skipping its release", name, lease.Spec.HolderIdentity)
+		return nil
+	}
+
+	err = p.K8sClient.CoordinationV1().Leases(p.namespace).Delete(context.TODO(), name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if k8serrors.IsNotFound(err) || k8serrors.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+// releasePoolSlots releases the backup slot and the volume lease held by the given task
+func (p *Plugin) releasePoolSlots(t *backupTask) {
+	p.releaseVolumeLease(t.lease)
+	t.lease = nil
+
+	p.releasePoolSlot(t.slot)
+	t.slot = nil
+}
+
+// releasePoolSlot releases the given backup slot if it is still held by the plugin instance,
+// it is no-op for nil slot
+func (p *Plugin) releasePoolSlot(slot *poolSlot) {
+	if slot == nil {
+		return
+	}
+	close(slot.stop)
+
+	if err := p.releaseLease(slot.name, slot.holder); err != nil {
+		p.Log.Warnf("Failed to release backup slot=%s, it will be released after %v : %s",
+			slot.name, poolSlotLeaseDuration, err)
+	}
+}
+
+// getVolumePools return the UIDs of the pools having the replica of given volume
+func (p *Plugin) getVolumePools(vol *Volume) ([]string, error) {
+	var pools []string
+
+	listOpts := metav1.ListOptions{
+		LabelSelector: cVRPVLabel + "=" + vol.volname,
+	}
+
+	if vol.isCSIVolume {
+		cvrList, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return nil, err
+		}
+		for _, cvr := range cvrList.Items {
+			if uid := cvr.Labels[cstorPoolInstanceUIDLabel]; uid != "" {
+				pools = append(pools, uid)
+			}
+		}
+		return pools, nil
+	}
+
+	cvrList, err := p.OpenEBSClient.OpenebsV1alpha1().CStorVolumeReplicas(p.namespace).List(context.TODO(), listOpts)
+	if err != nil {
+		return nil, err
+	}
+	for _, cvr := range cvrList.Items {
+		if uid := cvr.Labels[cstorPoolUIDLabel]; uid != "" {
+			pools = append(pools, uid)
+		}
+	}
+	return pools, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// dataPorts has the data ports used by the plugins of the process. Velero initializes a plugin
+// for each volumesnapshotlocation used by a backup or restore, and these plugins run in the
+// same process, so plugins having the same ports share the pool of backup ports and the restore
+// port, instead of failing to listen on the port used by the plugin of other location.
+var dataPorts = struct {
+	sync.Mutex
+
+	// backup are the pools of backup ports by first port of the pool
+	backup map[int]*backupPortPool
+
+	// restore are the locks of restore ports by port
+	restore map[int]*sync.Mutex
+}{
+	backup:  map[int]*backupPortPool{},
+	restore: map[int]*sync.Mutex{},
+}
+
+// backupPortPool is pool of backup ports from first to first+count-1
+type backupPortPool struct {
+	first, count int
+
+	// ports are the available ports of the pool
+	ports chan int
+
+	// lock serializes the acquisition of multiple backup ports
+	lock sync.Mutex
+}
+
+// overlaps returns true if given number of ports from the first port overlap the pool
+func (b *backupPortPool) overlaps(first, count int) bool {
+	return first < b.first+b.count && b.first < first+count
+}
+
+// idle returns true if none of the ports of the pool is in use
+func (b *backupPortPool) idle() bool {
+	return len(b.ports) == b.count
+}
+
+// getBackupPortPool return the pool of given number of backup ports from the first port. Pool
+// is shared by the plugins having the same ports. Idle pool of other plugin, overlapping the given
+// backup or restore ports, is replaced, else error is returned.
+func getBackupPortPool(first, count, restorePort int) (*backupPortPool, error) {
+	dataPorts.Lock()
+	defer dataPorts.Unlock()
+
+	if b, ok := dataPorts.backup[first]; ok && b.count == count {
+		return b, nil
+	}
+
+	for start, b := range dataPorts.backup {
+		if !b.overlaps(first, count) && !b.overlaps(restorePort, 1) {
+			continue
+		}
+		if !b.idle() {
+			return nil, errors.Errorf("invalid %s=%d or %s=%d, these conflict with backup ports %d-%d in use by other volumesnapshotlocation",
+				BackupPort, first, RestorePort, restorePort, b.first, b.first+b.count-1)
+		}
+		delete(dataPorts.backup, start)
+	}
+
+	for port := range dataPorts.restore {
+		if port >= first && port < first+count {
+			return nil, errors.Errorf("invalid %s=%d, backup ports %d-%d conflict with %s=%d of other volumesnapshotlocation",
+				BackupPort, first, first, first+count-1, RestorePort, port)
+		}
+	}
+
+	b := &backupPortPool{first: first, count: count, ports: make(chan int, count)}
+	for i := 0; i < count; i++ {
+		b.ports <- first + i
+	}
+	dataPorts.backup[first] = b
+	return b, nil
+}
+
+// getRestorePortLock return the lock of given restore port, shared by the plugins having the same
+// restore port. It is held while the data of a snapshot is served on the port.
+func getRestorePortLock(port int) *sync.Mutex {
+	dataPorts.Lock()
+	defer dataPorts.Unlock()
+
+	l, ok := dataPorts.restore[port]
+	if !ok {
+		l = &sync.Mutex{}
+		dataPorts.restore[port] = l
+	}
+	return l
+}
@@ -19,10 +19,10 @@ package cstor
 import (
 	"context"
 	"encoding/json"
-	"sort"
 
 	uuid "github.com/gofrs/uuid"
 	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -36,7 +36,7 @@ const (
 func (p *Plugin) updateVolCASInfo(data []byte, volumeID string) error {
 	var cas v1alpha1.CASVolume
 
-	vol := p.volumes[volumeID]
+	vol, _ := p.getVolume(volumeID)
 	if vol == nil {
 		return errors.Errorf("Volume{%s} not found in volume list", volumeID)
 	}
@@ -61,21 +61,27 @@ func (p *Plugin) updateVolCASInfo(data []byte, volumeID string) error {
 }
 
 // restoreVolumeFromCloud restore remote snapshot for the given volume
-// Note: cstor snapshots are incremental in nature, so restore will be executed
-// from base snapshot to incremental snapshot 'vol.backupName' if p.restoreAllSnapshots is set
-// else restore will be performed for the given backup only.
+// Note: cstor snapshots are incremental in nature, so if the targeted backup is part of
+// a schedule and p.restoreAllSnapshots is set then restore will be executed from
+// base snapshot to incremental snapshot 'vol.backupName', else restore will be
+// performed for the given backup only.
 func (p *Plugin) restoreVolumeFromCloud(vol *Volume, targetBackupName string) error {
 	var (
 		snapshotList []string
 		err          error
 	)
 
-	if p.restoreAllSnapshots {
+	scheduleName := p.getScheduleName(targetBackupName)
+	vol.restored = nil
+
+	if p.restoreAllSnapshots && scheduleName != targetBackupName {
 		// We are restoring from base backup to targeted Backup
-		snapshotList, err = p.cl.GetSnapListFromCloud(vol.snapshotTag, p.getScheduleName(targetBackupName))
+		snapshotList, err = p.getIncrementalChain(vol.snapshotTag, scheduleName)
 		if err != nil {
 			return err
 		}
+		p.Log.Infof("Backup=%s is part of schedule=%s, restoring incremental chain %v",
+			targetBackupName, scheduleName, snapshotList)
 	} else {
 		// We are restoring only given backup
 		snapshotList = []string{targetBackupName}
@@ -85,8 +91,41 @@ func (p *Plugin) restoreVolumeFromCloud(vol *Volume, targetBackupName string) er
 		return errors.Errorf("Targeted backup=%s not found in snapshot list", targetBackupName)
 	}
 
-	// snapshots are created using timestamp, we need to sort it in ascending order
-	sort.Strings(snapshotList)
+	// other velero replica may be restoring the same backup to the volume
+	ctx, cancel := context.WithTimeout(context.Background(), p.overlapTimeout)
+	defer cancel()
+
+	lease, err := p.acquireVolumeLease(ctx, vol.volname, volumeOpRestore, targetBackupName)
+	if err != nil {
+		return err
+	}
+	defer p.releaseVolumeLease(lease)
+
+	if p.restoreAllSnapshots && vol.restoredBackup != "" && p.getScheduleName(vol.restoredBackup) == scheduleName {
+		// volume has the snapshots of schedule till the restored backup, so only the
+		// incremental snapshots taken after it need to be restored
+		if !p.isBackupBefore(vol.restoredBackup, targetBackupName) {
+			p.Log.Infof("Backup=%s is already restored to volume=%s, skipping restore", vol.restoredBackup, vol.volname)
+			vol.restoreStatus = v1alpha1.RSTCStorStatusDone
+			vol.skipped = true
+			return nil
+		}
+
+		if !contains(snapshotList, vol.restoredBackup) {
+			return errors.Errorf("backup=%s restored to volume=%s not found in snapshot list, "+
+				"can't restore incremental snapshots", vol.restoredBackup, vol.volname)
+		}
+
+		var pending []string
+		for _, snap := range snapshotList {
+			if p.isBackupBefore(vol.restoredBackup, snap) {
+				pending = append(pending, snap)
+			}
+		}
+		p.Log.Infof("Backup=%s is already restored to volume=%s, restoring incremental snapshots %v",
+			vol.restoredBackup, vol.volname, pending)
+		snapshotList = pending
+	}
 
 	for _, snap := range snapshotList {
 		// Check if snapshot file exists or not.
@@ -105,15 +144,17 @@ func (p *Plugin) restoreVolumeFromCloud(vol *Volume, targetBackupName string) er
 			continue
 		}
 
-		p.Log.Infof("Restoring snapshot=%s", snap)
-
 		vol.backupName = snap
+		log := p.volumeLog(vol, phaseRestore)
+		log.Info("Restoring snapshot")
 
 		err = p.restoreSnapshotFromCloud(vol)
 		if err != nil {
 			return errors.Wrapf(err, "failed to restor snapshot=%s", snap)
 		}
-		p.Log.Infof("Restore of snapshot=%s completed", snap)
+
+		transferred, _ := p.cl.Progress()
+		log.WithField(logFieldBytes, transferred).Info("Restore of snapshot completed")
 
 		if snap == targetBackupName {
 			// we restored till the targetBackupName, no need to restore next snapshot
@@ -123,13 +164,74 @@ func (p *Plugin) restoreVolumeFromCloud(vol *Volume, targetBackupName string) er
 	return nil
 }
 
+// getIncrementalChain return the list of remote backups of the given volume created by the given schedule
+// Listing of remote backups is prefix based, so backups of other schedules having the same
+// prefix, eg: 'sched' and 'sched-daily', are filtered out from the list. List is sorted from
+// oldest to latest backup.
+func (p *Plugin) getIncrementalChain(snapshotTag, scheduleName string) ([]string, error) {
+	var chain []string
+
+	snapshotList, err := p.cl.GetSnapListFromCloud(snapshotTag, scheduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, snap := range snapshotList {
+		if p.getScheduleName(snap) == scheduleName {
+			chain = append(chain, snap)
+		}
+	}
+	p.sortBackups(chain)
+	return chain, nil
+}
+
 // restoreSnapshotFromCloud restore snapshot 'vol.backupName` to volume 'vol.volname'
 func (p *Plugin) restoreSnapshotFromCloud(vol *Volume) error {
-	p.cl.ExitServer = false
+	p.cl.ConnStateReset()
 
-	restore, err := p.sendRestoreRequest(vol)
+	m, err := p.getManifest(vol.snapshotTag, vol.backupName)
 	if err != nil {
-		return errors.Wrapf(err, "Restore request to apiServer failed")
+		return err
+	}
+
+	// checksum of restored data is computed using the algorithm used by backup
+	algorithm := p.cl.DefaultChecksumAlgorithm()
+	if m != nil && m.Checksum != "" {
+		algorithm = cloud.ChecksumAlgorithmOf(m.Checksum)
+	}
+	if err = p.cl.SetChecksumAlgorithm(algorithm); err != nil {
+		return errors.Wrapf(err, "failed to verify checksum of snapshot=%s", vol.backupName)
+	}
+
+	if m != nil {
+		pv, err := p.getPV(vol.volname)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get pv=%s", vol.volname)
+		}
+		if err = validateManifest(m, pv.Name, pv.Spec.Capacity[v1.ResourceStorage]); err != nil {
+			return err
+		}
+
+		for _, c := range m.RestoreConstraints {
+			p.Log.Warnf("Restoring snapshot=%s of volume=%s with constraint : %s", vol.backupName, m.Volume, c)
+		}
+	} else {
+		p.Log.Infof("Manifest not found for snapshot=%s, skipping validation", vol.backupName)
+	}
+
+	attested, err := p.verifyAttestation(vol.snapshotTag, vol.backupName)
+	if err != nil {
+		return err
+	}
+
+	// restore port is shared by the plugins of other volumesnapshotlocations,
+	// so it is held from the creation of restore till the data is served
+	p.restoreLock.Lock()
+	defer p.restoreLock.Unlock()
+
+	restore, err := p.createRestore(vol)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create restore")
 	}
 
 	filename := p.cl.GenerateRemoteFilename(vol.snapshotTag, vol.backupName)
@@ -137,17 +239,46 @@ func (p *Plugin) restoreSnapshotFromCloud(vol *Volume) error {
 		return errors.Errorf("Error creating remote file name for restore")
 	}
 
-	go p.checkRestoreStatus(restore, vol)
+	// status watch is stopped if download fails
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	ret := p.cl.Download(filename, CstorRestorePort)
+	result := make(chan v1alpha1.CStorRestoreStatus, 1)
+	go p.checkRestoreStatus(ctx, restore, vol, result)
+
+	ret := p.cl.Download(filename, p.restorePort)
 	if !ret {
+		// wait for status check to stop, so that it doesn't stop the
+		// server of a later download
+		cancel()
+		<-result
 		return errors.New("failed to restore snapshot")
 	}
 
+	// download completes once the restore status is final
+	vol.restoreStatus = <-result
+
 	if vol.restoreStatus != v1alpha1.RSTCStorStatusDone {
 		return errors.Errorf("failed to restore.. status {%s}", vol.restoreStatus)
 	}
 
+	transferred, _ := p.cl.Progress()
+	restored := restoredSnapshot{
+		Name:     vol.backupName,
+		Bytes:    transferred,
+		Checksum: p.cl.Checksum(),
+		Attested: attested,
+	}
+
+	if m != nil && m.Checksum != "" {
+		if m.Checksum != restored.Checksum {
+			return errors.Errorf("checksum mismatch for snapshot=%s, expected=%s restored=%s",
+				vol.backupName, m.Checksum, restored.Checksum)
+		}
+		restored.ChecksumVerified = true
+	}
+
+	vol.restored = append(vol.restored, restored)
 	return nil
 }
 
@@ -182,25 +313,38 @@ func (p *Plugin) getVolumeForLocalRestore(volumeID, snapName string) (*Volume, e
 	}
 	p.Log.Infof("Renaming PV %s to %s", pv.Name, clonePvName)
 
+	// velero will create the claim for clone PV in the namespace mapped by restore,
+	// source claim's namespace may not exist anymore
+	var targetedNs string
+	if pv.Spec.ClaimRef != nil {
+		targetedNs, err = p.getTargetNamespace(pv.Spec.ClaimRef.Namespace, snapName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	isCSIVolume := isCSIPv(*pv)
 
 	vol := &Volume{
 		volname:      clonePvName,
 		srcVolname:   pv.Name,
+		namespace:    targetedNs,
 		backupName:   snapName,
 		storageClass: pv.Spec.StorageClassName,
 		size:         pv.Spec.Capacity[v1.ResourceStorage],
 		isCSIVolume:  isCSIVolume,
+		local:        true,
 	}
-	p.volumes[vol.volname] = vol
+	p.setVolume(vol)
 	return vol, nil
 }
 
 // getVolumeForRemoteRestore return volume information to restore from remote backup for the given volumeID and snapName
 // volumeID : pv name from backup
 // snapName : snapshot name from where new volume will be created
-func (p *Plugin) getVolumeForRemoteRestore(volumeID, snapName string) (*Volume, error) {
-	vol, err := p.createPVC(volumeID, snapName)
+// volumeAZ : availability zone of the volume recorded by velero
+func (p *Plugin) getVolumeForRemoteRestore(volumeID, snapName, volumeAZ string) (*Volume, error) {
+	vol, err := p.createPVC(volumeID, snapName, volumeAZ)
 	if err != nil {
 		p.Log.Errorf("CreatePVC returned error=%s", err)
 		return nil, err
@@ -27,6 +27,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -39,11 +40,35 @@ const (
 
 	// PVCCheckInterval defines amount of delay for PVC bound check
 	PVCCheckInterval = 5 * time.Second
+
+	// ClaimStateTerminating represents that volume claim was terminating at the time of backup
+	ClaimStateTerminating = "ClaimTerminating"
+
+	// ClaimStateDeleted represents that volume claim was deleted at the time of backup
+	ClaimStateDeleted = "ClaimDeleted"
+
+	// ClaimStateNamespaceTerminating represents that namespace of volume claim was terminating at the time of backup
+	ClaimStateNamespaceTerminating = "NamespaceTerminating"
+
+	// ClaimStateNamespaceDeleted represents that namespace of volume claim was deleted at the time of backup
+	ClaimStateNamespaceDeleted = "NamespaceDeleted"
+
+	// ExistingVolumeRestore restores the data to the volume of existing PVC
+	ExistingVolumeRestore = "restore"
+
+	// ExistingVolumeSkip skips the restore of the volume if PVC already exists
+	ExistingVolumeSkip = "skip"
+
+	// ExistingVolumeFail fails the restore of the volume if PVC already exists
+	ExistingVolumeFail = "fail"
+
+	// ExistingVolumeRename restores the volume to a new PVC, having restore name as suffix, if PVC already exists
+	ExistingVolumeRename = "rename"
 )
 
 // backupPVC perform backup for given volume's PVC
 func (p *Plugin) backupPVC(volumeID string) error {
-	vol := p.volumes[volumeID]
+	vol, _ := p.getVolume(volumeID)
 	var bkpPvc *v1.PersistentVolumeClaim
 
 	pvcs, err := p.K8sClient.
@@ -63,6 +88,14 @@ func (p *Plugin) backupPVC(volumeID string) error {
 		}
 	}
 
+	if bkpPvc == nil && p.backupTerminating {
+		// claim of the volume is deleted, so PVC is generated from PV for restore
+		bkpPvc, err = p.getPVCFromPV(vol)
+		if err != nil {
+			return err
+		}
+	}
+
 	if bkpPvc == nil {
 		p.Log.Errorf("Failed to find PVC for PV{%s}", vol.volname)
 		return errors.Errorf("Failed to find PVC for volume{%s}", vol.volname)
@@ -75,9 +108,34 @@ func (p *Plugin) backupPVC(volumeID string) error {
 		bkpPvc.Spec.StorageClassName = &sc
 	}
 
+	if vol.clone != nil {
+		p.setCloneClaimSpec(bkpPvc, vol)
+	}
+
 	bkpPvc.Annotations = nil
+	if sc, err := p.getPVCStorageClass(bkpPvc); err == nil {
+		// storageClass may be changed or missing at restore
+		if spec, err := MarshalStorageClassSpec(sc); err == nil {
+			bkpPvc.Annotations = map[string]string{StorageClassSpecAnnotation: spec}
+		}
+	} else {
+		p.Log.Warnf("Failed to record storageClass of PVC=%s/%s : %s", bkpPvc.Namespace, bkpPvc.Name, err)
+	}
+
+	if vol.isCSIVolume {
+		// policy of the volume is set on its CStorVolumeConfig by storageClass or by user
+		if spec, err := p.getVolumePolicySpec(vol); err != nil {
+			p.Log.Warnf("Failed to record volume policy of PVC=%s/%s : %s", bkpPvc.Namespace, bkpPvc.Name, err)
+		} else if spec != "" {
+			if bkpPvc.Annotations == nil {
+				bkpPvc.Annotations = map[string]string{}
+			}
+			bkpPvc.Annotations[VolumePolicySpecAnnotation] = spec
+		}
+	}
 	bkpPvc.UID = ""
 	bkpPvc.Spec.VolumeName = ""
+	vol.claim = getClaimSpec(bkpPvc)
 
 	data, err := json.MarshalIndent(bkpPvc, "", "\t")
 	if err != nil {
@@ -97,7 +155,7 @@ func (p *Plugin) backupPVC(volumeID string) error {
 }
 
 // createPVC create PVC for given volume name
-func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
+func (p *Plugin) createPVC(volumeID, snapName, volumeAZ string) (*Volume, error) {
 	var vol *Volume
 
 	pvc, err := p.downloadPVC(volumeID, snapName)
@@ -105,19 +163,32 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 		return nil, errors.Wrapf(err, "failed to download pvc")
 	}
 
-	targetedNs, err := velero.GetRestoreNamespace(pvc.Namespace, snapName, p.Log)
+	// PVC from backup may have finalizers, owner references.. from source cluster
+	resetPVCMetadata(pvc)
+
+	m, err := p.getManifest(volumeID, snapName)
 	if err != nil {
 		return nil, err
 	}
+	p.setPVCClaimSpec(pvc, m, snapName)
+
+	// storageClass spec, and volume policy of CSI volume, are recorded at backup
+	scSpec := pvc.Annotations[StorageClassSpecAnnotation]
+	policySpec := pvc.Annotations[VolumePolicySpecAnnotation]
 
-	err = p.EnsureNamespaceOrCreate(targetedNs)
+	targetedNs, err := p.getTargetNamespace(pvc.Namespace, snapName)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error verifying namespace")
+		return nil, err
 	}
 
 	pvc.Namespace = targetedNs
 
-	newVol, err := p.getVolumeFromPVC(*pvc)
+	newVol, err := p.applyExistingVolumePolicy(pvc, snapName)
+	if err != nil || newVol != nil {
+		return newVol, err
+	}
+
+	newVol, err = p.getVolumeFromPVC(*pvc)
 	if err != nil {
 		return nil, err
 	}
@@ -128,12 +199,41 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 		return newVol, nil
 	}
 
+	if err = p.setPVCStorageClass(pvc, snapName); err != nil {
+		return nil, err
+	}
+
+	if err = p.setPVCStorageClassFromSpec(pvc, scSpec); err != nil {
+		return nil, err
+	}
+
+	if err = p.setPVCVolumePolicy(pvc, policySpec); err != nil {
+		return nil, err
+	}
+
+	if err = p.setPVCSize(pvc, snapName); err != nil {
+		return nil, err
+	}
+
 	p.Log.Infof("Creating PVC for volumeID:%s snapshot:%s in namespace=%s", volumeID, snapName, targetedNs)
 
 	pvc.Annotations = make(map[string]string)
 	// Add annotation PVCreatedByKey, with value 'restore' to PVC
 	// So that Maya-APIServer skip updating target IPAddress in CVR
 	pvc.Annotations[v1alpha1.PVCreatedByKey] = "restore"
+
+	if err = p.setPVCPoolCluster(pvc, snapName); err != nil {
+		return nil, err
+	}
+
+	if err = p.setPVCZone(pvc, m, volumeAZ, snapName); err != nil {
+		return nil, err
+	}
+
+	if err = p.setPVCReplicaCount(pvc, snapName); err != nil {
+		return nil, err
+	}
+
 	rpvc, err := p.K8sClient.
 		CoreV1().
 		PersistentVolumeClaims(pvc.Namespace).
@@ -158,6 +258,9 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 		}
 		if pvc.Status.Phase == v1.ClaimBound {
 			p.Log.Infof("PVC(%v) created..", pvc.Name)
+			if pvc, err = p.repairPVBinding(pvc); err != nil {
+				return nil, err
+			}
 			vol = &Volume{
 				volname:      pvc.Spec.VolumeName,
 				snapshotTag:  volumeID,
@@ -165,7 +268,7 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 				backupName:   snapName,
 				storageClass: *pvc.Spec.StorageClassName,
 			}
-			p.volumes[vol.volname] = vol
+			p.setVolume(vol)
 			break
 		}
 		time.Sleep(PVCCheckInterval)
@@ -199,6 +302,74 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 	return vol, nil
 }
 
+// getTargetNamespace return the namespace, mapped by velero restore for the snapshot, in which
+// restored volume claim should be created. Targeted namespace is created if it doesn't exist.
+func (p *Plugin) getTargetNamespace(ns, snapName string) (string, error) {
+	targetedNs, err := velero.GetRestoreNamespace(ns, snapName, p.Log)
+	if err != nil {
+		return "", err
+	}
+
+	if err = p.EnsureNamespaceOrCreate(targetedNs); err != nil {
+		return "", errors.Wrapf(err, "error verifying namespace")
+	}
+	return targetedNs, nil
+}
+
+// applyExistingVolumePolicy checks if the given PVC already exists and applies the existingVolumePolicy.
+// It returns the volume of existing PVC if its restore is skipped. PVC name is updated if policy is
+// rename, so that the volume is restored to a new PVC.
+func (p *Plugin) applyExistingVolumePolicy(pvc *v1.PersistentVolumeClaim, snapName string) (*Volume, error) {
+	if p.existingVolumePolicy == ExistingVolumeRestore {
+		return nil, nil
+	}
+
+	rpvc, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(pvc.Namespace).
+		Get(context.TODO(), pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to fetch PVC{%s}", pvc.Name)
+	}
+
+	// PVC left from previous restore is removed while creating the PVC
+	if rpvc.DeletionTimestamp != nil {
+		return nil, nil
+	}
+
+	switch p.existingVolumePolicy {
+	case ExistingVolumeFail:
+		return nil, errors.Errorf("PVC=%s/%s already exists with volume=%s, %s is %s",
+			rpvc.Namespace, rpvc.Name, rpvc.Spec.VolumeName, ExistingVolumePolicy, p.existingVolumePolicy)
+	case ExistingVolumeSkip:
+		if rpvc.Spec.VolumeName == "" {
+			return nil, errors.Errorf("PVC=%s/%s already exists and it is not bound, can't skip the restore",
+				rpvc.Namespace, rpvc.Name)
+		}
+		p.Log.Infof("PVC=%s/%s already exists with volume=%s, skipping the restore",
+			rpvc.Namespace, rpvc.Name, rpvc.Spec.VolumeName)
+
+		vol := &Volume{
+			volname:       rpvc.Spec.VolumeName,
+			snapshotTag:   rpvc.Spec.VolumeName,
+			namespace:     rpvc.Namespace,
+			backupName:    snapName,
+			restoreStatus: v1alpha1.RSTCStorStatusDone,
+			skipped:       true,
+		}
+		p.setVolume(vol)
+		return vol, nil
+	case ExistingVolumeRename:
+		name := pvc.Name + "-" + snapName
+		p.Log.Infof("PVC=%s/%s already exists, restoring to PVC=%s", rpvc.Namespace, rpvc.Name, name)
+		pvc.Name = name
+	}
+	return nil, nil
+}
+
 // getVolumeFromPVC returns volume info for given PVC if PVC is in bound state
 func (p *Plugin) getVolumeFromPVC(pvc v1.PersistentVolumeClaim) (*Volume, error) {
 	rpvc, err := p.K8sClient.
@@ -212,9 +383,20 @@ func (p *Plugin) getVolumeFromPVC(pvc v1.PersistentVolumeClaim) (*Volume, error)
 		return nil, errors.Wrapf(err, "failed to fetch PVC{%s}", pvc.Name)
 	}
 
+	if rpvc.DeletionTimestamp != nil {
+		// PVC is left from previous restore and is stuck in terminating state
+		if err = p.removeStalePVC(rpvc); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
 	if rpvc.Status.Phase == v1.ClaimLost {
-		p.Log.Errorf("PVC{%s} is not bound yet!", rpvc.Name)
-		return nil, errors.Errorf("pvc{%s} is not bound", rpvc.Name)
+		p.Log.Warningf("PVC{%s} is lost, repairing the binding with PV{%s}", rpvc.Name, rpvc.Spec.VolumeName)
+		if rpvc, err = p.repairPVBinding(rpvc); err != nil {
+			p.Log.Errorf("PVC{%s} is not bound yet!", rpvc.Name)
+			return nil, errors.Wrapf(err, "pvc{%s} is not bound", rpvc.Name)
+		}
 	}
 	// check for created volume type
 	pv, err := p.getPV(rpvc.Spec.VolumeName)
@@ -222,15 +404,31 @@ func (p *Plugin) getVolumeFromPVC(pvc v1.PersistentVolumeClaim) (*Volume, error)
 		p.Log.Errorf("Failed to get PV{%s}", rpvc.Spec.VolumeName)
 		return nil, errors.Wrapf(err, "failed to get pv=%s", rpvc.Spec.VolumeName)
 	}
+
+	// PVC may be pre-provisioned by user, so data can be restored to the volume
+	// only if it is a cStor volume and it is not being used
+	if err = p.validateExistingVolume(rpvc, pv); err != nil {
+		return nil, err
+	}
+
+	// filesystem data of backup can't be used through raw block volume, and vice versa
+	if mode, bkpMode := volumeModeOf(pv.Spec.VolumeMode), volumeModeOf(pvc.Spec.VolumeMode); mode != bkpMode {
+		return nil, errors.Errorf("PVC=%s/%s already exists with volumeMode=%s, backed up PVC has volumeMode=%s",
+			rpvc.Namespace, rpvc.Name, mode, bkpMode)
+	}
+
+	p.Log.Infof("PVC=%s/%s already exists, restoring to its volume=%s", rpvc.Namespace, rpvc.Name, pv.Name)
+
 	isCSIVolume := isCSIPv(*pv)
 	vol := &Volume{
 		volname:      rpvc.Spec.VolumeName,
 		snapshotTag:  rpvc.Spec.VolumeName,
 		namespace:    rpvc.Namespace,
-		storageClass: *rpvc.Spec.StorageClassName,
+		storageClass: pv.Spec.StorageClassName,
 		isCSIVolume:  isCSIVolume,
 	}
-	p.volumes[vol.volname] = vol
+	vol.restoredBackup = p.getRestoredBackup(rpvc)
+	p.setVolume(vol)
 
 	if err = p.waitForAllCVRs(vol); err != nil {
 		return nil, errors.Wrapf(err, "cvr not ready")
@@ -249,6 +447,277 @@ func (p *Plugin) getVolumeFromPVC(pvc v1.PersistentVolumeClaim) (*Volume, error)
 	return vol, nil
 }
 
+// validateExistingVolume checks if data can be restored to the volume of existing PVC
+func (p *Plugin) validateExistingVolume(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) error {
+	if isCStor, _ := getCStorVolumeType(pv); !isCStor {
+		return errors.Errorf("PVC=%s/%s already exists with non cStor volume=%s", pvc.Namespace, pvc.Name, pv.Name)
+	}
+
+	pods, err := p.K8sClient.
+		CoreV1().
+		Pods(pvc.Namespace).
+		List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list pods in namespace=%s", pvc.Namespace)
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if isPVCUsedByPod(pod, pvc.Name) {
+			return errors.Errorf("PVC=%s/%s already exists and it is used by pod=%s, can't restore to volume=%s",
+				pvc.Namespace, pvc.Name, pod.Name, pv.Name)
+		}
+	}
+	return nil
+}
+
+// setPVCClaimSpec updates the resource requests of given PVC as per the claim spec
+// recorded in the manifest of backup, so that restored claim doesn't depend on the
+// defaults of the cluster. Requested size is not set less than the capacity of backup.
+func (p *Plugin) setPVCClaimSpec(pvc *v1.PersistentVolumeClaim, m *backupManifest, snapName string) {
+	if m == nil || m.Claim == nil {
+		// backups created by older version of plugin don't have claim spec
+		return
+	}
+
+	if len(m.Claim.AccessModes) != 0 {
+		pvc.Spec.AccessModes = m.Claim.AccessModes
+	}
+	if m.Claim.VolumeMode != nil {
+		pvc.Spec.VolumeMode = m.Claim.VolumeMode
+	}
+
+	size := m.Claim.Size
+	if size.Cmp(m.Capacity) < 0 {
+		size = m.Capacity
+	}
+	if size.IsZero() {
+		return
+	}
+
+	if pvc.Spec.Resources.Requests == nil {
+		pvc.Spec.Resources.Requests = v1.ResourceList{}
+	}
+	current := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	if size.Cmp(current) != 0 {
+		p.Log.Infof("Changing size of PVC=%s/%s from %s to %s, as per backup=%s",
+			pvc.Namespace, pvc.Name, current.String(), size.String(), snapName)
+		pvc.Spec.Resources.Requests[v1.ResourceStorage] = size
+	}
+}
+
+// volumeModeOf return the given volume mode, or Filesystem if it is not set
+func volumeModeOf(mode *v1.PersistentVolumeMode) v1.PersistentVolumeMode {
+	if mode == nil || *mode == "" {
+		return v1.PersistentVolumeFilesystem
+	}
+	return *mode
+}
+
+// resetPVCMetadata clears the metadata, binding info, data source and status of the PVC from
+// backup, which are specific to the source cluster. Labels and annotations are retained.
+func resetPVCMetadata(pvc *v1.PersistentVolumeClaim) {
+	pvc.ObjectMeta = metav1.ObjectMeta{
+		Name:        pvc.Name,
+		Namespace:   pvc.Namespace,
+		Labels:      pvc.Labels,
+		Annotations: pvc.Annotations,
+	}
+	pvc.Spec.VolumeName = ""
+	// volume is restored from the backup data, not from the snapshot or volume of source cluster
+	pvc.Spec.DataSource = nil
+	pvc.Status = v1.PersistentVolumeClaimStatus{}
+}
+
+// getPVCFromPV return the PVC, for the claim of given volume, generated using the PV of the volume
+func (p *Plugin) getPVCFromPV(vol *Volume) (*v1.PersistentVolumeClaim, error) {
+	pv, err := p.getPV(vol.volname)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get pv=%s", vol.volname)
+	}
+
+	p.Log.Warningf("PVC=%s/%s of volume=%s not found, generating it from PV", vol.namespace, vol.pvcName, vol.volname)
+
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      vol.pvcName,
+			Namespace: vol.namespace,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: pv.Spec.AccessModes,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: pv.Spec.Capacity[v1.ResourceStorage],
+				},
+			},
+			StorageClassName: &pv.Spec.StorageClassName,
+			VolumeMode:       pv.Spec.VolumeMode,
+		},
+	}, nil
+}
+
+// getClaimState return the state of the claim of given volume, if claim or its namespace
+// is terminating or deleted. For active claim it will return empty string.
+func (p *Plugin) getClaimState(vol *Volume) (string, error) {
+	ns, err := p.K8sClient.CoreV1().Namespaces().Get(context.TODO(), vol.namespace, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return ClaimStateNamespaceDeleted, nil
+		}
+		return "", errors.Wrapf(err, "failed to get namespace=%s", vol.namespace)
+	}
+
+	if ns.DeletionTimestamp != nil || ns.Status.Phase == v1.NamespaceTerminating {
+		return ClaimStateNamespaceTerminating, nil
+	}
+
+	pvc, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(vol.namespace).
+		Get(context.TODO(), vol.pvcName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return ClaimStateDeleted, nil
+		}
+		return "", errors.Wrapf(err, "failed to get PVC=%s/%s", vol.namespace, vol.pvcName)
+	}
+
+	if pvc.DeletionTimestamp != nil {
+		return ClaimStateTerminating, nil
+	}
+	return "", nil
+}
+
+// isNamespaceUnavailable returns true if backup resources can't be created in the
+// namespace, of the given claim state
+func isNamespaceUnavailable(claimState string) bool {
+	return claimState == ClaimStateNamespaceTerminating || claimState == ClaimStateNamespaceDeleted
+}
+
+// getRestoreConstraints return the constraints for restoring the backup of a volume,
+// whose claim was in the given state at the time of backup
+func (p *Plugin) getRestoreConstraints(vol *Volume) []string {
+	var constraints []string
+
+	if isNamespaceUnavailable(vol.claimState) {
+		constraints = append(constraints,
+			"namespace "+vol.namespace+" was terminating at the time of backup, restore to the same namespace "+
+				"waits for its deletion, use namespace mapping to restore it to other namespace",
+			"backup resources of the volume are created in namespace "+vol.backupNamespace)
+	}
+
+	switch vol.claimState {
+	case ClaimStateDeleted, ClaimStateNamespaceDeleted:
+		constraints = append(constraints,
+			"PVC "+vol.pvcName+" was deleted at the time of backup, PVC is generated from PV, "+
+				"labels and annotations of the original PVC are not restored")
+	case ClaimStateTerminating:
+		constraints = append(constraints,
+			"PVC "+vol.pvcName+" was terminating at the time of backup, it is restored without finalizers")
+	}
+	return constraints
+}
+
+// findBackupNamespace return the namespace having the backup resources for the given schedule of volume.
+// If backup of terminating volumes is enabled, backup resources may be in openebs namespace
+// instead of the namespace of volume claim.
+func (p *Plugin) findBackupNamespace(volumeID, scheduleName, claimNamespace string) string {
+	if !p.backupTerminating {
+		return claimNamespace
+	}
+
+	records := append(p.listBackups(), p.listCompletedBackups()...)
+	for _, r := range records {
+		if r.namespace == p.namespace && r.volumeName == volumeID && r.backupName == scheduleName {
+			return p.namespace
+		}
+	}
+	return claimNamespace
+}
+
+// removeStalePVC removes the finalizers of the given terminating PVC and waits for its deletion
+func (p *Plugin) removeStalePVC(pvc *v1.PersistentVolumeClaim) error {
+	p.Log.Warningf("PVC=%s/%s is terminating, removing finalizers %v", pvc.Namespace, pvc.Name, pvc.Finalizers)
+
+	patch := []byte(`{"metadata":{"finalizers":null}}`)
+	_, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(pvc.Namespace).
+		Patch(context.TODO(), pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to remove finalizers from PVC=%s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	err = wait.PollImmediate(PVCCheckInterval, PVCWaitCount*PVCCheckInterval, func() (bool, error) {
+		_, err := p.K8sClient.
+			CoreV1().
+			PersistentVolumeClaims(pvc.Namespace).
+			Get(context.TODO(), pvc.Name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "PVC=%s/%s is not deleted", pvc.Namespace, pvc.Name)
+	}
+	return nil
+}
+
+// repairPVBinding ensures that PV of the given PVC refers to the PVC, by fixing the
+// stale claimRef of PV, and waits for PVC to be bound. It returns the bound PVC.
+func (p *Plugin) repairPVBinding(pvc *v1.PersistentVolumeClaim) (*v1.PersistentVolumeClaim, error) {
+	if pvc.Spec.VolumeName == "" {
+		return pvc, errors.Errorf("PVC=%s/%s doesn't have volume", pvc.Namespace, pvc.Name)
+	}
+
+	pv, err := p.getPV(pvc.Spec.VolumeName)
+	if err != nil {
+		return pvc, errors.Wrapf(err, "failed to get pv=%s", pvc.Spec.VolumeName)
+	}
+
+	ref := pv.Spec.ClaimRef
+	if ref != nil && ref.Namespace == pvc.Namespace && ref.Name == pvc.Name && ref.UID == pvc.UID {
+		if pvc.Status.Phase == v1.ClaimBound {
+			return pvc, nil
+		}
+	} else {
+		p.Log.Infof("Updating claimRef of PV=%s to PVC=%s/%s", pv.Name, pvc.Namespace, pvc.Name)
+
+		pv.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:            "PersistentVolumeClaim",
+			APIVersion:      "v1",
+			Namespace:       pvc.Namespace,
+			Name:            pvc.Name,
+			UID:             pvc.UID,
+			ResourceVersion: pvc.ResourceVersion,
+		}
+		if _, err = p.K8sClient.CoreV1().PersistentVolumes().Update(context.TODO(), pv, metav1.UpdateOptions{}); err != nil {
+			return pvc, errors.Wrapf(err, "failed to update claimRef of PV=%s", pv.Name)
+		}
+	}
+
+	bpvc := pvc
+	err = wait.PollImmediate(PVCCheckInterval, PVCWaitCount*PVCCheckInterval, func() (bool, error) {
+		obj, err := p.K8sClient.
+			CoreV1().
+			PersistentVolumeClaims(pvc.Namespace).
+			Get(context.TODO(), pvc.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		bpvc = obj
+		return obj.Status.Phase == v1.ClaimBound, nil
+	})
+	if err != nil {
+		return bpvc, errors.Wrapf(err, "PVC=%s/%s is not bound to PV=%s", pvc.Namespace, pvc.Name, pv.Name)
+	}
+	return bpvc, nil
+}
+
 func (p *Plugin) downloadPVC(volumeID, snapName string) (*v1.PersistentVolumeClaim, error) {
 	pvc := &v1.PersistentVolumeClaim{}
 
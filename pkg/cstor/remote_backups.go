@@ -0,0 +1,327 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RemoteBackupsCommand is the plugin command to list, and inspect, the backups in the storage-bucket
+	RemoteBackupsCommand = "backups"
+
+	// pvcSuffix is suffix for the name of PVC file of backup
+	pvcSuffix = ".pvc"
+)
+
+// RemoteBackup describes the backup of a volume in the storage-bucket
+type RemoteBackup struct {
+	// Backup is velero backup name
+	Backup string `json:"backup"`
+
+	// Volume is volume name
+	Volume string `json:"volume"`
+
+	// Schedule is schedule name for scheduled backup, or backup name for non-scheduled backup
+	Schedule string `json:"schedule"`
+
+	// Size is number of bytes of snapshot data
+	Size int64 `json:"size"`
+
+	// Incremental is true if backup is incremental to the Parent snapshot
+	Incremental bool `json:"incremental"`
+
+	// Parent is the snapshot from which this incremental backup is taken
+	Parent string `json:"parent,omitempty"`
+
+	// CreationTime is time at which backup is completed, it is nil if backup doesn't have manifest
+	CreationTime *metav1.Time `json:"creationTime,omitempty"`
+
+	// Files are keys of the snapshot file, manifest and other files of the backup
+	Files []string `json:"files"`
+
+	// Incomplete is true if snapshot file or manifest of the backup is missing
+	Incomplete bool `json:"incomplete,omitempty"`
+
+	// Orphan is true if velero backup resource doesn't exist for the backup
+	Orphan bool `json:"orphan,omitempty"`
+
+	// Cleaned is true if files of the backup are deleted
+	Cleaned bool `json:"cleaned,omitempty"`
+
+	// Error is the failure in inspecting, or deleting, the backup
+	Error string `json:"error,omitempty"`
+
+	// Manifest is manifest of the backup, it is set only if the backup is inspected
+	Manifest *backupManifest `json:"manifest,omitempty"`
+
+	// snapshotKey is key of the snapshot file
+	snapshotKey string
+
+	// manifestKey is key of the manifest
+	manifestKey string
+}
+
+// BackupChain is a full backup of a volume followed by its incremental backups
+type BackupChain struct {
+	// Volume is volume name
+	Volume string `json:"volume"`
+
+	// Schedule is schedule name of the backups
+	Schedule string `json:"schedule"`
+
+	// Backups are the backup names, from the full backup to the latest incremental backup
+	Backups []string `json:"backups"`
+
+	// Size is total size of snapshot data of the backups
+	Size int64 `json:"size"`
+
+	// Broken is true if the first backup of chain is incremental, i.e. its parent is missing,
+	// backups of such chain can't be restored
+	Broken bool `json:"broken,omitempty"`
+}
+
+// RemoteBackupReport is the list of backups in the storage-bucket
+type RemoteBackupReport struct {
+	// Time is time at which backups are listed
+	Time metav1.Time `json:"time"`
+
+	// Bucket is name of the storage-bucket
+	Bucket string `json:"bucket"`
+
+	// Backups is list of backups
+	Backups []RemoteBackup `json:"backups"`
+
+	// Chains is list of backup chains
+	Chains []BackupChain `json:"chains"`
+}
+
+// RemoteBackupOptions are the options to list the backups in the storage-bucket
+type RemoteBackupOptions struct {
+	// Config is config of volumesnapshotlocation
+	Config map[string]string
+
+	// Volume lists the backups of given volume only, if set
+	Volume string
+
+	// Backup lists and inspects the given backup only, if set
+	Backup string
+
+	// Orphans checks if velero backup resource exists for each backup
+	Orphans bool
+
+	// Cleanup deletes the files of orphan backups, it needs Orphans to be set
+	Cleanup bool
+}
+
+// RunRemoteBackups lists the backups in the storage-bucket of given config along with
+// their incremental chains, and deletes the orphan backups if cleanup is set.
+// It doesn't need velero metadata, except for finding the orphan backups, so it is
+// useful to find the restore points if velero metadata is lost.
+func RunRemoteBackups(log logrus.FieldLogger, opts RemoteBackupOptions) (*RemoteBackupReport, error) {
+	if opts.Cleanup && !opts.Orphans {
+		return nil, errors.New("cleanup needs orphan backups to be checked")
+	}
+
+	cl := &cloud.Conn{Log: log}
+	if err := cl.Init(opts.Config); err != nil {
+		return nil, err
+	}
+
+	tmpl, err := getNameTemplate(opts.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := cl.ListBackupFiles(opts.Backup)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RemoteBackupReport{
+		Time:    metav1.Now(),
+		Bucket:  opts.Config[cloud.BUCKET],
+		Backups: groupRemoteFiles(files),
+	}
+
+	backups := report.Backups[:0]
+	for _, b := range report.Backups {
+		if err := loadRemoteBackup(cl, tmpl, &b, opts.Backup != ""); err != nil {
+			log.Warnf("Failed to inspect backup=%s of volume=%s : %s", b.Backup, b.Volume, err)
+			b.Error = err.Error()
+		}
+		if opts.Volume != "" && b.Volume != opts.Volume {
+			continue
+		}
+		backups = append(backups, b)
+	}
+	report.Backups = backups
+	report.Chains = backupChains(report.Backups)
+
+	if !opts.Orphans {
+		return report, nil
+	}
+
+	for i := range report.Backups {
+		b := &report.Backups[i]
+
+		exists, err := velero.BackupExists(b.Backup)
+		if err != nil {
+			b.Error = err.Error()
+			continue
+		}
+		b.Orphan = !exists
+
+		if !b.Orphan || !opts.Cleanup {
+			continue
+		}
+
+		log.Infof("Deleting orphan backup=%s of volume=%s", b.Backup, b.Volume)
+		for _, key := range b.Files {
+			if !cl.Delete(key) {
+				b.Error = "failed to delete file " + key
+			}
+		}
+		b.Cleaned = b.Error == ""
+	}
+	return report, nil
+}
+
+// groupRemoteFiles groups the given files by backup and volume, i.e. the file name
+// without extension
+func groupRemoteFiles(files []cloud.RemoteFile) []RemoteBackup {
+	var backups []RemoteBackup
+	index := map[string]int{}
+
+	for _, f := range files {
+		name := f.Name
+		ext := ""
+		for _, suffix := range []string{manifestSuffix, attestationSuffix, pvcSuffix} {
+			if strings.HasSuffix(name, suffix) {
+				name, ext = strings.TrimSuffix(name, suffix), suffix
+				break
+			}
+		}
+
+		key := f.Backup + "/" + name
+		i, ok := index[key]
+		if !ok {
+			i = len(backups)
+			index[key] = i
+			backups = append(backups, RemoteBackup{Backup: f.Backup, Volume: name})
+		}
+
+		b := &backups[i]
+		b.Files = append(b.Files, f.Key)
+		switch ext {
+		case "":
+			b.snapshotKey, b.Size = f.Key, f.Size
+		case manifestSuffix:
+			b.manifestKey = f.Key
+		}
+	}
+	return backups
+}
+
+// loadRemoteBackup updates the given backup from its manifest, and sets the manifest
+// in backup if inspect is set
+func loadRemoteBackup(cl *cloud.Conn, tmpl *backupNameTemplate, b *RemoteBackup, inspect bool) error {
+	b.Incomplete = b.snapshotKey == "" || b.manifestKey == ""
+
+	if b.snapshotKey != "" {
+		// size of deduplicated snapshot is the size of data in chunks
+		if size, err := cl.ObjectSize(b.snapshotKey); err == nil {
+			b.Size = size
+		}
+	}
+
+	if b.manifestKey == "" {
+		// backups created by older version of plugin don't have manifest
+		b.Schedule = tmpl.scheduleOf(b.Backup)
+		return nil
+	}
+
+	data, ok := cl.Read(b.manifestKey)
+	if !ok {
+		return errors.Errorf("failed to download manifest=%s", b.manifestKey)
+	}
+
+	m := &backupManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return errors.Wrapf(err, "failed to decode manifest=%s", b.manifestKey)
+	}
+
+	b.Volume = m.Volume
+	b.Schedule = m.Schedule
+	b.Parent = m.IncrementalParent
+	b.Incremental = m.IncrementalParent != ""
+	b.CreationTime = &m.CreationTime
+	if inspect {
+		b.Manifest = m
+	}
+	return nil
+}
+
+// backupChains return the incremental chains of given backups. Backups of a volume and
+// schedule are ordered by creation time, and a chain starts at each full backup.
+func backupChains(backups []RemoteBackup) []BackupChain {
+	groups := map[string][]RemoteBackup{}
+	var keys []string
+	for _, b := range backups {
+		key := b.Volume + "/" + b.Schedule
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], b)
+	}
+	sort.Strings(keys)
+
+	var chains []BackupChain
+	for _, key := range keys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool {
+			ti, tj := group[i].CreationTime, group[j].CreationTime
+			if ti != nil && tj != nil && !ti.Equal(tj) {
+				return ti.Before(tj)
+			}
+			return group[i].Backup < group[j].Backup
+		})
+
+		var cur *BackupChain
+		for _, b := range group {
+			if cur == nil || !b.Incremental {
+				chains = append(chains, BackupChain{
+					Volume:   b.Volume,
+					Schedule: b.Schedule,
+					Broken:   b.Incremental,
+				})
+				cur = &chains[len(chains)-1]
+			}
+			cur.Backups = append(cur.Backups, b.Backup)
+			cur.Size += b.Size
+		}
+	}
+	return chains
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// RestoreReplicaCount config key for the replica count of volumes created by remote restore
+	RestoreReplicaCount = "restoreReplicaCount"
+
+	// restoreReplicaCountAnnotation is set on velero restore to override the replica count
+	// configured in volumesnapshotlocation for that restore
+	restoreReplicaCountAnnotation = "openebs.io/restore-replica-count"
+
+	// csiReplicaCountParameter is storageClass parameter for replica count of cStor CSI volume
+	csiReplicaCountParameter = "replicaCount"
+)
+
+// parseReplicaCount parse the replica count from given value, 0 represents that
+// replica count of source storageClass is used
+func parseReplicaCount(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return 0, errors.Errorf("invalid replica count=%s, expected positive number", value)
+	}
+	return count, nil
+}
+
+// getRestoreReplicaCount return the replica count for the volume restored from the given snapshot.
+// Replica count set on velero restore takes precedence over the plugin config.
+func (p *Plugin) getRestoreReplicaCount(snapName string) (int, error) {
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := r.Annotations[restoreReplicaCountAnnotation]
+	if !ok {
+		return p.restoreReplicaCount, nil
+	}
+
+	count, err := parseReplicaCount(value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse annotation=%s of restore=%s",
+			restoreReplicaCountAnnotation, r.Name)
+	}
+	return count, nil
+}
+
+// setPVCReplicaCount updates the given PVC to provision the volume with replica count of restore.
+// Replica count of non CSI volume is set using cas config annotation on PVC, while the PVC of
+// CSI volume uses the storageClass, created from PVC's storageClass, having the replica count.
+func (p *Plugin) setPVCReplicaCount(pvc *v1.PersistentVolumeClaim, snapName string) error {
+	count, err := p.getRestoreReplicaCount(snapName)
+	if err != nil || count == 0 {
+		return err
+	}
+
+	sc, err := p.getPVCStorageClass(pvc)
+	if err != nil {
+		return errors.Wrapf(err, "can't set replica count")
+	}
+
+	p.Log.Infof("Setting replica count of PVC=%s/%s to %d", pvc.Namespace, pvc.Name, count)
+
+	if sc.Provisioner != openebsCSIName {
+		return setCASConfig(pvc.Annotations, casConfigReplicaCount, strconv.Itoa(count))
+	}
+
+	if sc.Parameters[csiReplicaCountParameter] == strconv.Itoa(count) {
+		return nil
+	}
+
+	name, err := p.getDerivedStorageClass(sc, fmt.Sprintf("replica-%d", count), csiReplicaCountParameter, strconv.Itoa(count))
+	if err != nil {
+		return err
+	}
+	pvc.Spec.StorageClassName = &name
+	return nil
+}
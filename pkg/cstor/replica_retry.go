@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// BackupReplicaRetries config key for number of times the backup of a volume, failed on
+	// the replica, is retried on the other healthy replicas
+	BackupReplicaRetries = "backupReplicaRetries"
+
+	// defaultBackupReplicaRetries is default number of retries of backup on other replicas
+	defaultBackupReplicaRetries = 2
+)
+
+// backupPool return the UID of the pool sending the snapshot of given CStorBackup
+func backupPool(bkp *v1alpha1.CStorBackup, isCSIVolume bool) string {
+	if isCSIVolume {
+		return bkp.Labels[cstorPoolInstanceUIDLabel]
+	}
+	return bkp.Labels[cstorPoolUIDLabel]
+}
+
+// releaseFailedReplica aborts the data transfer of given backup, failed on its replica, so that
+// the partial data isn't committed to cloud storage, and deletes the CStorBackup. Snapshot of
+// the backup is retained so that it can be sent by another replica.
+func (p *Plugin) releaseFailedReplica(bkp *v1alpha1.CStorBackup, vol *Volume) {
+	var err error
+
+	vol.cl.AbortServer()
+
+	if vol.isCSIVolume {
+		err = p.OpenEBSAPIsClient.CstorV1().CStorBackups(bkp.Namespace).Delete(context.TODO(), bkp.Name, metav1.DeleteOptions{})
+	} else {
+		err = p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(bkp.Namespace).Delete(context.TODO(), bkp.Name, metav1.DeleteOptions{})
+	}
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.volumeLog(vol, phaseCleanup).WithError(err).Warnf("Failed to delete backup resource=%s/%s", bkp.Namespace, bkp.Name)
+	}
+}
+
+// cleanupRetainedBackup cleans up the snapshot retained by releaseFailedReplica, if the
+// backup is not retried
+func (p *Plugin) cleanupRetainedBackup(bkp *v1alpha1.CStorBackup, vol *Volume) {
+	failed := *bkp
+	failed.Status = v1alpha1.BKPCStorStatusFailed
+
+	if err := p.cleanupCompletedBackup(failed, vol.isCSIVolume); err != nil {
+		p.volumeLog(vol, phaseCleanup).WithError(err).Warn("Failed to execute clean-up request")
+	}
+}
+
+// retryBackupOnReplica recreates the CStorBackup of given task, failed on replica of the pools
+// in failed, on a healthy replica of other pool. Snapshot taken for the backup is sent again
+// by the new replica, so the snapshot hooks of the application are not executed again.
+func (p *Plugin) retryBackupOnReplica(t *backupTask, failed map[string]bool) error {
+	vol := t.vol
+
+	bkp := &v1alpha1.CStorBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      t.bkp.Name,
+			Namespace: t.bkp.Namespace,
+		},
+		Spec: t.bkp.Spec,
+	}
+
+	pool, err := p.getHealthyReplicaPool(vol.volname, vol.isCSIVolume, failed)
+	if err != nil {
+		return errors.Wrapf(err, "failed to retry backup on other replica")
+	}
+
+	// backup slot is held only on the pool sending the backup
+	if err := p.movePoolSlot(t, pool); err != nil {
+		return errors.Wrapf(err, "failed to retry backup on other replica")
+	}
+	vol.backupPool = pool
+
+	bkp, err = p.sendBackupRequest(vol, bkp, failed)
+	if err != nil {
+		return errors.Wrapf(err, "failed to retry backup on other replica")
+	}
+
+	t.bkp = bkp
+	// data server is aborted by the failed backup
+	vol.cl.ConnStateReset()
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RestMaxIdleConns config key for number of idle connections, per host, kept for reuse by REST API calls
+	RestMaxIdleConns = "restApiMaxIdleConns"
+
+	// RestIdleConnTimeout config key for time for which an idle connection of REST API calls is kept
+	RestIdleConnTimeout = "restApiIdleConnTimeout"
+
+	// RestTLSHandshakeTimeout config key for time limit of TLS handshake of REST API calls
+	RestTLSHandshakeTimeout = "restApiTLSHandshakeTimeout"
+
+	// RestCaCert config key for base64 encoded CA bundle to verify the server of REST API calls
+	RestCaCert = "restApiCaCert"
+
+	// RestInsecureSkipTLSVerify config key to skip the verification of server certificate of REST API calls
+	RestInsecureSkipTLSVerify = "restApiInsecureSkipTLSVerify"
+
+	// defaultRestMaxIdleConns is default number of idle connections kept per host. http.DefaultTransport
+	// keeps only 2 idle connections per host, so concurrent calls of many volumes re-establish the connections.
+	defaultRestMaxIdleConns = 32
+
+	// defaultRestIdleConnTimeout is default time for which an idle connection is kept
+	defaultRestIdleConnTimeout = 90 * time.Second
+
+	// defaultRestTLSHandshakeTimeout is default time limit of TLS handshake
+	defaultRestTLSHandshakeTimeout = 10 * time.Second
+
+	// restDialTimeout is time limit to establish the connection of REST API call
+	restDialTimeout = 30 * time.Second
+
+	// restKeepAlivePeriod is interval for TCP keep-alive probes of REST API connections
+	restKeepAlivePeriod = 30 * time.Second
+)
+
+// newRestClient returns the http client for REST API calls, having the given timeout. Client is
+// shared by the calls of the plugin, so that connections are reused across the volumes.
+func newRestClient(config map[string]string, timeout time.Duration) (*http.Client, error) {
+	var (
+		maxIdle          = defaultRestMaxIdleConns
+		idleTimeout      = defaultRestIdleConnTimeout
+		handshakeTimeout = defaultRestTLSHandshakeTimeout
+		err              error
+	)
+
+	if val, ok := config[RestMaxIdleConns]; ok {
+		if maxIdle, err = strconv.Atoi(val); err != nil || maxIdle <= 0 {
+			return nil, errors.Errorf("invalid %s=%s, expected positive number", RestMaxIdleConns, val)
+		}
+	}
+
+	if val, ok := config[RestIdleConnTimeout]; ok {
+		if idleTimeout, err = time.ParseDuration(val); err != nil || idleTimeout < 0 {
+			return nil, errors.Errorf("invalid %s=%s, expected non-negative duration", RestIdleConnTimeout, val)
+		}
+	}
+
+	if val, ok := config[RestTLSHandshakeTimeout]; ok {
+		if handshakeTimeout, err = time.ParseDuration(val); err != nil || handshakeTimeout < 0 {
+			return nil, errors.Errorf("invalid %s=%s, expected non-negative duration", RestTLSHandshakeTimeout, val)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if val, ok := config[RestInsecureSkipTLSVerify]; ok {
+		tlsConfig.InsecureSkipVerify = isTrue(val)
+	}
+
+	if val, ok := config[RestCaCert]; ok && val != "" {
+		data, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s value", RestCaCert)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("invalid %s, no certificate found", RestCaCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{
+		Timeout:   restDialTimeout,
+		KeepAlive: restKeepAlivePeriod,
+	}).DialContext
+	tr.MaxIdleConns = maxIdle
+	tr.MaxIdleConnsPerHost = maxIdle
+	tr.IdleConnTimeout = idleTimeout
+	tr.TLSHandshakeTimeout = handshakeTimeout
+	tr.TLSClientConfig = tlsConfig
+
+	return &http.Client{
+		Transport: tr,
+		Timeout:   timeout,
+	}, nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"github.com/openebs/velero-plugin/pkg/velero"
+)
+
+// isRestoreExcluded returns true if the claim of given volume, in backup, is in a namespace
+// excluded by the restore of given backup. Velero restores the PVs of all the namespaces if
+// cluster resources are included in the restore, along with the namespace filter, so the data
+// of such volumes is not restored as their claims are not restored.
+//
+// Claim of remote backup is read from the PVC file uploaded with the backup, and claim of
+// local snapshot from the source PV, so that the volume is not provisioned for the check.
+func (p *Plugin) isRestoreExcluded(volumeID, snapName string, local bool) bool {
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		p.Log.Warnf("Failed to get restore of backup=%s, skipping the check of restore filters : %s", snapName, err)
+		return false
+	}
+
+	if len(r.Spec.IncludedNamespaces) == 0 && len(r.Spec.ExcludedNamespaces) == 0 {
+		return false
+	}
+
+	var ns, name string
+	if local {
+		pv, err := p.getPV(volumeID)
+		if err != nil || pv.Spec.ClaimRef == nil {
+			return false
+		}
+		ns, name = pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+	} else {
+		pvc, err := p.downloadPVC(volumeID, snapName)
+		if err != nil {
+			// failure is reported by the restore
+			return false
+		}
+		ns, name = pvc.Namespace, pvc.Name
+	}
+
+	if !velero.IsNamespaceExcluded(r, ns) {
+		return false
+	}
+
+	p.Log.Infof("Skipping restore of volume=%s, its claim %s/%s is excluded by the namespace filter of restore=%s",
+		volumeID, ns, name, r.Name)
+	return true
+}
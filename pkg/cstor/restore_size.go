@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"strings"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// RestoreSize config key for the size of volumes created by remote restore
+	RestoreSize = "restoreSize"
+
+	// restoreSizeAnnotation is set on velero restore to override the size
+	// configured in volumesnapshotlocation for that restore
+	restoreSizeAnnotation = "openebs.io/restore-size"
+
+	// anyPVC is size mapping key matching all the PVCs
+	anyPVC = "*"
+)
+
+// parseSizeMapping parse the size mapping from given value.
+// Value is either a size, which is used for all the volumes, or
+// comma separated list of pvc_name:size.
+func parseSizeMapping(value string) (map[string]resource.Quantity, error) {
+	mapping := map[string]resource.Quantity{}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return mapping, nil
+	}
+
+	if !strings.Contains(value, ":") {
+		size, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size=%s", value)
+		}
+		mapping[anyPVC] = size
+		return mapping, nil
+	}
+
+	for _, m := range strings.Split(value, ",") {
+		s := strings.Split(strings.TrimSpace(m), ":")
+		if len(s) != 2 || s[0] == "" {
+			return nil, errors.Errorf("invalid size mapping=%s, expected pvc_name:size", m)
+		}
+
+		size, err := resource.ParseQuantity(s[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size mapping=%s", m)
+		}
+		mapping[s[0]] = size
+	}
+	return mapping, nil
+}
+
+// setPVCSize updates the requested size of given PVC as per the size mapping of restore.
+// Volume can be restored only to a larger size, so smaller size is ignored.
+func (p *Plugin) setPVCSize(pvc *v1.PersistentVolumeClaim, snapName string) error {
+	mapping := p.sizeMapping
+
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		return err
+	}
+
+	if value, ok := r.Annotations[restoreSizeAnnotation]; ok {
+		mapping, err = parseSizeMapping(value)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse annotation=%s of restore=%s", restoreSizeAnnotation, r.Name)
+		}
+	}
+
+	size, ok := mapping[pvc.Name]
+	if !ok {
+		if size, ok = mapping[anyPVC]; !ok {
+			return nil
+		}
+	}
+
+	current := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	if size.Cmp(current) <= 0 {
+		if size.Cmp(current) < 0 {
+			p.Log.Warnf("Restore size=%s of PVC=%s/%s is less than backed up size=%s, ignoring it",
+				size.String(), pvc.Namespace, pvc.Name, current.String())
+		}
+		return nil
+	}
+
+	p.Log.Infof("Changing size of PVC=%s/%s from %s to %s", pvc.Namespace, pvc.Name, current.String(), size.String())
+	if pvc.Spec.Resources.Requests == nil {
+		pvc.Spec.Resources.Requests = v1.ResourceList{}
+	}
+	pvc.Spec.Resources.Requests[v1.ResourceStorage] = size
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// restoreSummaryAnnotation is set on restored PVC, and velero restore, with the restore verification summary
+	restoreSummaryAnnotation = "openebs.io/restore-summary"
+
+	// ChecksumUnverified represents that checksum of restored data is not verified,
+	// since manifest of backup is not available
+	ChecksumUnverified = "unverified"
+
+	// ChecksumVerified represents that checksum of restored data matches with the backup manifest
+	ChecksumVerified = "verified"
+
+	// ChecksumNotApplicable represents that restore didn't transfer the data, in case of local restore
+	ChecksumNotApplicable = "not-applicable"
+)
+
+// restoredSnapshot describes a snapshot restored from cloud
+type restoredSnapshot struct {
+	// Name is backup name of the snapshot
+	Name string `json:"name"`
+
+	// Bytes is number of bytes restored
+	Bytes int64 `json:"bytes"`
+
+	// Checksum is checksum of the restored data
+	Checksum string `json:"checksum,omitempty"`
+
+	// ChecksumVerified is true if checksum matches with the backup manifest
+	ChecksumVerified bool `json:"checksumVerified"`
+
+	// Attested is true if backup manifest matches with the signed attestation of backup
+	Attested bool `json:"attested,omitempty"`
+}
+
+// restoreSummary describes the result of restore of a volume
+type restoreSummary struct {
+	// Backup is velero backup name
+	Backup string `json:"backup"`
+
+	// SourceVolume is volume name from backup
+	SourceVolume string `json:"sourceVolume"`
+
+	// Volume is restored volume name
+	Volume string `json:"volume"`
+
+	// Type is "local" or "remote"
+	Type string `json:"type"`
+
+	// Snapshots is list of snapshots restored from cloud
+	Snapshots []restoredSnapshot `json:"snapshots,omitempty"`
+
+	// BytesRestored is total number of bytes restored
+	BytesRestored int64 `json:"bytesRestored"`
+
+	// ChecksumResult is result of checksum verification of restored data
+	ChecksumResult string `json:"checksumResult"`
+
+	// VolumeHealth is phase of CStorVolume after restore
+	VolumeHealth string `json:"volumeHealth"`
+
+	// Duration is time taken to restore the volume
+	Duration string `json:"duration"`
+}
+
+// reportRestoreSummary sets the restore summary of the given volume on restored PVC and velero restore.
+// Failure in setting the summary doesn't fail the restore.
+func (p *Plugin) reportRestoreSummary(vol *Volume, srcVolume, snapName string, duration time.Duration) {
+	summary := restoreSummary{
+		Backup:         snapName,
+		SourceVolume:   srcVolume,
+		Volume:         vol.volname,
+		Type:           "remote",
+		Snapshots:      vol.restored,
+		ChecksumResult: ChecksumUnverified,
+		VolumeHealth:   p.getVolumeHealth(vol),
+		Duration:       duration.Round(time.Second).String(),
+	}
+
+	if vol.local {
+		summary.Type = "local"
+		summary.ChecksumResult = ChecksumNotApplicable
+	}
+
+	verified := len(vol.restored) != 0
+	for _, s := range vol.restored {
+		summary.BytesRestored += s.Bytes
+		verified = verified && s.ChecksumVerified
+	}
+
+	if verified {
+		summary.ChecksumResult = ChecksumVerified
+	}
+
+	p.Log.Infof("Restore summary for volume=%s : bytes=%d checksum=%s health=%s duration=%s",
+		vol.volname, summary.BytesRestored, summary.ChecksumResult, summary.VolumeHealth, summary.Duration)
+
+	if err := p.setPVCRestoreSummary(vol, summary); err != nil {
+		p.Log.Warnf("Failed to set restore summary on PVC of volume=%s : %s", vol.volname, err)
+	}
+
+	if err := p.setRestoreSummary(srcVolume, snapName, summary); err != nil {
+		p.Log.Warnf("Failed to set restore summary on restore of backup=%s : %s", snapName, err)
+	}
+}
+
+// setPVCRestoreSummary sets the restore summary on PVC of the given volume
+func (p *Plugin) setPVCRestoreSummary(vol *Volume, summary restoreSummary) error {
+	if vol.local {
+		// PV and PVC of local restore are created by velero after the restore of volume
+		p.Log.Debugf("Skipping restore summary on PVC of local restore volume=%s", vol.volname)
+		return nil
+	}
+
+	pv, err := p.getPV(vol.volname)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get pv=%s", vol.volname)
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		p.Log.Debugf("PV=%s is not bound to any PVC, skipping restore summary on PVC", vol.volname)
+		return nil
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				restoreSummaryAnnotation: string(data),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = p.K8sClient.CoreV1().PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).
+		Patch(context.TODO(), pv.Spec.ClaimRef.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// getRestoredBackup return the backup restored to the given PVC from its restore summary
+func (p *Plugin) getRestoredBackup(pvc *v1.PersistentVolumeClaim) string {
+	var summary restoreSummary
+
+	data, ok := pvc.Annotations[restoreSummaryAnnotation]
+	if !ok || data == "" {
+		return ""
+	}
+
+	if err := json.Unmarshal([]byte(data), &summary); err != nil {
+		p.Log.Warnf("Failed to decode restore summary of PVC=%s/%s : %s", pvc.Namespace, pvc.Name, err)
+		return ""
+	}
+	return summary.Backup
+}
+
+// setRestoreSummary adds the restore summary of the given volume to the velero restore
+// Annotation on velero restore has the map of source volume name to its restore summary
+func (p *Plugin) setRestoreSummary(srcVolume, snapName string, summary restoreSummary) error {
+	summaries := map[string]restoreSummary{}
+
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		return err
+	}
+
+	if data, ok := r.Annotations[restoreSummaryAnnotation]; ok && data != "" {
+		if err := json.Unmarshal([]byte(data), &summaries); err != nil {
+			p.Log.Warnf("Failed to decode restore summary of restore=%s, overwriting it : %s", r.Name, err)
+			summaries = map[string]restoreSummary{}
+		}
+	}
+	summaries[srcVolume] = summary
+
+	data, err := json.Marshal(summaries)
+	if err != nil {
+		return err
+	}
+	return velero.SetRestoreAnnotation(r, restoreSummaryAnnotation, string(data))
+}
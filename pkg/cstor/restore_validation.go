@@ -0,0 +1,480 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/openebs/api/v2/pkg/apis/types"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+const (
+	// RestoreDryRun config key for validating the restore without creating the volumes
+	RestoreDryRun = "restoreDryRun"
+
+	// restoreDryRunAnnotation is set on velero restore, with value "true", to validate the restore
+	// without creating the volumes
+	restoreDryRunAnnotation = "openebs.io/restore-dry-run"
+
+	// restoreValidationAnnotation is set on velero restore with the validation report of dry-run restore
+	restoreValidationAnnotation = "openebs.io/restore-validation"
+)
+
+// validationCheck describes the result of a validation performed by dry-run restore
+type validationCheck struct {
+	// Name is name of the validation
+	Name string `json:"name"`
+
+	// Passed is true if validation is successful
+	Passed bool `json:"passed"`
+
+	// Message describes the result of validation
+	Message string `json:"message,omitempty"`
+}
+
+// restoreValidation describes the result of dry-run restore of a volume
+type restoreValidation struct {
+	// Backup is velero backup name
+	Backup string `json:"backup"`
+
+	// SourceVolume is volume name from backup
+	SourceVolume string `json:"sourceVolume"`
+
+	// Type is "local" or "remote"
+	Type string `json:"type"`
+
+	// Valid is true if all the validations are successful
+	Valid bool `json:"valid"`
+
+	// Checks is list of validations performed
+	Checks []validationCheck `json:"checks"`
+}
+
+// poolDetails describes a cStor pool of the pool cluster
+type poolDetails struct {
+	name    string
+	version string
+	free    int64
+}
+
+// pass adds the successful validation to the report
+func (v *restoreValidation) pass(name, format string, args ...interface{}) {
+	v.Checks = append(v.Checks, validationCheck{Name: name, Passed: true, Message: fmt.Sprintf(format, args...)})
+}
+
+// fail adds the failed validation to the report
+func (v *restoreValidation) fail(name string, err error) {
+	v.Valid = false
+	v.Checks = append(v.Checks, validationCheck{Name: name, Message: err.Error()})
+}
+
+// isRestoreDryRun returns true if restore of the given snapshot is a dry-run
+// Annotation on velero restore takes precedence over the plugin config.
+func (p *Plugin) isRestoreDryRun(snapName string) bool {
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		p.Log.Warnf("Failed to get restore of backup=%s, using %s=%v : %s", snapName, RestoreDryRun, p.restoreDryRun, err)
+		return p.restoreDryRun
+	}
+
+	if value, ok := r.Annotations[restoreDryRunAnnotation]; ok {
+		return isTrue(value)
+	}
+	return p.restoreDryRun
+}
+
+// dryRunRestore validates the restore of the given snapshot and reports the result on velero restore.
+// It always returns the error, so that velero doesn't create the PV for the volume.
+func (p *Plugin) dryRunRestore(volumeID, snapName string, local bool) error {
+	var v *restoreValidation
+
+	if local {
+		v = p.validateLocalRestore(volumeID, snapName)
+	} else {
+		v = p.validateRemoteRestore(volumeID, snapName)
+	}
+
+	for _, c := range v.Checks {
+		if c.Passed {
+			p.Log.Infof("Dry-run restore of volume=%s snapshot=%s : %s passed : %s", volumeID, snapName, c.Name, c.Message)
+		} else {
+			p.Log.Errorf("Dry-run restore of volume=%s snapshot=%s : %s failed : %s", volumeID, snapName, c.Name, c.Message)
+		}
+	}
+
+	if err := p.setRestoreValidation(volumeID, snapName, *v); err != nil {
+		p.Log.Warnf("Failed to set validation report on restore of backup=%s : %s", snapName, err)
+	}
+
+	if !v.Valid {
+		return errors.Errorf("dry-run restore of volume=%s snapshot=%s failed validation, refer annotation=%s on restore",
+			volumeID, snapName, restoreValidationAnnotation)
+	}
+	return errors.Errorf("dry-run restore of volume=%s snapshot=%s passed validation, volume is not created",
+		volumeID, snapName)
+}
+
+// validateLocalRestore validates the restore of the given snapshot from local snapshot
+func (p *Plugin) validateLocalRestore(volumeID, snapName string) *restoreValidation {
+	v := &restoreValidation{
+		Backup:       snapName,
+		SourceVolume: volumeID,
+		Type:         "local",
+		Valid:        true,
+	}
+
+	pv, err := p.getPV(volumeID)
+	if err != nil {
+		v.fail("sourceVolume", errors.Wrapf(err, "failed to get source volume=%s", volumeID))
+		return v
+	}
+	v.pass("sourceVolume", "source volume=%s exists with storageClass=%s", pv.Name, pv.Spec.StorageClassName)
+
+	if pv.Spec.ClaimRef != nil {
+		ns, err := velero.GetRestoreNamespace(pv.Spec.ClaimRef.Namespace, snapName, p.Log)
+		if err != nil {
+			v.fail("namespace", err)
+		} else {
+			v.pass("namespace", "volume will be restored in namespace=%s", ns)
+		}
+	}
+	return v
+}
+
+// validateRemoteRestore validates the restore of the given snapshot from cloud
+func (p *Plugin) validateRemoteRestore(volumeID, snapName string) *restoreValidation {
+	v := &restoreValidation{
+		Backup:       snapName,
+		SourceVolume: volumeID,
+		Type:         "remote",
+		Valid:        true,
+	}
+
+	p.validateRemoteSnapshots(v, volumeID, snapName)
+
+	pvc, err := p.downloadPVC(volumeID, snapName)
+	if err != nil {
+		v.fail("pvc", err)
+		return v
+	}
+	v.pass("pvc", "PVC=%s/%s found in backup", pvc.Namespace, pvc.Name)
+
+	m, manifestErr := p.getManifest(volumeID, snapName)
+	if manifestErr != nil {
+		v.fail("manifest", manifestErr)
+	}
+
+	if _, err := p.verifyAttestation(volumeID, snapName); err != nil {
+		v.fail("attestation", err)
+	} else if p.attestationVerifier != nil {
+		v.pass("attestation", "attestation of backup is verified")
+	}
+
+	ns, err := velero.GetRestoreNamespace(pvc.Namespace, snapName, p.Log)
+	if err != nil {
+		v.fail("namespace", err)
+		return v
+	}
+	v.pass("namespace", "volume will be restored in namespace=%s", ns)
+	pvc.Namespace = ns
+
+	p.validateExistingPVC(v, pvc)
+
+	if err := p.setPVCStorageClass(pvc, snapName); err != nil {
+		v.fail("storageClass", err)
+		return v
+	}
+
+	sc, err := p.getPVCStorageClass(pvc)
+	if err != nil {
+		v.fail("storageClass", err)
+		return v
+	}
+	v.pass("storageClass", "volume will be provisioned using storageClass=%s", sc.Name)
+
+	if err := p.setPVCSize(pvc, snapName); err != nil {
+		v.fail("size", err)
+		return v
+	}
+	capacity := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+
+	if m != nil {
+		if err := validateManifest(m, pvc.Name, capacity); err != nil {
+			v.fail("manifest", err)
+		} else {
+			v.pass("manifest", "backup created by plugin version=%s is compatible, volume capacity=%s",
+				m.PluginVersion, capacity.String())
+		}
+	} else if manifestErr == nil {
+		v.pass("manifest", "manifest not found, compatibility of backup is not validated")
+	}
+
+	p.validatePools(v, sc, m, snapName)
+	return v
+}
+
+// validateRemoteSnapshots checks if the remote snapshots needed for restore of the given snapshot exist
+func (p *Plugin) validateRemoteSnapshots(v *restoreValidation, volumeID, snapName string) {
+	var missing []string
+
+	snapshotList := []string{snapName}
+
+	scheduleName := p.getScheduleName(snapName)
+	if p.restoreAllSnapshots && scheduleName != snapName {
+		chain, err := p.getIncrementalChain(volumeID, scheduleName)
+		if err != nil {
+			v.fail("snapshot", err)
+			return
+		}
+
+		snapshotList = nil
+		for _, snap := range chain {
+			snapshotList = append(snapshotList, snap)
+			if snap == snapName {
+				break
+			}
+		}
+	}
+
+	for _, snap := range snapshotList {
+		exists, err := p.cl.FileExists(volumeID, snap)
+		if err != nil {
+			v.fail("snapshot", errors.Wrapf(err, "failed to check remote snapshot=%s", snap))
+			return
+		}
+		if !exists {
+			missing = append(missing, snap)
+		}
+	}
+
+	if contains(missing, snapName) || !contains(snapshotList, snapName) {
+		v.fail("snapshot", errors.Errorf("remote snapshot=%s doesn't exist", snapName))
+		return
+	}
+
+	if len(missing) != 0 {
+		v.fail("snapshot", errors.Errorf("remote snapshots %v of incremental chain don't exist", missing))
+		return
+	}
+	v.pass("snapshot", "remote snapshots %v exist", snapshotList)
+}
+
+// validateExistingPVC checks if the restore of given PVC conflicts with the existing PVC
+func (p *Plugin) validateExistingPVC(v *restoreValidation, pvc *v1.PersistentVolumeClaim) {
+	rpvc, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(pvc.Namespace).
+		Get(context.TODO(), pvc.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			v.pass("existingVolume", "PVC=%s/%s doesn't exist", pvc.Namespace, pvc.Name)
+			return
+		}
+		v.fail("existingVolume", errors.Wrapf(err, "failed to fetch PVC=%s/%s", pvc.Namespace, pvc.Name))
+		return
+	}
+
+	if p.existingVolumePolicy == ExistingVolumeFail {
+		v.fail("existingVolume", errors.Errorf("PVC=%s/%s already exists with volume=%s, %s is %s",
+			rpvc.Namespace, rpvc.Name, rpvc.Spec.VolumeName, ExistingVolumePolicy, p.existingVolumePolicy))
+		return
+	}
+	v.pass("existingVolume", "PVC=%s/%s already exists with volume=%s, %s is %s",
+		rpvc.Namespace, rpvc.Name, rpvc.Spec.VolumeName, ExistingVolumePolicy, p.existingVolumePolicy)
+}
+
+// validatePools checks if the pools of the pool cluster used by given storageClass can have
+// the replicas of the restored volume
+func (p *Plugin) validatePools(v *restoreValidation, sc *storagev1.StorageClass, m *backupManifest, snapName string) {
+	var (
+		poolCluster  string
+		replicaCount string
+		err          error
+	)
+
+	isCSIVolume := sc.Provisioner == openebsCSIName
+	if isCSIVolume {
+		poolCluster = sc.Parameters[csiPoolClusterParameter]
+		replicaCount = sc.Parameters[csiReplicaCountParameter]
+	} else {
+		if poolCluster, err = getCASConfig(sc.Annotations, casConfigStoragePoolClaim); err == nil {
+			replicaCount, err = getCASConfig(sc.Annotations, casConfigReplicaCount)
+		}
+		if err != nil {
+			v.fail("pools", errors.Wrapf(err, "invalid storageClass=%s", sc.Name))
+			return
+		}
+	}
+
+	mapping, err := p.getPoolClusterMapping(snapName)
+	if err != nil {
+		v.fail("pools", err)
+		return
+	}
+	if newPoolCluster, ok := lookupNameMapping(mapping, poolCluster); ok {
+		poolCluster = newPoolCluster
+	}
+
+	if poolCluster == "" {
+		v.pass("pools", "pool cluster is not configured in storageClass=%s, pools are not validated", sc.Name)
+		return
+	}
+
+	count, err := p.getRestoreReplicaCount(snapName)
+	if err != nil {
+		v.fail("pools", err)
+		return
+	}
+	if count == 0 {
+		if count, err = strconv.Atoi(replicaCount); err != nil {
+			count = 1
+			if m != nil && m.ReplicaCount > 0 {
+				count = m.ReplicaCount
+			}
+		}
+	}
+
+	pools, err := p.getPools(poolCluster, isCSIVolume)
+	if err != nil {
+		v.fail("pools", err)
+		return
+	}
+
+	// size of restored data is estimated using the used size of volume at the time of backup
+	var (
+		required     int64
+		cstorVersion string
+	)
+	if m != nil {
+		required = m.UsedSize
+		if required == 0 {
+			required = m.Size
+		}
+		cstorVersion = m.CStorVersion
+	}
+
+	var usable []string
+	for _, pool := range pools {
+		if cstorVersion != "" && isOlderVersion(pool.version, cstorVersion) {
+			p.Log.Debugf("Pool=%s version=%s is older than cStor version=%s of backup", pool.name, pool.version, cstorVersion)
+			continue
+		}
+		if pool.free < required {
+			continue
+		}
+		usable = append(usable, pool.name)
+	}
+
+	if len(usable) < count {
+		v.fail("pools", errors.Errorf("%d of %d pools of pool cluster=%s can have the replica, "+
+			"required free space=%d bytes, cStor version=%s, replica count=%d",
+			len(usable), len(pools), poolCluster, required, cstorVersion, count))
+		return
+	}
+	v.pass("pools", "%d replicas can be placed on pools %v of pool cluster=%s", count, usable, poolCluster)
+}
+
+// getPools return the pools of the given pool cluster
+func (p *Plugin) getPools(poolCluster string, isCSIVolume bool) ([]poolDetails, error) {
+	var pools []poolDetails
+
+	if isCSIVolume {
+		list, err := p.OpenEBSAPIsClient.CstorV1().CStorPoolInstances(p.namespace).List(context.TODO(), metav1.ListOptions{
+			LabelSelector: types.CStorPoolClusterLabelKey + "=" + poolCluster,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list pools of cStorPoolCluster=%s", poolCluster)
+		}
+		for _, cspi := range list.Items {
+			pools = append(pools, poolDetails{
+				name:    cspi.Name,
+				version: cspi.VersionDetails.Status.Current,
+				free:    cspi.Status.Capacity.Free.Value(),
+			})
+		}
+		return pools, nil
+	}
+
+	list, err := p.OpenEBSClient.OpenebsV1alpha1().CStorPools().List(context.TODO(), metav1.ListOptions{
+		LabelSelector: string(v1alpha1.StoragePoolClaimCPK) + "=" + poolCluster,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list pools of storagePoolClaim=%s", poolCluster)
+	}
+	for _, csp := range list.Items {
+		free, err := parseZFSSize(csp.Status.Capacity.Free)
+		if err != nil {
+			p.Log.Debugf("Failed to parse free size=%q of pool=%s : %s", csp.Status.Capacity.Free, csp.Name, err)
+		}
+		pools = append(pools, poolDetails{
+			name:    csp.Name,
+			version: csp.VersionDetails.Status.Current,
+			free:    free,
+		})
+	}
+	return pools, nil
+}
+
+// isOlderVersion returns true if version v is older than the given version,
+// false is returned if any of the version can't be parsed
+func isOlderVersion(v, than string) bool {
+	ver, err := version.ParseGeneric(v)
+	if err != nil {
+		return false
+	}
+	thanVer, err := version.ParseGeneric(than)
+	if err != nil {
+		return false
+	}
+	return ver.LessThan(thanVer)
+}
+
+// setRestoreValidation adds the validation report of the given volume to the velero restore
+// Annotation on velero restore has the map of source volume name to its validation report
+func (p *Plugin) setRestoreValidation(srcVolume, snapName string, v restoreValidation) error {
+	reports := map[string]restoreValidation{}
+
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		return err
+	}
+
+	if data, ok := r.Annotations[restoreValidationAnnotation]; ok && data != "" {
+		if err := json.Unmarshal([]byte(data), &reports); err != nil {
+			p.Log.Warnf("Failed to decode validation report of restore=%s, overwriting it : %s", r.Name, err)
+			reports = map[string]restoreValidation{}
+		}
+	}
+	reports[srcVolume] = v
+
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return err
+	}
+	return velero.SetRestoreAnnotation(r, restoreValidationAnnotation, string(data))
+}
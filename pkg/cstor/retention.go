@@ -0,0 +1,196 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RetentionCount config key for number of remote backups retained per schedule of a volume
+	RetentionCount = "retentionCount"
+
+	// RetentionPeriod config key for age after which remote backups of a schedule are deleted
+	RetentionPeriod = "retentionPeriod"
+
+	// FullBackupInterval config key for number of backups of a schedule after which a full backup is taken
+	FullBackupInterval = "fullBackupInterval"
+)
+
+// applyRetention deletes the remote backups, and corresponding cStor snapshots, of the
+// volume's schedule which are beyond p.retentionCount or older than p.retentionPeriod.
+// Retention is independent of velero backup TTL, so remote backups are deleted even if
+// velero backups are deleted out-of-band. Backups needed to restore the retained
+// incremental backups are not deleted.
+// Failure in applying retention doesn't fail the backup.
+func (p *Plugin) applyRetention(vol *Volume) {
+	if p.retentionCount == 0 && p.retentionPeriod == 0 {
+		return
+	}
+
+	scheduleName := p.getScheduleName(vol.backupName)
+	if scheduleName == vol.backupName {
+		// retention is applied to scheduled backups only
+		return
+	}
+
+	expired, err := p.getExpiredBackups(vol, scheduleName)
+	if err != nil {
+		p.Log.Warningf("Failed to apply retention for schedule=%s of volume=%s : %s", scheduleName, vol.volname, err)
+		return
+	}
+
+	if len(expired) == 0 {
+		return
+	}
+
+	p.Log.Infof("Deleting backups %v of schedule=%s for volume=%s as per retention policy", expired, scheduleName, vol.volname)
+
+	namespace := p.findBackupNamespace(vol.volname, scheduleName, vol.backupNamespace)
+	for _, bkp := range expired {
+		if err := p.deleteBackup(bkp, vol.volname, namespace, scheduleName, vol.isCSIVolume); err != nil {
+			p.Log.Warningf("Failed to delete snapshot=%s of volume=%s : %s", bkp, vol.volname, err)
+			continue
+		}
+
+		if err := p.deleteRemoteSnapshot(vol.snapshotTag, bkp); err != nil {
+			p.Log.Warningf("Failed to delete remote snapshot=%s of volume=%s : %s", bkp, vol.volname, err)
+			continue
+		}
+		p.uncatalogBackup(vol.volname, bkp)
+	}
+}
+
+// getExpiredBackups return the remote backups of the given schedule of volume which can be
+// deleted as per retention policy
+func (p *Plugin) getExpiredBackups(vol *Volume, scheduleName string) ([]string, error) {
+	var expired []string
+
+	chain, err := p.getIncrementalChain(vol.snapshotTag, scheduleName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get remote backups")
+	}
+
+	isExpired := make(map[string]bool, len(chain))
+	for i, bkp := range chain {
+		if bkp == vol.backupName {
+			// backup in progress is always retained
+			continue
+		}
+
+		if p.retentionCount > 0 && i < len(chain)-p.retentionCount {
+			isExpired[bkp] = true
+			continue
+		}
+
+		if ts, ok := p.getBackupTimestamp(bkp); ok && p.retentionPeriod > 0 && time.Since(ts) > p.retentionPeriod {
+			isExpired[bkp] = true
+		}
+	}
+
+	required, err := p.getRequiredBackups(vol.snapshotTag, chain, isExpired)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bkp := range chain {
+		if !isExpired[bkp] {
+			continue
+		}
+
+		if required[bkp] {
+			p.Log.Infof("Retaining expired backup=%s of volume=%s, it is required to restore later incremental backups",
+				bkp, vol.volname)
+			continue
+		}
+		expired = append(expired, bkp)
+	}
+	return expired, nil
+}
+
+// isFullBackupDue checks if the backup of given volume's schedule should be a full backup, i.e.
+// p.fullBackupInterval-1 incremental backups are taken since the last full backup. Incremental
+// backups are counted from the manifests of the latest remote backups of the schedule.
+func (p *Plugin) isFullBackupDue(vol *Volume, scheduleName string) (bool, error) {
+	chain, err := p.getIncrementalChain(vol.snapshotTag, scheduleName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get remote backups")
+	}
+
+	incremental := 0
+	for i := len(chain) - 1; i >= 0 && incremental < p.fullBackupInterval-1; i-- {
+		if chain[i] == vol.backupName {
+			continue
+		}
+
+		m, err := p.getManifest(vol.snapshotTag, chain[i])
+		if err != nil {
+			return false, err
+		}
+		if m == nil || m.IncrementalParent == "" {
+			// backups created without manifest are considered as full backup
+			return false, nil
+		}
+		incremental++
+	}
+	return incremental >= p.fullBackupInterval-1, nil
+}
+
+// getRequiredBackups return the backups of the given sorted chain which are needed to restore
+// the backups not marked as expired. Incremental parent of the backup is found from its manifest.
+// Backups created by older version of plugin don't have manifest, for such backups all the
+// earlier backups of the chain are considered as required.
+func (p *Plugin) getRequiredBackups(snapshotTag string, chain []string, isExpired map[string]bool) (map[string]bool, error) {
+	required := map[string]bool{}
+
+	index := make(map[string]int, len(chain))
+	for i, bkp := range chain {
+		index[bkp] = i
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if isExpired[chain[i]] && !required[chain[i]] {
+			continue
+		}
+
+		m, err := p.getManifest(snapshotTag, chain[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if m == nil {
+			for _, bkp := range chain[:i] {
+				required[bkp] = true
+			}
+			break
+		}
+
+		if m.IncrementalParent == "" {
+			// full backup
+			continue
+		}
+
+		if _, ok := index[m.IncrementalParent]; !ok {
+			p.Log.Warningf("Incremental parent=%s of backup=%s not found in remote backups", m.IncrementalParent, chain[i])
+			continue
+		}
+		required[m.IncrementalParent] = true
+	}
+	return required, nil
+}
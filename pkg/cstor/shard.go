@@ -0,0 +1,389 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ShardGroup config key for name of the group of plugin instances sharing the volumes
+	ShardGroup = "shardGroup"
+
+	// ShardID config key for identity of the plugin instance in shard group
+	ShardID = "shardID"
+
+	// ShardLeaseDuration config key for time after which plugin instance is removed from
+	// shard group, if it doesn't renew its lease
+	ShardLeaseDuration = "shardLeaseDuration"
+
+	// ShardClaimDuration config key for time, after the backup of a volume by a plugin instance,
+	// for which other instances of the shard group don't backup the volume
+	ShardClaimDuration = "shardClaimDuration"
+
+	// defaultShardLeaseDuration is default time for which shard lease is valid, lease is
+	// renewed periodically while the plugin instance is running
+	defaultShardLeaseDuration = 2 * time.Minute
+
+	// defaultShardClaimDuration is default time for which claim of the backed up volume is valid
+	defaultShardClaimDuration = 30 * time.Minute
+
+	// shardGroupLabel is set on shard lease with shard group as value
+	shardGroupLabel = "openebs.io/velero-shard-group"
+
+	// shardClaimLabel is set on claim lease of a volume with shard group as value
+	shardClaimLabel = "openebs.io/velero-shard-claim"
+
+	// shardClaimStateAnnotation is set on claim lease with the state of claim
+	shardClaimStateAnnotation = "openebs.io/velero-shard-claim-state"
+
+	// claimRunning is state of claim, while the volume is being backed up. Claim is valid
+	// till its holder is a member of shard group.
+	claimRunning = "running"
+
+	// claimDone is state of claim, once the volume is backed up. Claim is valid till its duration.
+	claimDone = "done"
+
+	// shardLeasePrefix is prefix for the name of shard lease
+	shardLeasePrefix = "velero-shard-"
+)
+
+// shardLeaseName return the name of lease for the given shard group and shard ID
+func shardLeaseName(group, id string) string {
+	return shardLeasePrefix + group + "-" + id
+}
+
+// shardClaimName return the name of claim lease for the given shard group and key of volume
+func shardClaimName(group, key string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return fmt.Sprintf("%s%s-claim-%016x", shardLeasePrefix, group, h.Sum64())
+}
+
+// initSharding registers the plugin instance in shard group, by creating or renewing
+// its lease, and starts the periodic renewal of the lease
+func (p *Plugin) initSharding(config map[string]string) error {
+	group, ok := config[ShardGroup]
+	if !ok || group == "" {
+		return nil
+	}
+
+	id := config[ShardID]
+	if id == "" {
+		// velero in different namespaces will have different identity
+		id = velero.GetNamespace()
+	}
+	if id == "" {
+		return errors.Errorf("%s is required for %s=%s", ShardID, ShardGroup, group)
+	}
+
+	leaseDuration, err := parseShardDuration(config, ShardLeaseDuration, defaultShardLeaseDuration)
+	if err != nil {
+		return err
+	}
+
+	claimDuration, err := parseShardDuration(config, ShardClaimDuration, defaultShardClaimDuration)
+	if err != nil {
+		return err
+	}
+
+	p.shardGroup = group
+	p.shardID = id
+	p.shardLeaseDuration = leaseDuration
+	p.shardClaimDuration = claimDuration
+
+	if err := p.renewShardLease(); err != nil {
+		return errors.Wrapf(err, "failed to renew lease of shard=%s in group=%s", id, group)
+	}
+	go p.renewShardMembership()
+
+	members, err := p.getShardMembers()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get members of shard group=%s", group)
+	}
+
+	p.Log.Infof("Plugin instance %s is sharing the volumes with %v in shard group=%s", id, members, group)
+	return nil
+}
+
+// parseShardDuration return the positive duration of given config key, or the given default
+func parseShardDuration(config map[string]string, key string, def time.Duration) (time.Duration, error) {
+	val, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse %s", key)
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("invalid %s=%s, expected positive duration", key, val)
+	}
+	return d, nil
+}
+
+// renewShardMembership renews the lease of plugin instance in shard group, while the
+// plugin process is running, so that the instance is removed from the group soon after it exits
+func (p *Plugin) renewShardMembership() {
+	for {
+		time.Sleep(p.shardLeaseDuration / 3)
+
+		if err := p.renewShardLease(); err != nil {
+			p.Log.Warnf("Failed to renew lease of shard=%s in group=%s : %s", p.shardID, p.shardGroup, err)
+		}
+	}
+}
+
+// renewShardLease creates or renews the lease of plugin instance in shard group
+func (p *Plugin) renewShardLease() error {
+	name := shardLeaseName(p.shardGroup, p.shardID)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(p.shardLeaseDuration.Seconds())
+
+	lease, err := p.K8sClient.CoordinationV1().Leases(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return err
+		}
+
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: p.namespace,
+				Labels: map[string]string{
+					shardGroupLabel: p.shardGroup,
+				},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &p.shardID,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = p.K8sClient.CoordinationV1().Leases(p.namespace).Create(context.TODO(), lease, metav1.CreateOptions{})
+		return err
+	}
+
+	lease.Spec.HolderIdentity = &p.shardID
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.RenewTime = &now
+	_, err = p.K8sClient.CoordinationV1().Leases(p.namespace).Update(context.TODO(), lease, metav1.UpdateOptions{})
+	return err
+}
+
+// getShardMembers return the sorted list of plugin instances, of the shard group, having a valid lease
+func (p *Plugin) getShardMembers() ([]string, error) {
+	var members []string
+
+	leases, err := p.K8sClient.CoordinationV1().Leases(p.namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: shardGroupLabel + "=" + p.shardGroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range leases.Items {
+		l := &leases.Items[i]
+		if l.Spec.HolderIdentity == nil {
+			continue
+		}
+
+		if !isLeaseValid(l) {
+			p.Log.Debugf("Lease of shard=%s in group=%s has expired, skipping it", *l.Spec.HolderIdentity, p.shardGroup)
+			continue
+		}
+		members = append(members, *l.Spec.HolderIdentity)
+	}
+
+	sort.Strings(members)
+	return members, nil
+}
+
+// isLeaseValid returns true if the given lease is held and renewed within its duration
+func isLeaseValid(l *coordinationv1.Lease) bool {
+	if l.Spec.HolderIdentity == nil || l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+
+	expiry := l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().Before(expiry)
+}
+
+// isClaimValid returns true if the given claim lease is held by a plugin instance. Claim of
+// running backup is valid till its holder is in given members, and claim of completed
+// backup is valid till its duration.
+func isClaimValid(l *coordinationv1.Lease, members []string) bool {
+	if l.Spec.HolderIdentity == nil {
+		return false
+	}
+
+	if l.Annotations[shardClaimStateAnnotation] == claimDone {
+		return isLeaseValid(l)
+	}
+
+	for _, m := range members {
+		if m == *l.Spec.HolderIdentity {
+			return true
+		}
+	}
+	return false
+}
+
+// getShardKey return the key by which the volume of given PV is claimed. Volumes of a
+// consistency group are claimed together.
+func (p *Plugin) getShardKey(pv *v1.PersistentVolume) (string, error) {
+	if pv.Spec.ClaimRef == nil {
+		return pv.Name, nil
+	}
+
+	group, err := p.getConsistencyGroup(&Volume{
+		namespace: pv.Spec.ClaimRef.Namespace,
+		pvcName:   pv.Spec.ClaimRef.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+	if group != "" {
+		return groupBackupKey("", pv.Spec.ClaimRef.Namespace, group), nil
+	}
+	return pv.Name, nil
+}
+
+// claimVolume claims the volume of the given PV, or its consistency group, for backup by this
+// plugin instance. It return the name of claim lease, and false if the volume is claimed by
+// other plugin instance of the shard group. Claim is taken when velero requests the volume ID,
+// just before the snapshot, so the volumes are shared by the instances whose backups are running.
+func (p *Plugin) claimVolume(pv *v1.PersistentVolume) (string, bool, error) {
+	if p.shardGroup == "" {
+		return "", true, nil
+	}
+
+	key, err := p.getShardKey(pv)
+	if err != nil {
+		return "", false, err
+	}
+	name := shardClaimName(p.shardGroup, key)
+
+	// claim is retried if other instance has created or updated it concurrently
+	for {
+		members, err := p.getShardMembers()
+		if err != nil {
+			return "", false, errors.Wrapf(err, "failed to get members of shard group=%s", p.shardGroup)
+		}
+
+		lease, err := p.K8sClient.CoordinationV1().Leases(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return "", false, errors.Wrapf(err, "failed to get claim=%s", name)
+		}
+
+		create := err != nil
+		if create {
+			lease = &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: p.namespace,
+					Labels: map[string]string{
+						shardClaimLabel: p.shardGroup,
+					},
+				},
+			}
+		} else if holder := lease.Spec.HolderIdentity; holder != nil && *holder != p.shardID {
+			if isClaimValid(lease, members) {
+				p.Log.Infof("Volume=%s is claimed by plugin instance %s of shard group=%s, its backup is %s. Skipping it",
+					pv.Name, *holder, p.shardGroup, lease.Annotations[shardClaimStateAnnotation])
+				return name, false, nil
+			}
+			if lease.Annotations[shardClaimStateAnnotation] == claimRunning {
+				p.Log.Warnf("Volume=%s is claimed by plugin instance %s of shard group=%s, which is not running anymore. "+
+					"Taking over its backup", pv.Name, *holder, p.shardGroup)
+			}
+		}
+
+		now := metav1.NewMicroTime(time.Now())
+		seconds := int32(p.shardClaimDuration.Seconds())
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		lease.Annotations[shardClaimStateAnnotation] = claimRunning
+		lease.Spec.HolderIdentity = &p.shardID
+		lease.Spec.LeaseDurationSeconds = &seconds
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+
+		if create {
+			_, err = p.K8sClient.CoordinationV1().Leases(p.namespace).Create(context.TODO(), lease, metav1.CreateOptions{})
+		} else {
+			_, err = p.K8sClient.CoordinationV1().Leases(p.namespace).Update(context.TODO(), lease, metav1.UpdateOptions{})
+		}
+		if k8serrors.IsAlreadyExists(err) || k8serrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return "", false, errors.Wrapf(err, "failed to claim volume=%s", pv.Name)
+		}
+		return name, true, nil
+	}
+}
+
+// completeVolumeClaim marks the claim of given volume as done if the volume is backed up, so that
+// other instances of shard group don't backup the volume till the claim duration. If the backup
+// has failed then claim is released, so that the volume can be backed up by other instance.
+func (p *Plugin) completeVolumeClaim(vol *Volume, backedUp bool) {
+	if vol.shardClaim == "" {
+		return
+	}
+
+	if !backedUp {
+		if err := p.releaseLease(vol.shardClaim, p.shardID); err != nil {
+			p.Log.Warnf("Failed to release claim=%s of volume=%s : %s", vol.shardClaim, vol.volname, err)
+		}
+		return
+	}
+
+	lease, err := p.K8sClient.CoordinationV1().Leases(p.namespace).Get(context.TODO(), vol.shardClaim, metav1.GetOptions{})
+	if err == nil {
+		if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != p.shardID {
+			p.Log.Warnf("Claim=%s of volume=%s is taken over by %v", vol.shardClaim, vol.volname, lease.Spec.HolderIdentity)
+			return
+		}
+
+		now := metav1.NewMicroTime(time.Now())
+		if lease.Annotations == nil {
+			lease.Annotations = map[string]string{}
+		}
+		lease.Annotations[shardClaimStateAnnotation] = claimDone
+		lease.Spec.RenewTime = &now
+		_, err = p.K8sClient.CoordinationV1().Leases(p.namespace).Update(context.TODO(), lease, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		p.Log.Warnf("Failed to complete claim=%s of volume=%s, it may be backed up by other instance : %s",
+			vol.shardClaim, vol.volname, err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// snapshotIDPrefix is prefix of the structured snapshotID, followed by
+	// base64 encoded JSON of snapshotIDInfo
+	snapshotIDPrefix = "cstor."
+
+	// snapshotIDVersion is the version of structured snapshotID generated by plugin
+	snapshotIDVersion = 1
+)
+
+// snapshotIDInfo is the information encoded in the structured snapshotID
+type snapshotIDInfo struct {
+	Version int    `json:"v"`
+	Volume  string `json:"volume"`
+	Backup  string `json:"backup"`
+}
+
+// generateSnapshotID return the snapshotID for given volume and backup
+func generateSnapshotID(volumeID, backupName string) string {
+	data, _ := json.Marshal(snapshotIDInfo{
+		Version: snapshotIDVersion,
+		Volume:  volumeID,
+		Backup:  backupName,
+	})
+	return snapshotIDPrefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// getInfoFromSnapshotID return backup name and volume id from the given snapshotID.
+// snapshotID generated by older plugin, as volume + SnapshotIDIdentifier + backup, is also accepted.
+func getInfoFromSnapshotID(snapshotID string) (volumeID, backupName string, err error) {
+	snapshotID = strings.TrimSpace(snapshotID)
+
+	if strings.HasPrefix(snapshotID, snapshotIDPrefix) {
+		volumeID, backupName, err = parseSnapshotID(strings.TrimPrefix(snapshotID, snapshotIDPrefix))
+	} else {
+		volumeID, backupName, err = parseLegacySnapshotID(snapshotID)
+	}
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid snapshot id %q", snapshotID)
+	}
+
+	if volumeID == "" || backupName == "" {
+		return "", "", errors.Errorf("invalid snapshot id %q, volumeID=%s backupName=%s", snapshotID, volumeID, backupName)
+	}
+	return volumeID, backupName, nil
+}
+
+// parseSnapshotID parses the encoded part of structured snapshotID
+func parseSnapshotID(encoded string) (volumeID, backupName string, err error) {
+	// padding is tolerated, in case the ID is re-encoded by some tool
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to decode")
+	}
+
+	var info snapshotIDInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", "", errors.Wrapf(err, "failed to parse")
+	}
+
+	// newer versions may add fields, but volume and backup are expected to be retained
+	if info.Version < 1 {
+		return "", "", errors.Errorf("unsupported version %d", info.Version)
+	}
+	return info.Volume, info.Backup, nil
+}
+
+// parseLegacySnapshotID parses the snapshotID of format volume + SnapshotIDIdentifier + backup
+func parseLegacySnapshotID(snapshotID string) (volumeID, backupName string, err error) {
+	s := strings.SplitN(snapshotID, SnapshotIDIdentifier, 2)
+	if len(s) != 2 {
+		return "", "", errors.Errorf("missing %q", SnapshotIDIdentifier)
+	}
+	return s[0], s[1], nil
+}
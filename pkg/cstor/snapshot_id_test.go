@@ -0,0 +1,112 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestGetInfoFromSnapshotID(t *testing.T) {
+	tests := []struct {
+		name       string
+		snapshotID string
+		volumeID   string
+		backupName string
+		wantErr    bool
+	}{
+		{
+			name:       "structured",
+			snapshotID: generateSnapshotID("pvc-1", "backup-1"),
+			volumeID:   "pvc-1",
+			backupName: "backup-1",
+		},
+		{
+			name:       "structured with identifier in backup name",
+			snapshotID: generateSnapshotID("pvc-1", "daily-velero-bkp-20210513104034"),
+			volumeID:   "pvc-1",
+			backupName: "daily-velero-bkp-20210513104034",
+		},
+		{
+			name:       "structured with padding",
+			snapshotID: snapshotIDPrefix + base64.URLEncoding.EncodeToString([]byte(`{"v":1,"volume":"pvc-1","backup":"b"}`)),
+			volumeID:   "pvc-1",
+			backupName: "b",
+		},
+		{
+			name:       "structured from newer version",
+			snapshotID: snapshotIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(`{"v":2,"volume":"pvc-1","backup":"b","zone":"z"}`)),
+			volumeID:   "pvc-1",
+			backupName: "b",
+		},
+		{
+			name:       "legacy",
+			snapshotID: "pvc-1" + SnapshotIDIdentifier + "backup-1",
+			volumeID:   "pvc-1",
+			backupName: "backup-1",
+		},
+		{
+			name:       "legacy with surrounding space",
+			snapshotID: " pvc-1" + SnapshotIDIdentifier + "backup-1\n",
+			volumeID:   "pvc-1",
+			backupName: "backup-1",
+		},
+		{
+			name:       "legacy without identifier",
+			snapshotID: "pvc-1-backup-1",
+			wantErr:    true,
+		},
+		{
+			name:       "legacy without backup",
+			snapshotID: "pvc-1" + SnapshotIDIdentifier,
+			wantErr:    true,
+		},
+		{
+			name:       "structured with invalid encoding",
+			snapshotID: snapshotIDPrefix + "!!",
+			wantErr:    true,
+		},
+		{
+			name:       "structured with invalid JSON",
+			snapshotID: snapshotIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(`{"v":1`)),
+			wantErr:    true,
+		},
+		{
+			name:       "structured without version",
+			snapshotID: snapshotIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(`{"volume":"pvc-1","backup":"b"}`)),
+			wantErr:    true,
+		},
+		{
+			name:       "structured without volume",
+			snapshotID: snapshotIDPrefix + base64.RawURLEncoding.EncodeToString([]byte(`{"v":1,"backup":"b"}`)),
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumeID, backupName, err := getInfoFromSnapshotID(tt.snapshotID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getInfoFromSnapshotID(%q) error = %v, wantErr %v", tt.snapshotID, err, tt.wantErr)
+			}
+			if volumeID != tt.volumeID || backupName != tt.backupName {
+				t.Errorf("getInfoFromSnapshotID(%q) = %q, %q, want %q, %q",
+					tt.snapshotID, volumeID, backupName, tt.volumeID, tt.backupName)
+			}
+		})
+	}
+}
@@ -17,120 +17,239 @@ limitations under the License.
 package cstor
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-// checkBackupStatus queries MayaAPI server for given backup status
-// and wait until backup completes
-func (p *Plugin) checkBackupStatus(bkp *v1alpha1.CStorBackup, isCSIVolume bool) {
+const (
+	// backupProgressAnnotation is set on CStorBackup with the human readable transfer progress
+	backupProgressAnnotation = "openebs.io/backup-progress"
+
+	// backupBytesAnnotation is set on CStorBackup with the number of bytes transferred
+	backupBytesAnnotation = "openebs.io/backup-bytes-transferred"
+
+	// defaultBackupStallTimeout is default time limit to wait for the data of a backup
+	defaultBackupStallTimeout = 10 * time.Minute
+)
+
+// backupResult is the final state of backup reported by checkBackupStatus,
+// err is set if backup is aborted by plugin
+type backupResult struct {
+	status       v1alpha1.CStorBackupStatus
+	prevSnapName string
+	err          error
+
+	// retained is set if backup failed on the replica and its snapshot is retained for retry
+	retained bool
+}
+
+// checkBackupStatus watches the status of given backup from CStorBackup
+// and wait until backup completes. If ctx is done before the backup
+// completes, or no data is transferred for backupStallTimeout, then backup
+// is aborted. Final state of the backup is sent on given result channel,
+// once the backup is cleaned up. If retry is set, then the snapshot of backup
+// failed, or stuck, on the replica is retained so that it can be retried.
+func (p *Plugin) checkBackupStatus(ctx context.Context, bkp *v1alpha1.CStorBackup, bkpvolume *Volume,
+	retry bool, result chan<- backupResult) {
 	var (
-		bkpDone bool
-		url     string
+		last *v1alpha1.CStorBackup
+		res  = backupResult{status: v1alpha1.BKPCStorStatusFailed}
 	)
 
-	if isCSIVolume {
-		url = p.cvcAddr + backupEndpoint
-	} else {
-		url = p.mayaAddr + backupEndpoint
-	}
+	defer func() {
+		result <- res
+	}()
 
-	bkpvolume, exists := p.volumes[bkp.Spec.VolumeName]
-	if !exists {
-		p.Log.Errorf("Failed to fetch volume info for {%s}", bkp.Spec.VolumeName)
-		p.cl.ExitServer = true
-		bkpvolume.backupStatus = v1alpha1.BKPCStorStatusInvalid
-		return
-	}
+	log := p.volumeLog(bkpvolume, phaseUpload)
 
-	bkpData, err := json.Marshal(bkp)
-	if err != nil {
-		p.Log.Errorf("JSON marshal failed : %s", err.Error())
-		p.cl.ExitServer = true
-		bkpvolume.backupStatus = v1alpha1.BKPCStorStatusInvalid
-		return
-	}
+	isCSIVolume := bkpvolume.isCSIVolume
 
-	for !bkpDone {
-		var bs v1alpha1.CStorBackup
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		time.Sleep(backupStatusInterval * time.Second)
-		resp, err := p.httpRestCall(url, "GET", bkpData)
-		if err != nil {
-			p.Log.Warnf("Failed to fetch backup status : %s", err.Error())
-			continue
-		}
+	updates := p.watchBackup(wctx, bkp, isCSIVolume, p.backupStatusInterval)
+
+	// progress is reported periodically, since transfer doesn't update the CStorBackup
+	ticker := time.NewTicker(p.backupStatusInterval)
+	defer ticker.Stop()
+
+	// transfer is stuck if the pool stops sending the data, e.g. pool pod dies during backup
+	lastBytes, lastTransfer := int64(0), time.Now()
 
-		err = json.Unmarshal(resp, &bs)
-		if err != nil {
-			p.Log.Warnf("Unmarshal failed : %s", err.Error())
+	for {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				log.Errorf("Backup didn't complete in %v, marking it as failed", p.backupTimeout)
+			} else {
+				log.Error("Backup is aborted, marking it as failed")
+			}
+			p.abortBackup(bkp, bkpvolume)
+			return
+		case <-ticker.C:
+			if last != nil {
+				p.reportBackupProgress(last, bkpvolume)
+			}
+
+			if transferred, _ := bkpvolume.cl.Progress(); transferred != lastBytes {
+				lastBytes, lastTransfer = transferred, time.Now()
+			} else if p.backupStallTimeout > 0 && time.Since(lastTransfer) > p.backupStallTimeout {
+				res.err = errors.Errorf("backup is stuck, no data transferred for %v after %d bytes",
+					p.backupStallTimeout, transferred)
+				log.WithField(logFieldBytes, transferred).
+					Errorf("No data transferred for %v, marking backup as failed", p.backupStallTimeout)
+				if retry {
+					p.releaseFailedReplica(bkp, bkpvolume)
+					res.retained = true
+					return
+				}
+				p.abortBackup(bkp, bkpvolume)
+				return
+			}
 			continue
+		case bs, ok := <-updates:
+			if !ok {
+				// watch is closed only if ctx is done
+				updates = nil
+				continue
+			}
+			last = bs
 		}
 
-		bkpvolume.backupStatus = bs.Status
-
-		switch bs.Status {
+		switch last.Status {
 		case v1alpha1.BKPCStorStatusDone, v1alpha1.BKPCStorStatusFailed, v1alpha1.BKPCStorStatusInvalid:
-			bkpDone = true
-			p.cl.ExitServer = true
-			if err = p.cleanupCompletedBackup(bs, isCSIVolume); err != nil {
-				p.Log.Warningf("failed to execute clean-up request for backup=%s err=%s", bs.Name, err)
+			res = backupResult{status: last.Status, prevSnapName: last.Spec.PrevSnapName}
+			p.reportBackupProgress(last, bkpvolume)
+			if retry && last.Status == v1alpha1.BKPCStorStatusFailed {
+				p.releaseFailedReplica(last, bkpvolume)
+				res.retained = true
+				return
+			}
+			if last.Status == v1alpha1.BKPCStorStatusDone {
+				bkpvolume.cl.StopServer()
+			} else {
+				// data sent by the failed backup is incomplete
+				bkpvolume.cl.AbortServer()
+			}
+			if p.retainLocal && isBackupSucceeded(*last) {
+				// snapshot is retained in cStor pool as local restore point
+				log.Infof("Retaining local snapshot=%s", last.Spec.SnapName)
+				return
 			}
+			if err := p.cleanupCompletedBackup(*last, isCSIVolume); err != nil {
+				log.WithField(logFieldPhase, phaseCleanup).WithError(err).Warn("Failed to execute clean-up request")
+			}
+			return
 		}
 	}
 }
 
-// checkRestoreStatus queries MayaAPI server for given restore status
-// and wait until restore completes
-func (p *Plugin) checkRestoreStatus(rst *v1alpha1.CStorRestore, vol *Volume) {
-	var (
-		rstDone bool
-		url     string
-	)
+// reportBackupProgress logs the transfer progress of the given backup and
+// updates it on the CStorBackup resource as annotations.
+// Percentage is calculated from the volume capacity, so for incremental
+// or sparse volume backups, backup may complete before reaching 100%.
+func (p *Plugin) reportBackupProgress(bkp *v1alpha1.CStorBackup, vol *Volume) {
+	var err error
 
-	if vol.isCSIVolume {
-		url = p.cvcAddr + restorePath
-	} else {
-		url = p.mayaAddr + restorePath
+	transferred, total := vol.cl.Progress()
+	progress := formatBytes(transferred)
+	if total > 0 {
+		pct := transferred * 100 / total
+		if pct > 100 {
+			pct = 100
+		}
+		progress = fmt.Sprintf("%s/%s (%d%%)", progress, formatBytes(total), pct)
 	}
 
-	rstData, err := json.Marshal(rst)
+	log := p.volumeLog(vol, phaseUpload).WithFields(logrus.Fields{
+		"status":      bkp.Status,
+		logFieldBytes: transferred,
+	})
+	log.Infof("Backup progress %s", progress)
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				backupProgressAnnotation: progress,
+				backupBytesAnnotation:    strconv.FormatInt(transferred, 10),
+			},
+		},
+	})
 	if err != nil {
-		p.Log.Errorf("JSON marshal failed : %s", err.Error())
-		vol.restoreStatus = v1alpha1.RSTCStorStatusInvalid
-		p.cl.ExitServer = true
+		log.WithError(err).Warn("Failed to generate progress patch")
+		return
 	}
 
-	for !rstDone {
-		var rs v1alpha1.CStorRestore
+	if err = p.patchBackup(bkp, vol.isCSIVolume, patch); err != nil {
+		log.WithError(err).Debugf("Failed to update progress on backup resource=%s/%s", bkp.Namespace, bkp.Name)
+	}
+}
 
-		time.Sleep(restoreStatusInterval * time.Second)
-		resp, err := p.httpRestCall(url, "GET", rstData)
-		if err != nil {
-			p.Log.Warnf("Failed to fetch backup status : %s", err.Error())
-			continue
-		}
+// patchBackup applies the given merge patch on CStorBackup
+func (p *Plugin) patchBackup(bkp *v1alpha1.CStorBackup, isCSIVolume bool, patch []byte) error {
+	var err error
 
-		err = json.Unmarshal(resp, &rs.Status)
-		if err != nil {
-			p.Log.Warnf("Unmarshal failed : %s", err.Error())
-			continue
-		}
+	name := bkp.Name
+	if isCSIVolume {
+		_, err = p.OpenEBSAPIsClient.CstorV1().CStorBackups(bkp.Namespace).
+			Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(bkp.Namespace).
+			Patch(context.TODO(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	return err
+}
 
-		vol.restoreStatus = rs.Status
+// formatBytes return human readable, binary prefixed, representation of given bytes
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
 
-		switch rs.Status {
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// checkRestoreStatus watches the status of given restore from CStorRestores
+// and wait until restore completes or ctx is done. Last observed status
+// of the restore is sent on given result channel.
+func (p *Plugin) checkRestoreStatus(ctx context.Context, rst *v1alpha1.CStorRestore, vol *Volume,
+	result chan<- v1alpha1.CStorRestoreStatus) {
+	var last v1alpha1.CStorRestoreStatus
+
+	defer func() {
+		result <- last
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for status := range p.watchRestore(ctx, rst, vol.isCSIVolume, restoreStatusInterval*time.Second) {
+		last = status
+
+		switch status {
 		case v1alpha1.RSTCStorStatusDone, v1alpha1.RSTCStorStatusFailed, v1alpha1.RSTCStorStatusInvalid:
-			rstDone = true
-			p.cl.ExitServer = true
+			p.cl.StopServer()
+			return
 		}
 	}
 }
 
-// cleanupCompletedBackup send the delete request to apiserver
-// to cleanup backup resources
+// cleanupCompletedBackup deletes the backup resources and snapshot
 // If it is normal backup then it will delete the current backup, it can be failed or succeeded backup
 // If it is scheduled backup then
 //		- if current backup is base backup, not incremental one, then it will not perform any clean-up
@@ -138,7 +257,7 @@ func (p *Plugin) checkRestoreStatus(rst *v1alpha1.CStorRestore, vol *Volume) {
 //		- if current backup is incremental backup and completed successfully then
 //		  it will delete the last completed or previous backup
 func (p *Plugin) cleanupCompletedBackup(bkp v1alpha1.CStorBackup, isCSIVolume bool) error {
-	targetedSnapName := bkp.Spec.SnapName
+	targetedSnapName := backupNameOf(bkp)
 
 	// In case of scheduled backup we are using the last completed backup to send
 	// differential snapshot. So We don't need to delete the last completed backup.
@@ -151,16 +270,26 @@ func (p *Plugin) cleanupCompletedBackup(bkp v1alpha1.CStorBackup, isCSIVolume bo
 			return nil
 		}
 		targetedSnapName = bkp.Spec.PrevSnapName
+
+		// snapshot taken through CSI VolumeSnapshot is named by CSI driver
+		if isCSIVolume {
+			var err error
+			targetedSnapName, err = p.getSnapshotBackup(bkp.Namespace, bkp.Spec.VolumeName, bkp.Spec.PrevSnapName)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	p.Log.Infof("executing clean-up request.. snapshot=%s volume=%s ns=%s backup=%s",
-		targetedSnapName,
-		bkp.Spec.VolumeName,
-		bkp.Namespace,
-		bkp.Spec.BackupName,
-	)
+	p.Log.WithFields(logrus.Fields{
+		logFieldBackup:    targetedSnapName,
+		logFieldVolume:    bkp.Spec.VolumeName,
+		logFieldNamespace: bkp.Namespace,
+		logFieldPhase:     phaseCleanup,
+		"schedule":        bkp.Spec.BackupName,
+	}).Info("Executing clean-up request")
 
-	return p.sendDeleteRequest(targetedSnapName,
+	return p.deleteBackup(targetedSnapName,
 		bkp.Spec.VolumeName,
 		bkp.Namespace,
 		bkp.Spec.BackupName,
@@ -169,8 +298,8 @@ func (p *Plugin) cleanupCompletedBackup(bkp v1alpha1.CStorBackup, isCSIVolume bo
 
 // return true if given backup is part of schedule
 func isScheduledBackup(bkp v1alpha1.CStorBackup) bool {
-	// if backup is scheduled backup then snapshot name and backup name are different
-	return bkp.Spec.SnapName != bkp.Spec.BackupName
+	// if backup is scheduled backup then backup name and schedule name are different
+	return backupNameOf(bkp) != bkp.Spec.BackupName
 }
 
 // isBackupSucceeded returns true if backup completed successfully
@@ -0,0 +1,217 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"time"
+
+	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
+	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// watchBackup sends the CStorBackup of given backup on returned channel, once the watch is
+// established and then on each update of CStorBackup. If the watch is closed, it is
+// re-established after given interval. Channel is closed once ctx is done.
+func (p *Plugin) watchBackup(ctx context.Context, bkp *v1alpha1.CStorBackup, isCSIVolume bool,
+	interval time.Duration) <-chan *v1alpha1.CStorBackup {
+	ch := make(chan *v1alpha1.CStorBackup)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			if err := p.watchBackupOnce(ctx, bkp, isCSIVolume, ch); err != nil {
+				p.Log.Warnf("Watch of backup=%s/%s closed : %s", bkp.Namespace, bkp.Name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return ch
+}
+
+// watchBackupOnce fetches the given backup and watches it from the fetched version,
+// so that updates done while watch is not established are not missed
+func (p *Plugin) watchBackupOnce(ctx context.Context, bkp *v1alpha1.CStorBackup, isCSIVolume bool,
+	ch chan<- *v1alpha1.CStorBackup) error {
+	var (
+		w   watch.Interface
+		err error
+	)
+
+	cur, err := p.getBackup(bkp, isCSIVolume)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ch <- cur:
+	case <-ctx.Done():
+		return nil
+	}
+
+	opts := metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", cur.Name).String(),
+		ResourceVersion: cur.ResourceVersion,
+	}
+
+	if isCSIVolume {
+		w, err = p.OpenEBSAPIsClient.CstorV1().CStorBackups(bkp.Namespace).Watch(ctx, opts)
+	} else {
+		w, err = p.OpenEBSClient.OpenebsV1alpha1().CStorBackups(bkp.Namespace).Watch(ctx, opts)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch backup")
+	}
+	defer w.Stop()
+
+	for {
+		var b *v1alpha1.CStorBackup
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return errors.New("watch channel closed")
+			}
+
+			switch obj := ev.Object.(type) {
+			case *v1alpha1.CStorBackup:
+				b = obj
+			case *cstorv1.CStorBackup:
+				b = fromCStorV1Backup(obj)
+			case *metav1.Status:
+				return errors.Errorf("watch failed : %s", obj.Message)
+			default:
+				continue
+			}
+
+			if ev.Type == watch.Deleted {
+				return errors.New("backup is deleted")
+			}
+		}
+
+		select {
+		case ch <- b:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// watchRestore sends the status of given restore, aggregated from the CStorRestores of all
+// the replicas, on returned channel, once the watch is established and then on each update
+// of CStorRestores. If the watch is closed, it is re-established after given interval.
+// Channel is closed once ctx is done.
+func (p *Plugin) watchRestore(ctx context.Context, rst *v1alpha1.CStorRestore, isCSIVolume bool,
+	interval time.Duration) <-chan v1alpha1.CStorRestoreStatus {
+	ch := make(chan v1alpha1.CStorRestoreStatus)
+
+	go func() {
+		defer close(ch)
+
+		for {
+			if err := p.watchRestoreOnce(ctx, rst, isCSIVolume, ch); err != nil {
+				p.Log.Warnf("Watch of restore=%s of volume=%s closed : %s", rst.Spec.RestoreName, rst.Spec.VolumeName, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return ch
+}
+
+// watchRestoreOnce lists the CStorRestores of given restore and watches them from the
+// listed version, so that updates done while watch is not established are not missed
+func (p *Plugin) watchRestoreOnce(ctx context.Context, rst *v1alpha1.CStorRestore, isCSIVolume bool,
+	ch chan<- v1alpha1.CStorRestoreStatus) error {
+	var w watch.Interface
+
+	statuses, rv, err := p.listRestoreStatuses(rst, isCSIVolume)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case ch <- aggregateRestoreStatus(statuses):
+	case <-ctx.Done():
+		return nil
+	}
+
+	opts := metav1.ListOptions{
+		LabelSelector:   restoreSelector(rst),
+		ResourceVersion: rv,
+	}
+
+	if isCSIVolume {
+		w, err = p.OpenEBSAPIsClient.CstorV1().CStorRestores(rst.Namespace).Watch(ctx, opts)
+	} else {
+		w, err = p.OpenEBSClient.OpenebsV1alpha1().CStorRestores(rst.Namespace).Watch(ctx, opts)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to watch restores")
+	}
+	defer w.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return errors.New("watch channel closed")
+			}
+
+			switch obj := ev.Object.(type) {
+			case *v1alpha1.CStorRestore:
+				statuses[obj.Name] = obj.Status
+				if ev.Type == watch.Deleted {
+					delete(statuses, obj.Name)
+				}
+			case *cstorv1.CStorRestore:
+				statuses[obj.Name] = v1alpha1.CStorRestoreStatus(obj.Status)
+				if ev.Type == watch.Deleted {
+					delete(statuses, obj.Name)
+				}
+			case *metav1.Status:
+				return errors.Errorf("watch failed : %s", obj.Message)
+			default:
+				continue
+			}
+		}
+
+		select {
+		case ch <- aggregateRestoreStatus(statuses):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
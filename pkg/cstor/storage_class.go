@@ -0,0 +1,241 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RestoreStorageClass config key for the storageClass mapping used by remote restore
+	RestoreStorageClass = "restoreStorageClass"
+
+	// restoreStorageClassAnnotation is set on velero restore to override the storageClass
+	// mapping configured in volumesnapshotlocation for that restore
+	restoreStorageClassAnnotation = "openebs.io/restore-storageclass"
+
+	// derivedStorageClassLabel is set on the storageClass created by plugin, from the storageClass
+	// of restored PVC, with source storageClass as value
+	derivedStorageClassLabel = "openebs.io/velero-derived-from"
+
+	// betaStorageClassAnnotation is storageClass annotation of PVC, used by older PVCs
+	betaStorageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+
+	// casConfigStoragePoolClaim is cas config of non CSI volume for its StoragePoolClaim
+	casConfigStoragePoolClaim = "StoragePoolClaim"
+
+	// casConfigReplicaCount is cas config of non CSI volume for its replica count
+	casConfigReplicaCount = "ReplicaCount"
+
+	// anyName is mapping key matching all the names
+	anyName = "*"
+)
+
+// casConfig is configuration of non CSI volume, set using cas config annotation
+// on storageClass or PVC
+type casConfig struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// parseNameMapping parse the mapping of names from given value.
+// Value is either a name, which is used for all the source names, or
+// comma separated list of source:destination.
+func parseNameMapping(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return mapping, nil
+	}
+
+	if !strings.Contains(value, ":") {
+		mapping[anyName] = value
+		return mapping, nil
+	}
+
+	for _, m := range strings.Split(value, ",") {
+		names := strings.Split(strings.TrimSpace(m), ":")
+		if len(names) != 2 || names[0] == "" || names[1] == "" {
+			return nil, errors.Errorf("invalid mapping=%s, expected source:destination", m)
+		}
+		mapping[names[0]] = names[1]
+	}
+	return mapping, nil
+}
+
+// lookupNameMapping return the destination name for the given source name from mapping
+func lookupNameMapping(mapping map[string]string, name string) (string, bool) {
+	if dst, ok := mapping[name]; ok {
+		return dst, true
+	}
+	dst, ok := mapping[anyName]
+	return dst, ok
+}
+
+// getCASConfig return the value of given cas config from the annotations
+func getCASConfig(annotations map[string]string, name string) (string, error) {
+	var configs []casConfig
+
+	if err := yaml.Unmarshal([]byte(annotations[string(v1alpha1.CASConfigKey)]), &configs); err != nil {
+		return "", errors.Wrapf(err, "failed to parse %s", v1alpha1.CASConfigKey)
+	}
+
+	for _, c := range configs {
+		if c.Name == name {
+			return c.Value, nil
+		}
+	}
+	return "", nil
+}
+
+// setCASConfig sets the value of given cas config in the annotations
+func setCASConfig(annotations map[string]string, name, value string) error {
+	var configs []casConfig
+
+	if err := yaml.Unmarshal([]byte(annotations[string(v1alpha1.CASConfigKey)]), &configs); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", v1alpha1.CASConfigKey)
+	}
+
+	found := false
+	for i := range configs {
+		if configs[i].Name == name {
+			configs[i].Value = value
+			found = true
+		}
+	}
+	if !found {
+		configs = append(configs, casConfig{Name: name, Value: value})
+	}
+
+	data, err := yaml.Marshal(configs)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", v1alpha1.CASConfigKey)
+	}
+	annotations[string(v1alpha1.CASConfigKey)] = string(data)
+	return nil
+}
+
+// getDerivedStorageClass return the storageClass created from the given storageClass
+// with updated parameter. StorageClass is created if it doesn't exist.
+func (p *Plugin) getDerivedStorageClass(sc *storagev1.StorageClass, suffix, key, value string) (string, error) {
+	name := sc.Name + "-" + suffix
+
+	_, err := p.K8sClient.StorageV1().StorageClasses().Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		newSc := sc.DeepCopy()
+		newSc.ObjectMeta = metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				derivedStorageClassLabel: sc.Name,
+			},
+		}
+
+		newSc.Parameters = map[string]string{}
+		for k, v := range sc.Parameters {
+			newSc.Parameters[k] = v
+		}
+		newSc.Parameters[key] = value
+
+		p.Log.Infof("Creating storageClass=%s from storageClass=%s with %s=%s", name, sc.Name, key, value)
+		_, err = p.K8sClient.StorageV1().StorageClasses().Create(context.TODO(), newSc, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create storageClass=%s", name)
+	}
+	return name, nil
+}
+
+// getPVCStorageClass return the storageClass of given PVC
+func (p *Plugin) getPVCStorageClass(pvc *v1.PersistentVolumeClaim) (*storagev1.StorageClass, error) {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return nil, errors.Errorf("PVC=%s/%s doesn't have storageClass", pvc.Namespace, pvc.Name)
+	}
+
+	sc, err := p.K8sClient.StorageV1().StorageClasses().Get(context.TODO(), *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get storageClass=%s", *pvc.Spec.StorageClassName)
+	}
+	return sc, nil
+}
+
+// getRestoreStorageClass return the storageClass to be used for restoring the volume having
+// given storageClass. Mapping set on velero restore takes precedence over the plugin config.
+func (p *Plugin) getRestoreStorageClass(sc, snapName string) (string, error) {
+	mapping := p.storageClassMapping
+
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		return "", err
+	}
+
+	if value, ok := r.Annotations[restoreStorageClassAnnotation]; ok {
+		mapping, err = parseNameMapping(value)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to parse annotation=%s of restore=%s",
+				restoreStorageClassAnnotation, r.Name)
+		}
+	}
+
+	newSc, ok := lookupNameMapping(mapping, sc)
+	if !ok {
+		return sc, nil
+	}
+
+	if _, err := p.K8sClient.StorageV1().StorageClasses().Get(context.TODO(), newSc, metav1.GetOptions{}); err != nil {
+		return "", errors.Wrapf(err, "failed to get storageClass=%s for restore=%s", newSc, r.Name)
+	}
+	return newSc, nil
+}
+
+// setPVCStorageClass updates the storageClass of given PVC as per the storageClass mapping of restore
+func (p *Plugin) setPVCStorageClass(pvc *v1.PersistentVolumeClaim, snapName string) error {
+	var sc string
+
+	if pvc.Spec.StorageClassName != nil {
+		sc = *pvc.Spec.StorageClassName
+	} else if pvc.Annotations[betaStorageClassAnnotation] != "" {
+		sc = pvc.Annotations[betaStorageClassAnnotation]
+	}
+
+	newSc, err := p.getRestoreStorageClass(sc, snapName)
+	if err != nil {
+		return err
+	}
+
+	if newSc == sc {
+		return nil
+	}
+
+	p.Log.Infof("Changing storageClass of PVC=%s/%s from %s to %s", pvc.Namespace, pvc.Name, sc, newSc)
+	pvc.Spec.StorageClassName = &newSc
+	delete(pvc.Annotations, betaStorageClassAnnotation)
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// StorageClassSpecAnnotation is set on backed up PVC with the spec of its storageClass,
+	// so that restore can create the equivalent storageClass
+	StorageClassSpecAnnotation = "openebs.io/storageclass-spec"
+
+	// SnapshotIDAnnotation is set on backed up PVC with the snapshot ID of its volume
+	SnapshotIDAnnotation = "openebs.io/snapshot-id"
+)
+
+// SnapshotID return the snapshot ID of given volume for the given velero backup
+func SnapshotID(volumeID, backupName string) string {
+	return generateSnapshotID(volumeID, backupName)
+}
+
+// MarshalStorageClassSpec return the spec of given storageClass, without the metadata
+// specific to the source cluster. Only cas config annotation is retained.
+func MarshalStorageClassSpec(sc *storagev1.StorageClass) (string, error) {
+	spec := sc.DeepCopy()
+	spec.TypeMeta = metav1.TypeMeta{}
+	spec.ObjectMeta = metav1.ObjectMeta{Name: sc.Name}
+	if cfg, ok := sc.Annotations[string(v1alpha1.CASConfigKey)]; ok {
+		spec.Annotations = map[string]string{string(v1alpha1.CASConfigKey): cfg}
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode storageClass=%s", sc.Name)
+	}
+	return string(data), nil
+}
+
+// setPVCStorageClassFromSpec ensures that the storageClass of given PVC is equivalent to
+// the storageClass spec recorded at backup. If storageClass doesn't exist then it is created
+// from the spec, and if its provisioner, parameters or cas config differ from the spec then
+// PVC uses the storageClass created from the spec.
+func (p *Plugin) setPVCStorageClassFromSpec(pvc *v1.PersistentVolumeClaim, value string) error {
+	var spec storagev1.StorageClass
+
+	if value == "" || pvc.Spec.StorageClassName == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &spec); err != nil {
+		return errors.Wrapf(err, "failed to parse annotation=%s of PVC=%s/%s", StorageClassSpecAnnotation, pvc.Namespace, pvc.Name)
+	}
+
+	if spec.Name != *pvc.Spec.StorageClassName {
+		// storageClass is mapped by restore
+		return nil
+	}
+
+	sc, err := p.K8sClient.StorageV1().StorageClasses().Get(context.TODO(), spec.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		p.Log.Infof("Creating storageClass=%s from the spec in backup", spec.Name)
+		_, err = p.K8sClient.StorageV1().StorageClasses().Create(context.TODO(), &spec, metav1.CreateOptions{})
+		if err != nil && !k8serrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to create storageClass=%s", spec.Name)
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get storageClass=%s", spec.Name)
+	}
+
+	if isEquivalentStorageClass(sc, &spec) {
+		return nil
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(value))
+	name := fmt.Sprintf("%s-%x", spec.Name, h.Sum32())
+
+	_, err = p.K8sClient.StorageV1().StorageClasses().Get(context.TODO(), name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		newSc := spec.DeepCopy()
+		newSc.Name = name
+		newSc.Labels = map[string]string{
+			derivedStorageClassLabel: spec.Name,
+		}
+
+		p.Log.Infof("StorageClass=%s is changed since backup, creating storageClass=%s from the spec in backup", spec.Name, name)
+		_, err = p.K8sClient.StorageV1().StorageClasses().Create(context.TODO(), newSc, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to create storageClass=%s", name)
+	}
+
+	p.Log.Infof("Changing storageClass of PVC=%s/%s from %s to %s", pvc.Namespace, pvc.Name, spec.Name, name)
+	pvc.Spec.StorageClassName = &name
+	return nil
+}
+
+// isEquivalentStorageClass returns true if given storageClass provisions the volume
+// in same way as the given spec
+func isEquivalentStorageClass(sc, spec *storagev1.StorageClass) bool {
+	if sc.Provisioner != spec.Provisioner ||
+		sc.Annotations[string(v1alpha1.CASConfigKey)] != spec.Annotations[string(v1alpha1.CASConfigKey)] {
+		return false
+	}
+	if len(sc.Parameters) == 0 && len(spec.Parameters) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(sc.Parameters, spec.Parameters)
+}
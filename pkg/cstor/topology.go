@@ -0,0 +1,220 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"sort"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RestoreZoneMapping config key for the mapping of source zone to the zone used by remote restore
+	RestoreZoneMapping = "restoreZoneMapping"
+
+	// ZonePoolCluster config key for the pool cluster, StoragePoolClaim or CStorPoolCluster,
+	// having the pools in each zone of the cluster
+	ZonePoolCluster = "zonePoolCluster"
+
+	// restoreZoneMappingAnnotation is set on velero restore to override the zone
+	// mapping configured in volumesnapshotlocation for that restore
+	restoreZoneMappingAnnotation = "openebs.io/restore-zone-mapping"
+
+	// hostnameLabel is set on cStor pools (non CSI) with the node name of the pool
+	hostnameLabel = "kubernetes.io/hostname"
+)
+
+// zoneLabels and regionLabels are the node labels for zone and region, in the order of preference
+var (
+	zoneLabels   = []string{v1.LabelZoneFailureDomainStable, v1.LabelZoneFailureDomain}
+	regionLabels = []string{v1.LabelZoneRegionStable, v1.LabelZoneRegion}
+)
+
+// volumeTopology describes the zones of the volume at the time of backup
+type volumeTopology struct {
+	// Zone is availability zone of the volume, passed by velero
+	Zone string `json:"zone,omitempty"`
+
+	// Region is region of the nodes having the replicas of the volume
+	Region string `json:"region,omitempty"`
+
+	// ReplicaZones are the zones of the nodes having the replicas of the volume
+	ReplicaZones []string `json:"replicaZones,omitempty"`
+}
+
+// sourceZone return the zone from which the volume is backed up, it return empty
+// string if zone is not known
+func (t *volumeTopology) sourceZone() string {
+	if t == nil {
+		return ""
+	}
+	if t.Zone != "" {
+		return t.Zone
+	}
+	if len(t.ReplicaZones) == 1 {
+		return t.ReplicaZones[0]
+	}
+	return ""
+}
+
+// getNodeLabel return the value of first of the given labels set on the node
+func getNodeLabel(node *v1.Node, keys []string) string {
+	for _, k := range keys {
+		if val := node.Labels[k]; val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// getVolumeTopology return the topology of the given volume, from the zone passed by velero
+// and the zones of the nodes having the pools of its replicas
+func (p *Plugin) getVolumeTopology(vol *Volume) (*volumeTopology, error) {
+	t := &volumeTopology{Zone: vol.zone}
+
+	nodes, err := p.getReplicaNodes(vol)
+	if err != nil {
+		return t, err
+	}
+
+	zones := map[string]bool{}
+	for _, name := range nodes {
+		node, err := p.K8sClient.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return t, errors.Wrapf(err, "failed to get node=%s", name)
+		}
+		if zone := getNodeLabel(node, zoneLabels); zone != "" {
+			zones[zone] = true
+		}
+		if t.Region == "" {
+			t.Region = getNodeLabel(node, regionLabels)
+		}
+	}
+
+	for zone := range zones {
+		t.ReplicaZones = append(t.ReplicaZones, zone)
+	}
+	sort.Strings(t.ReplicaZones)
+	return t, nil
+}
+
+// getReplicaNodes return the nodes of the pools having the replica of given volume
+func (p *Plugin) getReplicaNodes(vol *Volume) ([]string, error) {
+	pools, err := p.getVolumePools(vol)
+	if err != nil || len(pools) == 0 {
+		return nil, err
+	}
+
+	isReplicaPool := map[string]bool{}
+	for _, uid := range pools {
+		isReplicaPool[uid] = true
+	}
+
+	var nodes []string
+	if vol.isCSIVolume {
+		cspis, err := p.OpenEBSAPIsClient.CstorV1().CStorPoolInstances(p.namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list cStorPoolInstances")
+		}
+		for _, cspi := range cspis.Items {
+			if isReplicaPool[string(cspi.UID)] && cspi.Spec.HostName != "" {
+				nodes = append(nodes, cspi.Spec.HostName)
+			}
+		}
+		return nodes, nil
+	}
+
+	csps, err := p.OpenEBSClient.OpenebsV1alpha1().CStorPools().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list cStorPools")
+	}
+	for _, csp := range csps.Items {
+		if isReplicaPool[string(csp.UID)] && csp.Labels[hostnameLabel] != "" {
+			nodes = append(nodes, csp.Labels[hostnameLabel])
+		}
+	}
+	return nodes, nil
+}
+
+// getZoneMapping return the mapping of zones used by the restore of given snapshot.
+// Mapping set on velero restore takes precedence over the plugin config.
+func (p *Plugin) getZoneMapping(snapName string) (map[string]string, error) {
+	r, err := velero.GetRestore(snapName)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := r.Annotations[restoreZoneMappingAnnotation]
+	if !ok {
+		return p.zoneMapping, nil
+	}
+
+	mapping, err := parseNameMapping(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse annotation=%s of restore=%s",
+			restoreZoneMappingAnnotation, r.Name)
+	}
+	return mapping, nil
+}
+
+// setPVCZone updates the given PVC to place the replicas of the volume on the pool cluster
+// of the zone, mapped by restore from the zone of backup. Zone of backup is taken from its
+// manifest, or the zone passed by velero. It is no-op if zonePoolCluster is not configured,
+// or if pool cluster is changed by restorePoolCluster mapping.
+func (p *Plugin) setPVCZone(pvc *v1.PersistentVolumeClaim, m *backupManifest, volumeAZ, snapName string) error {
+	if len(p.zonePoolCluster) == 0 {
+		return nil
+	}
+
+	if mapping, err := p.getPoolClusterMapping(snapName); err != nil || len(mapping) != 0 {
+		return err
+	}
+
+	srcZone := volumeAZ
+	if m != nil && m.Topology.sourceZone() != "" {
+		srcZone = m.Topology.sourceZone()
+	}
+	if srcZone == "" {
+		p.Log.Warnf("Zone of PVC=%s/%s is not known for backup=%s, replicas are placed as per storageClass",
+			pvc.Namespace, pvc.Name, snapName)
+		return nil
+	}
+
+	mapping, err := p.getZoneMapping(snapName)
+	if err != nil {
+		return err
+	}
+
+	zone, ok := lookupNameMapping(mapping, srcZone)
+	if !ok {
+		zone = srcZone
+	}
+
+	poolCluster, ok := lookupNameMapping(p.zonePoolCluster, zone)
+	if !ok {
+		p.Log.Warnf("Pool cluster of zone=%s is not configured in %s, replicas of PVC=%s/%s are placed as per storageClass",
+			zone, ZonePoolCluster, pvc.Namespace, pvc.Name)
+		return nil
+	}
+
+	p.Log.Infof("Placing replicas of PVC=%s/%s in zone=%s, backed up from zone=%s", pvc.Namespace, pvc.Name, zone, srcZone)
+	return p.changePVCPoolCluster(pvc, poolCluster)
+}
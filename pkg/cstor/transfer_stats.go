@@ -0,0 +1,94 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// transferStatsAnnotation is set on CStorCompletedBackup of the schedule with the transfer
+// statistics of the last completed backup of the volume
+const transferStatsAnnotation = "openebs.io/last-backup-transfer"
+
+// transferStats describes the upload of the snapshot of a backup
+type transferStats struct {
+	// Bytes is number of bytes of snapshot data uploaded
+	Bytes int64 `json:"bytes"`
+
+	// Duration is time taken to upload the snapshot, including the retries
+	Duration metav1.Duration `json:"duration"`
+
+	// Throughput is average bytes uploaded per second
+	Throughput int64 `json:"throughput"`
+
+	// ReplicaRetries is number of times the backup was retried on other replica
+	ReplicaRetries int `json:"replicaRetries"`
+}
+
+// newTransferStats return the statistics of the upload of given bytes in given duration
+func newTransferStats(bytes int64, duration time.Duration, retries int) *transferStats {
+	s := &transferStats{
+		Bytes:          bytes,
+		Duration:       metav1.Duration{Duration: duration},
+		ReplicaRetries: retries,
+	}
+	if duration > 0 {
+		s.Throughput = int64(float64(bytes) / duration.Seconds())
+	}
+	return s
+}
+
+// recordTransferStats sets the transfer statistics of the completed backup of given volume on
+// CStorCompletedBackup of its schedule. Failure in recording the statistics doesn't fail the backup.
+func (p *Plugin) recordTransferStats(vol *Volume) {
+	if vol.transfer == nil {
+		return
+	}
+
+	data, err := json.Marshal(vol.transfer)
+	if err == nil {
+		data, err = json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{
+					transferStatsAnnotation: string(data),
+				},
+			},
+		})
+	}
+	if err != nil {
+		p.Log.Warnf("Failed to encode transfer statistics of volume=%s : %s", vol.volname, err)
+		return
+	}
+
+	name := p.getScheduleName(vol.backupName) + "-" + vol.volname
+	if vol.isCSIVolume {
+		_, err = p.OpenEBSAPIsClient.CstorV1().CStorCompletedBackups(vol.backupNamespace).
+			Patch(context.TODO(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	} else {
+		_, err = p.OpenEBSClient.OpenebsV1alpha1().CStorCompletedBackups(vol.backupNamespace).
+			Patch(context.TODO(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	}
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Warnf("Failed to record transfer statistics on completed-backup=%s/%s : %s", vol.backupNamespace, name, err)
+	}
+}
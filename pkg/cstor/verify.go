@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// VerifyNone disables the verification of uploaded backup
+	VerifyNone = "none"
+
+	// VerifySize verifies that size of the uploaded object matches with the data received from cStor
+	VerifySize = "size"
+
+	// VerifyChecksum downloads the uploaded object and verifies its size and checksum
+	// with the data received from cStor
+	VerifyChecksum = "checksum"
+
+	// VerificationPassed is the result of successful verification
+	VerificationPassed = "Verified"
+)
+
+// backupVerification describes the verification of uploaded backup
+type backupVerification struct {
+	// Mode is verification mode, size or checksum
+	Mode string `json:"mode"`
+
+	// Result is verification result
+	Result string `json:"result"`
+
+	// Time is time at which backup is verified
+	Time metav1.Time `json:"time"`
+}
+
+// verifyBackup verifies the uploaded snapshot data of the given volume, as per p.verifyMode.
+// If verification is disabled then it will return nil verification.
+func (p *Plugin) verifyBackup(vol *Volume, filename string) (*backupVerification, error) {
+	if p.verifyMode == VerifyNone {
+		return nil, nil
+	}
+
+	expectedSize, _ := vol.cl.Progress()
+	expectedChecksum := vol.cl.Checksum()
+
+	p.Log.Infof("Verifying backup=%s of volume=%s with mode=%s", vol.backupName, vol.volname, p.verifyMode)
+
+	size, err := vol.cl.ObjectSize(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get size of file=%s", filename)
+	}
+	if size != expectedSize {
+		return nil, errors.Errorf("size=%d of uploaded file=%s doesn't match with transferred size=%d",
+			size, filename, expectedSize)
+	}
+
+	if p.verifyMode == VerifyChecksum {
+		checksum, err := vol.cl.ObjectChecksum(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compute checksum of file=%s", filename)
+		}
+		if checksum != expectedChecksum {
+			return nil, errors.Errorf("checksum=%s of uploaded file=%s doesn't match with transferred data checksum=%s",
+				checksum, filename, expectedChecksum)
+		}
+	}
+
+	p.Log.Infof("Backup=%s of volume=%s is verified", vol.backupName, vol.volname)
+	return &backupVerification{
+		Mode:   p.verifyMode,
+		Result: VerificationPassed,
+		Time:   metav1.Now(),
+	}, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// VolumeHealthPolicy config key for the action to take if volume is not healthy, or doesn't
+	// have quorum, before taking the snapshot
+	VolumeHealthPolicy = "volumeHealthPolicy"
+
+	// HealthPolicyFail fails the backup of unhealthy volume
+	HealthPolicyFail = "fail"
+
+	// HealthPolicyWarn backs up the unhealthy volume, and marks the backup as degraded
+	HealthPolicyWarn = "warn"
+
+	// degradedBackupAnnotation is set on CStorBackup of the volume backed up while unhealthy,
+	// with the health of volume as value
+	degradedBackupAnnotation = "openebs.io/degraded-backup"
+
+	// cvHealthy is phase of healthy CStorVolume, same for cstor v1 and v1alpha1
+	cvHealthy = "Healthy"
+
+	// replicaModeHealthy is mode of the healthy replica in status of CStorVolume
+	replicaModeHealthy = "Healthy"
+
+	// replicaQuorum is quorum of replica, in status of CStorVolume, having the written data
+	replicaQuorum = "1"
+)
+
+// initVolumeHealthPolicy parses the volume health policy config
+func (p *Plugin) initVolumeHealthPolicy(config map[string]string) error {
+	p.volumeHealthPolicy = HealthPolicyFail
+	if val, ok := config[VolumeHealthPolicy]; ok {
+		if val != HealthPolicyFail && val != HealthPolicyWarn {
+			return errors.Errorf("invalid %s=%s, expected %s or %s",
+				VolumeHealthPolicy, val, HealthPolicyFail, HealthPolicyWarn)
+		}
+		p.volumeHealthPolicy = val
+	}
+	return nil
+}
+
+// checkVolumeHealth ensures that the CStorVolume of given volume is healthy and its replicas
+// have quorum, so that the snapshot has consistent data. If the volume is unhealthy then
+// backup fails, or with warn policy, the volume is marked as degraded and backup continues.
+func (p *Plugin) checkVolumeHealth(vol *Volume) error {
+	vol.degraded = ""
+
+	cv, err := p.getCStorVolumeDetails(vol)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check health of volume=%s", vol.volname)
+	}
+
+	if cv.phase == cvHealthy && cv.hasQuorum() {
+		return nil
+	}
+
+	health := fmt.Sprintf("phase=%s, %d of %d replicas are healthy with quorum, consistency factor is %d",
+		cv.phase, cv.quorumReplicas, cv.replicationFactor, cv.getConsistencyFactor())
+
+	if p.volumeHealthPolicy != HealthPolicyWarn {
+		return errors.Errorf("volume=%s is not healthy, %s. Set %s=%s to backup unhealthy volumes",
+			vol.volname, health, VolumeHealthPolicy, HealthPolicyWarn)
+	}
+
+	p.volumeLog(vol, phaseSnapshot).Warnf("Volume is not healthy, %s. Backup is marked as degraded", health)
+	vol.degraded = health
+	return nil
+}
+
+// getConsistencyFactor return the minimum number of replicas required for quorum
+func (cv *cstorVolumeDetails) getConsistencyFactor() int {
+	if cv.consistencyFactor > 0 {
+		return cv.consistencyFactor
+	}
+	return cv.replicationFactor/2 + 1
+}
+
+// hasQuorum returns true if the replicas of volume, having the written data, are
+// enough for quorum. Quorum is not checked if target hasn't reported the replicas.
+func (cv *cstorVolumeDetails) hasQuorum() bool {
+	if !cv.replicasReported {
+		return true
+	}
+	return cv.quorumReplicas >= cv.getConsistencyFactor()
+}
+
+// annotateDegradedBackup sets the health of the volume on the given CStorBackup, if
+// the volume is backed up while unhealthy. Failure in setting the annotation doesn't fail the backup.
+func (p *Plugin) annotateDegradedBackup(bkp *v1alpha1.CStorBackup, vol *Volume) {
+	if vol.degraded == "" {
+		return
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				degradedBackupAnnotation: vol.degraded,
+			},
+		},
+	})
+	if err == nil {
+		err = p.patchBackup(bkp, vol.isCSIVolume, patch)
+	}
+	if err != nil {
+		p.Log.Warnf("Failed to mark backup=%s/%s as degraded : %s", bkp.Namespace, bkp.Name, err)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// volumeLeasePrefix is prefix for the name of lease of a volume
+	volumeLeasePrefix = "velero-volume-"
+
+	// volumeLeaseLabel is set on lease of a volume with volume name as value
+	volumeLeaseLabel = "openebs.io/velero-volume"
+
+	// volumeLeaseDuration is time for which volume lease is valid, lease is renewed while
+	// the data of volume is transferred, so that lease held by the plugin instance which
+	// is terminated is released after this duration
+	volumeLeaseDuration = time.Minute
+
+	// operations performed on the volume while holding its lease
+	volumeOpBackup  = "backup"
+	volumeOpRestore = "restore"
+	volumeOpDelete  = "delete"
+)
+
+// volumeLease is the lease held by the plugin instance on a volume while transferring its data.
+// Backup and restore resources of the volume have the address of the plugin instance, so
+// the lease ensures that velero replicas don't perform the same operation on the volume.
+type volumeLease struct {
+	name string
+
+	// holder is holder identity of the lease
+	holder string
+
+	// stop is closed to stop the renewal of lease
+	stop chan struct{}
+}
+
+// instanceID return the identity of the plugin instance, velero pod name and plugin process ID
+func instanceID() string {
+	hostname, _ := os.Hostname()
+	return hostname + "/" + strconv.Itoa(os.Getpid())
+}
+
+// volumeLeaseHolder return the holder identity of the lease for given operation
+func volumeLeaseHolder(op, name string) string {
+	return instanceID() + "/" + op + "/" + name
+}
+
+// acquireVolumeLease waits for the lease of given volume for the operation, backup or restore
+// of given name. If the lease is held by other plugin instance for the same operation, i.e. other
+// velero replica is performing the same backup or restore, then error is returned. If lease can't
+// be acquired due to an API error then operation is performed without the lease.
+func (p *Plugin) acquireVolumeLease(ctx context.Context, volname, op, name string) (*volumeLease, error) {
+	leaseName := volumeLeasePrefix + volname
+	holder := volumeLeaseHolder(op, name)
+	labels := map[string]string{volumeLeaseLabel: volname}
+
+	for logged := false; ; {
+		ok, current, err := p.tryAcquireLease(leaseName, labels, holder, volumeLeaseDuration)
+		if err != nil {
+			p.Log.Warnf("Failed to acquire lease=%s, %s=%s of volume=%s may collide with other velero instance : %s",
+				leaseName, op, name, volname, err)
+			return nil, nil
+		}
+
+		if ok {
+			l := &volumeLease{name: leaseName, holder: holder, stop: make(chan struct{})}
+			go p.renewLease(leaseName, holder, volumeLeaseDuration, l.stop)
+			return l, nil
+		}
+
+		if strings.HasSuffix(current, "/"+op+"/"+name) {
+			return nil, errors.Errorf("%s=%s of volume=%s is being performed by other velero instance %s",
+				op, name, volname, strings.TrimSuffix(current, "/"+op+"/"+name))
+		}
+
+		if !logged && current != "" {
+			p.Log.Infof("Volume=%s is locked by %s, waiting for it to complete %s=%s", volname, current, op, name)
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Errorf("failed to acquire lease of volume=%s for %s=%s : %s", volname, op, name, ctx.Err())
+		case <-time.After(p.backupStatusInterval):
+		}
+	}
+}
+
+// acquireVolumeLeases acquires the lease of volume for all the given backup tasks. Leases are
+// acquired in the order of volume name so that concurrent backups don't deadlock. If any of the
+// lease can't be acquired then acquired leases are released.
+func (p *Plugin) acquireVolumeLeases(ctx context.Context, tasks []*backupTask) error {
+	sorted := append([]*backupTask(nil), tasks...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].vol.volname < sorted[j].vol.volname })
+
+	for _, t := range sorted {
+		l, err := p.acquireVolumeLease(ctx, t.vol.volname, volumeOpBackup, t.vol.backupName)
+		if err != nil {
+			for _, t := range tasks {
+				p.releaseVolumeLease(t.lease)
+				t.lease = nil
+			}
+			return err
+		}
+		t.lease = l
+	}
+	return nil
+}
+
+// releaseVolumeLease releases the given lease if it is still held by the plugin instance,
+// it is no-op for nil lease
+func (p *Plugin) releaseVolumeLease(l *volumeLease) {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+
+	if err := p.releaseLease(l.name, l.holder); err != nil {
+		p.Log.Warnf("Failed to release lease=%s, it will be released after %v : %s", l.name, volumeLeaseDuration, err)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+
+	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
+	"github.com/openebs/api/v2/pkg/apis/types"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// VolumePolicySpecAnnotation is set on backed up PVC of cStor CSI volume with the policy
+	// and replica count of its CStorVolumeConfig, so that restored volume has the same policy
+	VolumePolicySpecAnnotation = "openebs.io/volume-policy-spec"
+
+	// csiVolumePolicyParameter is storageClass parameter for CStorVolumePolicy of cStor CSI volume
+	csiVolumePolicyParameter = "cstorVolumePolicy"
+
+	// restoredVolumePolicyLabel is set on CStorVolumePolicy created by restore, with the name
+	// of policy in backup as value
+	restoredVolumePolicyLabel = "openebs.io/restored-volume-policy"
+)
+
+// volumePolicySpec is the policy of cStor CSI volume recorded at backup
+type volumePolicySpec struct {
+	// Name of the CStorVolumePolicy of volume, it is empty if policy is not set by storageClass
+	Name string `json:"name,omitempty"`
+
+	// ReplicaCount is the replica count of volume, including the replicas scaled after provisioning
+	ReplicaCount int `json:"replicaCount,omitempty"`
+
+	// Spec is the policy of volume, without the pools of source cluster
+	Spec cstorv1.CStorVolumePolicySpec `json:"spec"`
+}
+
+// getVolumePolicySpec return the policy spec of given CSI volume from its CStorVolumeConfig,
+// it return empty string if CStorVolumeConfig doesn't exist
+func (p *Plugin) getVolumePolicySpec(vol *Volume) (string, error) {
+	cvc, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumeConfigs(p.namespace).Get(context.TODO(), vol.volname, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch cstorVolumeConfig=%s", vol.volname)
+	}
+
+	spec := volumePolicySpec{
+		Name:         cvc.Annotations[types.VolumePolicyKey],
+		ReplicaCount: cvc.Spec.Provision.ReplicaCount,
+		Spec:         *cvc.Spec.Policy.DeepCopy(),
+	}
+
+	// replica pools are updated on scaling the replicas
+	if n := len(spec.Spec.ReplicaPoolInfo); n > 0 {
+		spec.ReplicaCount = n
+	}
+	spec.Spec.ReplicaPoolInfo = nil
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode policy of cstorVolumeConfig=%s", vol.volname)
+	}
+	return string(data), nil
+}
+
+// setPVCVolumePolicy updates the given PVC of CSI volume to provision the volume with the
+// policy and replica count recorded at backup. CStorVolumePolicy is created from the recorded
+// spec, and PVC uses the storageClass, created from PVC's storageClass, having the policy
+// and replica count. Policy of the storageClass, if set to other policy, is not overridden.
+func (p *Plugin) setPVCVolumePolicy(pvc *v1.PersistentVolumeClaim, value string) error {
+	var spec volumePolicySpec
+
+	if value == "" {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &spec); err != nil {
+		return errors.Wrapf(err, "failed to parse annotation=%s of PVC=%s/%s", VolumePolicySpecAnnotation, pvc.Namespace, pvc.Name)
+	}
+
+	sc, err := p.getPVCStorageClass(pvc)
+	if err != nil {
+		return errors.Wrapf(err, "can't set volume policy")
+	}
+	if sc.Provisioner != openebsCSIName {
+		return nil
+	}
+
+	current := sc.Parameters[csiVolumePolicyParameter]
+	switch {
+	case current != "" && current != spec.Name:
+		p.Log.Infof("StorageClass=%s of PVC=%s/%s has volume policy=%s, skipping policy=%s of backup",
+			sc.Name, pvc.Namespace, pvc.Name, current, spec.Name)
+	case spec.Name != "" || !reflect.DeepEqual(spec.Spec, cstorv1.CStorVolumePolicySpec{}):
+		name, err := p.ensureVolumePolicy(&spec)
+		if err != nil {
+			return err
+		}
+		if name != current {
+			derived, err := p.getDerivedStorageClass(sc, "policy-"+name, csiVolumePolicyParameter, name)
+			if err != nil {
+				return err
+			}
+			p.Log.Infof("Setting volume policy=%s of PVC=%s/%s", name, pvc.Namespace, pvc.Name)
+			pvc.Spec.StorageClassName = &derived
+
+			if sc, err = p.getPVCStorageClass(pvc); err != nil {
+				return errors.Wrapf(err, "can't set replica count")
+			}
+		}
+	}
+
+	count := strconv.Itoa(spec.ReplicaCount)
+	if spec.ReplicaCount == 0 || sc.Parameters[csiReplicaCountParameter] == count {
+		return nil
+	}
+
+	name, err := p.getDerivedStorageClass(sc, "replica-"+count, csiReplicaCountParameter, count)
+	if err != nil {
+		return err
+	}
+	p.Log.Infof("Setting replica count of PVC=%s/%s to %s, as in backup", pvc.Namespace, pvc.Name, count)
+	pvc.Spec.StorageClassName = &name
+	return nil
+}
+
+// ensureVolumePolicy return the name of CStorVolumePolicy, in openebs namespace, having the given
+// spec. Policy of the recorded name is created if it doesn't exist, and if it exists with different
+// spec then policy is created with the name derived from the spec. Policy which was not named at
+// backup, i.e. set on the CStorVolumeConfig only, is created with the name derived from the spec.
+func (p *Plugin) ensureVolumePolicy(spec *volumePolicySpec) (string, error) {
+	data, err := json.Marshal(spec.Spec)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode volume policy=%s", spec.Name)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(data)
+	hash := fmt.Sprintf("%x", h.Sum32())
+
+	name := spec.Name
+	if name == "" {
+		name = "velero-" + hash
+	}
+
+	for {
+		policy, err := p.OpenEBSAPIsClient.CstorV1().CStorVolumePolicies(p.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get volume policy=%s", name)
+		}
+
+		existing := policy.Spec.DeepCopy()
+		existing.ReplicaPoolInfo = nil
+		if reflect.DeepEqual(*existing, spec.Spec) {
+			return name, nil
+		}
+
+		if spec.Name == "" || name != spec.Name {
+			return "", errors.Errorf("volume policy=%s exists with different spec", name)
+		}
+		p.Log.Infof("Volume policy=%s is changed since backup, using volume policy=%s-%s", name, name, hash)
+		name = spec.Name + "-" + hash
+	}
+
+	policy := &cstorv1.CStorVolumePolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: p.namespace,
+			Labels: map[string]string{
+				restoredVolumePolicyLabel: spec.Name,
+			},
+		},
+		Spec: spec.Spec,
+	}
+
+	p.Log.Infof("Creating volume policy=%s from the spec in backup", name)
+	_, err = p.OpenEBSAPIsClient.CstorV1().CStorVolumePolicies(p.namespace).Create(context.TODO(), policy, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return "", errors.Wrapf(err, "failed to create volume policy=%s", name)
+	}
+	return name, nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// VolumeStatusAnnotations config key to set the annotations of last backup and restore on PVC and PV
+	VolumeStatusAnnotations = "volumeStatusAnnotations"
+
+	// annotations of the last completed backup of the volume
+	lastBackupAnnotation           = "openebs.io/last-backup"
+	lastBackupTimeAnnotation       = "openebs.io/last-backup-time"
+	lastBackupSnapshotIDAnnotation = "openebs.io/last-backup-snapshot-id"
+
+	// annotations of the last completed restore to the volume
+	lastRestoreAnnotation           = "openebs.io/last-restore"
+	lastRestoreBackupAnnotation     = "openebs.io/last-restore-backup"
+	lastRestoreTimeAnnotation       = "openebs.io/last-restore-time"
+	lastRestoreSnapshotIDAnnotation = "openebs.io/last-restore-snapshot-id"
+)
+
+// volumeStatusAnnotations are the annotations of last backup and restore set on PVC and PV
+var volumeStatusAnnotations = []string{
+	lastBackupAnnotation, lastBackupTimeAnnotation, lastBackupSnapshotIDAnnotation,
+	lastRestoreAnnotation, lastRestoreBackupAnnotation, lastRestoreTimeAnnotation, lastRestoreSnapshotIDAnnotation,
+}
+
+// RemoveVolumeStatusAnnotations removes the annotations of last backup and restore from the given
+// annotations of PVC, since these describe the source volume and not the restored volume
+func RemoveVolumeStatusAnnotations(annotations map[string]string) {
+	for _, key := range volumeStatusAnnotations {
+		delete(annotations, key)
+	}
+}
+
+// annotateBackupStatus sets the annotations of the completed backup on PVC and PV of given volume.
+// Failure in setting the annotations doesn't fail the backup.
+func (p *Plugin) annotateBackupStatus(vol *Volume) {
+	if !p.volumeStatusAnnotations {
+		return
+	}
+
+	p.annotateVolume(vol.volname, vol.namespace, vol.pvcName, map[string]string{
+		lastBackupAnnotation:           vol.backupName,
+		lastBackupTimeAnnotation:       time.Now().UTC().Format(time.RFC3339),
+		lastBackupSnapshotIDAnnotation: generateSnapshotID(vol.volname, vol.backupName),
+	})
+}
+
+// annotateRestoreStatus sets the annotations of the completed restore on PVC and PV of given
+// restored volume. PV and PVC of local restore are created by velero after the restore of volume,
+// so these are not annotated. Failure in setting the annotations doesn't fail the restore.
+func (p *Plugin) annotateRestoreStatus(vol *Volume, srcVolume, snapName string) {
+	if !p.volumeStatusAnnotations || vol.local {
+		return
+	}
+
+	restoreName := ""
+	if r, err := velero.GetRestore(snapName); err == nil {
+		restoreName = r.Name
+	} else {
+		p.Log.Warnf("Failed to get restore of backup=%s : %s", snapName, err)
+	}
+
+	pv, err := p.getPV(vol.volname)
+	if err != nil {
+		p.Log.Warnf("Failed to set restore status on volume=%s : %s", vol.volname, err)
+		return
+	}
+
+	var ns, name string
+	if pv.Spec.ClaimRef != nil {
+		ns, name = pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name
+	}
+
+	p.annotateVolume(vol.volname, ns, name, map[string]string{
+		lastRestoreAnnotation:           restoreName,
+		lastRestoreBackupAnnotation:     snapName,
+		lastRestoreTimeAnnotation:       time.Now().UTC().Format(time.RFC3339),
+		lastRestoreSnapshotIDAnnotation: generateSnapshotID(srcVolume, snapName),
+	})
+}
+
+// annotateVolume sets the given annotations on PV, and on PVC if its name is set. PV or PVC
+// which doesn't exist, e.g. claim of a terminating namespace, is skipped.
+func (p *Plugin) annotateVolume(volname, ns, pvcName string, annotations map[string]string) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		p.Log.Warnf("Failed to encode status annotations of volume=%s : %s", volname, err)
+		return
+	}
+
+	_, err = p.K8sClient.CoreV1().PersistentVolumes().
+		Patch(context.TODO(), volname, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Warnf("Failed to set status annotations on PV=%s : %s", volname, err)
+	}
+
+	if pvcName == "" {
+		return
+	}
+
+	_, err = p.K8sClient.CoreV1().PersistentVolumeClaims(ns).
+		Patch(context.TODO(), pvcName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Warnf("Failed to set status annotations on PVC=%s/%s : %s", ns, pvcName, err)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package itemaction
+
+import (
+	"context"
+
+	"github.com/openebs/velero-plugin/pkg/cstor"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// BackupItemAction records the snapshot ID and the storageClass spec on the backed up
+// PVCs of cStor volumes, and adds their storageClass to the backup
+type BackupItemAction struct {
+	Log logrus.FieldLogger
+
+	k8sClient kubernetes.Interface
+}
+
+var _ velero.BackupItemAction = (*BackupItemAction)(nil)
+
+// AppliesTo returns the resources handled by the action
+func (a *BackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumeclaims"},
+	}, nil
+}
+
+// Execute sets the snapshot ID and the storageClass spec annotations on given PVC, if it is
+// bound to cStor volume, so that restore can create the equivalent volume even if storageClass
+// is changed or missing in the target cluster. Data source and the last backup and restore
+// annotations of the PVC are removed.
+func (a *BackupItemAction) Execute(item runtime.Unstructured,
+	backup *velerov1api.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	var pvc v1.PersistentVolumeClaim
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), &pvc); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to convert PVC")
+	}
+
+	if pvc.Spec.VolumeName == "" {
+		return item, nil, nil
+	}
+
+	if err := a.initClients(); err != nil {
+		return nil, nil, err
+	}
+
+	pv, err := a.k8sClient.CoreV1().PersistentVolumes().Get(context.TODO(), pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to get PV=%s of PVC=%s/%s", pvc.Spec.VolumeName, pvc.Namespace, pvc.Name)
+	}
+
+	if pv.Labels[casTypeLabel] != "cstor" && (pv.Spec.CSI == nil || pv.Spec.CSI.Driver != cstorCSIDriver) {
+		return item, nil, nil
+	}
+
+	annotations := pvc.Annotations
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	cstor.RemoveVolumeStatusAnnotations(annotations)
+
+	if backup.Spec.SnapshotVolumes == nil || *backup.Spec.SnapshotVolumes {
+		annotations[cstor.SnapshotIDAnnotation] = cstor.SnapshotID(pv.Name, backup.Name)
+	}
+
+	var additional []velero.ResourceIdentifier
+	if scName := pv.Spec.StorageClassName; scName != "" {
+		sc, err := a.k8sClient.StorageV1().StorageClasses().Get(context.TODO(), scName, metav1.GetOptions{})
+		switch {
+		case k8serrors.IsNotFound(err):
+			a.Log.Warnf("StorageClass=%s of PVC=%s/%s doesn't exist, skipping it", scName, pvc.Namespace, pvc.Name)
+		case err != nil:
+			return nil, nil, errors.Wrapf(err, "failed to get storageClass=%s", scName)
+		default:
+			spec, err := cstor.MarshalStorageClassSpec(sc)
+			if err != nil {
+				return nil, nil, err
+			}
+			annotations[cstor.StorageClassSpecAnnotation] = spec
+			additional = append(additional, velero.ResourceIdentifier{
+				GroupResource: schema.GroupResource{Group: "storage.k8s.io", Resource: "storageclasses"},
+				Name:          scName,
+			})
+		}
+	}
+
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	obj.SetAnnotations(annotations)
+
+	// volume provisioned from snapshot is restored from its backup data, as independent volume
+	if pvc.Spec.DataSource != nil {
+		a.Log.Infof("Removing dataSource=%s/%s from PVC=%s/%s", pvc.Spec.DataSource.Kind, pvc.Spec.DataSource.Name, pvc.Namespace, pvc.Name)
+		unstructured.RemoveNestedField(obj.Object, "spec", "dataSource")
+	}
+	return obj, additional, nil
+}
+
+// initClients creates the kubernetes client, if not created yet
+func (a *BackupItemAction) initClients() error {
+	if a.k8sClient != nil {
+		return nil
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get cluster config")
+	}
+
+	if a.k8sClient, err = kubernetes.NewForConfig(conf); err != nil {
+		return errors.Wrapf(err, "failed to create k8s client")
+	}
+	return nil
+}
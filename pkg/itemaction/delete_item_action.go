@@ -0,0 +1,163 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package itemaction
+
+import (
+	"context"
+
+	openebsapis "github.com/openebs/api/v2/pkg/client/clientset/versioned"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	openebs "github.com/openebs/maya/pkg/client/generated/clientset/versioned"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// pvLabel is set on CStorBackup with the name of backed up volume
+	pvLabel = "openebs.io/persistent-volume"
+
+	// casTypeLabel is set on non CSI PV with the cas type of OpenEBS volume
+	casTypeLabel = "openebs.io/cas-type"
+
+	// cstorCSIDriver is CSI driver of cStor CSI volume
+	cstorCSIDriver = "cstor.csi.openebs.io"
+)
+
+// DeleteItemAction deletes the CStorBackups, of the deleted backup, which
+// are not completed and so are not deleted along with the snapshots
+type DeleteItemAction struct {
+	Log logrus.FieldLogger
+
+	openEBSClient     openebs.Interface
+	openEBSAPIsClient openebsapis.Interface
+}
+
+var _ velero.DeleteItemAction = (*DeleteItemAction)(nil)
+
+// AppliesTo returns the resources handled by the action
+func (a *DeleteItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+// Execute deletes the stale CStorBackups of given volume created for the deleted backup.
+// Leaving them conflicts with the backup of the volume having the same name.
+func (a *DeleteItemAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
+	pv, err := meta.Accessor(input.Item)
+	if err != nil {
+		return err
+	}
+
+	driver, _, _ := unstructured.NestedString(input.Item.UnstructuredContent(), "spec", "csi", "driver")
+	if pv.GetLabels()[casTypeLabel] != "cstor" && driver != cstorCSIDriver {
+		return nil
+	}
+
+	if err := a.initClients(); err != nil {
+		return err
+	}
+
+	opts := metav1.ListOptions{
+		LabelSelector: labels.Set{
+			velerov1api.BackupNameLabel: label.GetValidName(input.Backup.Name),
+			pvLabel:                     pv.GetName(),
+		}.String(),
+	}
+
+	if err := a.deleteStaleBackups(pv.GetName(), opts); err != nil {
+		return err
+	}
+	return a.deleteStaleCSIBackups(pv.GetName(), opts)
+}
+
+// deleteStaleBackups deletes the non completed CStorBackups, of non CSI volume, matching given opts
+func (a *DeleteItemAction) deleteStaleBackups(volume string, opts metav1.ListOptions) error {
+	bkps, err := a.openEBSClient.OpenebsV1alpha1().CStorBackups(metav1.NamespaceAll).List(context.TODO(), opts)
+	if k8serrors.IsNotFound(err) {
+		// resource is not installed
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to list backups of volume=%s", volume)
+	}
+
+	for _, b := range bkps.Items {
+		if b.Status == v1alpha1.BKPCStorStatusDone {
+			continue
+		}
+		err = a.openEBSClient.OpenebsV1alpha1().CStorBackups(b.Namespace).Delete(context.TODO(), b.Name, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete backup=%s/%s", b.Namespace, b.Name)
+		}
+		a.Log.Infof("Deleted stale backup=%s/%s of volume=%s", b.Namespace, b.Name, volume)
+	}
+	return nil
+}
+
+// deleteStaleCSIBackups deletes the non completed CStorBackups, of CSI volume, matching given opts
+func (a *DeleteItemAction) deleteStaleCSIBackups(volume string, opts metav1.ListOptions) error {
+	bkps, err := a.openEBSAPIsClient.CstorV1().CStorBackups(metav1.NamespaceAll).List(context.TODO(), opts)
+	if k8serrors.IsNotFound(err) {
+		// resource is not installed
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to list backups of volume=%s", volume)
+	}
+
+	for _, b := range bkps.Items {
+		if v1alpha1.CStorBackupStatus(b.Status) == v1alpha1.BKPCStorStatusDone {
+			continue
+		}
+		err = a.openEBSAPIsClient.CstorV1().CStorBackups(b.Namespace).Delete(context.TODO(), b.Name, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete backup=%s/%s", b.Namespace, b.Name)
+		}
+		a.Log.Infof("Deleted stale backup=%s/%s of volume=%s", b.Namespace, b.Name, volume)
+	}
+	return nil
+}
+
+// initClients creates the openebs clients, if not created yet
+func (a *DeleteItemAction) initClients() error {
+	if a.openEBSClient != nil {
+		return nil
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get cluster config")
+	}
+
+	if a.openEBSAPIsClient, err = openebsapis.NewForConfig(conf); err != nil {
+		return errors.Wrapf(err, "failed to create openebs apis client")
+	}
+	if a.openEBSClient, err = openebs.NewForConfig(conf); err != nil {
+		return errors.Wrapf(err, "failed to create openebs client")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package itemaction
+
+import (
+	"strings"
+
+	veleroutil "github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// provisionedByAnnotation is set on dynamically provisioned PV with the provisioner name
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+
+	// openebsDomain is the domain of OpenEBS provisioners and CSI drivers
+	openebsDomain = "openebs.io"
+)
+
+// nodeTopologyKeys are the node affinity keys, of OpenEBS local volumes, having the node name as value.
+// metadata.name is the node name field used in node affinity fields.
+var nodeTopologyKeys = map[string]bool{
+	"metadata.name":          true,
+	"kubernetes.io/hostname": true,
+	"openebs.io/nodeid":      true,
+	"openebs.io/nodename":    true,
+}
+
+// PVRestoreItemAction updates the node affinity and the claimRef of restored OpenEBS PVs,
+// so that the PV can be bound and scheduled in the target cluster
+type PVRestoreItemAction struct {
+	Log logrus.FieldLogger
+
+	k8sClient kubernetes.Interface
+}
+
+var _ velero.RestoreItemAction = (*PVRestoreItemAction)(nil)
+
+// AppliesTo returns the resources handled by the action
+func (a *PVRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"persistentvolumes"},
+	}, nil
+}
+
+// Execute replaces the nodes in node affinity of given PV, if it is OpenEBS PV, as per the
+// node mapping configmap, and updates its claimRef as per the namespace mapping of restore.
+// cStor PV, whose claim is excluded by the namespace filter of restore, is not restored since
+// its data is not restored by the plugin.
+func (a *PVRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	var pv v1.PersistentVolume
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &pv); err != nil {
+		return nil, errors.Wrapf(err, "failed to convert PV")
+	}
+
+	if !isOpenEBSVolume(&pv) {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	if isExcludedCStorVolume(&pv, input.Restore) {
+		a.Log.Infof("Skipping restore of PV=%s, its claim %s/%s is excluded by the namespace filter of restore",
+			pv.Name, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+		return velero.NewRestoreItemActionExecuteOutput(input.Item).WithoutRestore(), nil
+	}
+
+	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
+		if err := a.initClients(); err != nil {
+			return nil, err
+		}
+
+		mapping, err := veleroutil.GetNodeMapping(a.k8sClient)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+			term := &pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i]
+			a.mapNodes(pv.Name, term.MatchExpressions, mapping)
+			a.mapNodes(pv.Name, term.MatchFields, mapping)
+		}
+	}
+
+	if ref := pv.Spec.ClaimRef; ref != nil {
+		if ns, ok := input.Restore.Spec.NamespaceMapping[ref.Namespace]; ok {
+			a.Log.Infof("Updating claimRef namespace of PV=%s %s=>%s", pv.Name, ref.Namespace, ns)
+			ref.Namespace = ns
+		}
+		// PVC is created again by restore, so binding to the source PVC is reset
+		ref.UID = ""
+		ref.ResourceVersion = ""
+	}
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pv)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert PV=%s", pv.Name)
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: res}), nil
+}
+
+// mapNodes replaces the node names in given node selector requirements as per given mapping
+func (a *PVRestoreItemAction) mapNodes(pvName string, reqs []v1.NodeSelectorRequirement, mapping map[string]string) {
+	for i := range reqs {
+		if !nodeTopologyKeys[reqs[i].Key] {
+			continue
+		}
+
+		for j, node := range reqs[i].Values {
+			tnode, ok := mapping[node]
+			if !ok {
+				continue
+			}
+			a.Log.Infof("Updating node affinity %s of PV=%s %s=>%s", reqs[i].Key, pvName, node, tnode)
+			reqs[i].Values[j] = tnode
+		}
+	}
+}
+
+// initClients creates the kubernetes client, if not created yet
+func (a *PVRestoreItemAction) initClients() error {
+	if a.k8sClient != nil {
+		return nil
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get cluster config")
+	}
+
+	if a.k8sClient, err = kubernetes.NewForConfig(conf); err != nil {
+		return errors.Wrapf(err, "failed to create k8s client")
+	}
+	return nil
+}
+
+// isExcludedCStorVolume returns true if given PV is cStor PV, restored from snapshot, whose
+// claim is excluded by the namespace filter of given restore
+func isExcludedCStorVolume(pv *v1.PersistentVolume, r *velerov1api.Restore) bool {
+	if pv.Labels[casTypeLabel] != "cstor" && (pv.Spec.CSI == nil || pv.Spec.CSI.Driver != cstorCSIDriver) {
+		return false
+	}
+
+	if pv.Spec.ClaimRef == nil || (r.Spec.RestorePVs != nil && !*r.Spec.RestorePVs) {
+		return false
+	}
+	return veleroutil.IsNamespaceExcluded(r, pv.Spec.ClaimRef.Namespace)
+}
+
+// isOpenEBSVolume returns true if given PV is provisioned by OpenEBS
+func isOpenEBSVolume(pv *v1.PersistentVolume) bool {
+	if _, ok := pv.Labels[casTypeLabel]; ok {
+		return true
+	}
+
+	if pv.Spec.CSI != nil && strings.HasSuffix(pv.Spec.CSI.Driver, openebsDomain) {
+		return true
+	}
+
+	// provisioner name is either prefixed, e.g. openebs.io/local, or suffixed by OpenEBS domain
+	return strings.Contains(pv.Annotations[provisionedByAnnotation], openebsDomain)
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package itemaction
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/ghodss/yaml"
+	veleroutil "github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// velero pod annotations of the exec restore hook, these are executed by velero
+// in the restored pod once its container is running
+const (
+	hookContainerAnnotation   = "post.hook.restore.velero.io/container"
+	hookCommandAnnotation     = "post.hook.restore.velero.io/command"
+	hookOnErrorAnnotation     = "post.hook.restore.velero.io/on-error"
+	hookExecTimeoutAnnotation = "post.hook.restore.velero.io/exec-timeout"
+	hookWaitTimeoutAnnotation = "post.hook.restore.velero.io/wait-timeout"
+)
+
+// restoreHook is a command, like remount or fsck, executed in the restored pods using
+// the OpenEBS volumes. It is configured in the restore hooks configmap, as yaml value
+// of the hook name.
+type restoreHook struct {
+	// Namespaces are the namespaces, after namespace mapping, of the pods. Hook applies
+	// to all namespaces if not set.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// LabelSelector selects the pods by their labels
+	LabelSelector string `json:"labelSelector,omitempty"`
+
+	// Container in which command is executed, velero uses the first container if not set
+	Container string `json:"container,omitempty"`
+
+	// Command to execute
+	Command []string `json:"command"`
+
+	// OnError is the action, Continue or Fail, if command fails
+	OnError velerov1api.HookErrorMode `json:"onError,omitempty"`
+
+	// ExecTimeout is the time to wait for the command to complete
+	ExecTimeout string `json:"execTimeout,omitempty"`
+
+	// WaitTimeout is the time to wait for the container to be running
+	WaitTimeout string `json:"waitTimeout,omitempty"`
+
+	name     string
+	selector labels.Selector
+}
+
+// matches return true if hook applies to the given pod in given namespace
+func (h *restoreHook) matches(pod *v1.Pod, ns string) bool {
+	if len(h.Namespaces) != 0 && !contains(h.Namespaces, ns) {
+		return false
+	}
+
+	if !h.selector.Matches(labels.Set(pod.Labels)) {
+		return false
+	}
+
+	if h.Container == "" {
+		return true
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == h.Container {
+			return true
+		}
+	}
+	return false
+}
+
+// RestoreHookAction adds the configured exec restore hooks to the restored pods using
+// OpenEBS volumes, so that velero executes the hook command, like remount or fsck, in
+// the pod once the volume is mounted and before the restore is completed
+type RestoreHookAction struct {
+	Log logrus.FieldLogger
+
+	k8sClient kubernetes.Interface
+}
+
+var _ velero.RestoreItemAction = (*RestoreHookAction)(nil)
+
+// AppliesTo returns the resources handled by the action
+func (a *RestoreHookAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"pods"},
+	}, nil
+}
+
+// Execute sets the restore hook annotations on given pod, if it uses the OpenEBS volumes and
+// matches any of the hooks in restore hooks configmap. Hook annotations already set on the
+// pod take precedence over the configmap.
+func (a *RestoreHookAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	var pod v1.Pod
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), &pod); err != nil {
+		return nil, errors.Wrapf(err, "failed to convert pod")
+	}
+
+	if _, ok := pod.Annotations[hookCommandAnnotation]; ok {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	if err := a.initClients(); err != nil {
+		return nil, err
+	}
+
+	hooks, err := a.getHooks()
+	if err != nil {
+		return nil, err
+	}
+
+	// pod is created in the mapped namespace, after the PVCs
+	ns := pod.Namespace
+	if tns, ok := input.Restore.Spec.NamespaceMapping[ns]; ok {
+		ns = tns
+	}
+
+	var matched []*restoreHook
+	for _, h := range hooks {
+		if h.matches(&pod, ns) {
+			matched = append(matched, h)
+		}
+	}
+	if len(matched) == 0 {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	ok, err := a.usesOpenEBSVolume(&pod, ns)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+
+	h := matched[0]
+	for _, m := range matched[1:] {
+		a.Log.Warnf("Restore hook=%s also matches pod=%s/%s, only hook=%s is used", m.name, ns, pod.Name, h.name)
+	}
+
+	if err := setHookAnnotations(&pod, h); err != nil {
+		return nil, err
+	}
+	a.Log.Infof("Added restore hook=%s to pod=%s/%s", h.name, ns, pod.Name)
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&pod)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to convert pod=%s/%s", ns, pod.Name)
+	}
+
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: res}), nil
+}
+
+// getHooks return the restore hooks, sorted by name, from the restore hooks configmap
+func (a *RestoreHookAction) getHooks() ([]*restoreHook, error) {
+	data, err := veleroutil.GetRestoreHooks(a.k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]*restoreHook, 0, len(data))
+	for name, val := range data {
+		h, err := parseRestoreHook(name, val)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].name < hooks[j].name })
+	return hooks, nil
+}
+
+// parseRestoreHook parses the given yaml value of restore hook
+func parseRestoreHook(name, val string) (*restoreHook, error) {
+	h := &restoreHook{name: name}
+
+	if err := yaml.Unmarshal([]byte(val), h); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse restore hook=%s", name)
+	}
+
+	if len(h.Command) == 0 {
+		return nil, errors.Errorf("command is required for restore hook=%s", name)
+	}
+
+	switch h.OnError {
+	case "", velerov1api.HookErrorModeContinue, velerov1api.HookErrorModeFail:
+	default:
+		return nil, errors.Errorf("invalid onError=%s of restore hook=%s, expected %s or %s",
+			h.OnError, name, velerov1api.HookErrorModeContinue, velerov1api.HookErrorModeFail)
+	}
+
+	for _, d := range []string{h.ExecTimeout, h.WaitTimeout} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return nil, errors.Wrapf(err, "invalid timeout of restore hook=%s", name)
+		}
+	}
+
+	var err error
+	if h.selector, err = labels.Parse(h.LabelSelector); err != nil {
+		return nil, errors.Wrapf(err, "invalid labelSelector of restore hook=%s", name)
+	}
+	return h, nil
+}
+
+// usesOpenEBSVolume returns true if any of the PVCs, in given namespace, used by the
+// pod is bound to OpenEBS volume
+func (a *RestoreHookAction) usesOpenEBSVolume(pod *v1.Pod, ns string) (bool, error) {
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		pvc, err := a.k8sClient.CoreV1().PersistentVolumeClaims(ns).
+			Get(context.TODO(), vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get PVC=%s/%s", ns, vol.PersistentVolumeClaim.ClaimName)
+		}
+		if pvc.Spec.VolumeName == "" {
+			continue
+		}
+
+		pv, err := a.k8sClient.CoreV1().PersistentVolumes().Get(context.TODO(), pvc.Spec.VolumeName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to get PV=%s", pvc.Spec.VolumeName)
+		}
+		if isOpenEBSVolume(pv) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// initClients creates the kubernetes client, if not created yet
+func (a *RestoreHookAction) initClients() error {
+	if a.k8sClient != nil {
+		return nil
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get cluster config")
+	}
+
+	if a.k8sClient, err = kubernetes.NewForConfig(conf); err != nil {
+		return errors.Wrapf(err, "failed to create k8s client")
+	}
+	return nil
+}
+
+// setHookAnnotations sets the velero restore hook annotations of given hook on the pod
+func setHookAnnotations(pod *v1.Pod, h *restoreHook) error {
+	cmd, err := json.Marshal(h.Command)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode command of restore hook=%s", h.name)
+	}
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+
+	pod.Annotations[hookCommandAnnotation] = string(cmd)
+	for key, val := range map[string]string{
+		hookContainerAnnotation:   h.Container,
+		hookOnErrorAnnotation:     string(h.OnError),
+		hookExecTimeoutAnnotation: h.ExecTimeout,
+		hookWaitTimeoutAnnotation: h.WaitTimeout,
+	} {
+		if val != "" {
+			pod.Annotations[key] = val
+		}
+	}
+	return nil
+}
+
+// contains returns true if given list has the given value
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
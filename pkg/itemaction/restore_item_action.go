@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package itemaction
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+const (
+	// restorePoolConfigAnnotation is set on velero restore, with value "true", to restore
+	// the pool config resources, StoragePoolClaim and CStorPoolCluster
+	restorePoolConfigAnnotation = "openebs.io/restore-pool-config"
+)
+
+// internalKinds are the OpenEBS resources created by OpenEBS for the volumes, pools and backups.
+// These are created again for the restored volumes, so restoring them conflicts with OpenEBS.
+var internalKinds = map[string]bool{
+	"CStorVolume":           true,
+	"CStorVolumeReplica":    true,
+	"CStorVolumeConfig":     true,
+	"CStorVolumeAttachment": true,
+	"CStorBackup":           true,
+	"CStorCompletedBackup":  true,
+	"CStorRestore":          true,
+	"CStorPool":             true,
+	"CStorPoolInstance":     true,
+	"BlockDevice":           true,
+	"BlockDeviceClaim":      true,
+}
+
+// poolConfigKinds are the OpenEBS pool config resources. These refer to the block devices
+// of source cluster, so these are restored only if set by restore annotation.
+var poolConfigKinds = map[string]bool{
+	"StoragePoolClaim": true,
+	"CStorPoolCluster": true,
+}
+
+// RestoreItemAction skips the restore of OpenEBS internal resources
+type RestoreItemAction struct {
+	Log logrus.FieldLogger
+}
+
+var _ velero.RestoreItemAction = (*RestoreItemAction)(nil)
+
+// AppliesTo returns the OpenEBS resources handled by the action
+func (a *RestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{
+			"cstorvolumes.openebs.io",
+			"cstorvolumereplicas.openebs.io",
+			"cstorbackups.openebs.io",
+			"cstorcompletedbackups.openebs.io",
+			"cstorrestores.openebs.io",
+			"cstorpools.openebs.io",
+			"storagepoolclaims.openebs.io",
+			"blockdevices.openebs.io",
+			"blockdeviceclaims.openebs.io",
+			"cstorvolumes.cstor.openebs.io",
+			"cstorvolumereplicas.cstor.openebs.io",
+			"cstorvolumeconfigs.cstor.openebs.io",
+			"cstorvolumeattachments.cstor.openebs.io",
+			"cstorbackups.cstor.openebs.io",
+			"cstorcompletedbackups.cstor.openebs.io",
+			"cstorrestores.cstor.openebs.io",
+			"cstorpoolinstances.cstor.openebs.io",
+			"cstorpoolclusters.cstor.openebs.io",
+		},
+	}, nil
+}
+
+// Execute skips the restore of given item if it is OpenEBS internal resource, or it is pool
+// config resource and the restore doesn't have restorePoolConfigAnnotation.
+func (a *RestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	out := velero.NewRestoreItemActionExecuteOutput(input.Item)
+
+	obj, err := meta.Accessor(input.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := input.Item.GetObjectKind().GroupVersionKind().Kind
+	switch {
+	case internalKinds[kind]:
+		a.Log.Infof("Skipping restore of %s=%s/%s, it is created by OpenEBS", kind, obj.GetNamespace(), obj.GetName())
+		return out.WithoutRestore(), nil
+	case poolConfigKinds[kind] && input.Restore.Annotations[restorePoolConfigAnnotation] != "true":
+		a.Log.Infof("Skipping restore of %s=%s, set annotation %s=true on restore to restore it",
+			kind, obj.GetName(), restorePoolConfigAnnotation)
+		return out.WithoutRestore(), nil
+	}
+	return out, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package velero
+
+import (
+	"context"
+	"path"
+
+	"github.com/pkg/errors"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// IsBackupCanceled return true if the given backup is deleted or canceled
+//
+// velero doesn't notify the plugin if backup is deleted, so plugin checks
+// the following to find out if the backup is canceled:
+//		- backup resource doesn't exist, or is being deleted OR
+//		- backup is in Failed or Deleting state OR
+//		- deletion is requested for the backup, and request is not yet processed
+func IsBackupCanceled(bkpName string) (bool, error) {
+	bkp, err := clientSet.VeleroV1().Backups(veleroNs).Get(context.TODO(), bkpName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, errors.Wrapf(err, "failed to get backup %s", bkpName)
+	}
+
+	if bkp.DeletionTimestamp != nil {
+		return true, nil
+	}
+
+	switch bkp.Status.Phase {
+	case velerov1api.BackupPhaseFailed, velerov1api.BackupPhaseDeleting:
+		return true, nil
+	}
+
+	list, err := clientSet.VeleroV1().DeleteBackupRequests(veleroNs).List(context.TODO(), label.NewListOptionsForBackup(bkpName))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get delete requests for backup %s", bkpName)
+	}
+
+	for _, req := range list.Items {
+		if req.Status.Phase != velerov1api.DeleteBackupRequestPhaseProcessed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// BackupExists return true if the given backup resource exists
+func BackupExists(bkpName string) (bool, error) {
+	_, err := clientSet.VeleroV1().Backups(veleroNs).Get(context.TODO(), bkpName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to get backup %s", bkpName)
+	}
+	return true, nil
+}
+
+// IsBackupInProgress return true if the given backup exists and is in InProgress state
+func IsBackupInProgress(bkpName string) (bool, error) {
+	bkp, err := clientSet.VeleroV1().Backups(veleroNs).Get(context.TODO(), bkpName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to get backup %s", bkpName)
+	}
+
+	return bkp.DeletionTimestamp == nil && bkp.Status.Phase == velerov1api.BackupPhaseInProgress, nil
+}
+
+// GetBackupLabels return the labels of the given backup along with the backup name label,
+// schedule name label is set by velero on the scheduled backup
+func GetBackupLabels(bkpName string) (map[string]string, error) {
+	bkp, err := clientSet.VeleroV1().Backups(veleroNs).Get(context.TODO(), bkpName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backup %s", bkpName)
+	}
+
+	bkpLabels := make(map[string]string, len(bkp.Labels)+1)
+	for k, v := range bkp.Labels {
+		bkpLabels[k] = v
+	}
+	bkpLabels[velerov1api.BackupNameLabel] = label.GetValidName(bkp.Name)
+	return bkpLabels, nil
+}
+
+// IsLatestScheduledBackup return true if there is no successful backup of the schedule of the
+// given backup started after it. Backup which is not created by schedule is considered as latest.
+func IsLatestScheduledBackup(bkpName string) (bool, error) {
+	bkp, err := clientSet.VeleroV1().Backups(veleroNs).Get(context.TODO(), bkpName, metav1.GetOptions{})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get backup %s", bkpName)
+	}
+
+	schedule := bkp.Labels[velerov1api.ScheduleNameLabel]
+	if schedule == "" || bkp.Status.StartTimestamp == nil {
+		return schedule == "", nil
+	}
+
+	list, err := clientSet.VeleroV1().Backups(veleroNs).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.Set{velerov1api.ScheduleNameLabel: schedule}.String(),
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get backups of schedule %s", schedule)
+	}
+
+	for _, b := range list.Items {
+		if b.Status.Phase != velerov1api.BackupPhaseCompleted &&
+			b.Status.Phase != velerov1api.BackupPhasePartiallyFailed {
+			continue
+		}
+		if b.Status.StartTimestamp != nil && b.Status.StartTimestamp.After(bkp.Status.StartTimestamp.Time) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// IsPVCIncludedInBackup return true if the given PVC is selected by the given backup
+// Only the namespace and label selector of the backup are checked, since PVs are
+// included through the PVCs.
+func IsPVCIncludedInBackup(bkpName string, pvc *v1.PersistentVolumeClaim) (bool, error) {
+	bkp, err := clientSet.VeleroV1().Backups(veleroNs).Get(context.TODO(), bkpName, metav1.GetOptions{})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get backup %s", bkpName)
+	}
+
+	if !isNamespaceIncluded(pvc.Namespace, bkp.Spec.IncludedNamespaces, bkp.Spec.ExcludedNamespaces) {
+		return false, nil
+	}
+
+	if bkp.Spec.LabelSelector == nil {
+		return true, nil
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(bkp.Spec.LabelSelector)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid label selector of backup %s", bkpName)
+	}
+	return selector.Matches(labels.Set(pvc.Labels)), nil
+}
+
+// isNamespaceIncluded return true if the given namespace is included as per the included
+// and excluded namespaces of a backup or restore. Namespaces are matched as velero does,
+// exclusion takes precedence, and empty included list or "*" includes all the namespaces.
+func isNamespaceIncluded(ns string, included, excluded []string) bool {
+	if matchNamespace(excluded, ns) {
+		return false
+	}
+	return len(included) == 0 || matchNamespace(included, ns)
+}
+
+// matchNamespace returns true if the given namespace matches any of the given names,
+// which can be glob patterns like "*" or "app-*"
+func matchNamespace(patterns []string, ns string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ns); ok || p == ns {
+			return true
+		}
+	}
+	return false
+}
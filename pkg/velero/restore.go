@@ -18,12 +18,15 @@ package velero
 
 import (
 	"context"
+	"encoding/json"
 	"sort"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -40,41 +43,123 @@ import (
 //		  backup for that restore matches with the backup name from snapshotID
 // Above approach works because velero support sequential restore
 func GetRestoreNamespace(ns, bkpName string, log logrus.FieldLogger) (string, error) {
+	r, err := GetRestore(bkpName)
+	if err != nil {
+		return "", err
+	}
+
+	targetedNs, ok := r.Spec.NamespaceMapping[ns]
+	if ok {
+		return targetedNs, nil
+	}
+	return ns, nil
+}
+
+// GetRestore return the in-progress restore for the given backup
+// Refer GetRestoreNamespace for the criteria used to find the restore
+func GetRestore(bkpName string) (*velerov1api.Restore, error) {
 	listOpts := metav1.ListOptions{}
 	list, err := clientSet.VeleroV1().Restores(veleroNs).List(context.TODO(), listOpts)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to get list of restore")
+		return nil, errors.Wrapf(err, "failed to get list of restore")
 	}
 
 	sort.Sort(sort.Reverse(RestoreByCreationTimestamp(list.Items)))
 
 	for _, r := range list.Items {
 		if r.Status.Phase == velerov1api.RestorePhaseInProgress && r.Spec.BackupName == bkpName {
-			targetedNs, ok := r.Spec.NamespaceMapping[ns]
-			if ok {
-				return targetedNs, nil
-			}
-			return ns, nil
+			return &r, nil
 		}
 	}
-	return "", errors.Errorf("restore not found for backup %s", bkpName)
+	return nil, errors.Errorf("restore not found for backup %s", bkpName)
+}
+
+// IsNamespaceExcluded returns true if the given namespace, of the item in backup, is excluded
+// from the given restore by its included and excluded namespaces
+func IsNamespaceExcluded(r *velerov1api.Restore, ns string) bool {
+	return !isNamespaceIncluded(ns, r.Spec.IncludedNamespaces, r.Spec.ExcludedNamespaces)
+}
+
+// GetRestoreLabels return the labels of the given restore along with the labels
+// of its backup and the restore name label
+func GetRestoreLabels(r *velerov1api.Restore) (map[string]string, error) {
+	rstLabels, err := GetBackupLabels(r.Spec.BackupName)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range r.Labels {
+		rstLabels[k] = v
+	}
+	rstLabels[velerov1api.RestoreNameLabel] = label.GetValidName(r.Name)
+	return rstLabels, nil
+}
+
+// SetRestoreAnnotation sets the given annotation on the restore
+func SetRestoreAnnotation(r *velerov1api.Restore, key, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				key: value,
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate patch for restore %s", r.Name)
+	}
+
+	_, err = clientSet.VeleroV1().Restores(r.Namespace).
+		Patch(context.TODO(), r.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to patch restore %s", r.Name)
+	}
+	return nil
 }
 
 // GetTargetNode return the node mapping for the given node
 // if node mapping not found then it will return the same nodename in which backup was created
 // if node mapping found then it will return the mapping/target nodename
-func GetTargetNode(k8s *kubernetes.Clientset, node string) (string, error) {
+func GetTargetNode(k8s kubernetes.Interface, node string) (string, error) {
+	mapping, err := GetNodeMapping(k8s)
+	if err != nil {
+		return "", err
+	}
+
+	tnode, ok := mapping[node]
+	if !ok {
+		return node, nil
+	}
+
+	return tnode, nil
+}
+
+// GetNodeMapping return the source to target node mapping from the velero plugin config
+// configmap of change-pvc-node-selector RestoreItemAction. If configmap doesn't exist
+// then it will return empty mapping.
+func GetNodeMapping(k8s kubernetes.Interface) (map[string]string, error) {
+	return getPluginConfig(k8s, "velero.io/plugin-config,velero.io/change-pvc-node-selector=RestoreItemAction")
+}
+
+// GetRestoreHooks return the restore hooks from the velero plugin config configmap
+// of openebs.io/restore-hooks RestoreItemAction. If configmap doesn't exist then it
+// will return empty config.
+func GetRestoreHooks(k8s kubernetes.Interface) (map[string]string, error) {
+	return getPluginConfig(k8s, "velero.io/plugin-config,openebs.io/restore-hooks=RestoreItemAction")
+}
+
+// getPluginConfig return the data of plugin config configmap matching the given label selector
+func getPluginConfig(k8s kubernetes.Interface, selector string) (map[string]string, error) {
 	opts := metav1.ListOptions{
-		LabelSelector: "velero.io/plugin-config,velero.io/change-pvc-node-selector=RestoreItemAction",
+		LabelSelector: selector,
 	}
 
 	list, err := k8s.CoreV1().ConfigMaps(veleroNs).List(context.TODO(), opts)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to get list of node mapping configmap")
+		return nil, errors.Wrapf(err, "failed to get list of plugin config configmap")
 	}
 
 	if len(list.Items) == 0 {
-		return node, nil
+		return map[string]string{}, nil
 	}
 
 	if len(list.Items) > 1 {
@@ -82,15 +167,8 @@ func GetTargetNode(k8s *kubernetes.Clientset, node string) (string, error) {
 		for _, item := range list.Items {
 			items = append(items, item.Name)
 		}
-		return "", errors.Errorf("found more than one ConfigMap matching label selector %q: %v", opts.LabelSelector, items)
-	}
-
-	config := list.Items[0]
-
-	tnode, ok := config.Data[node]
-	if !ok {
-		return node, nil
+		return nil, errors.Errorf("found more than one ConfigMap matching label selector %q: %v", opts.LabelSelector, items)
 	}
 
-	return tnode, nil
+	return list.Items[0].Data, nil
 }
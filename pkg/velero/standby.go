@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package velero
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/label"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// StandbyLabel is set on the restores created for standby restore of a schedule,
+	// with schedule name as value
+	StandbyLabel = "openebs.io/velero-standby"
+)
+
+// StandbyOptions describes the restores created for standby restore of a schedule
+type StandbyOptions struct {
+	// Schedule is name of the schedule whose backups are restored
+	Schedule string
+
+	// NamespaceMapping is namespace mapping of the restores
+	NamespaceMapping map[string]string
+
+	// IncludedResources is list of resources restored by the restores
+	IncludedResources []string
+}
+
+// SyncStandby creates the restore for the latest completed backup of the schedule, if the
+// backup is not restored yet and no other standby restore of the schedule is in progress.
+// It returns the name of created restore, or empty string if restore is not created.
+func SyncStandby(opts StandbyOptions) (string, error) {
+	selector := labels.Set{StandbyLabel: label.GetValidName(opts.Schedule)}.String()
+
+	restores, err := clientSet.VeleroV1().Restores(veleroNs).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list standby restores of schedule %s", opts.Schedule)
+	}
+
+	// restores are executed one by one, so that incremental snapshots are restored in order
+	for _, r := range restores.Items {
+		if r.Status.Phase == "" || r.Status.Phase == velerov1api.RestorePhaseNew ||
+			r.Status.Phase == velerov1api.RestorePhaseInProgress {
+			return "", nil
+		}
+	}
+
+	backups, err := clientSet.VeleroV1().Backups(veleroNs).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labels.Set{velerov1api.ScheduleNameLabel: opts.Schedule}.String(),
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get backups of schedule %s", opts.Schedule)
+	}
+
+	var latest *velerov1api.Backup
+	for i := range backups.Items {
+		b := &backups.Items[i]
+		if b.Status.Phase != velerov1api.BackupPhaseCompleted || b.Status.StartTimestamp == nil {
+			continue
+		}
+		if latest == nil || b.Status.StartTimestamp.After(latest.Status.StartTimestamp.Time) {
+			latest = b
+		}
+	}
+
+	if latest == nil {
+		return "", nil
+	}
+
+	// failed restore is not retried, since restoring the next backup restores its snapshots too
+	for _, r := range restores.Items {
+		if r.Spec.BackupName == latest.Name {
+			return "", nil
+		}
+	}
+
+	restorePVs := true
+	r := &velerov1api.Restore{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    veleroNs,
+			GenerateName: latest.Name + "-standby-",
+			Labels: map[string]string{
+				StandbyLabel: label.GetValidName(opts.Schedule),
+			},
+		},
+		Spec: velerov1api.RestoreSpec{
+			BackupName:        latest.Name,
+			NamespaceMapping:  opts.NamespaceMapping,
+			IncludedResources: opts.IncludedResources,
+			RestorePVs:        &restorePVs,
+		},
+	}
+
+	r, err = clientSet.VeleroV1().Restores(veleroNs).Create(context.TODO(), r, metav1.CreateOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create restore for backup %s", latest.Name)
+	}
+	return r.Name, nil
+}
@@ -35,6 +35,16 @@ func init() {
 	veleroNs = os.Getenv("VELERO_NAMESPACE")
 }
 
+// GetNamespace return the velero installation namespace
+func GetNamespace() string {
+	return veleroNs
+}
+
+// SetClientSet sets the velero clientset, it is used to run the plugin against fake clientset
+func SetClientSet(c veleroclient.Interface) {
+	clientSet = c
+}
+
 // InitializeClientSet initialize velero clientset
 func InitializeClientSet(config *rest.Config) error {
 	var err error
@@ -19,6 +19,7 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"net"
 	"sort"
 	"strconv"
 	"sync"
@@ -144,7 +145,7 @@ func (p *Plugin) createBackup(vol *apis.ZFSVolume, schdname, snapname string, po
 
 	p.Log.Debugf("zfs: backup incr(%d) schd=%s snap=%s prevsnap=%s vol=%s", p.incremental, schdname, snapname, prevSnap, vol.Name)
 
-	serverAddr := p.remoteAddr + ":" + strconv.Itoa(port)
+	serverAddr := net.JoinHostPort(p.remoteAddr, strconv.Itoa(port))
 
 	bkp, err := bkpbuilder.NewBuilder().
 		WithName(bkpname).
@@ -259,7 +260,7 @@ func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, por
 
 	// wait for the upload server to exit
 	defer func() {
-		p.cl.ExitServer = true
+		p.cl.StopServer()
 		wg.Wait()
 		p.cl.ConnReady = nil
 	}()
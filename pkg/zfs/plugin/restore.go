@@ -18,6 +18,7 @@ package plugin
 
 import (
 	"encoding/json"
+	"net"
 	"sort"
 	"strconv"
 	"sync"
@@ -203,7 +204,7 @@ func (p *Plugin) checkVolCreation(volname string) error {
 // startRestore creates the ZFSRestore CR to start downloading the data and returns ZFSRestore CR name
 func (p *Plugin) startRestore(zv *apis.ZFSVolume, bkpname string, port int) (string, error) {
 	node := zv.Spec.OwnerNodeID
-	serverAddr := p.remoteAddr + ":" + strconv.Itoa(port)
+	serverAddr := net.JoinHostPort(p.remoteAddr, strconv.Itoa(port))
 	zfsvol := zv.Name
 	rname := utils.GenerateResourceName(zfsvol, bkpname)
 
@@ -256,7 +257,7 @@ func (p *Plugin) dataRestore(zv *apis.ZFSVolume, pvname, schdname, bkpname strin
 
 	// wait for the download server to exit
 	defer func() {
-		p.cl.ExitServer = true
+		p.cl.StopServer()
 		wg.Wait()
 		p.cl.ConnReady = nil
 	}()
@@ -83,7 +83,11 @@ func (p *Plugin) Init(config map[string]string) error {
 	p.Log.Debugf("zfs: Init called %v", config)
 	p.config = config
 
-	p.remoteAddr, _ = utils.GetServerAddress()
+	if addr, ok := config[cloud.BindAddress]; ok {
+		p.remoteAddr = addr
+	} else {
+		p.remoteAddr, _ = utils.GetServerAddress()
+	}
 	if p.remoteAddr == "" {
 		return errors.New("zfs: error fetching Server address")
 	}
@@ -0,0 +1,175 @@
+#!/bin/bash
+
+# Copyright 2021 The OpenEBS Authors.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# Backs up an application from cluster A and restores it in cluster B, having
+# different node names and openebs namespace. Clusters are created as minikube
+# profiles sharing a minio server running on the host.
+#
+# Usage: ./script/migration-test.sh [setup|test|cleanup|all]
+
+set -e
+
+: ${VELERO_RELEASE:=v1.0.0}
+: ${CLUSTER_A:=velero-a}
+: ${CLUSTER_B:=velero-b}
+: ${OPENEBS_NS_A:=openebs}
+: ${OPENEBS_NS_B:=openebs-b}
+: ${MINIKUBE_DRIVER:=docker}
+: ${PLUGIN_IMAGE:=openebs/velero-plugin-amd64:ci}
+: ${WORK_DIR:=/tmp/velero-plugin-migration}
+
+OPENEBS_OPERATOR=https://raw.githubusercontent.com/openebs/openebs/master/k8s/openebs-operator.yaml
+MINIO_ACCESS_KEY=minio
+MINIO_SECRET_KEY=minio123
+BUCKET=velero
+REGION=minio
+
+function kubeconfig() {
+	echo ${WORK_DIR}/$1.kubeconfig
+}
+
+function waitForDeployment() {
+	DEPLOY=$1
+	NS=$2
+
+	for i in $(seq 1 50) ; do
+		replicas=$(kubectl get deployment -n ${NS} ${DEPLOY} -o json 2>/dev/null | jq ".status.readyReplicas")
+		if [ "$replicas" == "1" ]; then
+			return
+		fi
+		echo "Waiting for ${DEPLOY} to be ready"
+		sleep 10
+	done
+	echo "${DEPLOY} in ${NS} is not ready"
+	exit 1
+}
+
+# startMinio starts minio server on the host, shared by both the clusters
+function startMinio() {
+	if [ ! -f ${WORK_DIR}/minio ]; then
+		wget -nv -O ${WORK_DIR}/minio https://dl.min.io/server/minio/release/linux-amd64/minio
+		chmod +x ${WORK_DIR}/minio
+	fi
+
+	# directory in data directory is served as bucket
+	mkdir -p ${WORK_DIR}/data/${BUCKET}
+	MINIO_ACCESS_KEY=${MINIO_ACCESS_KEY} MINIO_SECRET_KEY=${MINIO_SECRET_KEY} \
+		${WORK_DIR}/minio server --address 0.0.0.0:9000 ${WORK_DIR}/data &
+	echo $! > ${WORK_DIR}/minio.pid
+	sleep 5
+}
+
+# minioEndpoint return the minio endpoint reachable from the given cluster, i.e. gateway of its network
+function minioEndpoint() {
+	if [ "${MINIKUBE_DRIVER}" == "docker" ]; then
+		ip=$(docker network inspect $1 -f '{{(index .IPAM.Config 0).Gateway}}')
+	else
+		ip=$(minikube -p $1 ssh -- ip route | awk '/default/ {print $3}')
+	fi
+	echo http://${ip}:9000
+}
+
+# setupCluster creates the cluster of given profile, and installs openebs in given namespace and velero
+function setupCluster() {
+	PROFILE=$1
+	OPENEBS_NS=$2
+	export KUBECONFIG=$(kubeconfig ${PROFILE})
+
+	minikube start -p ${PROFILE} --driver=${MINIKUBE_DRIVER}
+	minikube -p ${PROFILE} ssh -- "sudo apt-get update -qq && sudo apt-get install --yes -qq open-iscsi && sudo systemctl start iscsid"
+
+	echo "Installing openebs in ${PROFILE}/${OPENEBS_NS}"
+	curl -sSfL ${OPENEBS_OPERATOR} | \
+		sed -e "s/namespace: openebs$/namespace: ${OPENEBS_NS}/" -e "s/name: openebs$/name: ${OPENEBS_NS}/" | \
+		kubectl apply -f -
+	waitForDeployment maya-apiserver ${OPENEBS_NS}
+	waitForDeployment openebs-provisioner ${OPENEBS_NS}
+	waitForDeployment openebs-ndm-operator ${OPENEBS_NS}
+
+	echo "Loading ${PLUGIN_IMAGE} in ${PROFILE}"
+	docker save ${PLUGIN_IMAGE} | (eval $(minikube -p ${PROFILE} docker-env) && docker load)
+
+	ENDPOINT=$(minioEndpoint ${PROFILE})
+	echo "Installing velero in ${PROFILE}, using minio ${ENDPOINT}"
+	${VELERO} install \
+		--provider aws \
+		--bucket ${BUCKET} \
+		--secret-file ./script/minio-credentials \
+		--backup-location-config region=${REGION},s3ForcePathStyle="true",s3Url=${ENDPOINT} \
+		--wait
+
+	sed "s|MINIO_ENDPOINT|${ENDPOINT}|" script/volumesnapshotlocation.yaml > ${WORK_DIR}/${PROFILE}-vsl.yaml
+	echo "    namespace: ${OPENEBS_NS}" >> ${WORK_DIR}/${PROFILE}-vsl.yaml
+	kubectl apply -f ${WORK_DIR}/${PROFILE}-vsl.yaml
+	${VELERO} plugin add ${PLUGIN_IMAGE}
+	waitForDeployment velero velero
+}
+
+function setup() {
+	mkdir -p ${WORK_DIR}
+
+	wget -nv -O ${WORK_DIR}/velero.tar.gz \
+		https://github.com/heptio/velero/releases/download/${VELERO_RELEASE}/velero-${VELERO_RELEASE}-linux-amd64.tar.gz
+	tar xf ${WORK_DIR}/velero.tar.gz -C ${WORK_DIR}
+
+	startMinio
+	setupCluster ${CLUSTER_A} ${OPENEBS_NS_A}
+	setupCluster ${CLUSTER_B} ${OPENEBS_NS_B}
+}
+
+function runTest() {
+	export MIGRATION_STATE=${WORK_DIR}/state.json
+
+	echo "Backing up application in ${CLUSTER_A}"
+	KUBECONFIG=$(kubeconfig ${CLUSTER_A}) OPENEBS_NAMESPACE=${OPENEBS_NS_A} MIGRATION_PHASE=backup \
+		go test -v ./tests/migration/... -timeout 20m
+
+	echo "Restoring application in ${CLUSTER_B}"
+	KUBECONFIG=$(kubeconfig ${CLUSTER_B}) OPENEBS_NAMESPACE=${OPENEBS_NS_B} MIGRATION_PHASE=restore \
+		go test -v ./tests/migration/... -timeout 20m
+}
+
+function cleanup() {
+	minikube delete -p ${CLUSTER_A} || true
+	minikube delete -p ${CLUSTER_B} || true
+	if [ -f ${WORK_DIR}/minio.pid ]; then
+		kill $(cat ${WORK_DIR}/minio.pid) || true
+	fi
+	rm -rf ${WORK_DIR}
+}
+
+VELERO=${WORK_DIR}/velero-${VELERO_RELEASE}-linux-amd64/velero
+
+case "${1:-all}" in
+	setup)
+		setup
+		;;
+	test)
+		runTest
+		;;
+	cleanup)
+		cleanup
+		;;
+	all)
+		setup
+		runTest
+		cleanup
+		;;
+	*)
+		echo "Usage: $0 [setup|test|cleanup|all]"
+		exit 1
+		;;
+esac
@@ -18,9 +18,11 @@ package app
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/ghodss/yaml"
 	k8s "github.com/openebs/velero-plugin/tests/k8s"
+	"github.com/pkg/errors"
 	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -96,3 +98,49 @@ func DestroyApplication(appYaml, ns string) error {
 
 	return nil
 }
+
+// WaitForApplication waits till the given application, restored in given namespace, is running
+func WaitForApplication(appYaml, ns string) error {
+	var p corev1.Pod
+	if err := yaml.Unmarshal([]byte(appYaml), &p); err != nil {
+		return err
+	}
+	return k8s.Client.WaitForPod(p.Name, ns)
+}
+
+// GetApplicationPod return the pod of given application in given namespace
+func GetApplicationPod(appYaml, ns string) (*corev1.Pod, error) {
+	var p corev1.Pod
+	if err := yaml.Unmarshal([]byte(appYaml), &p); err != nil {
+		return nil, err
+	}
+	return k8s.Client.CoreV1().Pods(ns).Get(context.TODO(), p.Name, metav1.GetOptions{})
+}
+
+// WriteData writes the given MiB of random data to the given file in the volume of application
+func WriteData(appYaml, ns, file string, sizeMiB int) error {
+	pod, container, mountPath, err := appVolume(appYaml)
+	if err != nil {
+		return err
+	}
+
+	cmd := fmt.Sprintf("dd if=/dev/urandom of=%s/%s bs=1M count=%d && sync", mountPath, file, sizeMiB)
+	if _, stderr, err := k8s.Client.ExecArgs([]string{"sh", "-c", cmd}, pod, container, ns); err != nil {
+		return errors.Wrapf(err, "failed to write data to %s/%s, stderr=%s", ns, pod, stderr)
+	}
+	return nil
+}
+
+// appVolume return the pod, container and mount path of the volume of application
+func appVolume(appYaml string) (string, string, string, error) {
+	var p corev1.Pod
+	if err := yaml.Unmarshal([]byte(appYaml), &p); err != nil {
+		return "", "", "", err
+	}
+
+	c := p.Spec.Containers[0]
+	if len(c.VolumeMounts) == 0 {
+		return "", "", "", errors.Errorf("application %s doesn't have volume", p.Name)
+	}
+	return p.Name, c.Name, c.VolumeMounts[0].MountPath, nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	k8s "github.com/openebs/velero-plugin/tests/k8s"
+	"github.com/pkg/errors"
+)
+
+// patternBlockSize is size of the blocks of patterned data, each block starts with
+// the file name and block number so that misplaced blocks are detected
+const patternBlockSize = 4096
+
+// DataRecord is the patterned data written in the volume of application
+type DataRecord struct {
+	// File is path of the data file relative to the volume mount path
+	File string
+
+	// Size is size of the data in bytes
+	Size int64
+
+	// SHA256 is hex encoded sha256 checksum of the data
+	SHA256 string
+}
+
+// patternBlock fills buf with the data of given block of the patterned file
+func patternBlock(file string, block int64, buf []byte) {
+	n := copy(buf, fmt.Sprintf("%s:%d\n", file, block))
+
+	// the rest of the block is filled by a xorshift sequence seeded by block number
+	x := uint64(block)*0x9E3779B97F4A7C15 + 1
+	for ; n < len(buf); n += 8 {
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], x)
+		copy(buf[n:], b[:])
+	}
+}
+
+// patternReader reads the patterned data of given file, of given size
+type patternReader struct {
+	file   string
+	size   int64
+	offset int64
+	block  []byte
+}
+
+func newPatternReader(file string, size int64) *patternReader {
+	return &patternReader{file: file, size: size, block: make([]byte, patternBlockSize)}
+}
+
+// Read reads the patterned data from the current offset
+func (r *patternReader) Read(p []byte) (int, error) {
+	var n int
+	for n < len(p) && r.offset < r.size {
+		off := r.offset % patternBlockSize
+		if off == 0 {
+			patternBlock(r.file, r.offset/patternBlockSize, r.block)
+		}
+
+		l := int64(copy(p[n:], r.block[off:]))
+		if r.offset+l > r.size {
+			l = r.size - r.offset
+		}
+		n += int(l)
+		r.offset += l
+	}
+
+	if n == 0 && r.offset >= r.size {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// patternVerifier compares the data written to it with the patterned data, and records the
+// offset of the first mismatch
+type patternVerifier struct {
+	expected *patternReader
+	hash     hash.Hash
+
+	// size is number of bytes written
+	size int64
+
+	// mismatch is offset of the first mismatch, -1 if data matched
+	mismatch int64
+
+	buf []byte
+}
+
+// Write compares the given data with the patterned data
+func (v *patternVerifier) Write(p []byte) (int, error) {
+	v.hash.Write(p)
+
+	if v.mismatch < 0 {
+		if cap(v.buf) < len(p) {
+			v.buf = make([]byte, len(p))
+		}
+		exp := v.buf[:len(p)]
+		n, _ := io.ReadFull(v.expected, exp)
+
+		for i := range p {
+			if i >= n || p[i] != exp[i] {
+				v.mismatch = v.size + int64(i)
+				break
+			}
+		}
+	}
+
+	v.size += int64(len(p))
+	return len(p), nil
+}
+
+// WritePatternedData writes the patterned data, of given size in bytes, to the given file in the
+// volume of application. It return the record of the data to verify the restored volume.
+func WritePatternedData(appYaml, ns, file string, size int64) (*DataRecord, error) {
+	pod, container, mountPath, err := appVolume(appYaml)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	data := io.TeeReader(newPatternReader(file, size), h)
+
+	cmd := fmt.Sprintf("cat > %s/%s && sync", mountPath, file)
+	stderr, err := k8s.Client.ExecStream([]string{"sh", "-c", cmd}, pod, container, ns, data, ioutil.Discard)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to write data to %s/%s, stderr=%s", ns, pod, stderr)
+	}
+
+	return &DataRecord{
+		File:   file,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// VerifyData verifies byte-for-byte that the given file in the volume of application has
+// the patterned data of given record
+func VerifyData(appYaml, ns string, rec *DataRecord) error {
+	pod, container, mountPath, err := appVolume(appYaml)
+	if err != nil {
+		return err
+	}
+
+	v := &patternVerifier{
+		expected: newPatternReader(rec.File, rec.Size),
+		hash:     sha256.New(),
+		mismatch: -1,
+	}
+
+	stderr, err := k8s.Client.ExecStream([]string{"cat", mountPath + "/" + rec.File}, pod, container, ns, nil, v)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read data from %s/%s, stderr=%s", ns, pod, stderr)
+	}
+
+	if v.size != rec.Size {
+		return errors.Errorf("size of file=%s in %s/%s is %d, expected %d", rec.File, ns, pod, v.size, rec.Size)
+	}
+	if v.mismatch >= 0 {
+		return errors.Errorf("data of file=%s in %s/%s doesn't match at offset=%d", rec.File, ns, pod, v.mismatch)
+	}
+	if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != rec.SHA256 {
+		return errors.Errorf("sha256 of file=%s in %s/%s is %s, expected %s", rec.File, ns, pod, sum, rec.SHA256)
+	}
+	return nil
+}
@@ -47,8 +47,13 @@ func getHomeDir() (string, error) {
 	return "", fmt.Errorf("not able to locate home directory")
 }
 
-// GetConfigPath returns the filepath of kubeconfig file
+// GetConfigPath returns the filepath of kubeconfig file, set by KUBECONFIG env
+// or $HOME/.kube/config
 func getConfigPath() (string, error) {
+	if p := os.Getenv("KUBECONFIG"); p != "" {
+		return p, nil
+	}
+
 	home, err := getHomeDir()
 	if err != nil {
 		return "", err
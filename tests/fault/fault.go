@@ -0,0 +1,135 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fault injects the failures, in the storage and object store, during the
+// backup so that tests can verify that the plugin fails the backup cleanly.
+package fault
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	k8s "github.com/openebs/velero-plugin/tests/k8s"
+	openebs "github.com/openebs/velero-plugin/tests/openebs"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// poolPodLabel is label of cstor-pool pods
+	poolPodLabel = "app=cstor-pool"
+
+	// poolMgmtContainer is container of cstor-pool pod which sends the snapshot to plugin
+	poolMgmtContainer = "cstor-pool-mgmt"
+
+	// pollInterval is interval to check the state of resources
+	pollInterval = time.Second
+)
+
+// WaitForBackupInProgress waits till the CStorBackup of given backup, in namespace of the
+// volume, is in progress, so that the fault is injected while snapshot is transferred
+func WaitForBackupInProgress(backup, ns string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		blist, err := openebs.Client.GetCStorBackups(backup, ns)
+		if err != nil {
+			return errors.Wrapf(err, "failed to fetch cstorbackups of backup=%s", backup)
+		}
+
+		for _, bkp := range blist.Items {
+			switch bkp.Status {
+			case v1alpha1.BKPCStorStatusInProgress:
+				return nil
+			case v1alpha1.BKPCStorStatusDone, v1alpha1.BKPCStorStatusFailed:
+				return errors.Errorf("cstorbackup=%s is completed with status=%s before fault", bkp.Name, bkp.Status)
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+	return errors.Errorf("cstorbackup of backup=%s is not in progress in %v", backup, timeout)
+}
+
+// KillPoolPods deletes the cstor-pool pods, without grace period, like a crash of the pool
+func KillPoolPods() error {
+	podList, err := k8s.Client.GetPodList(openebs.OpenEBSNs, poolPodLabel)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list cstor-pool pods")
+	}
+	if len(podList.Items) == 0 {
+		return errors.Errorf("no cstor-pool pod in %s", openebs.OpenEBSNs)
+	}
+
+	grace := int64(0)
+	for _, p := range podList.Items {
+		fmt.Printf("Killing cstor-pool pod %s/%s\n", p.Namespace, p.Name)
+		err := k8s.Client.CoreV1().Pods(p.Namespace).Delete(context.TODO(), p.Name,
+			metav1.DeleteOptions{GracePeriodSeconds: &grace})
+		if err != nil {
+			return errors.Wrapf(err, "failed to delete pod %s/%s", p.Namespace, p.Name)
+		}
+	}
+	return nil
+}
+
+// WaitForPoolPods waits till the cstor-pool pods are running
+func WaitForPoolPods(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		podList, err := k8s.Client.GetPodList(openebs.OpenEBSNs, poolPodLabel)
+		if err == nil && len(podList.Items) != 0 {
+			running := true
+			for _, p := range podList.Items {
+				if p.DeletionTimestamp != nil || p.Status.Phase != "Running" {
+					running = false
+				}
+			}
+			if running {
+				return nil
+			}
+		}
+		time.Sleep(pollInterval)
+	}
+	return errors.Errorf("cstor-pool pods are not running in %v", timeout)
+}
+
+// DropDataConnection kills the processes sending the snapshot in cstor-pool pods,
+// so that the data connection to the plugin breaks in the middle of transfer
+func DropDataConnection() error {
+	podList, err := k8s.Client.GetPodList(openebs.OpenEBSNs, poolPodLabel)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list cstor-pool pods")
+	}
+
+	killed := false
+	for _, p := range podList.Items {
+		// pkill returns error if no process is matched
+		_, stderr, err := k8s.Client.ExecArgs([]string{"pkill", "-9", "-f", "zfs send"},
+			p.Name, poolMgmtContainer, p.Namespace)
+		if err != nil {
+			fmt.Printf("No snapshot sender killed in pod %s/%s : %s %s\n", p.Namespace, p.Name, err, stderr)
+			continue
+		}
+		fmt.Printf("Killed snapshot sender in pod %s/%s\n", p.Namespace, p.Name)
+		killed = true
+	}
+
+	if !killed {
+		return errors.New("no snapshot sender found in cstor-pool pods")
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fault
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	k8s "github.com/openebs/velero-plugin/tests/k8s"
+	velero "github.com/openebs/velero-plugin/tests/velero"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// proxyName is name of the pod, service and configmap of object store proxy
+	proxyName = "minio-fault"
+
+	// proxyPort is port of the object store proxy
+	proxyPort = 9000
+
+	// proxyFailFile is created in proxy pod to return 503 for all the requests
+	proxyFailFile = "/tmp/fail"
+
+	// credentialsSecret is secret having the credentials of object store, used by velero
+	credentialsSecret = "cloud-credentials"
+)
+
+// proxyConfig is nginx config of the object store proxy. Host header is preserved so that
+// the signature of requests is valid for the object store.
+const proxyConfig = `events {}
+http {
+  server {
+    listen %d;
+    client_max_body_size 0;
+    proxy_request_buffering off;
+    proxy_buffering off;
+    location / {
+      if (-f %s) {
+        return 503;
+      }
+      proxy_set_header Host $http_host;
+      proxy_pass %s;
+    }
+  }
+}
+`
+
+// DeployObjectStoreProxy deploys the proxy, to the object store of default volumesnapshotlocation,
+// which returns 503 for the requests once FailObjectStore is called. It creates the
+// volumesnapshotlocation of given name using the proxy.
+func DeployObjectStoreProxy(snapshotLocation string) error {
+	ns := velero.VeleroNamespace
+
+	vsl, err := velero.Client.VeleroV1().VolumeSnapshotLocations(ns).
+		Get(context.TODO(), velero.SnapshotLocation, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch volumesnapshotlocation=%s", velero.SnapshotLocation)
+	}
+	upstream := vsl.Spec.Config["s3Url"]
+	if upstream == "" {
+		return errors.Errorf("volumesnapshotlocation=%s doesn't have s3Url", vsl.Name)
+	}
+
+	labels := map[string]string{"app": proxyName}
+	meta := metav1.ObjectMeta{Name: proxyName, Namespace: ns, Labels: labels}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: meta,
+		Data:       map[string]string{"nginx.conf": fmt.Sprintf(proxyConfig, proxyPort, proxyFailFile, upstream)},
+	}
+	if _, err := k8s.Client.CoreV1().ConfigMaps(ns).Create(context.TODO(), cm, metav1.CreateOptions{}); err != nil &&
+		!k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create configmap %s/%s", ns, proxyName)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: meta,
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "nginx",
+				Image: "nginx",
+				Ports: []corev1.ContainerPort{{ContainerPort: proxyPort}},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "config",
+					MountPath: "/etc/nginx/nginx.conf",
+					SubPath:   "nginx.conf",
+				}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "config",
+				VolumeSource: corev1.VolumeSource{
+					ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: proxyName},
+					},
+				},
+			}},
+		},
+	}
+	if _, err := k8s.Client.CoreV1().Pods(ns).Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil &&
+		!k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create pod %s/%s", ns, proxyName)
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: meta,
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports:    []corev1.ServicePort{{Port: proxyPort, TargetPort: intstr.FromInt(proxyPort)}},
+		},
+	}
+	if _, err := k8s.Client.CoreV1().Services(ns).Create(context.TODO(), svc, metav1.CreateOptions{}); err != nil &&
+		!k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create service %s/%s", ns, proxyName)
+	}
+
+	if err := k8s.Client.WaitForPod(proxyName, ns); err != nil {
+		return err
+	}
+
+	svc, err = k8s.Client.CoreV1().Services(ns).Get(context.TODO(), proxyName, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch service %s/%s", ns, proxyName)
+	}
+
+	proxyVSL := vsl.DeepCopy()
+	proxyVSL.ObjectMeta = metav1.ObjectMeta{Name: snapshotLocation, Namespace: ns}
+	proxyVSL.Spec.Config["s3Url"] = fmt.Sprintf("http://%s:%d", svc.Spec.ClusterIP, proxyPort)
+	if _, err := velero.Client.VeleroV1().VolumeSnapshotLocations(ns).
+		Create(context.TODO(), proxyVSL, metav1.CreateOptions{}); err != nil && !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create volumesnapshotlocation=%s", snapshotLocation)
+	}
+	return nil
+}
+
+// DeleteObjectStoreProxy deletes the object store proxy, and the volumesnapshotlocation using it
+func DeleteObjectStoreProxy(snapshotLocation string) error {
+	ns := velero.VeleroNamespace
+
+	errs := []error{
+		velero.Client.VeleroV1().VolumeSnapshotLocations(ns).Delete(context.TODO(), snapshotLocation, metav1.DeleteOptions{}),
+		k8s.Client.CoreV1().Services(ns).Delete(context.TODO(), proxyName, metav1.DeleteOptions{}),
+		k8s.Client.CoreV1().Pods(ns).Delete(context.TODO(), proxyName, metav1.DeleteOptions{}),
+		k8s.Client.CoreV1().ConfigMaps(ns).Delete(context.TODO(), proxyName, metav1.DeleteOptions{}),
+	}
+	for _, err := range errs {
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete object store proxy")
+		}
+	}
+	return nil
+}
+
+// FailObjectStore makes the object store proxy return 503 for all the requests if fail is
+// set, otherwise requests are passed to the object store
+func FailObjectStore(fail bool) error {
+	cmd := []string{"touch", proxyFailFile}
+	if !fail {
+		cmd = []string{"rm", "-f", proxyFailFile}
+	}
+
+	if _, stderr, err := k8s.Client.ExecArgs(cmd, proxyName, "nginx", velero.VeleroNamespace); err != nil {
+		return errors.Wrapf(err, "failed to update object store proxy, stderr=%s", stderr)
+	}
+	return nil
+}
+
+// SnapshotObjects return the objects of given backup in the object store of default
+// volumesnapshotlocation, it is used to verify that partial snapshots are not left
+func SnapshotObjects(backup string) ([]string, error) {
+	ns := velero.VeleroNamespace
+
+	vsl, err := velero.Client.VeleroV1().VolumeSnapshotLocations(ns).
+		Get(context.TODO(), velero.SnapshotLocation, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch volumesnapshotlocation=%s", velero.SnapshotLocation)
+	}
+
+	id, key, err := objectStoreCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(vsl.Spec.Config["region"]),
+		Endpoint:         aws.String(vsl.Spec.Config["s3Url"]),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials(id, key, ""),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create object store session")
+	}
+
+	prefix := "backups/" + backup + "/"
+	if p := vsl.Spec.Config["backupPathPrefix"]; p != "" {
+		prefix = p + "/" + prefix
+	}
+
+	var keys []string
+	err = s3.New(sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(vsl.Spec.Config["bucket"]),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list objects of backup=%s", backup)
+	}
+	return keys, nil
+}
+
+// objectStoreCredentials return the access key id and secret key from the credentials secret of velero
+func objectStoreCredentials() (string, string, error) {
+	secret, err := k8s.Client.CoreV1().Secrets(velero.VeleroNamespace).
+		Get(context.TODO(), credentialsSecret, metav1.GetOptions{})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to fetch secret=%s", credentialsSecret)
+	}
+
+	var id, key string
+	for _, line := range strings.Split(string(secret.Data["cloud"]), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			id = strings.TrimSpace(kv[1])
+		case "aws_secret_access_key":
+			key = strings.TrimSpace(kv[1])
+		}
+	}
+
+	if id == "" || key == "" {
+		return "", "", errors.Errorf("secret=%s doesn't have aws credentials", credentialsSecret)
+	}
+	return id, key, nil
+}
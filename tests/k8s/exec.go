@@ -19,6 +19,7 @@ package k8s
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -29,7 +30,23 @@ import (
 
 // Exec execute the given command in given ns/pod/container and return the output
 func (k *KubeClient) Exec(command, pod, container, ns string) (string, string, error) {
-	var stderr, stdout bytes.Buffer
+	return k.ExecArgs(strings.Fields(command), pod, container, ns)
+}
+
+// ExecArgs execute the given command, having arguments with spaces, in given ns/pod/container
+// and return the output
+func (k *KubeClient) ExecArgs(command []string, pod, container, ns string) (string, string, error) {
+	var stdout bytes.Buffer
+
+	stderr, err := k.ExecStream(command, pod, container, ns, nil, &stdout)
+	return stdout.String(), stderr, err
+}
+
+// ExecStream execute the given command in given ns/pod/container, with given stdin, and
+// writes the output to stdout. stdin is not attached if it is nil. It return the stderr output.
+func (k *KubeClient) ExecStream(command []string, pod, container, ns string,
+	stdin io.Reader, stdout io.Writer) (string, error) {
+	var stderr bytes.Buffer
 
 	req := k.CoreV1().
 		RESTClient().
@@ -40,29 +57,31 @@ func (k *KubeClient) Exec(command, pod, container, ns string) (string, string, e
 		SubResource("exec")
 	scheme := runtime.NewScheme()
 	if err := corev1.AddToScheme(scheme); err != nil {
-		return "", "", errors.Errorf("error adding to scheme: %v", err)
+		return "", errors.Errorf("error adding to scheme: %v", err)
 	}
 
 	paramCodec := runtime.NewParameterCodec(scheme)
 	req.VersionedParams(&corev1.PodExecOptions{
-		Command:   strings.Fields(command),
+		Command:   command,
 		Container: container,
+		Stdin:     stdin != nil,
 		Stdout:    true,
 		Stderr:    true,
 	}, paramCodec)
 
 	exec, err := remotecommand.NewSPDYExecutor(cfg, "POST", req.URL())
 	if err != nil {
-		return "", "", fmt.Errorf("error while creating Executor: %v", err)
+		return "", fmt.Errorf("error while creating Executor: %v", err)
 	}
 
 	err = exec.Stream(remotecommand.StreamOptions{
-		Stdout: &stdout,
+		Stdin:  stdin,
+		Stdout: stdout,
 		Stderr: &stderr,
 	})
 	if err != nil {
-		return "", "", errors.Errorf("error in Stream: %v", err)
+		return stderr.String(), errors.Errorf("error in Stream: %v", err)
 	}
 
-	return stdout.String(), stderr.String(), nil
+	return stderr.String(), nil
 }
@@ -39,6 +39,21 @@ func (k *KubeClient) GetPVCPhase(pvc, ns string) (corev1.PersistentVolumeClaimPh
 	return o.Status.Phase, nil
 }
 
+// GetPVCStorageClass return given PVC's storageClass
+func (k *KubeClient) GetPVCStorageClass(pvc, ns string) (string, error) {
+	o, err := k.CoreV1().
+		PersistentVolumeClaims(ns).
+		Get(context.TODO(), pvc, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if o.Spec.StorageClassName == nil {
+		return "", nil
+	}
+	return *o.Spec.StorageClassName, nil
+}
+
 func (k *KubeClient) waitForPVCBound(pvc, ns string) (corev1.PersistentVolumeClaimPhase, error) {
 	for {
 		phase, err := k.GetPVCPhase(pvc, ns)
@@ -99,3 +99,17 @@ func (k *KubeClient) CreateStorageClass(scYAML string) error {
 
 	return nil
 }
+
+// DeleteStorageClass deletes storageClass of given yaml
+func (k *KubeClient) DeleteStorageClass(scYAML string) error {
+	var sc storagev1.StorageClass
+	if err := yaml.Unmarshal([]byte(scYAML), &sc); err != nil {
+		return err
+	}
+
+	err := k.StorageV1().StorageClasses().Delete(context.TODO(), sc.Name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	app "github.com/openebs/velero-plugin/tests/app"
+	k8s "github.com/openebs/velero-plugin/tests/k8s"
+	openebs "github.com/openebs/velero-plugin/tests/openebs"
+	velero "github.com/openebs/velero-plugin/tests/velero"
+)
+
+const (
+	// AppNs application namespace, same in both the clusters
+	AppNs = "migration"
+
+	BackupLocation   = "default"
+	SnapshotLocation = "default"
+
+	// PhaseBackup is value of MIGRATION_PHASE env to backup the application in source cluster
+	PhaseBackup = "backup"
+
+	// PhaseRestore is value of MIGRATION_PHASE env to restore the application in destination cluster
+	PhaseRestore = "restore"
+
+	// defaultStateFile is file to pass the backup details from backup phase to restore phase,
+	// if MIGRATION_STATE env is not set
+	defaultStateFile = "/tmp/velero-plugin-migration.json"
+
+	// migrationDataFile is written in the application volume to verify the migrated data
+	migrationDataFile = "migration-data"
+
+	// migrationDataSize is size of migrationDataFile
+	migrationDataSize = 64 * 1024 * 1024
+
+	// backupSyncTimeout is time limit for backup to be synced in destination cluster
+	backupSyncTimeout = 5 * time.Minute
+)
+
+// State is the backup details recorded by backup phase for restore phase
+type State struct {
+	Backup string          `json:"backup"`
+	PVC    string          `json:"pvc"`
+	Node   string          `json:"node"`
+	Data   *app.DataRecord `json:"data"`
+}
+
+func TestMigration(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Velero migration test suite")
+}
+
+var (
+	err   error
+	phase = os.Getenv("MIGRATION_PHASE")
+)
+
+// stateFile return the file path to record the state of migration
+func stateFile() string {
+	if f := os.Getenv("MIGRATION_STATE"); f != "" {
+		return f
+	}
+	return defaultStateFile
+}
+
+// appNode return the node of application pod in given namespace
+func appNode(ns string) string {
+	pod, perr := app.GetApplicationPod(app.BusyboxYaml, ns)
+	Expect(perr).NotTo(HaveOccurred(), "Failed to fetch application in namespace=%s", ns)
+	return pod.Spec.NodeName
+}
+
+var _ = BeforeSuite(func() {
+	if phase != PhaseBackup && phase != PhaseRestore {
+		return
+	}
+
+	velero.BackupLocation = BackupLocation
+	velero.SnapshotLocation = SnapshotLocation
+
+	// restore needs the storageClass and pool in destination cluster
+	err = k8s.Client.CreateStorageClass(openebs.SCYaml)
+	Expect(err).NotTo(HaveOccurred())
+
+	err = openebs.Client.CreateSPC(openebs.SPCYaml)
+	Expect(err).NotTo(HaveOccurred())
+})
+
+var _ = Describe("Migration Test", func() {
+	It("Backup application in source cluster", func() {
+		if phase != PhaseBackup {
+			Skip("MIGRATION_PHASE is not " + PhaseBackup)
+		}
+
+		err = app.CreateNamespace(AppNs)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = openebs.Client.CreateVolume(openebs.PVCYaml, AppNs, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = app.DeployApplication(app.BusyboxYaml, AppNs)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("Writing data in application volume")
+		data, werr := app.WritePatternedData(app.BusyboxYaml, AppNs, migrationDataFile, migrationDataSize)
+		Expect(werr).NotTo(HaveOccurred(), "Failed to write data in namespace=%s", AppNs)
+
+		// There are chances that istgt is not updated, but replica is healthy
+		time.Sleep(30 * time.Second)
+
+		By("Creating a backup")
+		bkp, status, berr := velero.Client.CreateBackup(AppNs)
+		if berr != nil || status != v1.BackupPhaseCompleted {
+			_ = velero.Client.DumpBackupLogs(bkp)
+			openebs.Client.DumpLogs()
+		}
+		Expect(berr).NotTo(HaveOccurred(), "Failed to create backup=%s for namespace=%s", bkp, AppNs)
+		Expect(status).To(Equal(v1.BackupPhaseCompleted), "Backup=%s for namespace=%s failed", bkp, AppNs)
+
+		state, merr := json.Marshal(State{Backup: bkp, PVC: app.PVCName, Node: appNode(AppNs), Data: data})
+		Expect(merr).NotTo(HaveOccurred())
+
+		err = ioutil.WriteFile(stateFile(), state, 0644)
+		Expect(err).NotTo(HaveOccurred(), "Failed to write migration state to %s", stateFile())
+	})
+
+	It("Restore application in destination cluster", func() {
+		if phase != PhaseRestore {
+			Skip("MIGRATION_PHASE is not " + PhaseRestore)
+		}
+
+		var state State
+		data, rerr := ioutil.ReadFile(stateFile())
+		Expect(rerr).NotTo(HaveOccurred(), "Failed to read migration state from %s", stateFile())
+		Expect(json.Unmarshal(data, &state)).To(Succeed(), "Failed to parse migration state")
+
+		// PVC name is set by DeployApplication in backup phase
+		app.PVCName = state.PVC
+
+		By("Waiting for the backup to be synced")
+		bstatus, serr := velero.Client.WaitForBackupSync(state.Backup, backupSyncTimeout)
+		Expect(serr).NotTo(HaveOccurred(), "Backup=%s is not synced", state.Backup)
+		Expect(bstatus).To(Equal(v1.BackupPhaseCompleted), "Synced backup=%s is not completed", state.Backup)
+
+		By("Restoring from the backup of source cluster")
+		status, cerr := velero.Client.CreateRestore(AppNs, AppNs, state.Backup, "")
+		if cerr != nil || status != v1.RestorePhaseCompleted {
+			velero.Client.DumpLogs()
+			openebs.Client.DumpLogs()
+		}
+		Expect(cerr).NotTo(HaveOccurred(), "Failed to create a restore from backup=%s", state.Backup)
+		Expect(status).To(Equal(v1.RestorePhaseCompleted), "Restore from backup=%s failed", state.Backup)
+
+		By("Checking if restored PVC is bound or not")
+		pvcPhase, perr := k8s.Client.GetPVCPhase(app.PVCName, AppNs)
+		Expect(perr).NotTo(HaveOccurred(), "Failed to verify PVC=%s bound status for namespace=%s", app.PVCName, AppNs)
+		Expect(pvcPhase).To(Equal(corev1.ClaimBound), "PVC=%s not bound", app.PVCName)
+
+		By("Checking if restored CVR are in healthy state")
+		ok := openebs.Client.CheckCVRStatus(app.PVCName, AppNs, v1alpha1.CVRStatusOnline)
+		if !ok {
+			openebs.Client.DumpLogs()
+		}
+		Expect(ok).To(BeTrue(), "CVR for PVC=%s is not in healthy state", app.PVCName)
+
+		By("Checking if restored data is same as backed up")
+		err = app.WaitForApplication(app.BusyboxYaml, AppNs)
+		Expect(err).NotTo(HaveOccurred(), "Restored application in namespace=%s is not running", AppNs)
+		Expect(appNode(AppNs)).NotTo(Equal(state.Node), "Application is restored on node of source cluster")
+
+		err = app.VerifyData(app.BusyboxYaml, AppNs, state.Data)
+		Expect(err).NotTo(HaveOccurred(), "Restored data of PVC=%s doesn't match the backup=%s", app.PVCName, state.Backup)
+	})
+})
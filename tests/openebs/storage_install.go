@@ -18,6 +18,7 @@ package openebs
 
 import (
 	"context"
+	"os"
 	"time"
 
 	"github.com/ghodss/yaml"
@@ -47,12 +48,12 @@ var (
 
 	// AppPVC created by openebs
 	AppPVC *corev1.PersistentVolumeClaim
-)
 
-const (
-	// OpenEBSNs openebs Namespace
+	// OpenEBSNs openebs Namespace, set by OPENEBS_NAMESPACE env
 	OpenEBSNs = "openebs"
+)
 
+const (
 	// PVDeploymentLabel for target pod Deployment
 	PVDeploymentLabel = "openebs.io/persistent-volume"
 )
@@ -67,6 +68,10 @@ func init() {
 		panic(err)
 	}
 	Client = &ClientSet{client}
+
+	if ns := os.Getenv("OPENEBS_NAMESPACE"); ns != "" {
+		OpenEBSNs = ns
+	}
 }
 
 // CreateSPC create SPC for given YAML
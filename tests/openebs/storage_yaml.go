@@ -45,6 +45,20 @@ metadata:
       - name: ReplicaCount
         value: "1"
 provisioner: openebs.io/provisioner-iscsi
+`
+	// AltSCYaml for SC CR, used as storageClass of restored volume
+	AltSCYaml = `apiVersion: storage.k8s.io/v1
+kind: StorageClass
+metadata:
+  name: openebs-cstor-sparse-alt
+  annotations:
+    openebs.io/cas-type: cstor
+    cas.openebs.io/config: |
+      - name: StoragePoolClaim
+        value: "sparse-claim-auto"
+      - name: ReplicaCount
+        value: "1"
+provisioner: openebs.io/provisioner-iscsi
 `
 	// PVCYaml for PVC CR
 	PVCYaml = `kind: PersistentVolumeClaim
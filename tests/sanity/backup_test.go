@@ -41,6 +41,12 @@ const (
 
 	BackupLocation   = "default"
 	SnapshotLocation = "default"
+
+	// backupDataFile is written in the application volume before backup to verify the restored data
+	backupDataFile = "backup-data"
+
+	// backupDataSize is size of backupDataFile
+	backupDataSize = 16 * 1024 * 1024
 )
 
 func TestVELERO(t *testing.T) {
@@ -52,6 +58,7 @@ var (
 	err          error
 	backupName   string
 	scheduleName string
+	backupData   *app.DataRecord
 )
 
 var _ = BeforeSuite(func() {
@@ -70,6 +77,9 @@ var _ = BeforeSuite(func() {
 	err = app.DeployApplication(app.BusyboxYaml, AppNs)
 	Expect(err).NotTo(HaveOccurred())
 
+	backupData, err = app.WritePatternedData(app.BusyboxYaml, AppNs, backupDataFile, backupDataSize)
+	Expect(err).NotTo(HaveOccurred())
+
 	velero.BackupLocation = BackupLocation
 	velero.SnapshotLocation = SnapshotLocation
 })
@@ -162,6 +172,13 @@ var _ = Describe("Backup/Restore Test", func() {
 				dumpLogs()
 			}
 			Expect(ok).To(BeTrue(), "CVR for PVC=%s are not in healthy state", app.PVCName)
+
+			By("Checking if restored data is same as backed up")
+			err = app.WaitForApplication(app.BusyboxYaml, AppNs)
+			Expect(err).NotTo(HaveOccurred(), "Restored application in namespace=%s is not running", AppNs)
+
+			err = app.VerifyData(app.BusyboxYaml, AppNs, backupData)
+			Expect(err).NotTo(HaveOccurred(), "Restored data of PVC=%s doesn't match the backup", app.PVCName)
 		})
 
 		It("Restore from scheduled backup", func() {
@@ -190,6 +207,13 @@ var _ = Describe("Backup/Restore Test", func() {
 			}
 			Expect(ok).To(BeTrue(), "CVR for PVC=%s are not in healthy state", app.PVCName)
 
+			By("Checking if restored data is same as backed up")
+			err = app.WaitForApplication(app.BusyboxYaml, AppNs)
+			Expect(err).NotTo(HaveOccurred(), "Restored application in namespace=%s is not running", AppNs)
+
+			err = app.VerifyData(app.BusyboxYaml, AppNs, backupData)
+			Expect(err).NotTo(HaveOccurred(), "Restored data of PVC=%s doesn't match the backup", app.PVCName)
+
 			By("Checking if restore has created snapshot or not")
 			snapshotList, serr := velero.Client.GetRestoredSnapshotFromSchedule(scheduleName)
 			Expect(serr).NotTo(HaveOccurred())
@@ -240,6 +264,13 @@ var _ = Describe("Backup/Restore Test", func() {
 				dumpLogs()
 			}
 			Expect(ok).To(BeTrue(), "CVR for PVC=%s is not in healthy state", app.PVCName)
+
+			By("Checking if restored data is same as backed up")
+			err = app.WaitForApplication(app.BusyboxYaml, TargetedNs)
+			Expect(err).NotTo(HaveOccurred(), "Restored application in namespace=%s is not running", TargetedNs)
+
+			err = app.VerifyData(app.BusyboxYaml, TargetedNs, backupData)
+			Expect(err).NotTo(HaveOccurred(), "Restored data of PVC=%s doesn't match the backup", app.PVCName)
 		})
 
 		It("Restore from scheduled backup to different Namespace", func() {
@@ -265,6 +296,13 @@ var _ = Describe("Backup/Restore Test", func() {
 			}
 			Expect(ok).To(BeTrue(), "CVR for PVC=%s is not in healthy state", app.PVCName)
 
+			By("Checking if restored data is same as backed up")
+			err = app.WaitForApplication(app.BusyboxYaml, TargetedNs)
+			Expect(err).NotTo(HaveOccurred(), "Restored application in namespace=%s is not running", TargetedNs)
+
+			err = app.VerifyData(app.BusyboxYaml, TargetedNs, backupData)
+			Expect(err).NotTo(HaveOccurred(), "Restored data of PVC=%s doesn't match the backup", app.PVCName)
+
 			By("Checking if restore has created snapshot or not")
 			snapshotList, err := velero.Client.GetRestoredSnapshotFromSchedule(scheduleName)
 			Expect(err).NotTo(HaveOccurred())
@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sanity
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+
+	app "github.com/openebs/velero-plugin/tests/app"
+	fault "github.com/openebs/velero-plugin/tests/fault"
+	openebs "github.com/openebs/velero-plugin/tests/openebs"
+	velero "github.com/openebs/velero-plugin/tests/velero"
+)
+
+const (
+	// FaultSnapshotLocation volumesnapshotlocation using the object store proxy
+	FaultSnapshotLocation = "fault"
+
+	// faultDataFile is written in the application volume so that backup lasts till the fault is injected
+	faultDataFile = "fault-data"
+
+	// faultDataSizeMiB is size of faultDataFile
+	faultDataSizeMiB = 1024
+
+	// faultTimeout is time limit for backup to reach transfer, and for pool to recover
+	faultTimeout = 5 * time.Minute
+)
+
+var _ = Describe("Backup Failure Test", func() {
+	BeforeEach(func() {
+		err = openebs.Client.WaitForHealthyCVR(openebs.AppPVC)
+		Expect(err).NotTo(HaveOccurred(), "No healthy CVR for %s", openebs.AppPVC)
+
+		err = app.WriteData(app.BusyboxYaml, AppNs, faultDataFile, faultDataSizeMiB)
+		Expect(err).NotTo(HaveOccurred(), "Failed to write data in namespace=%s", AppNs)
+	})
+
+	// backupWithFault starts the backup using given volumesnapshotlocation, injects the fault
+	// once snapshot transfer is started and verifies that backup failed cleanly
+	backupWithFault := func(snapshotLocation string, inject func() error) {
+		By("Starting a backup")
+		bkp, serr := velero.Client.StartBackup(AppNs, snapshotLocation)
+		Expect(serr).NotTo(HaveOccurred(), "Failed to create backup for namespace=%s", AppNs)
+
+		err = fault.WaitForBackupInProgress(bkp, AppNs, faultTimeout)
+		Expect(err).NotTo(HaveOccurred(), "Backup=%s didn't start transfer", bkp)
+
+		By("Injecting the fault")
+		err = inject()
+		Expect(err).NotTo(HaveOccurred(), "Failed to inject fault in backup=%s", bkp)
+
+		status, werr := velero.Client.WaitForBackupCompletion(bkp)
+		Expect(werr).NotTo(HaveOccurred(), "Failed to wait for backup=%s", bkp)
+		if status == v1.BackupPhaseCompleted {
+			_ = velero.Client.DumpBackupLogs(bkp)
+			dumpLogs()
+		}
+		Expect(status).NotTo(Equal(v1.BackupPhaseCompleted), "Backup=%s completed in spite of fault", bkp)
+
+		By("Checking if backup resources are cleaned up")
+		isExist, ierr := openebs.Client.IsBackupResourcesExist(bkp, app.PVCName, AppNs)
+		Expect(ierr).NotTo(HaveOccurred(), "Failed to verify snapshot cleanup for backup=%s", bkp)
+		Expect(isExist).To(BeFalse(), "Snapshot for backup=%s still exist", bkp)
+
+		By("Checking if partial snapshot is removed from object store")
+		objs, oerr := fault.SnapshotObjects(bkp)
+		Expect(oerr).NotTo(HaveOccurred(), "Failed to list objects of backup=%s", bkp)
+		Expect(objs).To(BeEmpty(), "Partial snapshot of backup=%s still exist", bkp)
+	}
+
+	Context("Pool failure", func() {
+		AfterEach(func() {
+			err = fault.WaitForPoolPods(faultTimeout)
+			Expect(err).NotTo(HaveOccurred(), "cstor-pool pods are not recovered")
+		})
+
+		It("Backup fails if cstor-pool pods are killed", func() {
+			backupWithFault(SnapshotLocation, fault.KillPoolPods)
+		})
+	})
+
+	Context("Data connection failure", func() {
+		It("Backup fails if data connection is dropped", func() {
+			backupWithFault(SnapshotLocation, fault.DropDataConnection)
+		})
+	})
+
+	Context("Object store failure", func() {
+		BeforeEach(func() {
+			err = fault.DeployObjectStoreProxy(FaultSnapshotLocation)
+			Expect(err).NotTo(HaveOccurred(), "Failed to deploy object store proxy")
+		})
+
+		AfterEach(func() {
+			err = fault.FailObjectStore(false)
+			Expect(err).NotTo(HaveOccurred(), "Failed to recover object store proxy")
+
+			err = fault.DeleteObjectStoreProxy(FaultSnapshotLocation)
+			Expect(err).NotTo(HaveOccurred(), "Failed to delete object store proxy")
+		})
+
+		It("Backup fails if object store returns error", func() {
+			backupWithFault(FaultSnapshotLocation, func() error {
+				return fault.FailObjectStore(true)
+			})
+		})
+	})
+})
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sanity
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+
+	app "github.com/openebs/velero-plugin/tests/app"
+	k8s "github.com/openebs/velero-plugin/tests/k8s"
+	openebs "github.com/openebs/velero-plugin/tests/openebs"
+	velero "github.com/openebs/velero-plugin/tests/velero"
+)
+
+const (
+	// MappedNs namespace used for restore with different storageClass
+	MappedNs = "ns2"
+
+	// SourceSC storageClass of application volume, refer openebs.SCYaml
+	SourceSC = "openebs-cstor-sparse-auto"
+
+	// TargetSC storageClass of restored volume, refer openebs.AltSCYaml
+	TargetSC = "openebs-cstor-sparse-alt"
+
+	// integrityDataFile is written in the application volume to verify the restored data
+	integrityDataFile = "integrity-data"
+
+	// integrityDataSize is size of integrityDataFile
+	integrityDataSize = 64 * 1024 * 1024
+)
+
+var _ = Describe("Restore Test with different StorageClass", func() {
+	var (
+		bkpName string
+		data    *app.DataRecord
+	)
+
+	BeforeEach(func() {
+		err = k8s.Client.CreateStorageClass(openebs.AltSCYaml)
+		Expect(err).NotTo(HaveOccurred(), "Failed to create storageClass=%s", TargetSC)
+
+		err = openebs.Client.WaitForHealthyCVR(openebs.AppPVC)
+		Expect(err).NotTo(HaveOccurred(), "No healthy CVR for %s", openebs.AppPVC)
+
+		By("Writing data in application volume")
+		data, err = app.WritePatternedData(app.BusyboxYaml, AppNs, integrityDataFile, integrityDataSize)
+		Expect(err).NotTo(HaveOccurred(), "Failed to write data in namespace=%s", AppNs)
+
+		// There are chances that istgt is not updated, but replica is healthy
+		time.Sleep(30 * time.Second)
+
+		By("Creating a backup")
+		var status v1.BackupPhase
+		bkpName, status, err = velero.Client.CreateBackup(AppNs)
+		if (err != nil) || status != v1.BackupPhaseCompleted {
+			_ = velero.Client.DumpBackupLogs(bkpName)
+			openebs.Client.DumpLogs()
+		}
+		Expect(err).NotTo(HaveOccurred(), "Failed to create backup=%s for namespace=%s", bkpName, AppNs)
+		Expect(status).To(Equal(v1.BackupPhaseCompleted), "Backup=%s for namespace=%s failed", bkpName, AppNs)
+	})
+
+	AfterEach(func() {
+		By("Destroying Application and Volume")
+		err = app.DestroyApplication(app.BusyboxYaml, MappedNs)
+		Expect(err).NotTo(HaveOccurred(), "Failed to destroy application in namespace=%s", MappedNs)
+
+		err = openebs.Client.DeleteVolume(openebs.PVCYaml, MappedNs)
+		Expect(err).NotTo(HaveOccurred(), "Failed to delete volume for namespace=%s", MappedNs)
+
+		err = app.DestroyNamespace(MappedNs)
+		Expect(err).NotTo(HaveOccurred(), "Failed to delete namespace=%s", MappedNs)
+
+		err = k8s.Client.DeleteStorageClass(openebs.AltSCYaml)
+		Expect(err).NotTo(HaveOccurred(), "Failed to delete storageClass=%s", TargetSC)
+	})
+
+	It("Restore to different Namespace and StorageClass", func() {
+		var status v1.RestorePhase
+
+		By("Restoring to a different namespace and storageClass")
+		status, err = velero.Client.CreateRestoreWithStorageClass(AppNs, MappedNs, bkpName, SourceSC+":"+TargetSC)
+		if err != nil || status != v1.RestorePhaseCompleted {
+			dumpLogs()
+		}
+		Expect(err).NotTo(HaveOccurred(), "Failed to create a restore from backup=%s", bkpName)
+		Expect(status).To(Equal(v1.RestorePhaseCompleted), "Restore from backup=%s failed", bkpName)
+
+		By("Checking if restored PVC is bound and having mapped storageClass")
+		phase, perr := k8s.Client.GetPVCPhase(app.PVCName, MappedNs)
+		Expect(perr).NotTo(HaveOccurred(), "Failed to verify PVC=%s bound status for namespace=%s", app.PVCName, MappedNs)
+		Expect(phase).To(Equal(corev1.ClaimBound), "PVC=%s not bound", app.PVCName)
+
+		sc, serr := k8s.Client.GetPVCStorageClass(app.PVCName, MappedNs)
+		Expect(serr).NotTo(HaveOccurred(), "Failed to fetch storageClass of PVC=%s in namespace=%s", app.PVCName, MappedNs)
+		Expect(sc).To(Equal(TargetSC), "PVC=%s is not restored with storageClass=%s", app.PVCName, TargetSC)
+
+		By("Checking if restored CVR are in healthy state")
+		ok := openebs.Client.CheckCVRStatus(app.PVCName, MappedNs, v1alpha1.CVRStatusOnline)
+		if !ok {
+			dumpLogs()
+		}
+		Expect(ok).To(BeTrue(), "CVR for PVC=%s is not in healthy state", app.PVCName)
+
+		By("Checking if restored data is same as backed up")
+		err = app.WaitForApplication(app.BusyboxYaml, MappedNs)
+		Expect(err).NotTo(HaveOccurred(), "Restored application in namespace=%s is not running", MappedNs)
+
+		err = app.VerifyData(app.BusyboxYaml, MappedNs, data)
+		Expect(err).NotTo(HaveOccurred(), "Restored data of PVC=%s doesn't match the backup=%s", app.PVCName, bkpName)
+	})
+})
+
+var _ = Describe("Restore Test with namespace filter", func() {
+	var bkpName string
+
+	BeforeEach(func() {
+		err = openebs.Client.WaitForHealthyCVR(openebs.AppPVC)
+		Expect(err).NotTo(HaveOccurred(), "No healthy CVR for %s", openebs.AppPVC)
+
+		By("Creating a backup")
+		var status v1.BackupPhase
+		bkpName, status, err = velero.Client.CreateBackup(AppNs)
+		if (err != nil) || status != v1.BackupPhaseCompleted {
+			_ = velero.Client.DumpBackupLogs(bkpName)
+			openebs.Client.DumpLogs()
+		}
+		Expect(err).NotTo(HaveOccurred(), "Failed to create backup=%s for namespace=%s", bkpName, AppNs)
+		Expect(status).To(Equal(v1.BackupPhaseCompleted), "Backup=%s for namespace=%s failed", bkpName, AppNs)
+	})
+
+	It("Skip the volume of excluded namespace", func() {
+		var status v1.RestorePhase
+
+		// PV of the backup is restored with a new name, due to namespace mapping, and
+		// its snapshot is processed by the plugin even though its claim namespace is excluded
+		By("Restoring the backup excluding the namespace of volume")
+		status, err = velero.Client.CreateRestoreWithNamespaceFilter(AppNs, MappedNs, bkpName,
+			[]string{"*"}, []string{AppNs})
+		if err != nil || status != v1.RestorePhaseCompleted {
+			dumpLogs()
+		}
+		Expect(err).NotTo(HaveOccurred(), "Failed to create a restore from backup=%s", bkpName)
+		Expect(status).To(Equal(v1.RestorePhaseCompleted), "Restore from backup=%s failed", bkpName)
+
+		By("Checking that volume of excluded namespace is not restored")
+		_, perr := k8s.Client.GetPVCPhase(app.PVCName, MappedNs)
+		Expect(k8serrors.IsNotFound(perr)).To(BeTrue(), "PVC=%s of excluded namespace is restored in namespace=%s",
+			app.PVCName, MappedNs)
+	})
+})
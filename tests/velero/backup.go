@@ -95,11 +95,27 @@ func (c *ClientSet) generateBackupName() (string, error) {
 // CreateBackup creates the backup for given namespace
 func (c *ClientSet) CreateBackup(ns string) (string, v1.BackupPhase, error) {
 	var status v1.BackupPhase
+
+	bname, err := c.StartBackup(ns, SnapshotLocation)
+	if err != nil {
+		return "", status, err
+	}
+
+	if status, err = c.waitForBackupCompletion(bname); err == nil {
+		return bname, status, nil
+	}
+
+	return bname, status, err
+}
+
+// StartBackup creates the backup for given namespace using given volumesnapshotlocation,
+// it doesn't wait for the backup to complete
+func (c *ClientSet) StartBackup(ns, snapshotLocation string) (string, error) {
 	snapVolume := true
 
 	bname, err := c.generateBackupName()
 	if err != nil {
-		return "", status, err
+		return "", err
 	}
 	bkp := &v1.Backup{
 		ObjectMeta: metav1.ObjectMeta{
@@ -110,21 +126,21 @@ func (c *ClientSet) CreateBackup(ns string) (string, v1.BackupPhase, error) {
 			IncludedNamespaces:      []string{ns},
 			SnapshotVolumes:         &snapVolume,
 			StorageLocation:         BackupLocation,
-			VolumeSnapshotLocations: []string{SnapshotLocation},
+			VolumeSnapshotLocations: []string{snapshotLocation},
 		},
 	}
 	o, err := c.VeleroV1().
 		Backups(VeleroNamespace).
 		Create(context.TODO(), bkp, metav1.CreateOptions{})
 	if err != nil {
-		return "", status, err
-	}
-
-	if status, err = c.waitForBackupCompletion(o.Name); err == nil {
-		return o.Name, status, nil
+		return "", err
 	}
+	return o.Name, nil
+}
 
-	return bname, status, err
+// WaitForBackupCompletion waits for the given backup to complete, and return its phase
+func (c *ClientSet) WaitForBackupCompletion(name string) (v1.BackupPhase, error) {
+	return c.waitForBackupCompletion(name)
 }
 
 func (c *ClientSet) waitForBackupCompletion(name string) (v1.BackupPhase, error) {
@@ -146,6 +162,26 @@ func (c *ClientSet) waitForBackupCompletion(name string) (v1.BackupPhase, error)
 	}
 }
 
+// WaitForBackupSync waits till the given backup, created in another cluster, is synced from
+// the backup storage location and return its phase
+func (c *ClientSet) WaitForBackupSync(name string, timeout time.Duration) (v1.BackupPhase, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		bkp, err := c.getBackup(name)
+		if err == nil {
+			return bkp.Status.Phase, nil
+		}
+		if !k8serrors.IsNotFound(err) {
+			return "", err
+		}
+		if time.Now().After(deadline) {
+			return "", errors.Errorf("backup %s is not synced in %v", name, timeout)
+		}
+		fmt.Printf("Waiting for backup %s to be synced..\n", name)
+		time.Sleep(10 * time.Second)
+	}
+}
+
 func (c *ClientSet) getBackup(name string) (*v1.Backup, error) {
 	return c.VeleroV1().
 		Backups(VeleroNamespace).
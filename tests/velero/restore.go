@@ -28,6 +28,9 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// RestoreStorageClassAnnotation is set on restore to change the storageClass of restored volumes
+const RestoreStorageClassAnnotation = "openebs.io/restore-storageclass"
+
 type byCreationTimeStamp []v1.Backup
 
 func (rc byCreationTimeStamp) Len() int {
@@ -86,6 +89,35 @@ func (c *ClientSet) GetScheduledBackups(schedule string) ([]string, error) {
 // - backup : name of the backup, from which restore will happen
 // - schedule : name of schedule, from which restore should happen. If mentioned, backup should be empty
 func (c *ClientSet) CreateRestore(ns, targetedNs, backup, schedule string) (v1.RestorePhase, error) {
+	return c.createRestore(ns, targetedNs, backup, schedule, nil, nil)
+}
+
+// CreateRestoreWithStorageClass create restore from given backup for ns Namespace to targetedNs,
+// changing the storageClass of restored volumes as per given scMapping. scMapping is set as
+// restore-storageclass annotation of the restore, either a storageClass name or comma separated
+// list of source_sc:destination_sc.
+func (c *ClientSet) CreateRestoreWithStorageClass(ns, targetedNs, backup, scMapping string) (v1.RestorePhase, error) {
+	return c.createRestore(ns, targetedNs, backup, "", map[string]string{RestoreStorageClassAnnotation: scMapping}, nil)
+}
+
+// CreateRestoreWithNamespaceFilter create restore from given backup for ns Namespace to targetedNs,
+// having the given included and excluded namespaces. Cluster resources, like PVs, are included in
+// the restore so that the volumes of the backup are processed irrespective of the namespace filter.
+func (c *ClientSet) CreateRestoreWithNamespaceFilter(ns, targetedNs, backup string,
+	included, excluded []string) (v1.RestorePhase, error) {
+	includeClusterResources := true
+
+	return c.createRestore(ns, targetedNs, backup, "", nil, func(spec *v1.RestoreSpec) {
+		spec.IncludedNamespaces = included
+		spec.ExcludedNamespaces = excluded
+		spec.IncludeClusterResources = &includeClusterResources
+	})
+}
+
+// createRestore create the restore and waits for its completion, update is applied on the
+// spec of restore, if set, before creating it
+func (c *ClientSet) createRestore(ns, targetedNs, backup, schedule string,
+	annotations map[string]string, update func(spec *v1.RestoreSpec)) (v1.RestorePhase, error) {
 	var (
 		status      v1.RestorePhase
 		restoreName string
@@ -111,8 +143,9 @@ func (c *ClientSet) CreateRestore(ns, targetedNs, backup, schedule string) (v1.R
 
 	rst := &v1.Restore{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      restoreName,
-			Namespace: VeleroNamespace,
+			Name:        restoreName,
+			Namespace:   VeleroNamespace,
+			Annotations: annotations,
 		},
 		Spec: v1.RestoreSpec{
 			IncludedNamespaces: []string{ns},
@@ -122,6 +155,10 @@ func (c *ClientSet) CreateRestore(ns, targetedNs, backup, schedule string) (v1.R
 			NamespaceMapping:   nsMapping,
 		},
 	}
+	if update != nil {
+		update(&rst.Spec)
+	}
+
 	o, err := c.VeleroV1().
 		Restores(VeleroNamespace).
 		Create(context.TODO(), rst, metav1.CreateOptions{})
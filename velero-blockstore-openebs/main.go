@@ -17,21 +17,273 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/cstor"
+	"github.com/openebs/velero-plugin/pkg/itemaction"
 	snap "github.com/openebs/velero-plugin/pkg/snapshot"
+	"github.com/openebs/velero-plugin/pkg/velero"
 	zfssnap "github.com/openebs/velero-plugin/pkg/zfs/snapshot"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// standbyCommand is the plugin command to restore each new backup of a schedule to the standby cluster
+	standbyCommand = "standby"
+
+	// benchCommand is the plugin command to measure the throughput of data transfer to an in-memory bucket
+	benchCommand = "bench"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == cstor.InventoryCommand {
+		os.Exit(runInventory(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == cstor.RemoteBackupsCommand {
+		os.Exit(runRemoteBackups(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == standbyCommand {
+		os.Exit(runStandby(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == benchCommand {
+		os.Exit(runBench(os.Args[2:]))
+	}
+
 	veleroplugin.NewServer().
 		BindFlags(pflag.CommandLine).
 		RegisterVolumeSnapshotter("openebs.io/cstor-blockstore", openebsSnapPlugin).
 		RegisterVolumeSnapshotter("openebs.io/zfspv-blockstore", zfsSnapPlugin).
+		RegisterBackupItemAction("openebs.io/cstor-pvc-metadata", openebsBackupItemAction).
+		RegisterRestoreItemAction("openebs.io/skip-internal-resources", openebsRestoreItemAction).
+		RegisterRestoreItemAction("openebs.io/pv-node-mapping", openebsPVRestoreItemAction).
+		RegisterRestoreItemAction("openebs.io/restore-hooks", openebsRestoreHookAction).
+		RegisterDeleteItemAction("openebs.io/cstor-stale-backups", openebsDeleteItemAction).
 		Serve()
 }
 
+// runInventory prints the report of resources left in the cluster by cStor plugin,
+// and deletes them if --cleanup is set
+func runInventory(args []string) int {
+	flags := pflag.NewFlagSet(cstor.InventoryCommand, pflag.ContinueOnError)
+	namespace := flags.String("namespace", "openebs", "OpenEBS namespace")
+	cleanup := flags.Bool("cleanup", false, "delete the resources left by the plugin")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+
+	report, err := cstor.RunInventory(log, *namespace, *cleanup)
+	if err != nil {
+		log.Errorf("Failed to take inventory : %s", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Errorf("Failed to write inventory report : %s", err)
+		return 1
+	}
+
+	for _, item := range report.Items {
+		if item.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// runRemoteBackups prints the backups, and their incremental chains, in the storage-bucket
+// of given volumesnapshotlocation config, and deletes the orphan backups if --cleanup is set
+func runRemoteBackups(args []string) int {
+	flags := pflag.NewFlagSet(cstor.RemoteBackupsCommand, pflag.ContinueOnError)
+	config := flags.StringToString("config", nil, "config of volumesnapshotlocation, key=value")
+	volume := flags.String("volume", "", "list the backups of given volume only")
+	backup := flags.String("backup", "", "list the given backup only, along with its manifest")
+	orphans := flags.Bool("orphans", false, "check if velero backup exists for each backup")
+	cleanup := flags.Bool("cleanup", false, "delete the orphan backups, needs --orphans")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+
+	if len(*config) == 0 {
+		log.Errorf("--config is required")
+		return 2
+	}
+
+	if *orphans {
+		conf, err := rest.InClusterConfig()
+		if err != nil {
+			log.Errorf("Failed to get in-cluster config : %s", err)
+			return 1
+		}
+
+		if err := velero.InitializeClientSet(conf); err != nil {
+			log.Errorf("Failed to initialize velero clientSet : %s", err)
+			return 1
+		}
+	}
+
+	report, err := cstor.RunRemoteBackups(log, cstor.RemoteBackupOptions{
+		Config:  *config,
+		Volume:  *volume,
+		Backup:  *backup,
+		Orphans: *orphans,
+		Cleanup: *cleanup,
+	})
+	if err != nil {
+		log.Errorf("Failed to list backups : %s", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Errorf("Failed to write backup report : %s", err)
+		return 1
+	}
+
+	for _, b := range report.Backups {
+		if b.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// runStandby creates the restore for each new completed backup of the schedule, so that
+// the volumes of standby cluster lag the source cluster by one schedule interval
+func runStandby(args []string) int {
+	flags := pflag.NewFlagSet(standbyCommand, pflag.ContinueOnError)
+	schedule := flags.String("schedule", "", "schedule whose backups are restored")
+	nsMapping := flags.StringToString("namespace-mappings", nil, "namespace mapping of restores, source_ns=destination_ns")
+	resources := flags.String("include-resources", "persistentvolumeclaims,persistentvolumes", "resources restored by restores")
+	interval := flags.Duration("interval", 5*time.Minute, "interval to check for the new backup")
+	once := flags.Bool("once", false, "check for the new backup once and exit")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+
+	if *schedule == "" {
+		log.Errorf("--schedule is required")
+		return 2
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		log.Errorf("Failed to get in-cluster config : %s", err)
+		return 1
+	}
+
+	if err := velero.InitializeClientSet(conf); err != nil {
+		log.Errorf("Failed to initialize velero clientSet : %s", err)
+		return 1
+	}
+
+	opts := velero.StandbyOptions{
+		Schedule:         *schedule,
+		NamespaceMapping: *nsMapping,
+	}
+	if *resources != "" {
+		opts.IncludedResources = strings.Split(*resources, ",")
+	}
+
+	for {
+		name, err := velero.SyncStandby(opts)
+		if err != nil {
+			log.Errorf("Failed to sync standby restore of schedule=%s : %s", *schedule, err)
+		} else if name != "" {
+			log.Infof("Created restore=%s for schedule=%s", name, *schedule)
+		}
+
+		if *once {
+			if err != nil {
+				return 1
+			}
+			return 0
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// runBench streams the synthetic data through the data server to an in-memory bucket,
+// and prints the throughput and allocations of backup and restore
+func runBench(args []string) int {
+	flags := pflag.NewFlagSet(benchCommand, pflag.ContinueOnError)
+	size := flags.String("size", "256Mi", "size of the synthetic data transferred")
+	writeSize := flags.String("write-size", "1Mi", "size of the writes by the client")
+	port := flags.Int("port", 9100, "port of the data server")
+	restore := flags.Bool("restore", true, "download the uploaded data")
+	config := flags.StringToString("config", nil, "config of volumesnapshotlocation, key=value")
+	asJSON := flags.Bool("json", false, "print the results as json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	log := logrus.New()
+	log.SetOutput(os.Stderr)
+	log.SetLevel(logrus.WarnLevel)
+
+	cfg := cloud.BenchmarkConfig{
+		Port:    *port,
+		Restore: *restore,
+		Config:  *config,
+	}
+	for flag, val := range map[string]string{"size": *size, "write-size": *writeSize} {
+		q, err := resource.ParseQuantity(val)
+		if err != nil {
+			log.Errorf("Invalid --%s=%s : %s", flag, val, err)
+			return 2
+		}
+		if flag == "size" {
+			cfg.Size = q.Value()
+		} else {
+			cfg.WriteSize = int(q.Value())
+		}
+	}
+
+	results, err := cloud.RunBenchmark(log, cfg)
+	if err != nil {
+		log.Errorf("Benchmark failed : %s", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			log.Errorf("Failed to write benchmark results : %s", err)
+			return 1
+		}
+		return 0
+	}
+
+	for _, r := range results {
+		fmt.Println(r.String())
+	}
+	return 0
+}
+
 func openebsSnapPlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &snap.BlockStore{Log: logger}, nil
 }
@@ -39,3 +291,23 @@ func openebsSnapPlugin(logger logrus.FieldLogger) (interface{}, error) {
 func zfsSnapPlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &zfssnap.BlockStore{Log: logger}, nil
 }
+
+func openebsBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &itemaction.BackupItemAction{Log: logger}, nil
+}
+
+func openebsRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &itemaction.RestoreItemAction{Log: logger}, nil
+}
+
+func openebsPVRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &itemaction.PVRestoreItemAction{Log: logger}, nil
+}
+
+func openebsRestoreHookAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &itemaction.RestoreHookAction{Log: logger}, nil
+}
+
+func openebsDeleteItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	return &itemaction.DeleteItemAction{Log: logger}, nil
+}